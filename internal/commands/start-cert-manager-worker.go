@@ -1,6 +1,7 @@
 package commands
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
@@ -8,10 +9,10 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/go-co-op/gocron/v2"
 	"github.com/scncore/scnorion-worker/internal/common"
-	"github.com/scncore/utils"
 	"github.com/urfave/cli/v2"
 )
 
@@ -45,10 +46,151 @@ func StartCertManagerWorkerFlags() []cli.Flag {
 		Required: true,
 	})
 
+	flags = append(flags, &cli.StringFlag{
+		Name:    "crl-path",
+		Usage:   "the path where the CRL signed by the CA will be written in PEM format, e.g certificates/ca.crl",
+		EnvVars: []string{"CRL_FILENAME"},
+	})
+
+	flags = append(flags, &cli.StringFlag{
+		Name:    "crl-urls",
+		Usage:   "comma-separated list of urls where the CRL is published, e.g http://crl.example.com/ca.crl",
+		EnvVars: []string{"CRL_URLS"},
+	})
+
+	flags = append(flags, &cli.IntFlag{
+		Name:    "crl-frequency",
+		Value:   60,
+		Usage:   "the frequency in minutes used to generate the CRL",
+		EnvVars: []string{"CRL_FREQUENCY"},
+	})
+
+	flags = append(flags, &cli.BoolFlag{
+		Name:    "allow-legacy-agent-enrollment",
+		Usage:   "allow agents that don't send a CSR to get a certificate and a private key generated by the worker, deprecated and enabled until every agent sends a CSR, set it to false once they do",
+		EnvVars: []string{"ALLOW_LEGACY_AGENT_ENROLLMENT"},
+		Value:   true,
+	})
+
+	flags = append(flags, &cli.StringFlag{
+		Name:    "user-key-algorithm",
+		Value:   "rsa-4096",
+		Usage:   "the private key algorithm for user certificates: rsa-2048, rsa-3072, rsa-4096, ecdsa-p256, ecdsa-p384, ecdsa-p521 or ed25519",
+		EnvVars: []string{"USER_KEY_ALGORITHM"},
+	})
+
+	flags = append(flags, &cli.StringFlag{
+		Name:    "agent-key-algorithm",
+		Value:   "rsa-4096",
+		Usage:   "the private key algorithm for agent certificates generated by the worker: rsa-2048, rsa-3072, rsa-4096, ecdsa-p256, ecdsa-p384, ecdsa-p521 or ed25519",
+		EnvVars: []string{"AGENT_KEY_ALGORITHM"},
+	})
+
+	flags = append(flags, &cli.IntFlag{
+		Name:    "max-concurrent-issuance",
+		Usage:   "the maximum number of certificates issued in parallel, defaults to the number of CPUs",
+		EnvVars: []string{"MAX_CONCURRENT_ISSUANCE"},
+	})
+
+	flags = append(flags, &cli.IntFlag{
+		Name:    "agent-renewal-window",
+		Value:   30,
+		Usage:   "renew agent certificates expiring within this number of days, a negative value disables the renewal",
+		EnvVars: []string{"AGENT_RENEWAL_WINDOW"},
+	})
+
+	flags = append(flags, &cli.BoolFlag{
+		Name:    "disable-user-expiry-reminders",
+		Usage:   "don't email users whose console certificate expires in 30, 7 or 1 days",
+		EnvVars: []string{"DISABLE_USER_EXPIRY_REMINDERS"},
+	})
+
+	flags = append(flags, &cli.BoolFlag{
+		Name:    "user-auto-renewal",
+		Usage:   "issue and email a new certificate to users whose console certificate is about to expire instead of a reminder",
+		EnvVars: []string{"USER_AUTO_RENEWAL"},
+	})
+
+	flags = append(flags, &cli.StringFlag{
+		Name:    "user-certificate-delivery",
+		Value:   common.UserCertificateDeliveryAttachment,
+		Usage:   "how user certificates are delivered: attachment (emailed pfx) or download (one-time link and a password sent separately)",
+		EnvVars: []string{"USER_CERTIFICATE_DELIVERY"},
+	})
+
+	flags = append(flags, &cli.IntFlag{
+		Name:    "user-download-ttl",
+		Value:   24,
+		Usage:   "the number of hours a one-time user certificate download link is valid",
+		EnvVars: []string{"USER_DOWNLOAD_TTL"},
+	})
+
+	flags = append(flags, &cli.StringFlag{
+		Name:    "console-url",
+		Usage:   "the url of the scnorion console used in the emails sent to users, e.g https://console.example.com",
+		EnvVars: []string{"CONSOLE_URL"},
+	})
+
+	flags = append(flags, &cli.StringFlag{
+		Name:    "cachain",
+		Usage:   "the path to a PEM bundle with the issuing CA certificate first followed by its intermediates, the CA private key must belong to the issuing CA",
+		EnvVars: []string{"CA_CHAIN_FILENAME"},
+	})
+
+	flags = append(flags, &cli.StringFlag{
+		Name:    "cakey-passphrase-file",
+		Usage:   "the path to a file with the passphrase of an encrypted CA private key, if not set CA_KEY_PASSPHRASE is used or the passphrase is asked",
+		EnvVars: []string{"CA_KEY_PASSPHRASE_FILE"},
+	})
+
+	flags = append(flags, &cli.StringFlag{
+		Name:    "acme-address",
+		Usage:   "the address where the ACME server for internal server certificates listens, e.g :8443. The ACME server is disabled if not set",
+		EnvVars: []string{"ACME_ADDRESS"},
+	})
+
+	flags = append(flags, &cli.StringFlag{
+		Name:    "acme-url",
+		Usage:   "the external url of the ACME server used in the directory, e.g https://ca.example.com:8443",
+		EnvVars: []string{"ACME_URL"},
+	})
+
+	flags = append(flags, &cli.StringFlag{
+		Name:    "acme-tls-cert",
+		Usage:   "the path to the TLS certificate file in PEM format of the ACME server, plain HTTP is used if not set",
+		EnvVars: []string{"ACME_TLS_CERT_FILENAME"},
+	})
+
+	flags = append(flags, &cli.StringFlag{
+		Name:    "acme-tls-key",
+		Usage:   "the path to the TLS private key file in PEM format of the ACME server",
+		EnvVars: []string{"ACME_TLS_KEY_FILENAME"},
+	})
+
+	flags = append(flags, &cli.StringFlag{
+		Name:    "acme-dns-suffixes",
+		Usage:   "comma-separated list of DNS suffixes the ACME server issues certificates for, e.g example.internal. The ACME server is not started if not set",
+		EnvVars: []string{"ACME_DNS_SUFFIXES"},
+	})
+
+	flags = append(flags, &cli.IntFlag{
+		Name:    "acme-validity",
+		Value:   90,
+		Usage:   "the maximum number of days a certificate issued by the ACME server is valid",
+		EnvVars: []string{"ACME_VALIDITY"},
+	})
+
+	flags = append(flags, &cli.IntFlag{
+		Name:    "acme-http01-port",
+		Value:   80,
+		Usage:   "the port used to validate HTTP-01 challenges",
+		EnvVars: []string{"ACME_HTTP01_PORT"},
+	})
+
 	return append(flags, &cli.StringFlag{
 		Name:    "cakey",
 		Value:   "certificates/ca.key",
-		Usage:   "the path to your CA private key file in PEM format",
+		Usage:   "the path to your CA private key file in PEM format (PKCS#1, PKCS#8, encrypted PKCS#8 or SEC1)",
 		EnvVars: []string{"CA_KEY_FILENAME"},
 	})
 }
@@ -65,7 +207,20 @@ func startCertManagerWorker(cCtx *cli.Context) error {
 	}
 
 	caKeyPath := filepath.Join(cwd, cCtx.String("cakey"))
-	worker.CAPrivateKey, err = utils.ReadPEMPrivateKey(caKeyPath)
+	if cCtx.String("cakey-passphrase-file") != "" {
+		worker.CAKeyPassphraseFile = filepath.Join(cwd, cCtx.String("cakey-passphrase-file"))
+	}
+	worker.CAPrivateKey, err = common.ReadEncryptedPEMSigner(caKeyPath, common.CAKeyPassphrase(worker.CAKeyPassphraseFile, true))
+	if err != nil {
+		return err
+	}
+
+	worker.UserKeySpec, err = common.ParseKeySpec(cCtx.String("user-key-algorithm"))
+	if err != nil {
+		return err
+	}
+
+	worker.AgentKeySpec, err = common.ParseKeySpec(cCtx.String("agent-key-algorithm"))
 	if err != nil {
 		return err
 	}
@@ -77,10 +232,64 @@ func startCertManagerWorker(cCtx *cli.Context) error {
 	}
 	worker.OCSPResponders = ocspServers
 
+	// get CRL settings
+	if cCtx.String("crl-path") != "" {
+		worker.CRLPath = filepath.Join(cwd, cCtx.String("crl-path"))
+	}
+	crlURLs := []string{}
+	for _, crl := range strings.Split(cCtx.String("crl-urls"), ",") {
+		if strings.TrimSpace(crl) != "" {
+			crlURLs = append(crlURLs, strings.TrimSpace(crl))
+		}
+	}
+	worker.CRLDistributionPoints = crlURLs
+	worker.CRLFrequency = time.Duration(cCtx.Int("crl-frequency")) * time.Minute
+
+	worker.LegacyAgentEnrollment = cCtx.Bool("allow-legacy-agent-enrollment")
+	worker.MaxConcurrentIssuance = cCtx.Int("max-concurrent-issuance")
+	worker.AgentRenewalWindow = common.RenewalWindow(cCtx.Int("agent-renewal-window"))
+	worker.UserExpiryReminders = !cCtx.Bool("disable-user-expiry-reminders")
+	worker.UserAutoRenewal = cCtx.Bool("user-auto-renewal")
+	worker.ConsoleURL = cCtx.String("console-url")
+	switch cCtx.String("user-certificate-delivery") {
+	case common.UserCertificateDeliveryAttachment, common.UserCertificateDeliveryDownload:
+		worker.UserCertificateDelivery = cCtx.String("user-certificate-delivery")
+	default:
+		return fmt.Errorf("user-certificate-delivery must be %s or %s", common.UserCertificateDeliveryAttachment, common.UserCertificateDeliveryDownload)
+	}
+	worker.UserCertificateDownloadTTL = time.Duration(cCtx.Int("user-download-ttl")) * time.Hour
+
+	// get ACME server settings
+	worker.ACMEAddress = cCtx.String("acme-address")
+	worker.ACMEURL = cCtx.String("acme-url")
+	if cCtx.String("acme-tls-cert") != "" {
+		worker.ACMETLSCertPath = filepath.Join(cwd, cCtx.String("acme-tls-cert"))
+	}
+	if cCtx.String("acme-tls-key") != "" {
+		worker.ACMETLSKeyPath = filepath.Join(cwd, cCtx.String("acme-tls-key"))
+	}
+	acmeSuffixes := []string{}
+	for _, suffix := range strings.Split(cCtx.String("acme-dns-suffixes"), ",") {
+		if strings.TrimSpace(suffix) != "" {
+			acmeSuffixes = append(acmeSuffixes, strings.TrimSpace(suffix))
+		}
+	}
+	worker.ACMEDNSSuffixes = acmeSuffixes
+	worker.ACMEValidity = time.Duration(cCtx.Int("acme-validity")) * 24 * time.Hour
+	worker.ACMEHTTP01Port = cCtx.Int("acme-http01-port")
+
 	if err := worker.CheckCLICommonRequisites(cCtx); err != nil {
 		log.Printf("[ERROR]: could not generate config for Cert Manager Worker: %v", err)
 	}
 
+	caChainPath := ""
+	if cCtx.String("cachain") != "" {
+		caChainPath = filepath.Join(cwd, cCtx.String("cachain"))
+	}
+	if err := worker.LoadCAChain(caChainPath); err != nil {
+		return err
+	}
+
 	if err := os.WriteFile("PIDFILE", []byte(strconv.Itoa(os.Getpid())), 0666); err != nil {
 		return err
 	}
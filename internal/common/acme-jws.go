@@ -0,0 +1,190 @@
+package common
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// JSON Web Signatures (RFC 7515) as used by ACME clients, only the flattened
+// JSON serialization with a single signature is accepted
+
+// minACMERSAKeySize is the smallest RSA key accepted for accounts and certificates
+const minACMERSAKeySize = 2048
+
+type acmeJWS struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+type acmeJWSHeader struct {
+	Algorithm string          `json:"alg"`
+	Nonce     string          `json:"nonce"`
+	URL       string          `json:"url"`
+	JWK       json.RawMessage `json:"jwk,omitempty"`
+	KeyID     string          `json:"kid,omitempty"`
+}
+
+type acmeJWK struct {
+	KeyType string `json:"kty"`
+	Curve   string `json:"crv,omitempty"`
+	N       string `json:"n,omitempty"`
+	E       string `json:"e,omitempty"`
+	X       string `json:"x,omitempty"`
+	Y       string `json:"y,omitempty"`
+}
+
+// ParseACMEJWK returns the public key and its canonical JSON (RFC 7638), the
+// canonical form is what's stored for the account and hashed for the thumbprint
+func ParseACMEJWK(data []byte) (crypto.PublicKey, []byte, error) {
+	jwk := acmeJWK{}
+	if err := json.Unmarshal(data, &jwk); err != nil {
+		return nil, nil, fmt.Errorf("invalid JWK: %v", err)
+	}
+
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil || len(n) == 0 {
+			return nil, nil, errors.New("invalid RSA modulus in JWK")
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, nil, errors.New("invalid RSA exponent in JWK")
+		}
+
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.N.BitLen() < minACMERSAKeySize {
+			return nil, nil, fmt.Errorf("RSA keys must have at least %d bits", minACMERSAKeySize)
+		}
+		if key.E < 3 || key.E%2 == 0 {
+			return nil, nil, errors.New("invalid RSA exponent in JWK")
+		}
+
+		canonical := fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, jwk.E, jwk.N)
+		return key, []byte(canonical), nil
+	case "EC":
+		curve, err := acmeCurve(jwk.Curve)
+		if err != nil {
+			return nil, nil, err
+		}
+		size := (curve.Params().BitSize + 7) / 8
+
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || len(x) != size {
+			return nil, nil, errors.New("invalid EC x coordinate in JWK")
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil || len(y) != size {
+			return nil, nil, errors.New("invalid EC y coordinate in JWK")
+		}
+
+		key, err := ecdsa.ParseUncompressedPublicKey(curve, append(append([]byte{4}, x...), y...))
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid EC key in JWK: %v", err)
+		}
+
+		canonical := fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, jwk.Curve, jwk.X, jwk.Y)
+		return key, []byte(canonical), nil
+	case "OKP":
+		if jwk.Curve != "Ed25519" {
+			return nil, nil, fmt.Errorf("unsupported OKP curve %s", jwk.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, nil, errors.New("invalid Ed25519 key in JWK")
+		}
+
+		canonical := fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":%q}`, jwk.X)
+		return ed25519.PublicKey(x), []byte(canonical), nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported JWK key type %s", jwk.KeyType)
+	}
+}
+
+// ACMEThumbprint is the base64url SHA-256 of the canonical JWK, used in key authorizations
+func ACMEThumbprint(canonicalJWK []byte) string {
+	sum := sha256.Sum256(canonicalJWK)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// verifyACMESignature checks the JWS signature over the protected header and the payload
+func verifyACMESignature(key crypto.PublicKey, algorithm string, jws *acmeJWS) error {
+	signature, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	if err != nil {
+		return errors.New("the JWS signature is not base64url encoded")
+	}
+	signingInput := []byte(jws.Protected + "." + jws.Payload)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if algorithm != "RS256" {
+			return fmt.Errorf("algorithm %s can't be used with an RSA key", algorithm)
+		}
+		digest := sha256.Sum256(signingInput)
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+			return errors.New("invalid JWS signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		var digest []byte
+		switch {
+		case algorithm == "ES256" && key.Curve == elliptic.P256():
+			sum := sha256.Sum256(signingInput)
+			digest = sum[:]
+		case algorithm == "ES384" && key.Curve == elliptic.P384():
+			sum := sha512.Sum384(signingInput)
+			digest = sum[:]
+		case algorithm == "ES512" && key.Curve == elliptic.P521():
+			sum := sha512.Sum512(signingInput)
+			digest = sum[:]
+		default:
+			return fmt.Errorf("algorithm %s can't be used with a %s key", algorithm, key.Curve.Params().Name)
+		}
+
+		// JWS ECDSA signatures are r and s concatenated, not ASN.1
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid JWS signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("invalid JWS signature")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if algorithm != "EdDSA" {
+			return fmt.Errorf("algorithm %s can't be used with an Ed25519 key", algorithm)
+		}
+		if !ed25519.Verify(key, signingInput, signature) {
+			return errors.New("invalid JWS signature")
+		}
+		return nil
+	default:
+		return errors.New("unsupported account key")
+	}
+}
+
+func acmeCurve(name string) (elliptic.Curve, error) {
+	switch name {
+	case "P-256":
+		return elliptic.P256(), nil
+	case "P-384":
+		return elliptic.P384(), nil
+	case "P-521":
+		return elliptic.P521(), nil
+	default:
+		return nil, fmt.Errorf("unsupported EC curve %s", name)
+	}
+}
@@ -0,0 +1,253 @@
+package common
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"golang.org/x/crypto/acme"
+)
+
+// The RSA key of RFC 7638 section 3.1 and its thumbprint
+const (
+	rfc7638JWK        = `{"kty":"RSA","n":"0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw","e":"AQAB","alg":"RS256","kid":"2011-04-29"}`
+	rfc7638Thumbprint = "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"
+)
+
+func TestACMEThumbprintRFC7638(t *testing.T) {
+	key, canonical, err := ParseACMEJWK([]byte(rfc7638JWK))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := key.(*rsa.PublicKey); !ok {
+		t.Fatalf("got a %T key, want an RSA key", key)
+	}
+	if got := ACMEThumbprint(canonical); got != rfc7638Thumbprint {
+		t.Errorf("got thumbprint %s, want %s", got, rfc7638Thumbprint)
+	}
+}
+
+// TestParseACMEJWK checks the keys against the JWKs and thumbprints of the ACME client package
+func TestParseACMEJWK(t *testing.T) {
+	for name, signer := range testACMEKeys(t) {
+		t.Run(name, func(t *testing.T) {
+			jwk := testJWK(t, signer.Public())
+
+			key, canonical, err := ParseACMEJWK([]byte(jwk))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !key.(interface{ Equal(crypto.PublicKey) bool }).Equal(signer.Public()) {
+				t.Error("the parsed key is not the JWK's key")
+			}
+
+			if _, ok := signer.(ed25519.PrivateKey); ok {
+				return
+			}
+			want, err := acme.JWKThumbprint(signer.Public())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ACMEThumbprint(canonical); got != want {
+				t.Errorf("got thumbprint %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestParseACMEJWKRejectsInvalidKeys(t *testing.T) {
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := b64(p256.X.FillBytes(make([]byte, 32)))
+	y := b64(p256.Y.FillBytes(make([]byte, 32)))
+	offCurve := b64(new(big.Int).Add(p256.Y, big.NewInt(1)).FillBytes(make([]byte, 32)))
+
+	tests := map[string]string{
+		"not json":             `{"kty":`,
+		"unknown key type":     `{"kty":"oct","k":"c2VjcmV0"}`,
+		"small RSA key":        testJWK(t, small.Public()),
+		"even RSA exponent":    fmt.Sprintf(`{"kty":"RSA","n":%q,"e":"Ag"}`, b64(small.N.Bytes())),
+		"unknown curve":        fmt.Sprintf(`{"kty":"EC","crv":"P-192","x":%q,"y":%q}`, x, y),
+		"short coordinate":     fmt.Sprintf(`{"kty":"EC","crv":"P-256","x":%q,"y":%q}`, x[2:], y),
+		"point not on curve":   fmt.Sprintf(`{"kty":"EC","crv":"P-256","x":%q,"y":%q}`, x, offCurve),
+		"curve of another key": fmt.Sprintf(`{"kty":"EC","crv":"P-384","x":%q,"y":%q}`, x, y),
+		"unknown OKP curve":    fmt.Sprintf(`{"kty":"OKP","crv":"X25519","x":%q}`, x),
+		"short Ed25519 key":    fmt.Sprintf(`{"kty":"OKP","crv":"Ed25519","x":%q}`, b64([]byte("short"))),
+	}
+	for name, jwk := range tests {
+		if _, _, err := ParseACMEJWK([]byte(jwk)); err == nil {
+			t.Errorf("%s: the JWK has been accepted", name)
+		}
+	}
+}
+
+func TestVerifyACMESignature(t *testing.T) {
+	algorithms := map[string]string{"RSA": "RS256", "P-256": "ES256", "P-384": "ES384", "P-521": "ES512", "Ed25519": "EdDSA"}
+
+	for name, signer := range testACMEKeys(t) {
+		t.Run(name, func(t *testing.T) {
+			algorithm := algorithms[name]
+			jws := testSignJWS(t, signer, algorithm, `{"nonce":"n"}`, `{"termsOfServiceAgreed":true}`)
+
+			if err := verifyACMESignature(signer.Public(), algorithm, jws); err != nil {
+				t.Fatalf("a valid signature has been rejected: %v", err)
+			}
+
+			tampered := *jws
+			tampered.Payload = b64([]byte(`{"termsOfServiceAgreed":false}`))
+			if err := verifyACMESignature(signer.Public(), algorithm, &tampered); err == nil {
+				t.Error("the signature of a modified payload has been accepted")
+			}
+
+			tampered = *jws
+			tampered.Protected = b64([]byte(`{"nonce":"m"}`))
+			if err := verifyACMESignature(signer.Public(), algorithm, &tampered); err == nil {
+				t.Error("the signature of a modified header has been accepted")
+			}
+
+			for _, other := range algorithms {
+				if other == algorithm {
+					continue
+				}
+				if err := verifyACMESignature(signer.Public(), other, jws); err == nil {
+					t.Errorf("the key has been accepted for %s", other)
+				}
+			}
+
+			otherKey := testACMEKeys(t)[name]
+			if err := verifyACMESignature(otherKey.Public(), algorithm, jws); err == nil {
+				t.Error("the signature has been accepted for another key")
+			}
+		})
+	}
+}
+
+// TestVerifyACMESignatureRejectsASN1 checks ECDSA signatures must use the JWS encoding
+func TestVerifyACMESignatureRejectsASN1(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jws := &acmeJWS{Protected: b64([]byte(`{}`)), Payload: b64([]byte(`{}`))}
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	jws.Signature = b64(signature)
+
+	if err := verifyACMESignature(key.Public(), "ES256", jws); err == nil {
+		t.Error("an ASN.1 signature has been accepted")
+	}
+}
+
+func testACMEKeys(t *testing.T) map[string]crypto.Signer {
+	t.Helper()
+
+	keys := map[string]crypto.Signer{}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys["RSA"] = rsaKey
+	for name, curve := range map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()} {
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[name] = key
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys["Ed25519"] = edKey
+	return keys
+}
+
+// testJWK encodes the public key as a JWK the way ACME clients do, with members in no particular order
+func testJWK(t *testing.T, key crypto.PublicKey) string {
+	t.Helper()
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf(`{"n":%q,"kty":"RSA","e":%q}`, b64(key.N.Bytes()), b64(big.NewInt(int64(key.E)).Bytes()))
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		return fmt.Sprintf(`{"y":%q,"x":%q,"kty":"EC","crv":%q}`,
+			b64(key.Y.FillBytes(make([]byte, size))), b64(key.X.FillBytes(make([]byte, size))), key.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return fmt.Sprintf(`{"x":%q,"kty":"OKP","crv":"Ed25519"}`, b64(key))
+	default:
+		t.Fatalf("unsupported key %T", key)
+		return ""
+	}
+}
+
+// testSignJWS signs the header and payload as described by RFC 7518 for the algorithm
+func testSignJWS(t *testing.T, signer crypto.Signer, algorithm, header, payload string) *acmeJWS {
+	t.Helper()
+
+	jws := &acmeJWS{Protected: b64([]byte(header)), Payload: b64([]byte(payload))}
+	signingInput := []byte(jws.Protected + "." + jws.Payload)
+
+	var signature []byte
+	var err error
+	switch key := signer.(type) {
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256(signingInput)
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var digest []byte
+		switch algorithm {
+		case "ES256":
+			sum := sha256.Sum256(signingInput)
+			digest = sum[:]
+		case "ES384":
+			sum := sha512.Sum384(signingInput)
+			digest = sum[:]
+		default:
+			sum := sha512.Sum512(signingInput)
+			digest = sum[:]
+		}
+		var der []byte
+		der, err = ecdsa.SignASN1(rand.Reader, key, digest)
+		if err == nil {
+			var rs struct{ R, S *big.Int }
+			if _, err := asn1.Unmarshal(der, &rs); err != nil {
+				t.Fatal(err)
+			}
+			size := (key.Curve.Params().BitSize + 7) / 8
+			signature = append(rs.R.FillBytes(make([]byte, size)), rs.S.FillBytes(make([]byte, size))...)
+		}
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, signingInput)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jws.Signature = b64(signature)
+	return jws
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
@@ -0,0 +1,1425 @@
+package common
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"mime"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"github.com/scncore/ent"
+	"github.com/scncore/scnorion-worker/internal/models"
+	"golang.org/x/crypto/ocsp"
+)
+
+// ACME (RFC 8555) server for internal server certificates. Only DNS identifiers
+// validated with HTTP-01 are supported, certificates are signed with the
+// cert-manager's CA. Names must end with one of the allowed DNS suffixes as
+// External Account Binding is not supported, anyone reaching the server may
+// create an account
+
+const (
+	DefaultACMEValidity   = 90 * 24 * time.Hour
+	DefaultACMEHTTP01Port = 80
+	// ACMECertificateType is the type of the certificates.revoked events of ACME certificates
+	ACMECertificateType = "acme"
+)
+
+const (
+	acmeNonceLifetime     = time.Hour
+	acmeJobFrequency      = time.Minute
+	acmeOrderLifetime     = 7 * 24 * time.Hour
+	acmeValidationTimeout = 10 * time.Second
+	acmeMaxRedirects      = 10
+	acmeBackdate          = 5 * time.Minute
+	maxACMERequestSize    = 64 * 1024
+	maxACMEIdentifiers    = 100
+	maxACMEChallengeSize  = 1024
+)
+
+const (
+	acmeStatusPending     = "pending"
+	acmeStatusReady       = "ready"
+	acmeStatusProcessing  = "processing"
+	acmeStatusValid       = "valid"
+	acmeStatusInvalid     = "invalid"
+	acmeStatusExpired     = "expired"
+	acmeStatusDeactivated = "deactivated"
+)
+
+// ACMEStore keeps the ACME state, the worker's Model implements it
+type ACMEStore interface {
+	AddACMENonce(nonce string, expires time.Time) error
+	UseACMENonce(nonce string) (bool, error)
+	DeleteExpiredACMENonces() error
+	AddACMEAccount(account *models.ACMEAccount) error
+	GetACMEAccount(id string) (*models.ACMEAccount, error)
+	GetACMEAccountByThumbprint(thumbprint string) (*models.ACMEAccount, error)
+	UpdateACMEAccount(account *models.ACMEAccount) error
+	AddACMEOrder(order *models.ACMEOrder, authorizations []*models.ACMEAuthorization) error
+	GetACMEOrder(id string) (*models.ACMEOrder, error)
+	GetACMEOrderIDBySerial(serial string) (string, error)
+	GetACMEAccountOrderIDs(accountID string) ([]string, error)
+	UpdateACMEOrder(order *models.ACMEOrder) error
+	SetACMEOrderStatus(id, from, to string) (bool, error)
+	GetACMEAuthorization(id string) (*models.ACMEAuthorization, error)
+	GetACMEOrderAuthorizations(orderID string) ([]*models.ACMEAuthorization, error)
+	UpdateACMEAuthorization(authz *models.ACMEAuthorization) error
+	SetACMEChallengeStatus(id, from, to string) (bool, error)
+	SaveACMECertificate(serial *big.Int, order *models.ACMEOrder, expiry time.Time) error
+	RevokeACMECertificate(serial *big.Int, reason int, info string) (*models.ACMECertificate, error)
+	GetRevocationBySerial(serial *big.Int) (*ent.Revocation, error)
+}
+
+type ACMEServer struct {
+	Worker *Worker
+	Store  ACMEStore
+	// URL is the external URL clients use, e.g https://ca.example.com:8443, if empty it's taken from the request
+	URL         string
+	DNSSuffixes []string
+	Validity    time.Duration
+	HTTP01Port  int
+	HTTPClient  *http.Client
+	Server      *http.Server
+}
+
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+// acmeRequest is a verified JWS request, Payload is nil for POST-as-GET requests
+type acmeRequest struct {
+	Payload []byte
+	Account *models.ACMEAccount
+	Key     crypto.PublicKey
+	JWK     []byte
+}
+
+type acmeKeyMode int
+
+const (
+	acmeKeyID acmeKeyMode = iota
+	acmeJWKOnly
+	acmeAnyKey
+)
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeAccountObject struct {
+	Status  string   `json:"status"`
+	Contact []string `json:"contact,omitempty"`
+	Orders  string   `json:"orders"`
+}
+
+type acmeOrderObject struct {
+	Status         string           `json:"status"`
+	Expires        string           `json:"expires"`
+	Identifiers    []acmeIdentifier `json:"identifiers"`
+	NotBefore      string           `json:"notBefore,omitempty"`
+	NotAfter       string           `json:"notAfter,omitempty"`
+	Authorizations []string         `json:"authorizations"`
+	Finalize       string           `json:"finalize"`
+	Certificate    string           `json:"certificate,omitempty"`
+	Error          json.RawMessage  `json:"error,omitempty"`
+}
+
+type acmeAuthorizationObject struct {
+	Identifier acmeIdentifier        `json:"identifier"`
+	Status     string                `json:"status"`
+	Expires    string                `json:"expires"`
+	Challenges []acmeChallengeObject `json:"challenges"`
+}
+
+type acmeChallengeObject struct {
+	Type      string          `json:"type"`
+	URL       string          `json:"url"`
+	Token     string          `json:"token"`
+	Status    string          `json:"status"`
+	Validated string          `json:"validated,omitempty"`
+	Error     json.RawMessage `json:"error,omitempty"`
+}
+
+func NewACMEServer(w *Worker, store ACMEStore) *ACMEServer {
+	validity := w.ACMEValidity
+	if validity <= 0 {
+		validity = DefaultACMEValidity
+	}
+
+	port := w.ACMEHTTP01Port
+	if port <= 0 {
+		port = DefaultACMEHTTP01Port
+	}
+
+	return &ACMEServer{
+		Worker:      w,
+		Store:       store,
+		URL:         strings.TrimSuffix(w.ACMEURL, "/"),
+		DNSSuffixes: w.ACMEDNSSuffixes,
+		Validity:    validity,
+		HTTP01Port:  port,
+		HTTPClient:  &http.Client{Timeout: acmeValidationTimeout},
+	}
+}
+
+// StartACMEServer starts the ACME server if an address has been set, once the database is
+// available. The job that deletes the expired nonces starts it again if it couldn't listen
+func (w *Worker) StartACMEServer() error {
+	var err error
+
+	if w.ACMEAddress == "" || w.ACMEJob != nil {
+		return nil
+	}
+
+	// Without External Account Binding the suffixes are all that keeps anyone from getting certificates
+	if len(w.ACMEDNSSuffixes) == 0 {
+		log.Println("[ERROR]: the ACME server has not been started, the DNS suffixes it issues certificates for must be set")
+		return nil
+	}
+
+	if w.ACMEURL == "" {
+		log.Println("[INFO]: no external URL has been set for the ACME server, the host requested by clients will be used")
+	}
+
+	if err := w.startACMEServer(); err != nil {
+		log.Printf("[ERROR]: could not start the ACME server, reason: %v", err)
+	}
+
+	w.ACMEJob, err = w.TaskScheduler.NewJob(
+		gocron.DurationJob(
+			acmeJobFrequency,
+		),
+		gocron.NewTask(
+			func() {
+				if err := w.startACMEServer(); err != nil {
+					log.Printf("[ERROR]: could not start the ACME server, reason: %v", err)
+					return
+				}
+				if err := w.Model.DeleteExpiredACMENonces(); err != nil {
+					log.Printf("[ERROR]: could not delete expired ACME nonces, reason: %v", err)
+				}
+			},
+		),
+	)
+	if err != nil {
+		log.Printf("[ERROR]: could not start the ACME server job: %v", err)
+		return err
+	}
+	return nil
+}
+
+// startACMEServer listens and serves unless the server is already running, the
+// server is forgotten if it stops so the next call starts it again
+func (w *Worker) startACMEServer() error {
+	w.acmeMutex.Lock()
+	defer w.acmeMutex.Unlock()
+
+	if w.ACMEServer != nil {
+		return nil
+	}
+
+	server := NewACMEServer(w, w.Model)
+	listener, err := server.Listen(w.ACMEAddress, w.ACMETLSCertPath, w.ACMETLSKeyPath)
+	if err != nil {
+		return err
+	}
+	w.ACMEServer = server
+
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			log.Printf("[ERROR]: the ACME server has stopped, reason: %v", err)
+		}
+
+		w.acmeMutex.Lock()
+		defer w.acmeMutex.Unlock()
+		if w.ACMEServer == server {
+			w.ACMEServer = nil
+		}
+	}()
+	return nil
+}
+
+// StopACMEServer stops the ACME server if it's running, its job is removed first so it isn't started again
+func (w *Worker) StopACMEServer() {
+	if w.ACMEJob != nil && w.TaskScheduler != nil {
+		if err := w.TaskScheduler.RemoveJob(w.ACMEJob.ID()); err != nil {
+			log.Printf("[ERROR]: could not remove the ACME server job, reason: %v", err)
+		}
+	}
+
+	w.acmeMutex.Lock()
+	server := w.ACMEServer
+	w.ACMEServer = nil
+	w.acmeMutex.Unlock()
+
+	if server != nil {
+		server.Stop()
+	}
+}
+
+// Listen opens the address so errors are known before serving, it uses TLS if a certificate
+// has been set. RFC 8555 requires HTTPS, plain HTTP is only meant for a TLS terminating proxy
+func (s *ACMEServer) Listen(address, certFile, keyFile string) (net.Listener, error) {
+	var tlsConfig *tls.Config
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Server = &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	if tlsConfig != nil {
+		log.Printf("[INFO]: ACME server listening on %s", address)
+		return tls.NewListener(listener, tlsConfig), nil
+	}
+	log.Printf("[INFO]: ACME server listening on %s without TLS", address)
+	return listener, nil
+}
+
+func (s *ACMEServer) Serve(listener net.Listener) error {
+	if err := s.Server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *ACMEServer) Stop() {
+	if s.Server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := s.Server.Shutdown(ctx); err != nil {
+			log.Printf("[ERROR]: could not shutdown the ACME server, reason: %v", err)
+		}
+	}
+}
+
+func (s *ACMEServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /acme/directory", s.DirectoryHandler)
+	mux.HandleFunc("GET /acme/new-nonce", s.NewNonceHandler)
+	mux.HandleFunc("POST /acme/new-account", s.NewAccountHandler)
+	mux.HandleFunc("POST /acme/new-order", s.NewOrderHandler)
+	mux.HandleFunc("POST /acme/revoke-cert", s.RevokeCertHandler)
+	mux.HandleFunc("POST /acme/account/{id}", s.AccountHandler)
+	mux.HandleFunc("POST /acme/account/{id}/orders", s.AccountOrdersHandler)
+	mux.HandleFunc("POST /acme/order/{id}", s.OrderHandler)
+	mux.HandleFunc("POST /acme/order/{id}/finalize", s.FinalizeHandler)
+	mux.HandleFunc("POST /acme/authz/{id}", s.AuthorizationHandler)
+	mux.HandleFunc("POST /acme/chall/{id}", s.ChallengeHandler)
+	mux.HandleFunc("POST /acme/cert/{id}", s.CertificateHandler)
+	return mux
+}
+
+func (s *ACMEServer) DirectoryHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, r, http.StatusOK, map[string]any{
+		"newNonce":   s.link(r, "/acme/new-nonce"),
+		"newAccount": s.link(r, "/acme/new-account"),
+		"newOrder":   s.link(r, "/acme/new-order"),
+		"revokeCert": s.link(r, "/acme/revoke-cert"),
+		"meta": map[string]any{
+			"externalAccountRequired": false,
+		},
+	})
+}
+
+func (s *ACMEServer) NewNonceHandler(w http.ResponseWriter, r *http.Request) {
+	s.addNonce(w)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Link", fmt.Sprintf("<%s>;rel=\"index\"", s.link(r, "/acme/directory")))
+
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *ACMEServer) NewAccountHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.readRequest(w, r, acmeJWKOnly)
+	if !ok {
+		return
+	}
+
+	payload := struct {
+		Contact              []string `json:"contact"`
+		TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+		OnlyReturnExisting   bool     `json:"onlyReturnExisting"`
+	}{}
+	if req.Payload == nil || json.Unmarshal(req.Payload, &payload) != nil {
+		s.writeProblem(w, r, newACMEProblem("malformed", http.StatusBadRequest, "invalid new account request"))
+		return
+	}
+
+	thumbprint := ACMEThumbprint(req.JWK)
+	account, err := s.Store.GetACMEAccountByThumbprint(thumbprint)
+	if err == nil {
+		if account.Status != acmeStatusValid {
+			s.writeProblem(w, r, newACMEProblem("unauthorized", http.StatusUnauthorized, "the account has been %s", account.Status))
+			return
+		}
+		w.Header().Set("Location", s.link(r, "/acme/account/"+account.ID))
+		s.writeJSON(w, r, http.StatusOK, s.accountObject(r, account))
+		return
+	}
+	if !ent.IsNotFound(err) {
+		s.writeServerError(w, r, "could not get ACME account", err)
+		return
+	}
+
+	if payload.OnlyReturnExisting {
+		s.writeProblem(w, r, newACMEProblem("accountDoesNotExist", http.StatusBadRequest, "no account exists for this key"))
+		return
+	}
+
+	if problem := validateACMEContacts(payload.Contact); problem != nil {
+		s.writeProblem(w, r, problem)
+		return
+	}
+
+	account = &models.ACMEAccount{
+		ID:         randomACMEString(16),
+		JWK:        req.JWK,
+		Thumbprint: thumbprint,
+		Contact:    payload.Contact,
+		Status:     acmeStatusValid,
+	}
+	if err := s.Store.AddACMEAccount(account); err != nil {
+		s.writeServerError(w, r, "could not save ACME account", err)
+		return
+	}
+	log.Printf("[INFO]: new ACME account %s has been registered", account.ID)
+
+	w.Header().Set("Location", s.link(r, "/acme/account/"+account.ID))
+	s.writeJSON(w, r, http.StatusCreated, s.accountObject(r, account))
+}
+
+func (s *ACMEServer) AccountHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.readRequest(w, r, acmeKeyID)
+	if !ok {
+		return
+	}
+
+	if req.Account.ID != r.PathValue("id") {
+		s.writeProblem(w, r, newACMEProblem("unauthorized", http.StatusUnauthorized, "the request is not signed by this account"))
+		return
+	}
+
+	if req.Payload != nil {
+		payload := struct {
+			Contact *[]string `json:"contact"`
+			Status  string    `json:"status"`
+		}{}
+		if err := json.Unmarshal(req.Payload, &payload); err != nil {
+			s.writeProblem(w, r, newACMEProblem("malformed", http.StatusBadRequest, "invalid account update request"))
+			return
+		}
+
+		switch payload.Status {
+		case "", acmeStatusValid:
+		case acmeStatusDeactivated:
+			req.Account.Status = acmeStatusDeactivated
+		default:
+			s.writeProblem(w, r, newACMEProblem("malformed", http.StatusBadRequest, "an account can only be deactivated"))
+			return
+		}
+
+		if payload.Contact != nil {
+			if problem := validateACMEContacts(*payload.Contact); problem != nil {
+				s.writeProblem(w, r, problem)
+				return
+			}
+			req.Account.Contact = *payload.Contact
+		}
+
+		if err := s.Store.UpdateACMEAccount(req.Account); err != nil {
+			s.writeServerError(w, r, "could not update ACME account", err)
+			return
+		}
+	}
+
+	s.writeJSON(w, r, http.StatusOK, s.accountObject(r, req.Account))
+}
+
+func (s *ACMEServer) AccountOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.readRequest(w, r, acmeKeyID)
+	if !ok {
+		return
+	}
+
+	if req.Account.ID != r.PathValue("id") {
+		s.writeProblem(w, r, newACMEProblem("unauthorized", http.StatusUnauthorized, "the request is not signed by this account"))
+		return
+	}
+
+	ids, err := s.Store.GetACMEAccountOrderIDs(req.Account.ID)
+	if err != nil {
+		s.writeServerError(w, r, "could not get ACME orders", err)
+		return
+	}
+
+	orders := []string{}
+	for _, id := range ids {
+		orders = append(orders, s.link(r, "/acme/order/"+id))
+	}
+	s.writeJSON(w, r, http.StatusOK, map[string][]string{"orders": orders})
+}
+
+func (s *ACMEServer) NewOrderHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.readRequest(w, r, acmeKeyID)
+	if !ok {
+		return
+	}
+
+	payload := struct {
+		Identifiers []acmeIdentifier `json:"identifiers"`
+		NotBefore   time.Time        `json:"notBefore"`
+		NotAfter    time.Time        `json:"notAfter"`
+	}{}
+	if req.Payload == nil || json.Unmarshal(req.Payload, &payload) != nil {
+		s.writeProblem(w, r, newACMEProblem("malformed", http.StatusBadRequest, "invalid new order request"))
+		return
+	}
+
+	if len(payload.Identifiers) == 0 {
+		s.writeProblem(w, r, newACMEProblem("malformed", http.StatusBadRequest, "the order has no identifiers"))
+		return
+	}
+	if len(payload.Identifiers) > maxACMEIdentifiers {
+		s.writeProblem(w, r, newACMEProblem("rejectedIdentifier", http.StatusBadRequest, "an order can't have more than %d identifiers", maxACMEIdentifiers))
+		return
+	}
+
+	names := []string{}
+	for _, identifier := range payload.Identifiers {
+		if problem := s.checkACMEIdentifier(identifier); problem != nil {
+			s.writeProblem(w, r, problem)
+			return
+		}
+		name := strings.ToLower(identifier.Value)
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	now := time.Now()
+	if !payload.NotBefore.IsZero() && !payload.NotAfter.IsZero() && !payload.NotAfter.After(payload.NotBefore) {
+		s.writeProblem(w, r, newACMEProblem("malformed", http.StatusBadRequest, "notAfter must be later than notBefore"))
+		return
+	}
+	if !payload.NotAfter.IsZero() && payload.NotAfter.After(now.Add(s.Validity)) {
+		s.writeProblem(w, r, newACMEProblem("malformed", http.StatusBadRequest, "certificates can't be valid for more than %d days", int(s.Validity.Hours()/24)))
+		return
+	}
+
+	order := &models.ACMEOrder{
+		ID:          randomACMEString(16),
+		AccountID:   req.Account.ID,
+		Status:      acmeStatusPending,
+		Identifiers: names,
+		NotBefore:   payload.NotBefore,
+		NotAfter:    payload.NotAfter,
+		Expires:     now.Add(acmeOrderLifetime).UTC().Truncate(time.Second),
+	}
+
+	authorizations := []*models.ACMEAuthorization{}
+	for _, name := range names {
+		authorizations = append(authorizations, &models.ACMEAuthorization{
+			ID:              randomACMEString(16),
+			OrderID:         order.ID,
+			AccountID:       req.Account.ID,
+			Identifier:      name,
+			Status:          acmeStatusPending,
+			Expires:         order.Expires,
+			Token:           randomACMEString(32),
+			ChallengeStatus: acmeStatusPending,
+		})
+	}
+
+	if err := s.Store.AddACMEOrder(order, authorizations); err != nil {
+		s.writeServerError(w, r, "could not save ACME order", err)
+		return
+	}
+
+	w.Header().Set("Location", s.link(r, "/acme/order/"+order.ID))
+	s.writeJSON(w, r, http.StatusCreated, s.orderObject(r, order, authorizations))
+}
+
+func (s *ACMEServer) OrderHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.readRequest(w, r, acmeKeyID)
+	if !ok {
+		return
+	}
+
+	order, authorizations, ok := s.getOrder(w, r, req, r.PathValue("id"))
+	if !ok {
+		return
+	}
+
+	if order.Status == acmeStatusProcessing {
+		w.Header().Set("Retry-After", "1")
+	}
+	s.writeJSON(w, r, http.StatusOK, s.orderObject(r, order, authorizations))
+}
+
+func (s *ACMEServer) AuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.readRequest(w, r, acmeKeyID)
+	if !ok {
+		return
+	}
+
+	authz, ok := s.getAuthorization(w, r, req, r.PathValue("id"))
+	if !ok {
+		return
+	}
+
+	if req.Payload != nil {
+		payload := struct {
+			Status string `json:"status"`
+		}{}
+		if err := json.Unmarshal(req.Payload, &payload); err != nil || payload.Status != acmeStatusDeactivated {
+			s.writeProblem(w, r, newACMEProblem("malformed", http.StatusBadRequest, "an authorization can only be deactivated"))
+			return
+		}
+		if authz.Status != acmeStatusPending && authz.Status != acmeStatusValid {
+			s.writeProblem(w, r, newACMEProblem("malformed", http.StatusBadRequest, "the authorization is %s", authz.Status))
+			return
+		}
+
+		authz.Status = acmeStatusDeactivated
+		if err := s.Store.UpdateACMEAuthorization(authz); err != nil {
+			s.writeServerError(w, r, "could not update ACME authorization", err)
+			return
+		}
+	}
+
+	s.writeJSON(w, r, http.StatusOK, s.authorizationObject(r, authz))
+}
+
+func (s *ACMEServer) ChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.readRequest(w, r, acmeKeyID)
+	if !ok {
+		return
+	}
+
+	authz, ok := s.getAuthorization(w, r, req, r.PathValue("id"))
+	if !ok {
+		return
+	}
+
+	// Any payload, usually an empty object, means the client is ready for the validation
+	if req.Payload != nil && authz.Status == acmeStatusPending && authz.ChallengeStatus == acmeStatusPending {
+		started, err := s.Store.SetACMEChallengeStatus(authz.ID, acmeStatusPending, acmeStatusProcessing)
+		if err != nil {
+			s.writeServerError(w, r, "could not update ACME challenge", err)
+			return
+		}
+		authz.ChallengeStatus = acmeStatusProcessing
+
+		if started {
+			go s.ValidateHTTP01Challenge(authz, req.Account.Thumbprint)
+		}
+	}
+
+	w.Header().Add("Link", fmt.Sprintf("<%s>;rel=\"up\"", s.link(r, "/acme/authz/"+authz.ID)))
+	s.writeJSON(w, r, http.StatusOK, s.challengeObject(r, authz))
+}
+
+// ValidateHTTP01Challenge fetches the key authorization from the DNS name and
+// sets the challenge and its authorization as valid or invalid
+func (s *ACMEServer) ValidateHTTP01Challenge(authz *models.ACMEAuthorization, thumbprint string) {
+	host := authz.Identifier
+	if s.HTTP01Port != DefaultACMEHTTP01Port {
+		host = net.JoinHostPort(authz.Identifier, strconv.Itoa(s.HTTP01Port))
+	}
+	url := fmt.Sprintf("http://%s/.well-known/acme-challenge/%s", host, authz.Token)
+
+	problem := s.fetchKeyAuthorization(url, authz.Identifier, authz.Token+"."+thumbprint)
+	if problem != nil {
+		log.Printf("[INFO]: ACME HTTP-01 challenge for %s has failed: %s", authz.Identifier, problem.Detail)
+		authz.Status = acmeStatusInvalid
+		authz.ChallengeStatus = acmeStatusInvalid
+		authz.Error = problem.JSON()
+	} else {
+		log.Printf("[INFO]: ACME HTTP-01 challenge for %s is valid", authz.Identifier)
+		authz.Status = acmeStatusValid
+		authz.ChallengeStatus = acmeStatusValid
+		authz.Validated = time.Now().UTC().Truncate(time.Second)
+	}
+
+	if err := s.Store.UpdateACMEAuthorization(authz); err != nil {
+		log.Printf("[ERROR]: could not save the ACME challenge result for %s, reason: %v", authz.Identifier, err)
+	}
+}
+
+// fetchKeyAuthorization gets the key authorization from the url, redirects are only followed
+// to the DNS name being validated so it can't be answered by another server
+func (s *ACMEServer) fetchKeyAuthorization(url, identifier, keyAuthorization string) *acmeProblem {
+	client := *s.HTTPClient
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= acmeMaxRedirects {
+			return errors.New("too many redirects")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("redirect to a %s url is not allowed", req.URL.Scheme)
+		}
+		if !strings.EqualFold(req.URL.Hostname(), identifier) {
+			return fmt.Errorf("redirect to %s is not allowed, only to %s", req.URL.Hostname(), identifier)
+		}
+		return nil
+	}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return newACMEProblem("connection", http.StatusBadRequest, "could not connect to %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newACMEProblem("unauthorized", http.StatusForbidden, "%s returned HTTP status %d", url, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxACMEChallengeSize))
+	if err != nil {
+		return newACMEProblem("connection", http.StatusBadRequest, "could not read the response from %s: %v", url, err)
+	}
+
+	if strings.TrimSpace(string(body)) != keyAuthorization {
+		return newACMEProblem("incorrectResponse", http.StatusForbidden, "the key authorization returned by %s does not match", url)
+	}
+	return nil
+}
+
+func (s *ACMEServer) FinalizeHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.readRequest(w, r, acmeKeyID)
+	if !ok {
+		return
+	}
+
+	order, authorizations, ok := s.getOrder(w, r, req, r.PathValue("id"))
+	if !ok {
+		return
+	}
+
+	if order.Status != acmeStatusReady {
+		s.writeProblem(w, r, newACMEProblem("orderNotReady", http.StatusForbidden, "the order is %s", order.Status))
+		return
+	}
+
+	payload := struct {
+		CSR string `json:"csr"`
+	}{}
+	if req.Payload == nil || json.Unmarshal(req.Payload, &payload) != nil {
+		s.writeProblem(w, r, newACMEProblem("malformed", http.StatusBadRequest, "invalid finalize request"))
+		return
+	}
+
+	csr, problem := checkACMECSR(payload.CSR, order.Identifiers)
+	if problem != nil {
+		s.writeProblem(w, r, problem)
+		return
+	}
+
+	processing, err := s.Store.SetACMEOrderStatus(order.ID, acmeStatusReady, acmeStatusProcessing)
+	if err != nil {
+		s.writeServerError(w, r, "could not update ACME order", err)
+		return
+	}
+	if !processing {
+		s.writeProblem(w, r, newACMEProblem("orderNotReady", http.StatusForbidden, "the order is already being finalized"))
+		return
+	}
+
+	cert, chain, err := s.IssueCertificate(order, csr)
+	if err != nil {
+		log.Printf("[ERROR]: could not issue the certificate for ACME order %s, reason: %v", order.ID, err)
+		order.Status = acmeStatusInvalid
+		order.Error = newACMEProblem("serverInternal", http.StatusInternalServerError, "the certificate could not be issued").JSON()
+		if err := s.Store.UpdateACMEOrder(order); err != nil {
+			log.Printf("[ERROR]: could not update ACME order %s, reason: %v", order.ID, err)
+		}
+		s.writeProblem(w, r, newACMEProblem("serverInternal", http.StatusInternalServerError, "the certificate could not be issued"))
+		return
+	}
+
+	order.Status = acmeStatusValid
+	order.Serial = models.FormatSerial(cert.SerialNumber)
+	order.Certificate = chain
+	if err := s.Store.UpdateACMEOrder(order); err != nil {
+		s.writeServerError(w, r, "could not update ACME order", err)
+		return
+	}
+	log.Printf("[INFO]: ACME certificate with serial %s has been issued for %s", order.Serial, strings.Join(order.Identifiers, ", "))
+
+	w.Header().Set("Location", s.link(r, "/acme/order/"+order.ID))
+	s.writeJSON(w, r, http.StatusOK, s.orderObject(r, order, authorizations))
+}
+
+// IssueCertificate signs a server certificate for the order's DNS names and
+// returns it with the PEM chain clients download
+func (s *ACMEServer) IssueCertificate(order *models.ACMEOrder, csr *x509.CertificateRequest) (*x509.Certificate, string, error) {
+	w := s.Worker
+	if w.CACert == nil || w.CAPrivateKey == nil {
+		return nil, "", errors.New("the CA certificate and private key are not loaded")
+	}
+
+	notBefore, notAfter, err := s.certificateValidity(order, time.Now())
+	if err != nil {
+		return nil, "", err
+	}
+
+	serialNumber, err := w.NewSerialNumber()
+	if err != nil {
+		return nil, "", err
+	}
+
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, ok := csr.PublicKey.(*rsa.PublicKey); ok {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: order.Identifiers[0]},
+		Issuer:                w.CACert.Subject,
+		DNSNames:              order.Identifiers,
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              keyUsage,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		OCSPServer:            w.OCSPResponders,
+		CRLDistributionPoints: w.CRLDistributionPoints,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, w.CACert, csr.PublicKey, w.CAPrivateKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := s.Store.SaveACMECertificate(cert.SerialNumber, order, cert.NotAfter); err != nil {
+		return nil, "", err
+	}
+
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	for _, intermediate := range w.Intermediates() {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: intermediate.Raw})...)
+	}
+
+	return cert, string(chain), nil
+}
+
+// certificateValidity keeps the validity the client asked for between now and the validity
+// allowed by the server, the order may be finalized long after it was created
+func (s *ACMEServer) certificateValidity(order *models.ACMEOrder, now time.Time) (time.Time, time.Time, error) {
+	notBefore := now.Add(-acmeBackdate)
+	if order.NotBefore.After(notBefore) {
+		notBefore = order.NotBefore
+	}
+
+	notAfter := now.Add(s.Validity)
+	if !order.NotAfter.IsZero() && order.NotAfter.Before(notAfter) {
+		notAfter = order.NotAfter
+	}
+
+	if !notAfter.After(notBefore) {
+		return time.Time{}, time.Time{}, fmt.Errorf("the validity requested from %s to %s can't be issued", acmeTime(order.NotBefore), acmeTime(order.NotAfter))
+	}
+	return notBefore.UTC(), notAfter.UTC(), nil
+}
+
+func (s *ACMEServer) CertificateHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.readRequest(w, r, acmeKeyID)
+	if !ok {
+		return
+	}
+
+	order, _, ok := s.getOrder(w, r, req, r.PathValue("id"))
+	if !ok {
+		return
+	}
+
+	if order.Status != acmeStatusValid || order.Certificate == "" {
+		s.writeProblem(w, r, newACMEProblem("malformed", http.StatusNotFound, "the order has no certificate"))
+		return
+	}
+
+	s.addNonce(w)
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.Header().Set("Link", fmt.Sprintf("<%s>;rel=\"index\"", s.link(r, "/acme/directory")))
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.WriteString(w, order.Certificate); err != nil {
+		log.Printf("[ERROR]: could not write ACME certificate, reason: %v", err)
+	}
+}
+
+// RevokeCertHandler revokes certificates issued to the account or signed with the certificate's own key
+func (s *ACMEServer) RevokeCertHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.readRequest(w, r, acmeAnyKey)
+	if !ok {
+		return
+	}
+
+	payload := struct {
+		Certificate string `json:"certificate"`
+		Reason      *int   `json:"reason"`
+	}{}
+	if req.Payload == nil || json.Unmarshal(req.Payload, &payload) != nil {
+		s.writeProblem(w, r, newACMEProblem("malformed", http.StatusBadRequest, "invalid revocation request"))
+		return
+	}
+
+	der, err := base64.RawURLEncoding.DecodeString(payload.Certificate)
+	if err != nil {
+		s.writeProblem(w, r, newACMEProblem("malformed", http.StatusBadRequest, "the certificate is not base64url encoded"))
+		return
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		s.writeProblem(w, r, newACMEProblem("malformed", http.StatusBadRequest, "could not parse the certificate"))
+		return
+	}
+	if err := cert.CheckSignatureFrom(s.Worker.CACert); err != nil {
+		s.writeProblem(w, r, newACMEProblem("unauthorized", http.StatusForbidden, "the certificate has not been issued by this CA"))
+		return
+	}
+
+	reason := ocsp.Unspecified
+	if payload.Reason != nil {
+		reason = *payload.Reason
+	}
+	switch reason {
+	case ocsp.Unspecified, ocsp.KeyCompromise, ocsp.AffiliationChanged, ocsp.Superseded, ocsp.CessationOfOperation:
+	default:
+		s.writeProblem(w, r, newACMEProblem("badRevocationReason", http.StatusBadRequest, "revocation reason %d is not allowed", reason))
+		return
+	}
+
+	serial := models.FormatSerial(cert.SerialNumber)
+	info := ""
+	if req.Account != nil {
+		orderID, err := s.Store.GetACMEOrderIDBySerial(serial)
+		if err != nil && !ent.IsNotFound(err) {
+			s.writeServerError(w, r, "could not get ACME order", err)
+			return
+		}
+		order := &models.ACMEOrder{}
+		if err == nil {
+			order, err = s.Store.GetACMEOrder(orderID)
+			if err != nil {
+				s.writeServerError(w, r, "could not get ACME order", err)
+				return
+			}
+		}
+		if order.AccountID != req.Account.ID {
+			s.writeProblem(w, r, newACMEProblem("unauthorized", http.StatusForbidden, "the certificate has not been issued to this account"))
+			return
+		}
+		info = "revoked by ACME account " + req.Account.ID
+	} else {
+		key, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+		if !ok || !key.Equal(req.Key) {
+			s.writeProblem(w, r, newACMEProblem("unauthorized", http.StatusForbidden, "the request is not signed by the certificate's key"))
+			return
+		}
+		info = "revoked with the certificate key using ACME"
+	}
+
+	if _, err := s.Store.GetRevocationBySerial(cert.SerialNumber); err == nil {
+		s.writeProblem(w, r, newACMEProblem("alreadyRevoked", http.StatusBadRequest, "the certificate has already been revoked"))
+		return
+	} else if !ent.IsNotFound(err) {
+		s.writeServerError(w, r, "could not get revocation", err)
+		return
+	}
+
+	if _, err := s.Store.RevokeACMECertificate(cert.SerialNumber, reason, info); err != nil {
+		s.writeServerError(w, r, "could not revoke certificate", err)
+		return
+	}
+	log.Printf("[INFO]: certificate with serial %s has been revoked using ACME", serial)
+
+	s.Worker.AnnounceRevocation(ACMECertificateType, "", serial, reason, info)
+
+	s.addNonce(w)
+	w.Header().Set("Link", fmt.Sprintf("<%s>;rel=\"index\"", s.link(r, "/acme/directory")))
+	w.WriteHeader(http.StatusOK)
+}
+
+// readRequest verifies the JWS, its nonce and URL, and writes the problem if the request is rejected
+func (s *ACMEServer) readRequest(w http.ResponseWriter, r *http.Request, mode acmeKeyMode) (*acmeRequest, bool) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/jose+json" {
+		s.writeProblem(w, r, newACMEProblem("malformed", http.StatusUnsupportedMediaType, "the content type must be application/jose+json"))
+		return nil, false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxACMERequestSize+1))
+	if err != nil || len(body) > maxACMERequestSize {
+		s.writeProblem(w, r, newACMEProblem("malformed", http.StatusBadRequest, "could not read the request"))
+		return nil, false
+	}
+
+	jws := acmeJWS{}
+	if err := json.Unmarshal(body, &jws); err != nil {
+		s.writeProblem(w, r, newACMEProblem("malformed", http.StatusBadRequest, "the request is not a flattened JWS"))
+		return nil, false
+	}
+
+	protected, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		s.writeProblem(w, r, newACMEProblem("malformed", http.StatusBadRequest, "the protected header is not base64url encoded"))
+		return nil, false
+	}
+
+	header := acmeJWSHeader{}
+	if err := json.Unmarshal(protected, &header); err != nil {
+		s.writeProblem(w, r, newACMEProblem("malformed", http.StatusBadRequest, "invalid protected header"))
+		return nil, false
+	}
+
+	switch header.Algorithm {
+	case "RS256", "ES256", "ES384", "ES512", "EdDSA":
+	default:
+		s.writeProblem(w, r, newACMEProblem("badSignatureAlgorithm", http.StatusBadRequest, "unsupported signature algorithm %q", header.Algorithm))
+		return nil, false
+	}
+
+	if header.URL != s.link(r, r.URL.Path) {
+		s.writeProblem(w, r, newACMEProblem("unauthorized", http.StatusUnauthorized, "the url in the protected header does not match the request"))
+		return nil, false
+	}
+
+	valid, err := s.Store.UseACMENonce(header.Nonce)
+	if err != nil {
+		s.writeServerError(w, r, "could not check ACME nonce", err)
+		return nil, false
+	}
+	if !valid {
+		s.writeProblem(w, r, newACMEProblem("badNonce", http.StatusBadRequest, "invalid or expired nonce"))
+		return nil, false
+	}
+
+	req := acmeRequest{}
+	switch {
+	case len(header.JWK) > 0 && header.KeyID == "" && mode != acmeKeyID:
+		req.Key, req.JWK, err = ParseACMEJWK(header.JWK)
+		if err != nil {
+			s.writeProblem(w, r, newACMEProblem("badPublicKey", http.StatusBadRequest, "%v", err))
+			return nil, false
+		}
+	case len(header.JWK) == 0 && header.KeyID != "" && mode != acmeJWKOnly:
+		prefix := s.link(r, "/acme/account/")
+		if !strings.HasPrefix(header.KeyID, prefix) {
+			s.writeProblem(w, r, newACMEProblem("accountDoesNotExist", http.StatusBadRequest, "unknown account %s", header.KeyID))
+			return nil, false
+		}
+
+		req.Account, err = s.Store.GetACMEAccount(strings.TrimPrefix(header.KeyID, prefix))
+		if err != nil {
+			if ent.IsNotFound(err) {
+				s.writeProblem(w, r, newACMEProblem("accountDoesNotExist", http.StatusBadRequest, "unknown account %s", header.KeyID))
+			} else {
+				s.writeServerError(w, r, "could not get ACME account", err)
+			}
+			return nil, false
+		}
+		if req.Account.Status != acmeStatusValid {
+			s.writeProblem(w, r, newACMEProblem("unauthorized", http.StatusUnauthorized, "the account has been %s", req.Account.Status))
+			return nil, false
+		}
+
+		req.Key, req.JWK, err = ParseACMEJWK(req.Account.JWK)
+		if err != nil {
+			s.writeServerError(w, r, "could not parse ACME account key", err)
+			return nil, false
+		}
+	case mode == acmeJWKOnly:
+		s.writeProblem(w, r, newACMEProblem("malformed", http.StatusBadRequest, "the request must include the account key as jwk"))
+		return nil, false
+	default:
+		s.writeProblem(w, r, newACMEProblem("malformed", http.StatusBadRequest, "the request must be signed with the account key ID as kid"))
+		return nil, false
+	}
+
+	if err := verifyACMESignature(req.Key, header.Algorithm, &jws); err != nil {
+		s.writeProblem(w, r, newACMEProblem("malformed", http.StatusBadRequest, "%v", err))
+		return nil, false
+	}
+
+	if jws.Payload != "" {
+		req.Payload, err = base64.RawURLEncoding.DecodeString(jws.Payload)
+		if err != nil {
+			s.writeProblem(w, r, newACMEProblem("malformed", http.StatusBadRequest, "the payload is not base64url encoded"))
+			return nil, false
+		}
+	}
+
+	return &req, true
+}
+
+// getOrder returns the account's order and its authorizations, with the status updated from the authorizations
+func (s *ACMEServer) getOrder(w http.ResponseWriter, r *http.Request, req *acmeRequest, id string) (*models.ACMEOrder, []*models.ACMEAuthorization, bool) {
+	order, err := s.Store.GetACMEOrder(id)
+	if err != nil {
+		if ent.IsNotFound(err) {
+			s.writeProblem(w, r, newACMEProblem("malformed", http.StatusNotFound, "order not found"))
+		} else {
+			s.writeServerError(w, r, "could not get ACME order", err)
+		}
+		return nil, nil, false
+	}
+
+	if order.AccountID != req.Account.ID {
+		s.writeProblem(w, r, newACMEProblem("unauthorized", http.StatusForbidden, "the order belongs to another account"))
+		return nil, nil, false
+	}
+
+	authorizations, err := s.Store.GetACMEOrderAuthorizations(order.ID)
+	if err != nil {
+		s.writeServerError(w, r, "could not get ACME authorizations", err)
+		return nil, nil, false
+	}
+
+	status, problem := acmeOrderStatus(order, authorizations)
+	if status != order.Status {
+		order.Status = status
+		if problem != nil {
+			order.Error = problem.JSON()
+		}
+		if err := s.Store.UpdateACMEOrder(order); err != nil {
+			s.writeServerError(w, r, "could not update ACME order", err)
+			return nil, nil, false
+		}
+	}
+
+	return order, authorizations, true
+}
+
+func (s *ACMEServer) getAuthorization(w http.ResponseWriter, r *http.Request, req *acmeRequest, id string) (*models.ACMEAuthorization, bool) {
+	authz, err := s.Store.GetACMEAuthorization(id)
+	if err != nil {
+		if ent.IsNotFound(err) {
+			s.writeProblem(w, r, newACMEProblem("malformed", http.StatusNotFound, "authorization not found"))
+		} else {
+			s.writeServerError(w, r, "could not get ACME authorization", err)
+		}
+		return nil, false
+	}
+
+	if authz.AccountID != req.Account.ID {
+		s.writeProblem(w, r, newACMEProblem("unauthorized", http.StatusForbidden, "the authorization belongs to another account"))
+		return nil, false
+	}
+
+	if authz.Status == acmeStatusPending && time.Now().After(authz.Expires) {
+		authz.Status = acmeStatusExpired
+		if err := s.Store.UpdateACMEAuthorization(authz); err != nil {
+			s.writeServerError(w, r, "could not update ACME authorization", err)
+			return nil, false
+		}
+	}
+
+	return authz, true
+}
+
+// acmeOrderStatus is pending until every authorization is valid, then the order is ready to be finalized
+func acmeOrderStatus(order *models.ACMEOrder, authorizations []*models.ACMEAuthorization) (string, *acmeProblem) {
+	if order.Status != acmeStatusPending && order.Status != acmeStatusReady {
+		return order.Status, nil
+	}
+
+	if time.Now().After(order.Expires) {
+		return acmeStatusInvalid, newACMEProblem("malformed", http.StatusForbidden, "the order has expired")
+	}
+
+	if order.Status == acmeStatusReady {
+		return order.Status, nil
+	}
+
+	for _, authz := range authorizations {
+		switch {
+		case authz.Status == acmeStatusPending && time.Now().After(authz.Expires), authz.Status == acmeStatusExpired:
+			return acmeStatusInvalid, newACMEProblem("unauthorized", http.StatusForbidden, "the authorization for %s has expired", authz.Identifier)
+		case authz.Status == acmeStatusInvalid, authz.Status == acmeStatusDeactivated:
+			return acmeStatusInvalid, newACMEProblem("unauthorized", http.StatusForbidden, "the authorization for %s is %s", authz.Identifier, authz.Status)
+		case authz.Status == acmeStatusPending:
+			return acmeStatusPending, nil
+		}
+	}
+	return acmeStatusReady, nil
+}
+
+func (s *ACMEServer) checkACMEIdentifier(identifier acmeIdentifier) *acmeProblem {
+	if identifier.Type != "dns" {
+		return newACMEProblem("unsupportedIdentifier", http.StatusBadRequest, "identifier type %s is not supported, only dns", identifier.Type)
+	}
+
+	name := strings.ToLower(identifier.Value)
+	if strings.HasPrefix(name, "*.") {
+		return newACMEProblem("rejectedIdentifier", http.StatusBadRequest, "wildcard names can't be validated with HTTP-01")
+	}
+	if !isValidDNSName(name) {
+		return newACMEProblem("rejectedIdentifier", http.StatusBadRequest, "%s is not a valid DNS name", identifier.Value)
+	}
+	if !dnsSuffixAllowed(name, s.DNSSuffixes) {
+		return newACMEProblem("rejectedIdentifier", http.StatusBadRequest, "%s does not end with a DNS suffix allowed by this server", identifier.Value)
+	}
+	return nil
+}
+
+// checkACMECSR parses the CSR and checks it asks for exactly the order's DNS names
+func checkACMECSR(encoded string, identifiers []string) (*x509.CertificateRequest, *acmeProblem) {
+	der, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, newACMEProblem("badCSR", http.StatusBadRequest, "the CSR is not base64url encoded")
+	}
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, newACMEProblem("badCSR", http.StatusBadRequest, "could not parse the CSR: %v", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, newACMEProblem("badCSR", http.StatusBadRequest, "invalid CSR signature: %v", err)
+	}
+
+	switch key := csr.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < minACMERSAKeySize {
+			return nil, newACMEProblem("badCSR", http.StatusBadRequest, "RSA keys must have at least %d bits", minACMERSAKeySize)
+		}
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+	default:
+		return nil, newACMEProblem("badCSR", http.StatusBadRequest, "unsupported public key algorithm")
+	}
+
+	if len(csr.IPAddresses) > 0 || len(csr.EmailAddresses) > 0 || len(csr.URIs) > 0 {
+		return nil, newACMEProblem("badCSR", http.StatusBadRequest, "the CSR can only request DNS names")
+	}
+
+	names := []string{}
+	for _, name := range csr.DNSNames {
+		name = strings.ToLower(name)
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	if cn := strings.ToLower(csr.Subject.CommonName); cn != "" && !slices.Contains(names, cn) {
+		names = append(names, cn)
+	}
+	slices.Sort(names)
+
+	if !slices.Equal(names, identifiers) {
+		return nil, newACMEProblem("badCSR", http.StatusBadRequest, "the CSR must request exactly the DNS names of the order: %s", strings.Join(identifiers, ", "))
+	}
+	return csr, nil
+}
+
+func validateACMEContacts(contacts []string) *acmeProblem {
+	for _, contact := range contacts {
+		address, found := strings.CutPrefix(contact, "mailto:")
+		if !found {
+			return newACMEProblem("unsupportedContact", http.StatusBadRequest, "only mailto contacts are supported")
+		}
+		if strings.ContainsAny(address, ",?") || !strings.Contains(address, "@") {
+			return newACMEProblem("invalidContact", http.StatusBadRequest, "invalid contact %s", contact)
+		}
+	}
+	return nil
+}
+
+func isValidDNSName(name string) bool {
+	if name == "" || len(name) > 253 || net.ParseIP(name) != nil {
+		return false
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s *ACMEServer) accountObject(r *http.Request, account *models.ACMEAccount) acmeAccountObject {
+	return acmeAccountObject{
+		Status:  account.Status,
+		Contact: account.Contact,
+		Orders:  s.link(r, "/acme/account/"+account.ID+"/orders"),
+	}
+}
+
+func (s *ACMEServer) orderObject(r *http.Request, order *models.ACMEOrder, authorizations []*models.ACMEAuthorization) acmeOrderObject {
+	object := acmeOrderObject{
+		Status:         order.Status,
+		Expires:        acmeTime(order.Expires),
+		Identifiers:    []acmeIdentifier{},
+		NotBefore:      acmeTime(order.NotBefore),
+		NotAfter:       acmeTime(order.NotAfter),
+		Authorizations: []string{},
+		Finalize:       s.link(r, "/acme/order/"+order.ID+"/finalize"),
+	}
+
+	for _, name := range order.Identifiers {
+		object.Identifiers = append(object.Identifiers, acmeIdentifier{Type: "dns", Value: name})
+	}
+	for _, authz := range authorizations {
+		object.Authorizations = append(object.Authorizations, s.link(r, "/acme/authz/"+authz.ID))
+	}
+	if order.Status == acmeStatusValid {
+		object.Certificate = s.link(r, "/acme/cert/"+order.ID)
+	}
+	if order.Error != "" {
+		object.Error = json.RawMessage(order.Error)
+	}
+	return object
+}
+
+func (s *ACMEServer) authorizationObject(r *http.Request, authz *models.ACMEAuthorization) acmeAuthorizationObject {
+	return acmeAuthorizationObject{
+		Identifier: acmeIdentifier{Type: "dns", Value: authz.Identifier},
+		Status:     authz.Status,
+		Expires:    acmeTime(authz.Expires),
+		Challenges: []acmeChallengeObject{s.challengeObject(r, authz)},
+	}
+}
+
+func (s *ACMEServer) challengeObject(r *http.Request, authz *models.ACMEAuthorization) acmeChallengeObject {
+	object := acmeChallengeObject{
+		Type:      "http-01",
+		URL:       s.link(r, "/acme/chall/"+authz.ID),
+		Token:     authz.Token,
+		Status:    authz.ChallengeStatus,
+		Validated: acmeTime(authz.Validated),
+	}
+	if authz.Error != "" {
+		object.Error = json.RawMessage(authz.Error)
+	}
+	return object
+}
+
+// link returns the absolute URL of a path, it's also what the JWS url header must match
+func (s *ACMEServer) link(r *http.Request, path string) string {
+	if s.URL != "" {
+		return s.URL + path
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + path
+}
+
+// addNonce sets a fresh nonce in the Replay-Nonce header, every POST response needs one
+func (s *ACMEServer) addNonce(w http.ResponseWriter) {
+	nonce := randomACMEString(16)
+	if err := s.Store.AddACMENonce(nonce, time.Now().Add(acmeNonceLifetime)); err != nil {
+		log.Printf("[ERROR]: could not save ACME nonce, reason: %v", err)
+		return
+	}
+	w.Header().Set("Replay-Nonce", nonce)
+}
+
+func (s *ACMEServer) writeJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	if r.Method == http.MethodPost {
+		s.addNonce(w)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Link", fmt.Sprintf("<%s>;rel=\"index\"", s.link(r, "/acme/directory")))
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[ERROR]: could not write ACME response, reason: %v", err)
+	}
+}
+
+func (s *ACMEServer) writeProblem(w http.ResponseWriter, r *http.Request, problem *acmeProblem) {
+	s.addNonce(w)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Add("Link", fmt.Sprintf("<%s>;rel=\"index\"", s.link(r, "/acme/directory")))
+	w.WriteHeader(problem.Status)
+
+	if _, err := io.WriteString(w, problem.JSON()); err != nil {
+		log.Printf("[ERROR]: could not write ACME problem, reason: %v", err)
+	}
+}
+
+func (s *ACMEServer) writeServerError(w http.ResponseWriter, r *http.Request, message string, err error) {
+	log.Printf("[ERROR]: %s, reason: %v", message, err)
+	s.writeProblem(w, r, newACMEProblem("serverInternal", http.StatusInternalServerError, "%s", message))
+}
+
+func newACMEProblem(errorType string, status int, format string, args ...any) *acmeProblem {
+	return &acmeProblem{
+		Type:   "urn:ietf:params:acme:error:" + errorType,
+		Detail: fmt.Sprintf(format, args...),
+		Status: status,
+	}
+}
+
+func (p *acmeProblem) JSON() string {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
+
+func acmeTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func randomACMEString(size int) string {
+	b := make([]byte, size)
+	// crypto/rand.Read never fails since Go 1.24
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
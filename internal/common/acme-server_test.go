@@ -0,0 +1,573 @@
+package common
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/scncore/ent"
+	"github.com/scncore/scnorion-worker/internal/models"
+	"golang.org/x/crypto/acme"
+)
+
+// TestACMEServerIssuesAndRevokes runs an ACME client against the server, the HTTP-01
+// challenge is answered by a responder listening on localhost
+func TestACMEServerIssuesAndRevokes(t *testing.T) {
+	w := newTestWorker(t)
+	w.ACMEDNSSuffixes = []string{"localhost"}
+	store := newMemoryACMEStore()
+
+	responses := sync.Map{}
+	responder := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		response, ok := responses.Load(r.URL.Path)
+		if !ok {
+			http.NotFound(rw, r)
+			return
+		}
+		_, _ = rw.Write([]byte(response.(string)))
+	}))
+	defer responder.Close()
+
+	s := NewACMEServer(w, store)
+	s.HTTP01Port = testPort(t, responder.URL)
+	server := httptest.NewServer(s.Handler())
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &acme.Client{Key: key, DirectoryURL: server.URL + "/acme/directory"}
+
+	account, err := client.Register(ctx, &acme.Account{}, acme.AcceptTOS)
+	if err != nil {
+		t.Fatalf("could not register the account: %v", err)
+	}
+
+	if _, err := client.AuthorizeOrder(ctx, acme.DomainIDs("www.example.com")); err == nil {
+		t.Error("an order for a name without an allowed suffix has been accepted")
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs("localhost"))
+	if err != nil {
+		t.Fatalf("could not create the order: %v", err)
+	}
+
+	for _, authzURL := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, authzURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var challenge *acme.Challenge
+		for _, c := range authz.Challenges {
+			if c.Type == "http-01" {
+				challenge = c
+			}
+		}
+		if challenge == nil {
+			t.Fatal("the authorization has no HTTP-01 challenge")
+		}
+
+		response, err := client.HTTP01ChallengeResponse(challenge.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		responses.Store(client.HTTP01ChallengePath(challenge.Token), response)
+
+		if _, err := client.Accept(ctx, challenge); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+			t.Fatalf("the authorization has not been validated: %v", err)
+		}
+	}
+
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		t.Fatalf("the order is not ready: %v", err)
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "localhost"},
+		DNSNames: []string{"localhost"},
+	}, certKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		t.Fatalf("could not finalize the order: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.CheckSignatureFrom(w.CACert); err != nil {
+		t.Errorf("the certificate has not been signed by the CA: %v", err)
+	}
+	if !slices.Equal(cert.DNSNames, []string{"localhost"}) {
+		t.Errorf("got DNS names %v, want localhost", cert.DNSNames)
+	}
+	if !certKey.PublicKey.Equal(cert.PublicKey) {
+		t.Error("the certificate is not for the CSR's key")
+	}
+	if cert.NotAfter.After(time.Now().Add(s.Validity)) {
+		t.Errorf("the certificate is valid until %s, longer than allowed", cert.NotAfter)
+	}
+
+	saved, err := store.GetACMECertificate(cert.SerialNumber)
+	if err != nil {
+		t.Fatalf("the certificate has not been saved: %v", err)
+	}
+	if saved.AccountID != testAccountID(account.URI) {
+		t.Errorf("the certificate has been saved for account %s, want %s", saved.AccountID, testAccountID(account.URI))
+	}
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &acme.Client{Key: otherKey, DirectoryURL: client.DirectoryURL}
+	if _, err := other.Register(ctx, &acme.Account{}, acme.AcceptTOS); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.RevokeCert(ctx, nil, chain[0], acme.CRLReasonKeyCompromise); err == nil {
+		t.Error("another account has revoked the certificate")
+	}
+
+	if err := client.RevokeCert(ctx, nil, chain[0], acme.CRLReasonKeyCompromise); err != nil {
+		t.Fatalf("could not revoke the certificate: %v", err)
+	}
+	if _, err := store.GetRevocationBySerial(cert.SerialNumber); err != nil {
+		t.Errorf("the certificate has not been revoked: %v", err)
+	}
+}
+
+func TestACMEIdentifierRequiresSuffix(t *testing.T) {
+	s := &ACMEServer{}
+	if problem := s.checkACMEIdentifier(acmeIdentifier{Type: "dns", Value: "www.example.com"}); problem == nil {
+		t.Error("a name has been accepted without DNS suffixes")
+	}
+
+	s.DNSSuffixes = []string{"example.internal"}
+	if problem := s.checkACMEIdentifier(acmeIdentifier{Type: "dns", Value: "www.example.internal"}); problem != nil {
+		t.Errorf("a name with an allowed suffix has been rejected: %s", problem.Detail)
+	}
+	if problem := s.checkACMEIdentifier(acmeIdentifier{Type: "dns", Value: "www.example.com"}); problem == nil {
+		t.Error("a name without an allowed suffix has been accepted")
+	}
+}
+
+func TestStartACMEServerRequiresSuffixes(t *testing.T) {
+	w := newTestWorker(t)
+	w.ACMEAddress = "127.0.0.1:0"
+
+	if err := w.StartACMEServer(); err != nil {
+		t.Fatal(err)
+	}
+	if w.ACMEServer != nil || w.ACMEJob != nil {
+		t.Error("the ACME server has been started without DNS suffixes")
+	}
+}
+
+// TestStartACMEServerAgain checks the server can be started again when the address was in use
+func TestStartACMEServerAgain(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := newTestWorker(t)
+	w.ACMEAddress = listener.Addr().String()
+
+	if err := w.startACMEServer(); err == nil {
+		t.Fatal("the ACME server has been started on an address in use")
+	}
+	if w.ACMEServer != nil {
+		t.Fatal("the ACME server is set although it could not listen")
+	}
+
+	listener.Close()
+	if err := w.startACMEServer(); err != nil {
+		t.Fatalf("the ACME server has not been started again: %v", err)
+	}
+	defer w.StopACMEServer()
+
+	resp, err := http.Get("http://" + w.ACMEAddress + "/acme/directory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got HTTP status %d from the directory", resp.StatusCode)
+	}
+}
+
+func TestFetchKeyAuthorizationRedirects(t *testing.T) {
+	var responder *httptest.Server
+	responder = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		port := strconv.Itoa(testPort(t, responder.URL))
+		switch r.URL.Path {
+		case "/same-host":
+			http.Redirect(rw, r, "http://localhost:"+port+"/token", http.StatusFound)
+		case "/other-host":
+			http.Redirect(rw, r, "http://127.0.0.1:"+port+"/token", http.StatusFound)
+		case "/token":
+			_, _ = rw.Write([]byte("token.thumbprint"))
+		}
+	}))
+	defer responder.Close()
+
+	s := NewACMEServer(newTestWorker(t), newMemoryACMEStore())
+	base := "http://localhost:" + strconv.Itoa(testPort(t, responder.URL))
+
+	if problem := s.fetchKeyAuthorization(base+"/same-host", "localhost", "token.thumbprint"); problem != nil {
+		t.Errorf("a redirect to the same host has been rejected: %s", problem.Detail)
+	}
+	if problem := s.fetchKeyAuthorization(base+"/other-host", "localhost", "token.thumbprint"); problem == nil {
+		t.Error("a redirect to another host has been followed")
+	}
+	if problem := s.fetchKeyAuthorization(base+"/token", "localhost", "another.thumbprint"); problem == nil {
+		t.Error("a wrong key authorization has been accepted")
+	}
+}
+
+func TestACMECertificateValidity(t *testing.T) {
+	s := &ACMEServer{Validity: 90 * 24 * time.Hour}
+	now := time.Now()
+
+	tests := []struct {
+		name          string
+		order         models.ACMEOrder
+		wantNotBefore time.Time
+		wantNotAfter  time.Time
+		wantErr       bool
+	}{
+		{
+			name:          "no validity requested",
+			wantNotBefore: now.Add(-acmeBackdate),
+			wantNotAfter:  now.Add(s.Validity),
+		},
+		{
+			name:          "shorter validity",
+			order:         models.ACMEOrder{NotBefore: now.Add(time.Hour), NotAfter: now.Add(24 * time.Hour)},
+			wantNotBefore: now.Add(time.Hour),
+			wantNotAfter:  now.Add(24 * time.Hour),
+		},
+		{
+			name:          "order finalized long after it was created",
+			order:         models.ACMEOrder{NotBefore: now.Add(-30 * 24 * time.Hour), NotAfter: now.Add(365 * 24 * time.Hour)},
+			wantNotBefore: now.Add(-acmeBackdate),
+			wantNotAfter:  now.Add(s.Validity),
+		},
+		{
+			name:    "validity already ended",
+			order:   models.ACMEOrder{NotAfter: now.Add(-time.Hour)},
+			wantErr: true,
+		},
+		{
+			name:    "validity starting after the limit",
+			order:   models.ACMEOrder{NotBefore: now.Add(s.Validity + time.Hour)},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		notBefore, notAfter, err := s.certificateValidity(&tt.order, now)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: got validity from %s to %s, want an error", tt.name, notBefore, notAfter)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !notBefore.Equal(tt.wantNotBefore) || !notAfter.Equal(tt.wantNotAfter) {
+			t.Errorf("%s: got validity from %s to %s, want from %s to %s", tt.name, notBefore, notAfter, tt.wantNotBefore, tt.wantNotAfter)
+		}
+	}
+}
+
+func testPort(t *testing.T, rawURL string) int {
+	t.Helper()
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
+
+func testAccountID(accountURL string) string {
+	u, err := url.Parse(accountURL)
+	if err != nil {
+		return ""
+	}
+	return u.Path[len("/acme/account/"):]
+}
+
+// memoryACMEStore keeps the ACME state in memory, it returns copies as the database does
+type memoryACMEStore struct {
+	mu             sync.Mutex
+	nonces         map[string]time.Time
+	accounts       map[string]models.ACMEAccount
+	orders         map[string]models.ACMEOrder
+	authorizations map[string]models.ACMEAuthorization
+	certificates   map[string]models.ACMECertificate
+	revocations    map[string]ent.Revocation
+}
+
+func newMemoryACMEStore() *memoryACMEStore {
+	return &memoryACMEStore{
+		nonces:         map[string]time.Time{},
+		accounts:       map[string]models.ACMEAccount{},
+		orders:         map[string]models.ACMEOrder{},
+		authorizations: map[string]models.ACMEAuthorization{},
+		certificates:   map[string]models.ACMECertificate{},
+		revocations:    map[string]ent.Revocation{},
+	}
+}
+
+func (m *memoryACMEStore) AddACMENonce(nonce string, expires time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nonces[nonce] = expires
+	return nil
+}
+
+func (m *memoryACMEStore) UseACMENonce(nonce string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	expires, ok := m.nonces[nonce]
+	delete(m.nonces, nonce)
+	return ok && expires.After(time.Now()), nil
+}
+
+func (m *memoryACMEStore) DeleteExpiredACMENonces() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for nonce, expires := range m.nonces {
+		if !expires.After(time.Now()) {
+			delete(m.nonces, nonce)
+		}
+	}
+	return nil
+}
+
+func (m *memoryACMEStore) AddACMEAccount(account *models.ACMEAccount) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.accounts[account.ID] = *account
+	return nil
+}
+
+func (m *memoryACMEStore) GetACMEAccount(id string) (*models.ACMEAccount, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	account, ok := m.accounts[id]
+	if !ok {
+		return nil, &ent.NotFoundError{}
+	}
+	return &account, nil
+}
+
+func (m *memoryACMEStore) GetACMEAccountByThumbprint(thumbprint string) (*models.ACMEAccount, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, account := range m.accounts {
+		if account.Thumbprint == thumbprint {
+			return &account, nil
+		}
+	}
+	return nil, &ent.NotFoundError{}
+}
+
+func (m *memoryACMEStore) UpdateACMEAccount(account *models.ACMEAccount) error {
+	return m.AddACMEAccount(account)
+}
+
+func (m *memoryACMEStore) AddACMEOrder(order *models.ACMEOrder, authorizations []*models.ACMEAuthorization) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.orders[order.ID] = *order
+	for _, authz := range authorizations {
+		m.authorizations[authz.ID] = *authz
+	}
+	return nil
+}
+
+func (m *memoryACMEStore) GetACMEOrder(id string) (*models.ACMEOrder, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	order, ok := m.orders[id]
+	if !ok {
+		return nil, &ent.NotFoundError{}
+	}
+	return &order, nil
+}
+
+func (m *memoryACMEStore) GetACMEOrderIDBySerial(serial string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, order := range m.orders {
+		if order.Serial != "" && order.Serial == serial {
+			return order.ID, nil
+		}
+	}
+	return "", &ent.NotFoundError{}
+}
+
+func (m *memoryACMEStore) GetACMEAccountOrderIDs(accountID string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ids := []string{}
+	for _, order := range m.orders {
+		if order.AccountID == accountID {
+			ids = append(ids, order.ID)
+		}
+	}
+	return ids, nil
+}
+
+func (m *memoryACMEStore) UpdateACMEOrder(order *models.ACMEOrder) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := m.orders[order.ID]
+	stored.Status, stored.Error, stored.Serial, stored.Certificate = order.Status, order.Error, order.Serial, order.Certificate
+	m.orders[order.ID] = stored
+	return nil
+}
+
+func (m *memoryACMEStore) SetACMEOrderStatus(id, from, to string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	order, ok := m.orders[id]
+	if !ok || order.Status != from {
+		return false, nil
+	}
+	order.Status = to
+	m.orders[id] = order
+	return true, nil
+}
+
+func (m *memoryACMEStore) GetACMEAuthorization(id string) (*models.ACMEAuthorization, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	authz, ok := m.authorizations[id]
+	if !ok {
+		return nil, &ent.NotFoundError{}
+	}
+	return &authz, nil
+}
+
+func (m *memoryACMEStore) GetACMEOrderAuthorizations(orderID string) ([]*models.ACMEAuthorization, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	authorizations := []*models.ACMEAuthorization{}
+	for _, authz := range m.authorizations {
+		if authz.OrderID == orderID {
+			authorizations = append(authorizations, &authz)
+		}
+	}
+	return authorizations, nil
+}
+
+func (m *memoryACMEStore) UpdateACMEAuthorization(authz *models.ACMEAuthorization) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := m.authorizations[authz.ID]
+	stored.Status, stored.ChallengeStatus, stored.Validated, stored.Error = authz.Status, authz.ChallengeStatus, authz.Validated, authz.Error
+	m.authorizations[authz.ID] = stored
+	return nil
+}
+
+func (m *memoryACMEStore) SetACMEChallengeStatus(id, from, to string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	authz, ok := m.authorizations[id]
+	if !ok || authz.ChallengeStatus != from {
+		return false, nil
+	}
+	authz.ChallengeStatus = to
+	m.authorizations[id] = authz
+	return true, nil
+}
+
+func (m *memoryACMEStore) SaveACMECertificate(serial *big.Int, order *models.ACMEOrder, expiry time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.certificates[serial.String()] = models.ACMECertificate{
+		Serial:      models.ShortSerial(serial),
+		OrderID:     order.ID,
+		AccountID:   order.AccountID,
+		Identifiers: order.Identifiers,
+		Expiry:      expiry,
+		Created:     time.Now(),
+	}
+	return nil
+}
+
+func (m *memoryACMEStore) GetACMECertificate(serial *big.Int) (*models.ACMECertificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cert, ok := m.certificates[serial.String()]
+	if !ok {
+		return nil, &ent.NotFoundError{}
+	}
+	return &cert, nil
+}
+
+func (m *memoryACMEStore) RevokeACMECertificate(serial *big.Int, reason int, info string) (*models.ACMECertificate, error) {
+	cert, err := m.GetACMECertificate(serial)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.revocations[serial.String()]; ok {
+		return nil, errors.New("the certificate has already been revoked")
+	}
+	m.revocations[serial.String()] = ent.Revocation{ID: cert.Serial, Reason: reason, Info: info, Expiry: cert.Expiry, Revoked: time.Now()}
+	return cert, nil
+}
+
+func (m *memoryACMEStore) GetRevocationBySerial(serial *big.Int) (*ent.Revocation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	revocation, ok := m.revocations[serial.String()]
+	if !ok {
+		return nil, &ent.NotFoundError{}
+	}
+	return &revocation, nil
+}
@@ -0,0 +1,116 @@
+package common
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// LoadCAChain reads a PEM bundle whose first certificate is the issuing CA,
+// followed by its intermediates. The issuing CA signs the certificates with
+// the CA key while the root loaded from CACertPath can stay offline
+func (w *Worker) LoadCAChain(path string) error {
+	if w.CACert == nil || w.CAPrivateKey == nil {
+		return errors.New("the CA certificate and private key must be loaded before the chain")
+	}
+
+	// CACert has just been read from CACertPath so it's the root
+	w.RootCACert = w.CACert
+	w.CAChain = nil
+
+	if path == "" {
+		return nil
+	}
+
+	bundle, err := ReadPEMCertificates(path)
+	if err != nil {
+		return err
+	}
+
+	issuing := bundle[0]
+	if !issuing.IsCA {
+		return errors.New("the first certificate of the chain bundle is not a CA certificate")
+	}
+
+	if publicKey, ok := w.CAPrivateKey.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !publicKey.Equal(issuing.PublicKey) {
+		return errors.New("the CA private key does not match the issuing CA certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	chain := []*x509.Certificate{}
+	for _, cert := range bundle[1:] {
+		// The root may be part of the bundle, it's added at the end of the chain anyway
+		if cert.Equal(w.RootCACert) {
+			continue
+		}
+		intermediates.AddCert(cert)
+		chain = append(chain, cert)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(w.RootCACert)
+	if _, err := issuing.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return fmt.Errorf("the issuing CA does not chain to the root CA: %v", err)
+	}
+
+	if !issuing.Equal(w.RootCACert) {
+		chain = append(chain, w.RootCACert)
+	}
+
+	w.CAChainPath = path
+	w.CACert = issuing
+	w.CAChain = chain
+	return nil
+}
+
+// CertificateChain returns the issuing CA followed by its intermediates and the root
+func (w *Worker) CertificateChain() []*x509.Certificate {
+	return append([]*x509.Certificate{w.CACert}, w.CAChain...)
+}
+
+// Intermediates returns the CA certificates between the root and the issued certificates
+func (w *Worker) Intermediates() []*x509.Certificate {
+	intermediates := []*x509.Certificate{}
+	for _, cert := range w.CertificateChain() {
+		if !cert.Equal(w.RootCACert) {
+			intermediates = append(intermediates, cert)
+		}
+	}
+	return intermediates
+}
+
+func ReadPEMCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	certs := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s does not contain any certificate", path)
+	}
+	return certs, nil
+}
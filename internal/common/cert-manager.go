@@ -3,48 +3,64 @@ package common
 import (
 	"archive/zip"
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
-	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"log"
+	"math/big"
+	"net"
 	"os"
+	"runtime"
 	"strings"
 	"time"
 
+	"github.com/go-co-op/gocron/v2"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/scncore/ent"
+	"github.com/scncore/ent/agent"
 	"github.com/scncore/ent/certificate"
 
 	scnorion_nats "github.com/scncore/nats"
-	"github.com/scncore/utils"
+	"github.com/scncore/scnorion-worker/internal/common/notifications"
+	"github.com/scncore/scnorion-worker/internal/models"
+	"golang.org/x/crypto/ocsp"
 	"software.sslmate.com/src/go-pkcs12"
 )
 
 func (w *Worker) SubscribeToCertManagerWorkerQueues() error {
+	if w.issuanceSlots == nil {
+		if w.MaxConcurrentIssuance <= 0 {
+			w.MaxConcurrentIssuance = runtime.NumCPU()
+		}
+		w.issuanceSlots = make(chan struct{}, w.MaxConcurrentIssuance)
+	}
 
-	_, err := w.NATSConnection.QueueSubscribe("certificates.user", "scnorion-cert-manager", w.NewUserCertificateHandler)
-	if err != nil {
-		log.Printf("[ERROR]: could not subscribe to certificates.user, reason: %v", err)
+	if err := w.StartJetStream(CertificatesStream, []string{"certificates.user", "certificates.agent.*"}); err != nil {
 		return err
 	}
-	log.Printf("[INFO]: subscribed to queue certificates.user")
 
-	_, err = w.NATSConnection.QueueSubscribe("certificates.revoke", "scnorion-cert-manager", w.RevokeCertificateHandler)
-	if err != nil {
-		log.Printf("[ERROR]: could not subscribe to certificates.revoke, reason: %v", err)
+	if err := w.ConsumeJetStream(CertificatesStream, []JetStreamConsumer{
+		{Durable: "scnorion-cert-manager-user", Subject: "certificates.user", Handler: w.LimitIssuance(w.NewUserCertificateHandler), MaxMessages: w.MaxConcurrentIssuance},
+		{Durable: "scnorion-cert-manager-agent", Subject: "certificates.agent.*", Handler: w.LimitIssuance(w.NewAgentCertificateHandler), MaxMessages: w.MaxConcurrentIssuance},
+	}); err != nil {
 		return err
 	}
-	log.Printf("[INFO]: subscribed to queue certificates.revoke")
 
-	_, err = w.NATSConnection.QueueSubscribe("certificates.agent.*", "scnorion-cert-manager", w.NewAgentCertificateHandler)
+	_, err := w.NATSConnection.QueueSubscribe("certificates.revoke", "scnorion-cert-manager", w.RevokeCertificateHandler)
 	if err != nil {
-		log.Printf("[ERROR]: could not subscribe to certificates.agent.*, reason: %v", err)
+		log.Printf("[ERROR]: could not subscribe to certificates.revoke, reason: %v", err)
 		return err
 	}
-	log.Printf("[INFO]: subscribed to queue certificates.agent")
+	log.Printf("[INFO]: subscribed to queue certificates.revoke")
 
 	_, err = w.NATSConnection.QueueSubscribe("ping.certmanagerworker", "scnorion-cert-manager", w.PingHandler)
 	if err != nil {
@@ -52,72 +68,216 @@ func (w *Worker) SubscribeToCertManagerWorkerQueues() error {
 		return err
 	}
 	log.Printf("[INFO]: subscribed to queue ping.certmanagerworker")
+
+	if err := w.StartCRLJob(); err != nil {
+		return err
+	}
+
+	if err := w.StartCertificateIssuancesJob(); err != nil {
+		return err
+	}
+
+	if err := w.StartAgentRenewalJob(); err != nil {
+		return err
+	}
+
+	if err := w.StartUserExpiryJob(); err != nil {
+		return err
+	}
+
+	if w.UserCertificateDelivery == UserCertificateDeliveryDownload {
+		_, err = w.NATSConnection.QueueSubscribe("certificates.download", "scnorion-cert-manager", w.CertificateDownloadHandler)
+		if err != nil {
+			log.Printf("[ERROR]: could not subscribe to certificates.download, reason: %v", err)
+			return err
+		}
+		log.Printf("[INFO]: subscribed to queue certificates.download")
+
+		if err := w.StartCertificateDownloadJob(); err != nil {
+			return err
+		}
+	}
+
+	if err := w.StartACMEServer(); err != nil {
+		return err
+	}
 	return nil
 }
 
-func (w *Worker) GenerateUserCertificate() error {
+// certificateIssuancePurgeFrequency is how often the issuances the stream no longer keeps are deleted
+const certificateIssuancePurgeFrequency = time.Hour
+
+// issuanceProgressInterval is how often the server is told that a message waiting
+// for an issuance slot is still ours, well below the ack wait of the consumers
+var issuanceProgressInterval = 20 * time.Second
+
+// LimitIssuance runs the handler in its own goroutine, blocking the subscription
+// while MaxConcurrentIssuance certificates are already being issued
+func (w *Worker) LimitIssuance(handler jetstream.MessageHandler) jetstream.MessageHandler {
+	return func(msg jetstream.Msg) {
+		w.acquireIssuanceSlot(msg)
+		w.issuances.Add(1)
+		go func() {
+			defer w.issuances.Done()
+			defer func() { <-w.issuanceSlots }()
+			handler(msg)
+		}()
+	}
+}
+
+// acquireIssuanceSlot waits for a free slot. Meanwhile the message is marked as in
+// progress, otherwise its ack wait would expire and it'd be redelivered to another worker
+func (w *Worker) acquireIssuanceSlot(msg jetstream.Msg) {
+	select {
+	case w.issuanceSlots <- struct{}{}:
+		return
+	default:
+	}
+
+	ticker := time.NewTicker(issuanceProgressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case w.issuanceSlots <- struct{}{}:
+			return
+		case <-ticker.C:
+			if err := msg.InProgress(); err != nil {
+				log.Printf("[ERROR]: could not extend the ack wait of a message from %s, reason: %v", msg.Subject(), err)
+			}
+		}
+	}
+}
+
+// IssuedCertificate holds the state of a single issuance so concurrent requests never share keys or certificates
+type IssuedCertificate struct {
+	Request    *scnorion_nats.CertificateRequest
+	Cert       *x509.Certificate
+	CertBytes  []byte
+	PrivateKey crypto.Signer
+	PKCS12     []byte
+	// Password is the random password of the PKCS#12 for one-time downloads
+	Password string
+}
+
+// CertificateStore keeps the certificates issued for the requests and whether they have been delivered
+type CertificateStore interface {
+	GetCertificateIssuance(requestID string) (*models.CertificateIssuance, error)
+	SaveCertificateIssuance(requestID string, serial *big.Int, owner string) error
+	SetCertificateIssuanceSent(requestID string) error
+	SaveCertificate(serial *big.Int, certType certificate.Type, uid, description string, expiry time.Time) error
+	GetCertificateBySerial(serial *big.Int) (*ent.Certificate, error)
+	GetRevocationBySerial(serial *big.Int) (*ent.Revocation, error)
+	RevokeCertificate(serial *big.Int, reason int, info string) (*ent.Certificate, error)
+	SetCertificateSent(uid string) error
+	SetEmailVerified(uid string) error
+}
+
+// certificates returns the database unless another store has been set
+func (w *Worker) certificates() CertificateStore {
+	if w.certificateStore != nil {
+		return w.certificateStore
+	}
+	return w.Model
+}
+
+func (w *Worker) GenerateUserCertificate(cr *scnorion_nats.CertificateRequest) (*IssuedCertificate, error) {
 	var err error
-	template, err := w.NewX509UserCertificateTemplate()
+	template, err := w.NewX509UserCertificateTemplate(cr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	certPrivKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	policy, err := w.UserCertificatePolicy()
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("could not get the certificate policy: %v", err)
 	}
 
-	certBytes, err := x509.CreateCertificate(rand.Reader, template, w.CACert, &certPrivKey.PublicKey, w.CAPrivateKey)
+	if err := ApplyUserPolicy(template, cr, policy); err != nil {
+		return nil, err
+	}
+
+	issued := IssuedCertificate{Request: cr}
+
+	issued.PrivateKey, err = GenerateKey(w.UserKeySpec.OrDefault())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	w.Cert, err = x509.ParseCertificate(certBytes)
+	issued.CertBytes, err = x509.CreateCertificate(rand.Reader, template, w.CACert, issued.PrivateKey.Public(), w.CAPrivateKey)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	issued.Cert, err = x509.ParseCertificate(issued.CertBytes)
+	if err != nil {
+		return nil, err
 	}
 
-	password := w.CertRequest.Password
-	if password == "" {
+	password := cr.Password
+	if w.UserCertificateDelivery == UserCertificateDeliveryDownload {
+		issued.Password = NewDownloadPassword()
+		password = issued.Password
+	} else if password == "" {
 		password = pkcs12.DefaultPassword
 	}
 
-	w.PKCS12, err = pkcs12.Modern.Encode(certPrivKey, w.Cert, []*x509.Certificate{w.CACert}, password)
+	issued.PKCS12, err = pkcs12.Modern.Encode(issued.PrivateKey, issued.Cert, w.CertificateChain(), password)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return &issued, nil
 }
 
-func (w *Worker) GenerateAgentCertificate() error {
+func (w *Worker) GenerateAgentCertificate(cr *scnorion_nats.CertificateRequest) (*IssuedCertificate, error) {
+	privateKey, err := GenerateKey(w.AgentKeySpec.OrDefault())
+	if err != nil {
+		return nil, err
+	}
+
+	issued, err := w.signAgentCertificate(cr, privateKey.Public(), nil)
+	if err != nil {
+		return nil, err
+	}
+	issued.PrivateKey = privateKey
+
+	return issued, nil
+}
+
+func (w *Worker) signAgentCertificate(cr *scnorion_nats.CertificateRequest, publicKey crypto.PublicKey, ipAddresses []net.IP) (*IssuedCertificate, error) {
 	var err error
-	template, err := w.NewX509AgentCertificateTemplate()
+	template, err := w.NewX509AgentCertificateTemplate(cr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	w.PrivateKey, err = rsa.GenerateKey(rand.Reader, 4096)
+	policy, err := w.AgentCertificatePolicy(cr.AgentId)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("could not get the certificate policy: %v", err)
 	}
 
-	certBytes, err := x509.CreateCertificate(rand.Reader, template, w.CACert, &w.PrivateKey.PublicKey, w.CAPrivateKey)
+	if err := ApplyAgentPolicy(template, ipAddresses, policy); err != nil {
+		return nil, err
+	}
+
+	issued := IssuedCertificate{Request: cr}
+
+	issued.CertBytes, err = x509.CreateCertificate(rand.Reader, template, w.CACert, publicKey, w.CAPrivateKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	w.CertBytes = certBytes
 
-	w.Cert, err = x509.ParseCertificate(certBytes)
+	issued.Cert, err = x509.ParseCertificate(issued.CertBytes)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return &issued, nil
 }
 
-func (w *Worker) NewX509UserCertificateTemplate() (*x509.Certificate, error) {
-	serialNumber, err := utils.GenerateSerialNumber()
+func (w *Worker) NewX509UserCertificateTemplate(cr *scnorion_nats.CertificateRequest) (*x509.Certificate, error) {
+	serialNumber, err := w.NewSerialNumber()
 	if err != nil {
 		return nil, err
 	}
@@ -125,25 +285,26 @@ func (w *Worker) NewX509UserCertificateTemplate() (*x509.Certificate, error) {
 	return &x509.Certificate{
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
-			CommonName:    w.CertRequest.Username,
-			Organization:  []string{w.CertRequest.Organization},
-			Country:       []string{w.CertRequest.Country},
-			Province:      []string{w.CertRequest.Province},
-			Locality:      []string{w.CertRequest.Locality},
-			StreetAddress: []string{w.CertRequest.Address},
-			PostalCode:    []string{w.CertRequest.PostalCode},
+			CommonName:    cr.Username,
+			Organization:  []string{cr.Organization},
+			Country:       []string{cr.Country},
+			Province:      []string{cr.Province},
+			Locality:      []string{cr.Locality},
+			StreetAddress: []string{cr.Address},
+			PostalCode:    []string{cr.PostalCode},
 		},
-		Issuer:      w.CACert.Subject,
-		NotBefore:   time.Now().Add(-5 * time.Minute).UTC(),
-		NotAfter:    time.Now().AddDate(w.CertRequest.YearsValid, w.CertRequest.MonthsValid, w.CertRequest.DaysValid),
-		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
-		KeyUsage:    x509.KeyUsageDigitalSignature,
-		OCSPServer:  w.OCSPResponders,
+		Issuer:                w.CACert.Subject,
+		NotBefore:             time.Now().Add(-5 * time.Minute).UTC(),
+		NotAfter:              time.Now().AddDate(cr.YearsValid, cr.MonthsValid, cr.DaysValid),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		OCSPServer:            w.OCSPResponders,
+		CRLDistributionPoints: w.CRLDistributionPoints,
 	}, nil
 }
 
-func (w *Worker) NewX509AgentCertificateTemplate() (*x509.Certificate, error) {
-	serialNumber, err := utils.GenerateSerialNumber()
+func (w *Worker) NewX509AgentCertificateTemplate(cr *scnorion_nats.CertificateRequest) (*x509.Certificate, error) {
+	serialNumber, err := w.NewSerialNumber()
 	if err != nil {
 		return nil, err
 	}
@@ -152,64 +313,97 @@ func (w *Worker) NewX509AgentCertificateTemplate() (*x509.Certificate, error) {
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
 			CommonName:    "scnorion Agent Services",
-			Organization:  []string{w.CertRequest.Organization},
-			Country:       []string{w.CertRequest.Country},
-			Province:      []string{w.CertRequest.Province},
-			Locality:      []string{w.CertRequest.Locality},
-			StreetAddress: []string{w.CertRequest.Address},
-			PostalCode:    []string{w.CertRequest.PostalCode},
+			Organization:  []string{cr.Organization},
+			Country:       []string{cr.Country},
+			Province:      []string{cr.Province},
+			Locality:      []string{cr.Locality},
+			StreetAddress: []string{cr.Address},
+			PostalCode:    []string{cr.PostalCode},
 		},
-		Issuer:      w.CACert.Subject,
-		DNSNames:    []string{strings.ToLower(w.CertRequest.DNSName)},
-		NotBefore:   time.Now().Add(-5 * time.Minute).UTC(),
-		NotAfter:    time.Now().AddDate(w.CertRequest.YearsValid, w.CertRequest.MonthsValid, w.CertRequest.DaysValid),
-		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		KeyUsage:    x509.KeyUsageDigitalSignature,
-		OCSPServer:  w.OCSPResponders,
+		Issuer:                w.CACert.Subject,
+		DNSNames:              []string{strings.ToLower(cr.DNSName)},
+		NotBefore:             time.Now().Add(-5 * time.Minute).UTC(),
+		NotAfter:              time.Now().AddDate(cr.YearsValid, cr.MonthsValid, cr.DaysValid),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		OCSPServer:            w.OCSPResponders,
+		CRLDistributionPoints: w.CRLDistributionPoints,
 	}, nil
 }
 
-func (w *Worker) NewUserCertificateHandler(msg *nats.Msg) {
+func (w *Worker) NewUserCertificateHandler(msg jetstream.Msg) {
 
 	// Read message
 	cr := scnorion_nats.CertificateRequest{}
-	if err := json.Unmarshal(msg.Data, &cr); err != nil {
+	if err := json.Unmarshal(msg.Data(), &cr); err != nil {
 		log.Printf("[ERROR]: could not unmarshall new certificate request, reason: %v", err)
-		msg.NakWithDelay(5 * time.Minute)
+		msg.Nak()
 		return
 	}
-	w.CertRequest = &cr
 
-	if err := w.GenerateUserCertificate(); err != nil {
-		log.Printf("[ERROR]: could not generate the user certificate, reason: %v", err)
-		msg.NakWithDelay(5 * time.Minute)
+	requestID, err := jetStreamMessageID(msg)
+	if err != nil {
+		log.Printf("[ERROR]: could not get the ID of the certificate request, reason: %v", err)
+		msg.Nak()
 		return
 	}
 
-	if err := w.SendCertificate(); err != nil {
-		log.Printf("[ERROR]: could not send the user certificate, reason: %v", err)
-		msg.NakWithDelay(5 * time.Minute)
+	sent, err := w.retryIssuance(requestID, certificate.TypeUser.String())
+	if err != nil {
+		log.Printf("[ERROR]: could not check the previous attempts of the certificate request, reason: %v", err)
+		msg.Nak()
+		return
+	}
+	if sent {
+		msg.Ack()
 		return
 	}
 
-	certDescription := w.CertRequest.Username + " client certificate"
-	if err := w.Model.SaveCertificate(w.Cert.SerialNumber.Int64(), certificate.Type("user"), w.CertRequest.Username, certDescription, w.Cert.NotAfter); err != nil {
+	issued, err := w.GenerateUserCertificate(&cr)
+	if err != nil {
+		var policyErr *PolicyError
+		if errors.As(err, &policyErr) {
+			w.DenyUserCertificate(cr.Username, err)
+			msg.Ack()
+			return
+		}
+		log.Printf("[ERROR]: could not generate the user certificate, reason: %v", err)
+		msg.Nak()
+		return
+	}
+
+	// The certificate is saved before it's sent, so a retry finds it if the delivery fails
+	if err := w.certificates().SaveCertificateIssuance(requestID, issued.Cert.SerialNumber, cr.Username); err != nil {
 		log.Println("[ERROR]: error saving certificate status", err.Error())
-		msg.NakWithDelay(5 * time.Minute)
+		msg.Nak()
 		return
 	}
 
-	if err := w.Model.SetCertificateSent(w.CertRequest.Username); err != nil {
+	certDescription := cr.Username + " client certificate"
+	if err := w.certificates().SaveCertificate(issued.Cert.SerialNumber, certificate.Type("user"), cr.Username, certDescription, issued.Cert.NotAfter); err != nil {
 		log.Println("[ERROR]: error saving certificate status", err.Error())
-		msg.NakWithDelay(5 * time.Minute)
+		msg.Nak()
+		return
+	}
+
+	if err := w.SendCertificate(issued); err != nil {
+		log.Printf("[ERROR]: could not send the user certificate, reason: %v", err)
+		msg.Nak()
 		return
 	}
 
+	// From here on a retry would send another certificate, errors are only logged
+	if err := w.certificates().SetCertificateIssuanceSent(requestID); err != nil {
+		log.Println("[ERROR]: error saving certificate status", err.Error())
+	}
+
+	if err := w.certificates().SetCertificateSent(cr.Username); err != nil {
+		log.Println("[ERROR]: error saving certificate status", err.Error())
+	}
+
 	// If certificate has been sent we also set email as verified in case it wasn't (import users)
-	if err := w.Model.SetEmailVerified(w.CertRequest.Username); err != nil {
+	if err := w.certificates().SetEmailVerified(cr.Username); err != nil {
 		log.Println("[ERROR]: error saving certificate status", err.Error())
-		msg.NakWithDelay(5 * time.Minute)
-		return
 	}
 
 	if err := msg.Ack(); err != nil {
@@ -218,103 +412,549 @@ func (w *Worker) NewUserCertificateHandler(msg *nats.Msg) {
 	}
 }
 
-func (w *Worker) NewAgentCertificateHandler(msg *nats.Msg) {
+// retryIssuance is called before issuing the certificate of a request, it returns true when
+// a previous attempt delivered it and the request only has to be acknowledged. The certificate
+// of an attempt that failed to deliver it is revoked, so a request never leaves two valid certificates
+func (w *Worker) retryIssuance(requestID, certType string) (bool, error) {
+	issuance, err := w.certificates().GetCertificateIssuance(requestID)
+	if err != nil {
+		if ent.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if issuance.Sent {
+		log.Printf("[INFO]: the certificate %s requested in %s has already been sent", issuance.Serial, requestID)
+		return true, nil
+	}
+
+	serial, err := ParseSerial(issuance.Serial)
+	if err != nil {
+		return false, err
+	}
+	return false, w.discardCertificate(certType, issuance.Owner, serial, "certificate request retried after a failed delivery")
+}
+
+func (w *Worker) StartCertificateIssuancesJob() error {
+	var err error
+
+	if w.CertificateIssuancesJob != nil {
+		return nil
+	}
+
+	w.CertificateIssuancesJob, err = w.TaskScheduler.NewJob(
+		gocron.DurationJob(
+			certificateIssuancePurgeFrequency,
+		),
+		gocron.NewTask(w.PurgeCertificateIssuances),
+		gocron.WithStartAt(gocron.WithStartImmediately()),
+	)
+	if err != nil {
+		log.Printf("[ERROR]: could not start the certificate issuances job: %v", err)
+		return err
+	}
+	log.Printf("[INFO]: new certificate issuances job has been scheduled every %s", certificateIssuancePurgeFrequency)
+	return nil
+}
+
+// PurgeCertificateIssuances forgets the issuances of requests the stream no longer keeps
+func (w *Worker) PurgeCertificateIssuances() {
+	if w.Model == nil {
+		return
+	}
+
+	if _, err := w.Model.DeleteCertificateIssuances(time.Now().Add(-jetstreamWorkQueueMaxAge)); err != nil {
+		log.Printf("[ERROR]: could not purge the certificate issuances, reason: %v", err)
+	}
+}
+
+// discardCertificate revokes a saved certificate that may not have been delivered
+func (w *Worker) discardCertificate(certType, uid string, serial *big.Int, info string) error {
+	if _, err := w.certificates().GetRevocationBySerial(serial); err == nil {
+		return nil
+	} else if !ent.IsNotFound(err) {
+		return err
+	}
+
+	if _, err := w.certificates().GetCertificateBySerial(serial); err != nil {
+		if ent.IsNotFound(err) {
+			// The attempt failed before saving it
+			return nil
+		}
+		return err
+	}
+
+	if _, err := w.certificates().RevokeCertificate(serial, ocsp.Superseded, info); err != nil {
+		return err
+	}
+	w.AnnounceRevocation(certType, uid, models.FormatSerial(serial), ocsp.Superseded, info)
+	return nil
+}
+
+type AgentCertificateRequest struct {
+	scnorion_nats.CertificateRequest
+	CSR []byte `json:"csr,omitempty"`
+}
+
+type AgentCertificateResponse struct {
+	scnorion_nats.AgentCertificateData
+	ChainBytes [][]byte `json:"chain_bytes,omitempty"`
+}
+
+func (w *Worker) NewAgentCertificateHandler(msg jetstream.Msg) {
+	var err error
+	var issued *IssuedCertificate
+
 	// Read message
-	cr := scnorion_nats.CertificateRequest{}
-	if err := json.Unmarshal(msg.Data, &cr); err != nil {
+	cr := AgentCertificateRequest{}
+	if err := json.Unmarshal(msg.Data(), &cr); err != nil {
 		log.Printf("[ERROR]: could not unmarshall new certificate request, reason: %v", err)
 		msg.Ack()
 		return
 	}
-	w.CertRequest = &cr
 
-	if err := w.GenerateAgentCertificate(); err != nil {
-		log.Printf("[ERROR]: could not generate the agent certificate, reason: %v", err)
+	requestID, err := jetStreamMessageID(msg)
+	if err != nil {
+		log.Printf("[ERROR]: could not get the ID of the certificate request, reason: %v", err)
+		msg.Nak()
+		return
+	}
+
+	sent, err := w.retryIssuance(requestID, certificate.TypeAgent.String())
+	if err != nil {
+		log.Printf("[ERROR]: could not check the previous attempts of the certificate request, reason: %v", err)
+		msg.Nak()
+		return
+	}
+	if sent {
 		msg.Ack()
 		return
 	}
 
-	if w.NATSConnection == nil || !w.NATSConnection.IsConnected() {
-		log.Println("[ERROR]: could not send the agent certificate to the agent, reason: NATS is not connected")
-		msg.NakWithDelay(10 * time.Minute)
+	if len(cr.CSR) > 0 {
+		csr, err := w.ValidateAgentCSR(&cr)
+		if err != nil {
+			w.DenyAgentCertificate(cr.AgentId, fmt.Errorf("invalid CSR: %v", err))
+			msg.Ack()
+			return
+		}
+
+		if err := w.CheckAgentAdmission(&cr.CertificateRequest); err != nil {
+			w.DenyAgentCertificate(cr.AgentId, err)
+			msg.Ack()
+			return
+		}
+
+		// The agent keeps its private key, we only sign its public key
+		issued, err = w.signAgentCertificate(&cr.CertificateRequest, csr.PublicKey, csr.IPAddresses)
+		if err != nil {
+			var policyErr *PolicyError
+			if errors.As(err, &policyErr) {
+				w.DenyAgentCertificate(cr.AgentId, err)
+				msg.Ack()
+				return
+			}
+			log.Printf("[ERROR]: could not sign the agent certificate, reason: %v", err)
+			msg.Nak()
+			return
+		}
+	} else {
+		if !w.LegacyAgentEnrollment {
+			log.Printf("[WARN]: agent %s requested a certificate without a CSR and legacy enrollment is disabled, update the agent or enable allow-legacy-agent-enrollment", cr.AgentId)
+			w.DenyAgentCertificate(cr.AgentId, errors.New("a certificate was requested without a CSR and legacy enrollment is disabled"))
+			msg.Ack()
+			return
+		}
+
+		if err := w.CheckAgentAdmission(&cr.CertificateRequest); err != nil {
+			w.DenyAgentCertificate(cr.AgentId, err)
+			msg.Ack()
+			return
+		}
+
+		log.Printf("[WARN]: agent %s is using the deprecated legacy enrollment, its private key is generated by the worker", cr.AgentId)
+		issued, err = w.GenerateAgentCertificate(&cr.CertificateRequest)
+		if err != nil {
+			var policyErr *PolicyError
+			if errors.As(err, &policyErr) {
+				w.DenyAgentCertificate(cr.AgentId, err)
+				msg.Ack()
+				return
+			}
+			log.Printf("[ERROR]: could not generate the agent certificate, reason: %v", err)
+			msg.Nak()
+			return
+		}
+	}
+
+	// The certificate is saved before it's sent, so a retry finds it if the delivery fails
+	if err := w.certificates().SaveCertificateIssuance(requestID, issued.Cert.SerialNumber, cr.AgentId); err != nil {
+		log.Println("[ERROR]: error saving certificate status", err.Error())
+		msg.Nak()
 		return
 	}
 
-	certData, err := json.Marshal(scnorion_nats.AgentCertificateData{
-		CertBytes:       w.CertBytes,
-		PrivateKeyBytes: x509.MarshalPKCS1PrivateKey(w.PrivateKey),
-	})
-	if err != nil {
-		log.Println("[ERROR]: could not marshal data with agent certificate, reason: NATS is not connected")
-		msg.Ack()
+	if err := w.SaveAgentCertificate(cr.AgentId, issued); err != nil {
+		log.Println("[ERROR]: error saving certificate status", err.Error())
+		msg.Nak()
 		return
 	}
 
-	err = w.NATSConnection.Publish("agent.certificate."+cr.AgentId, certData)
-	if err != nil {
-		log.Printf("[ERROR]: could not publish the agent certificate message, reason: %v", err)
-		msg.NakWithDelay(10 * time.Minute)
+	if err := w.SendAgentCertificate(cr.AgentId, issued); err != nil {
+		log.Printf("[ERROR]: could not send the agent certificate to the agent, reason: %v", err)
+		msg.Nak()
+		return
+	}
+
+	// From here on a retry would send another certificate, errors are only logged
+	if err := w.certificates().SetCertificateIssuanceSent(requestID); err != nil {
+		log.Println("[ERROR]: error saving certificate status", err.Error())
+	}
+
+	w.SupersedeAgentCertificates(cr.AgentId, issued)
+
+	if err := msg.Ack(); err != nil {
+		log.Println("[ERROR]: could not send response", err.Error())
 		return
 	}
+}
 
-	certDescription := w.CertRequest.DNSName + " agent certificate"
+func (w *Worker) SendAgentCertificate(agentID string, issued *IssuedCertificate) error {
+	var err error
 
-	if err := w.Model.RevokePreviousCertificates(certDescription); err != nil {
+	if w.NATSConnection == nil || !w.NATSConnection.IsConnected() {
+		return errors.New("NATS is not connected")
+	}
+
+	response := AgentCertificateResponse{
+		AgentCertificateData: scnorion_nats.AgentCertificateData{
+			CertBytes: issued.CertBytes,
+		},
+	}
+	for _, cert := range w.CertificateChain() {
+		response.ChainBytes = append(response.ChainBytes, cert.Raw)
+	}
+	if issued.PrivateKey != nil {
+		response.PrivateKeyBytes, err = MarshalPrivateKey(issued.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("could not marshal the agent private key: %v", err)
+		}
+	}
+
+	certData, err := json.Marshal(response)
+	if err != nil {
+		return fmt.Errorf("could not marshal data with agent certificate: %v", err)
+	}
+
+	return w.NATSConnection.Publish("agent.certificate."+agentID, certData)
+}
+
+// SaveAgentCertificate stores the new certificate, the one it supersedes is only revoked
+// by SupersedeAgentCertificates once the agent has been sent the new one
+func (w *Worker) SaveAgentCertificate(agentID string, issued *IssuedCertificate) error {
+	certDescription := issued.Request.DNSName + " agent certificate"
+
+	if err := w.Model.SaveCertificate(issued.Cert.SerialNumber, certificate.TypeAgent, agentID, certDescription, issued.Cert.NotAfter); err != nil {
+		return err
+	}
+
+	// Agents that sent a CSR have no private key in the issuance, the renewal signs their key again
+	return w.Model.SaveIssuedAgentCertificate(issued.Cert.SerialNumber, agentID, issued.CertBytes, issued.PrivateKey == nil)
+}
+
+// SupersedeAgentCertificates revokes the other certificates of the agent's DNS name, including the
+// ones saved by attempts that could not deliver them
+func (w *Worker) SupersedeAgentCertificates(agentID string, issued *IssuedCertificate) {
+	certDescription := issued.Request.DNSName + " agent certificate"
+	info := "certificate superseded by " + models.FormatSerial(issued.Cert.SerialNumber)
+
+	previous, err := w.Model.SupersedeCertificates(certDescription, issued.Cert.SerialNumber, info)
+	if err != nil {
 		log.Printf("[ERROR]: could not revoke previous certificate, reason: %v", err)
+		return
 	}
 
-	if err := w.Model.SaveCertificate(w.Cert.SerialNumber.Int64(), certificate.Type("agent"), "", certDescription, w.Cert.NotAfter); err != nil {
-		log.Println("[ERROR]: error saving certificate status", err.Error())
-		msg.NakWithDelay(10 * time.Minute)
+	for _, p := range previous {
+		info := "certificate superseded by " + models.FormatSerial(issued.Cert.SerialNumber)
+		if serial, err := w.Model.GetFullSerial(p.ID); err == nil {
+			info = fmt.Sprintf("certificate %s superseded by %s", models.FormatSerial(serial), models.FormatSerial(issued.Cert.SerialNumber))
+		}
+		if err := w.Model.AddCertificateEvent(models.CertificateEventRenewed, models.ShortSerial(issued.Cert.SerialNumber), agentID, info); err != nil {
+			log.Printf("[ERROR]: could not record the certificate renewal, reason: %v", err)
+		}
+	}
+}
+
+// ValidateAgentCSR checks the CSR signature and that it asks for a single DNS name
+func (w *Worker) ValidateAgentCSR(cr *AgentCertificateRequest) (*x509.CertificateRequest, error) {
+	der := cr.CSR
+	if block, _ := pem.Decode(cr.CSR); block != nil {
+		if block.Type != "CERTIFICATE REQUEST" && block.Type != "NEW CERTIFICATE REQUEST" {
+			return nil, fmt.Errorf("unexpected PEM block %s", block.Type)
+		}
+		der = block.Bytes
+	}
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse CSR: %v", err)
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid CSR signature: %v", err)
+	}
+
+	if err := checkPublicKeyStrength(csr.PublicKey); err != nil {
+		return nil, err
+	}
+
+	// IP addresses are checked later against the tenant policy
+	if len(csr.EmailAddresses) > 0 || len(csr.URIs) > 0 {
+		return nil, errors.New("only DNS names and IP addresses can be requested")
+	}
+
+	dnsNames := csr.DNSNames
+	if len(dnsNames) == 0 && csr.Subject.CommonName != "" {
+		dnsNames = []string{csr.Subject.CommonName}
+	}
+	if len(dnsNames) != 1 {
+		return nil, fmt.Errorf("the CSR must request exactly one DNS name, found %d", len(dnsNames))
+	}
+
+	cr.DNSName = strings.ToLower(dnsNames[0])
+	return csr, nil
+}
+
+// CheckAgentAdmission only lets admitted agents get a certificate for the hostname they reported
+func (w *Worker) CheckAgentAdmission(cr *scnorion_nats.CertificateRequest) error {
+	if w.Model == nil {
+		return errors.New("no connection with database")
+	}
+
+	a, err := w.Model.GetAgentById(cr.AgentId)
+	if err != nil {
+		if ent.IsNotFound(err) {
+			return fmt.Errorf("agent %s is not registered", cr.AgentId)
+		}
+		return fmt.Errorf("could not find agent: %v", err)
+	}
+
+	switch a.AgentStatus {
+	case agent.AgentStatusWaitingForAdmission:
+		return fmt.Errorf("agent %s has not been admitted yet", cr.AgentId)
+	case agent.AgentStatusDisabled:
+		return fmt.Errorf("agent %s is disabled", cr.AgentId)
+	}
+
+	dnsName := strings.ToLower(cr.DNSName)
+	if !dnsNameMatchesHostname(dnsName, a.Hostname) {
+		return fmt.Errorf("requested DNS name %s does not match the agent's hostname %s", dnsName, a.Hostname)
+	}
+
+	return nil
+}
+
+// DenyAgentCertificate records why a certificate was refused so the console can show it
+func (w *Worker) DenyAgentCertificate(agentID string, reason error) {
+	log.Printf("[ERROR]: certificate request from agent %s has been denied, reason: %v", agentID, reason)
+
+	if w.Model == nil {
+		return
+	}
+
+	if err := w.Model.AddCertificateEvent(models.CertificateEventIssuanceDenied, 0, agentID, reason.Error()); err != nil {
+		log.Printf("[ERROR]: could not record the denied certificate request, reason: %v", err)
+	}
+}
+
+// DenyUserCertificate records why the certificate of a user was refused so the console can show it
+func (w *Worker) DenyUserCertificate(username string, reason error) {
+	log.Printf("[ERROR]: certificate request for user %s has been denied, reason: %v", username, reason)
+
+	if w.Model == nil {
 		return
 	}
+
+	if err := w.Model.AddCertificateEvent(models.CertificateEventIssuanceDenied, 0, username, reason.Error()); err != nil {
+		log.Printf("[ERROR]: could not record the denied certificate request, reason: %v", err)
+	}
+}
+
+// dnsNameMatchesHostname accepts the hostname reported by the agent or a FQDN for that hostname
+func dnsNameMatchesHostname(dnsName, hostname string) bool {
+	hostname = strings.ToLower(strings.TrimSpace(hostname))
+	if hostname == "" {
+		return false
+	}
+	return dnsName == hostname || strings.HasPrefix(dnsName, hostname+".")
+}
+
+func checkPublicKeyStrength(publicKey any) error {
+	switch k := publicKey.(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < 2048 {
+			return fmt.Errorf("RSA keys must be at least 2048 bits, found %d", k.N.BitLen())
+		}
+	case *ecdsa.PublicKey:
+		if k.Curve.Params().BitSize < 256 {
+			return fmt.Errorf("ECDSA keys must use at least a P-256 curve")
+		}
+	case ed25519.PublicKey:
+	default:
+		return fmt.Errorf("unsupported public key type %T", publicKey)
+	}
+	return nil
+}
+
+// RevocationRequest carries the serial number in hexadecimal as it may not fit in an int64
+type RevocationRequest struct {
+	Serial string `json:"serial"`
+	Reason int    `json:"reason"`
+	Info   string `json:"info,omitempty"`
+}
+
+type RevocationResponse struct {
+	Success bool   `json:"success"`
+	Serial  string `json:"serial,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type RevokedCertificateEvent struct {
+	Serial  string    `json:"serial"`
+	Type    string    `json:"type"`
+	UID     string    `json:"uid,omitempty"`
+	Reason  int       `json:"reason"`
+	Info    string    `json:"info,omitempty"`
+	Revoked time.Time `json:"revoked"`
 }
 
 func (w *Worker) RevokeCertificateHandler(msg *nats.Msg) {
-	if err := msg.Ack(); err != nil {
-		log.Println("[ERROR]: could not send response", err.Error())
+	rr := RevocationRequest{}
+	if err := json.Unmarshal(msg.Data, &rr); err != nil {
+		log.Printf("[ERROR]: could not unmarshall revocation request, reason: %v", err)
+		w.RespondRevocation(msg, RevocationResponse{Error: fmt.Sprintf("could not read revocation request: %v", err)})
+		return
+	}
+
+	serial, err := ParseSerial(rr.Serial)
+	if err != nil {
+		log.Println("[ERROR]: revocation request has no valid serial number")
+		w.RespondRevocation(msg, RevocationResponse{Error: "a valid certificate serial number is required"})
 		return
 	}
+	rr.Serial = models.FormatSerial(serial)
+
+	if !isValidRevocationReason(rr.Reason) {
+		log.Printf("[ERROR]: revocation request for serial %s has an invalid reason code %d", rr.Serial, rr.Reason)
+		w.RespondRevocation(msg, RevocationResponse{Serial: rr.Serial, Error: fmt.Sprintf("invalid revocation reason code %d", rr.Reason)})
+		return
+	}
+
+	certType, uid, err := w.revokeCertificate(serial, rr.Reason, rr.Info)
+	if err != nil {
+		log.Printf("[ERROR]: could not revoke certificate with serial %s, reason: %v", rr.Serial, err)
+		w.RespondRevocation(msg, RevocationResponse{Serial: rr.Serial, Error: err.Error()})
+		return
+	}
+	log.Printf("[INFO]: certificate with serial %s has been revoked", rr.Serial)
+
+	w.AnnounceRevocation(certType, uid, rr.Serial, rr.Reason, rr.Info)
+
+	w.RespondRevocation(msg, RevocationResponse{Success: true, Serial: rr.Serial})
 }
 
-func (w *Worker) SendCertificate() error {
+// revokeCertificate revokes the certificate and returns its type and owner, ACME
+// certificates are not saved with the others and have no owner
+func (w *Worker) revokeCertificate(serial *big.Int, reason int, info string) (string, string, error) {
+	_, err := w.Model.RevokeACMECertificate(serial, reason, info)
+	if err == nil {
+		return ACMECertificateType, "", nil
+	}
+	if !ent.IsNotFound(err) {
+		return "", "", err
+	}
 
-	// Read the CA certificate file to attach it to the message
-	caCert, err := os.ReadFile(w.CACertPath)
+	cert, err := w.Model.RevokeCertificate(serial, reason, info)
 	if err != nil {
-		return err
+		return "", "", err
 	}
+	return cert.Type.String(), cert.UID, nil
+}
 
-	// ZIP the file as Outlook block the .cer, .crt extensions....
-	buf := new(bytes.Buffer)
-	zw := zip.NewWriter(buf)
-	f, err := zw.Create("ca.cer")
+// AnnounceRevocation regenerates the CRL and publishes the certificates.revoked event
+func (w *Worker) AnnounceRevocation(certType, uid, serial string, reason int, info string) {
+	// Relying parties that only check CRLs should learn about the revocation as soon as possible
+	if err := w.GenerateCRL(); err != nil {
+		log.Printf("[ERROR]: could not generate the CRL after revocation, reason: %v", err)
+	}
+
+	event, err := json.Marshal(RevokedCertificateEvent{
+		Serial:  serial,
+		Type:    certType,
+		UID:     uid,
+		Reason:  reason,
+		Info:    info,
+		Revoked: time.Now(),
+	})
+	if err != nil {
+		log.Printf("[ERROR]: could not marshal certificate revoked event, reason: %v", err)
+	} else if w.NATSConnection != nil && w.NATSConnection.IsConnected() {
+		if err := w.NATSConnection.Publish("certificates.revoked", event); err != nil {
+			log.Printf("[ERROR]: could not publish certificates.revoked event, reason: %v", err)
+		}
+	}
+}
+
+func (w *Worker) RespondRevocation(msg *nats.Msg, response RevocationResponse) {
+	if msg.Reply == "" {
+		return
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("[ERROR]: could not marshal revocation response, reason: %v", err)
+		return
+	}
+
+	if err := msg.Respond(data); err != nil {
+		log.Printf("[ERROR]: could not respond to revocation request, reason: %v", err)
+	}
+}
+
+// isValidRevocationReason checks the code against RFC 5280 CRLReason, value 7 is not used
+func isValidRevocationReason(reason int) bool {
+	return reason >= ocsp.Unspecified && reason <= ocsp.AACompromise && reason != 7
+}
+
+func (w *Worker) SendCertificate(issued *IssuedCertificate) error {
+	if w.UserCertificateDelivery == UserCertificateDeliveryDownload {
+		return w.SendCertificateDownload(issued)
+	}
+
+	caZip, err := w.CACertificatesZip()
 	if err != nil {
 		return err
 	}
-	_, err = f.Write(caCert)
+
+	pfx, err := w.NotificationAttachment(issued.Request.Username+".pfx", "application/x-pkcs12", issued.PKCS12)
 	if err != nil {
 		return err
 	}
 
-	if err := zw.Close(); err != nil {
+	caAttachment, err := w.NotificationAttachment("ca_crt.zip", "application/zip", caZip)
+	if err != nil {
 		return err
 	}
 
-	notification := scnorion_nats.Notification{
-		To:           w.CertRequest.Email,
-		Subject:      "Your certificate to log in to scnorion web console",
-		MessageTitle: "scnorion | Your certificate",
-		MessageText: `You can find attached the digital certificate in pfx format that you must import to your browser so you can use it to log in to the scnorion console. 
-		
-		<br/><br/>Also you may need to import the zipped ca.cer file as a trusted root certificate authority so your browser can trust in the certificates generated by scnorion CA`,
-		MessageGreeting:        fmt.Sprintf("Hi %s", w.CertRequest.FullName),
-		MessageAction:          "Go to console",
-		MessageActionURL:       w.CertRequest.ConsoleURL,
-		MessageAttachFileName:  w.CertRequest.Username + ".pfx",
-		MessageAttachFile:      base64.StdEncoding.EncodeToString(w.PKCS12),
-		MessageAttachFileName2: "ca_crt.zip",
-		MessageAttachFile2:     base64.StdEncoding.EncodeToString(buf.Bytes()),
+	notification := TenantNotification{
+		Notification: scnorion_nats.Notification{
+			To:               issued.Request.Email,
+			MessageActionURL: issued.Request.ConsoleURL,
+		},
+		Template:    notifications.TemplateSendCertificate,
+		Data:        map[string]string{"name": issued.Request.FullName},
+		Attachments: []notifications.Attachment{pfx, caAttachment},
 	}
 
 	data, err := json.Marshal(notification)
@@ -323,7 +963,7 @@ func (w *Worker) SendCertificate() error {
 	}
 
 	if w.NATSConnection == nil || !w.NATSConnection.IsConnected() {
-		return err
+		return errors.New("NATS is not connected")
 	}
 
 	if err := w.NATSConnection.Publish("notification.send_certificate", data); err != nil {
@@ -332,3 +972,40 @@ func (w *Worker) SendCertificate() error {
 
 	return nil
 }
+
+// CACertificatesZip returns the CA certificate and the intermediates zipped, ready to be attached to a message
+func (w *Worker) CACertificatesZip() ([]byte, error) {
+	// Read the CA certificate file to attach it to the message
+	caCert, err := os.ReadFile(w.CACertPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// ZIP the file as Outlook block the .cer, .crt extensions....
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	f, err := zw.Create("ca.cer")
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(caCert)
+	if err != nil {
+		return nil, err
+	}
+
+	// Browsers need the intermediates too when the root is not the issuing CA
+	for i, cert := range w.Intermediates() {
+		f, err := zw.Create(fmt.Sprintf("intermediate-%d.cer", i+1))
+		if err != nil {
+			return nil, err
+		}
+		if err := pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
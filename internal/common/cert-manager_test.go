@@ -0,0 +1,458 @@
+package common
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/scncore/ent"
+	"github.com/scncore/ent/certificate"
+	scnorion_nats "github.com/scncore/nats"
+	"github.com/scncore/scnorion-worker/internal/models"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// TestLimitIssuanceConcurrent issues hundreds of user and agent certificates from two
+// consumers at once, run it with -race to check that issuances share no state
+func TestLimitIssuanceConcurrent(t *testing.T) {
+	const requests = 300
+
+	w := newTestWorker(t)
+	w.MaxConcurrentIssuance = 8
+	w.issuanceSlots = make(chan struct{}, w.MaxConcurrentIssuance)
+
+	var active, peak atomic.Int32
+	var mu sync.Mutex
+	issuedSerials := map[string]string{}
+	errs := make(chan error, requests)
+
+	wg := sync.WaitGroup{}
+	wg.Add(requests)
+
+	issue := func(generate func(id string) (*IssuedCertificate, error)) func(msg *testMsg) {
+		return func(msg *testMsg) {
+			defer wg.Done()
+
+			n := active.Add(1)
+			defer active.Add(-1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+
+			id := string(msg.Data())
+			issued, err := generate(id)
+			if err != nil {
+				errs <- err
+				msg.Nak()
+				return
+			}
+
+			if err := issued.Cert.CheckSignatureFrom(w.CACert); err != nil {
+				errs <- fmt.Errorf("%s: %v", id, err)
+			}
+			if !issued.PrivateKey.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(issued.Cert.PublicKey) {
+				errs <- fmt.Errorf("%s got the private key of another certificate", id)
+			}
+
+			mu.Lock()
+			if other, ok := issuedSerials[issued.Cert.SerialNumber.String()]; ok {
+				errs <- fmt.Errorf("%s and %s have the same serial number", id, other)
+			}
+			issuedSerials[issued.Cert.SerialNumber.String()] = id
+			mu.Unlock()
+
+			msg.Ack()
+		}
+	}
+
+	userHandler := issue(func(id string) (*IssuedCertificate, error) {
+		issued, err := w.GenerateUserCertificate(&scnorion_nats.CertificateRequest{Username: id, YearsValid: 1})
+		if err == nil && issued.Cert.Subject.CommonName != id {
+			err = fmt.Errorf("%s got the certificate of %s", id, issued.Cert.Subject.CommonName)
+		}
+		return issued, err
+	})
+	agentHandler := issue(func(id string) (*IssuedCertificate, error) {
+		issued, err := w.GenerateAgentCertificate(&scnorion_nats.CertificateRequest{AgentId: id, DNSName: id + ".example.com", YearsValid: 1})
+		if err == nil && (len(issued.Cert.DNSNames) != 1 || issued.Cert.DNSNames[0] != id+".example.com") {
+			err = fmt.Errorf("%s got the certificate of %v", id, issued.Cert.DNSNames)
+		}
+		return issued, err
+	})
+
+	msgs := []*testMsg{}
+	consumers := sync.WaitGroup{}
+	for _, c := range []struct {
+		prefix  string
+		handler func(msg *testMsg)
+	}{{"user", userHandler}, {"agent", agentHandler}} {
+		limited := w.LimitIssuance(func(msg jetstream.Msg) { c.handler(msg.(*testMsg)) })
+
+		batch := []*testMsg{}
+		for i := range requests / 2 {
+			batch = append(batch, newTestMsg("certificates."+c.prefix, fmt.Appendf(nil, "%s%d", c.prefix, i)))
+		}
+		msgs = append(msgs, batch...)
+
+		// Consume calls the handler of each consumer from its own goroutine
+		consumers.Add(1)
+		go func() {
+			defer consumers.Done()
+			for _, msg := range batch {
+				limited(msg)
+			}
+		}()
+	}
+	consumers.Wait()
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if len(issuedSerials) != requests {
+		t.Errorf("%d certificates issued, want %d", len(issuedSerials), requests)
+	}
+	if peak.Load() > int32(w.MaxConcurrentIssuance) {
+		t.Errorf("%d certificates issued at once, the limit is %d", peak.Load(), w.MaxConcurrentIssuance)
+	}
+	for _, msg := range msgs {
+		if acks, _, _ := msg.counts(); acks != 1 {
+			t.Errorf("message %s acknowledged %d times", msg.Data(), acks)
+		}
+	}
+}
+
+func TestLimitIssuanceKeepsWaitingMessages(t *testing.T) {
+	interval := issuanceProgressInterval
+	issuanceProgressInterval = 10 * time.Millisecond
+	t.Cleanup(func() { issuanceProgressInterval = interval })
+
+	w := newTestWorker(t)
+	w.issuanceSlots = make(chan struct{}, 1)
+
+	release := make(chan struct{})
+	done := make(chan struct{}, 2)
+	limited := w.LimitIssuance(func(msg jetstream.Msg) {
+		<-release
+		done <- struct{}{}
+	})
+
+	first := newTestMsg("certificates.user", nil)
+	second := newTestMsg("certificates.user", nil)
+
+	limited(first)
+	go limited(second)
+
+	time.Sleep(100 * time.Millisecond)
+	if _, _, inProgress := second.counts(); inProgress == 0 {
+		t.Error("the message waiting for a slot was not marked as in progress")
+	}
+	if _, _, inProgress := first.counts(); inProgress != 0 {
+		t.Error("the message with a slot was marked as in progress")
+	}
+
+	close(release)
+	<-done
+	<-done
+}
+
+// TestDownloadRandomPassword checks every certificate for download gets its own random
+// password, even when the console has no password for the user
+func TestDownloadRandomPassword(t *testing.T) {
+	w := newTestWorker(t)
+	w.UserCertificateDelivery = UserCertificateDeliveryDownload
+
+	passwords := map[string]bool{}
+	for _, consolePassword := range []string{"", "", "console password"} {
+		cr := &scnorion_nats.CertificateRequest{Username: "user", YearsValid: 1, Password: consolePassword}
+		issued, err := w.GenerateUserCertificate(cr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(issued.Password) != downloadPasswordLength || strings.Trim(issued.Password, downloadPasswordAlphabet) != "" {
+			t.Errorf("got password %q", issued.Password)
+		}
+		if passwords[issued.Password] || issued.Password == consolePassword {
+			t.Errorf("the password %q has been used before", issued.Password)
+		}
+		passwords[issued.Password] = true
+
+		if _, _, _, err := pkcs12.DecodeChain(issued.PKCS12, issued.Password); err != nil {
+			t.Errorf("the PKCS#12 can't be opened with its password: %v", err)
+		}
+	}
+
+	// Attachments keep the password of the console
+	w.UserCertificateDelivery = UserCertificateDeliveryAttachment
+	issued, err := w.GenerateUserCertificate(&scnorion_nats.CertificateRequest{Username: "user", YearsValid: 1, Password: "console password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issued.Password != "" {
+		t.Errorf("got password %q for an attachment", issued.Password)
+	}
+	if _, _, _, err := pkcs12.DecodeChain(issued.PKCS12, "console password"); err != nil {
+		t.Errorf("the PKCS#12 can't be opened with the console password: %v", err)
+	}
+}
+
+// testCertificateStore keeps the issuances and the certificates in memory as the database does
+type testCertificateStore struct {
+	mu           sync.Mutex
+	issuances    map[string]models.CertificateIssuance
+	certificates map[int64]*ent.Certificate
+	revocations  map[int64]*ent.Certificate
+	// failSave are the owners whose first certificate is saved but reported as
+	// failed, as if the connection was lost before the commit was acknowledged
+	failSave map[string]bool
+}
+
+func newTestCertificateStore() *testCertificateStore {
+	return &testCertificateStore{
+		issuances:    map[string]models.CertificateIssuance{},
+		certificates: map[int64]*ent.Certificate{},
+		revocations:  map[int64]*ent.Certificate{},
+		failSave:     map[string]bool{},
+	}
+}
+
+func (s *testCertificateStore) GetCertificateIssuance(requestID string) (*models.CertificateIssuance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	issuance, ok := s.issuances[requestID]
+	if !ok {
+		return nil, &ent.NotFoundError{}
+	}
+	return &issuance, nil
+}
+
+func (s *testCertificateStore) SaveCertificateIssuance(requestID string, serial *big.Int, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.issuances[requestID] = models.CertificateIssuance{RequestID: requestID, Serial: models.FormatSerial(serial), Owner: owner, Created: time.Now()}
+	return nil
+}
+
+func (s *testCertificateStore) SetCertificateIssuanceSent(requestID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	issuance := s.issuances[requestID]
+	issuance.Sent = true
+	s.issuances[requestID] = issuance
+	return nil
+}
+
+func (s *testCertificateStore) SaveCertificate(serial *big.Int, certType certificate.Type, uid, description string, expiry time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := models.ShortSerial(serial)
+	if _, ok := s.certificates[id]; ok {
+		return fmt.Errorf("duplicate key value, certificate %s already exists", models.FormatSerial(serial))
+	}
+	if _, ok := s.revocations[id]; ok {
+		return fmt.Errorf("duplicate key value, certificate %s has been revoked", models.FormatSerial(serial))
+	}
+	s.certificates[id] = &ent.Certificate{ID: id, Type: certType, UID: uid, Description: description, Expiry: expiry}
+
+	if s.failSave[uid] {
+		delete(s.failSave, uid)
+		return errors.New("connection reset by peer")
+	}
+	return nil
+}
+
+func (s *testCertificateStore) GetCertificateBySerial(serial *big.Int) (*ent.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cert, ok := s.certificates[models.ShortSerial(serial)]
+	if !ok {
+		return nil, &ent.NotFoundError{}
+	}
+	return cert, nil
+}
+
+func (s *testCertificateStore) GetRevocationBySerial(serial *big.Int) (*ent.Revocation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.revocations[models.ShortSerial(serial)]; !ok {
+		return nil, &ent.NotFoundError{}
+	}
+	return &ent.Revocation{ID: models.ShortSerial(serial)}, nil
+}
+
+func (s *testCertificateStore) RevokeCertificate(serial *big.Int, reason int, info string) (*ent.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := models.ShortSerial(serial)
+	cert, ok := s.certificates[id]
+	if !ok {
+		return nil, fmt.Errorf("certificate with serial %s not found", models.FormatSerial(serial))
+	}
+	delete(s.certificates, id)
+	s.revocations[id] = cert
+	return cert, nil
+}
+
+func (s *testCertificateStore) SetCertificateSent(uid string) error { return nil }
+func (s *testCertificateStore) SetEmailVerified(uid string) error   { return nil }
+
+// TestUserCertificateHandlerConcurrent sends concurrent requests through the handler, with the
+// certificates kept in memory and the emails taken from NATS. Some saves fail and some requests
+// are delivered again, every user must end with one valid certificate, the one it was sent
+func TestUserCertificateHandlerConcurrent(t *testing.T) {
+	const users = 100
+
+	w := newTestJetStream(t)
+	w.MaxConcurrentIssuance = 8
+	w.issuanceSlots = make(chan struct{}, w.MaxConcurrentIssuance)
+	store := newTestCertificateStore()
+	w.certificateStore = store
+
+	w.CACertPath = filepath.Join(t.TempDir(), "ca.cer")
+	if err := os.WriteFile(w.CACertPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: w.CACert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	emails, err := w.NATSConnection.SubscribeSync("notification.send_certificate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := emails.SetPendingLimits(-1, -1); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []*testMsg{}
+	for i := range users {
+		username := fmt.Sprintf("user%d", i)
+		data, err := json.Marshal(scnorion_nats.CertificateRequest{Username: username, Email: username + "@example.com", YearsValid: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := newTestMsg("certificates.user", data)
+		msg.headers.Set(nats.MsgIdHdr, fmt.Sprintf("request-%d", i))
+		msgs = append(msgs, msg)
+
+		if i%5 == 0 {
+			store.failSave[username] = true
+		}
+	}
+
+	handler := w.LimitIssuance(w.NewUserCertificateHandler)
+	deliver := func(msgs []*testMsg) {
+		for _, msg := range msgs {
+			handler(msg)
+		}
+		w.issuances.Wait()
+	}
+
+	deliver(msgs)
+
+	// The rejected messages are delivered again, and some of the others as if their ack was lost
+	redelivered := []*testMsg{}
+	for i, msg := range msgs {
+		if acks, naks, _ := msg.counts(); naks > 0 || (acks > 0 && i%7 == 0) {
+			redelivered = append(redelivered, msg)
+		}
+	}
+	deliver(redelivered)
+
+	for i, msg := range msgs {
+		acks, naks, _ := msg.counts()
+		switch {
+		case i%5 == 0 && (acks != 1 || naks != 1):
+			t.Errorf("request %d with a failed save got %d acks and %d naks, want 1 and 1", i, acks, naks)
+		case i%5 != 0 && naks != 0:
+			t.Errorf("request %d got %d naks", i, naks)
+		}
+	}
+
+	if err := w.NATSConnection.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	sent := map[string][]*x509.Certificate{}
+	for {
+		m, err := emails.NextMsg(100 * time.Millisecond)
+		if errors.Is(err, nats.ErrTimeout) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n := TenantNotification{}
+		if err := json.Unmarshal(m.Data, &n); err != nil {
+			t.Fatal(err)
+		}
+		username, _, _ := strings.Cut(n.To, "@")
+		for _, a := range n.Attachments {
+			if a.Filename != username+".pfx" {
+				continue
+			}
+			pfx, err := base64.StdEncoding.DecodeString(a.Content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, cert, _, err := pkcs12.DecodeChain(pfx, pkcs12.DefaultPassword)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cert.Subject.CommonName != username {
+				t.Errorf("%s got the certificate of %s", username, cert.Subject.CommonName)
+			}
+			sent[username] = append(sent[username], cert)
+		}
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i := range users {
+		username := fmt.Sprintf("user%d", i)
+		if len(sent[username]) != 1 {
+			t.Errorf("%s got %d certificates, want 1", username, len(sent[username]))
+			continue
+		}
+		cert, ok := store.certificates[models.ShortSerial(sent[username][0].SerialNumber)]
+		if !ok || cert.UID != username {
+			t.Errorf("the certificate sent to %s is not saved as a valid certificate of the user", username)
+		}
+		if issuance := store.issuances[fmt.Sprintf("request-%d", i)]; !issuance.Sent || issuance.Serial != models.FormatSerial(sent[username][0].SerialNumber) {
+			t.Errorf("the issuance of %s is %+v", username, issuance)
+		}
+	}
+
+	// The certificates saved by the failed attempts are revoked, nothing else is left
+	if len(store.certificates) != users {
+		t.Errorf("%d valid certificates, want %d", len(store.certificates), users)
+	}
+	if len(store.revocations) != users/5 {
+		t.Errorf("%d certificates revoked, want %d", len(store.revocations), users/5)
+	}
+}
@@ -0,0 +1,306 @@
+package common
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/scncore/ent"
+	scnorion_nats "github.com/scncore/nats"
+	"github.com/scncore/scnorion-worker/internal/common/notifications"
+	"github.com/scncore/scnorion-worker/internal/models"
+)
+
+const (
+	UserCertificateDeliveryAttachment = "attachment"
+	UserCertificateDeliveryDownload   = "download"
+
+	DefaultUserCertificateDownloadTTL = 24 * time.Hour
+
+	certificateDownloadPurgeFrequency = 15 * time.Minute
+	downloadPasswordLength            = 20
+	downloadPasswordAlphabet          = "ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz23456789"
+)
+
+// CertificateDownloadRequest is sent by the console to redeem a one-time download link
+type CertificateDownloadRequest struct {
+	Token         string `json:"token"`
+	RemoteAddress string `json:"remote_address,omitempty"`
+}
+
+type CertificateDownloadResponse struct {
+	Success  bool   `json:"success"`
+	Username string `json:"username,omitempty"`
+	FileName string `json:"file_name,omitempty"`
+	PKCS12   []byte `json:"pkcs12,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// NewDownloadPassword returns a random password for a PKCS#12 delivered by download,
+// ambiguous characters are left out as users may have to type it
+func NewDownloadPassword() string {
+	b := make([]byte, downloadPasswordLength)
+	for i := range b {
+		b[i] = downloadPasswordAlphabet[randIntn(len(downloadPasswordAlphabet))]
+	}
+	return string(b)
+}
+
+func randIntn(n int) int {
+	// Rejection sampling so every character is equally likely
+	max := 256 - 256%n
+	b := make([]byte, 1)
+	for {
+		// crypto/rand.Read never fails since Go 1.24
+		rand.Read(b)
+		if int(b[0]) < max {
+			return int(b[0]) % n
+		}
+	}
+}
+
+func hashDownloadToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// SendCertificateDownload stores the PKCS#12 for a one-time download and sends the link and
+// its password as two notifications. The password has its own type, certificate_password,
+// so it can be routed to a channel other than the one that gets the link
+func (w *Worker) SendCertificateDownload(issued *IssuedCertificate) error {
+	if w.Model == nil {
+		return errors.New("no connection with database")
+	}
+
+	if issued.Password == "" {
+		return errors.New("the PKCS#12 has no password for a download")
+	}
+
+	consoleURL := issued.Request.ConsoleURL
+	if consoleURL == "" {
+		consoleURL = w.ConsoleURL
+	}
+	if consoleURL == "" {
+		return errors.New("the console URL is required to send a download link")
+	}
+
+	caZip, err := w.CACertificatesZip()
+	if err != nil {
+		return err
+	}
+
+	b := make([]byte, 32)
+	// crypto/rand.Read never fails since Go 1.24
+	rand.Read(b)
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	ttl := w.UserCertificateDownloadTTL
+	if ttl <= 0 {
+		ttl = DefaultUserCertificateDownloadTTL
+	}
+	expires := time.Now().Add(ttl)
+
+	serial := models.FormatSerial(issued.Cert.SerialNumber)
+	if err := w.Model.AddCertificateDownload(hashDownloadToken(token), &models.CertificateDownload{
+		Username: issued.Request.Username,
+		Serial:   serial,
+		PKCS12:   issued.PKCS12,
+		Expires:  expires,
+	}); err != nil {
+		return err
+	}
+
+	link := strings.TrimSuffix(consoleURL, "/") + "/certificates/download/" + token
+
+	caAttachment, err := w.NotificationAttachment("ca_crt.zip", "application/zip", caZip)
+	if err != nil {
+		return err
+	}
+
+	linkNotification := TenantNotification{
+		Notification: scnorion_nats.Notification{
+			To:               issued.Request.Email,
+			MessageActionURL: link,
+		},
+		Template: notifications.TemplateCertificateDownload,
+		Data: map[string]string{
+			"name":    issued.Request.FullName,
+			"expires": expires.UTC().Format("2006-01-02 15:04 MST"),
+		},
+		Attachments: []notifications.Attachment{caAttachment},
+	}
+
+	passwordNotification := TenantNotification{
+		Notification: scnorion_nats.Notification{
+			To:               issued.Request.Email,
+			MessageActionURL: consoleURL,
+		},
+		Template: notifications.TemplateCertificatePassword,
+		Data: map[string]string{
+			"name":     issued.Request.FullName,
+			"password": issued.Password,
+		},
+	}
+
+	if w.NATSConnection == nil || !w.NATSConnection.IsConnected() {
+		return errors.New("NATS is not connected")
+	}
+
+	for _, n := range []struct {
+		subject      string
+		notification TenantNotification
+	}{
+		{"notification.send_certificate", linkNotification},
+		{"notification.certificate_password", passwordNotification},
+	} {
+		data, err := json.Marshal(n.notification)
+		if err != nil {
+			return err
+		}
+		if err := w.NATSConnection.Publish(n.subject, data); err != nil {
+			return err
+		}
+	}
+
+	info := fmt.Sprintf("download link expires on %s", expires.UTC().Format(time.RFC3339))
+	if err := w.Model.AddCertificateEvent(models.CertificateEventDownloadCreated, models.ShortSerial(issued.Cert.SerialNumber), issued.Request.Username, info); err != nil {
+		log.Printf("[ERROR]: could not record the certificate download link, reason: %v", err)
+	}
+
+	return nil
+}
+
+func (w *Worker) CertificateDownloadHandler(msg *nats.Msg) {
+	dr := CertificateDownloadRequest{}
+	if err := json.Unmarshal(msg.Data, &dr); err != nil {
+		log.Printf("[ERROR]: could not unmarshall certificate download request, reason: %v", err)
+		w.RespondCertificateDownload(msg, CertificateDownloadResponse{Error: fmt.Sprintf("could not read download request: %v", err)})
+		return
+	}
+
+	if dr.Token == "" {
+		w.RespondCertificateDownload(msg, CertificateDownloadResponse{Error: "a download token is required"})
+		return
+	}
+
+	if w.Model == nil {
+		w.RespondCertificateDownload(msg, CertificateDownloadResponse{Error: "no connection with database"})
+		return
+	}
+
+	download, err := w.Model.RedeemCertificateDownload(hashDownloadToken(dr.Token))
+	if err != nil {
+		if ent.IsNotFound(err) {
+			log.Printf("[ERROR]: certificate download requested from %s with an unknown or already used token", dr.RemoteAddress)
+			w.RespondCertificateDownload(msg, CertificateDownloadResponse{Error: "the download link is not valid or has already been used"})
+			return
+		}
+		log.Printf("[ERROR]: could not redeem certificate download, reason: %v", err)
+		w.RespondCertificateDownload(msg, CertificateDownloadResponse{Error: err.Error()})
+		return
+	}
+
+	serial, err := ParseSerial(download.Serial)
+	if err != nil {
+		log.Printf("[ERROR]: certificate download for user %s has an invalid serial %s", download.Username, download.Serial)
+		w.RespondCertificateDownload(msg, CertificateDownloadResponse{Error: "the download link is not valid"})
+		return
+	}
+
+	if time.Now().After(download.Expires) {
+		w.auditCertificateDownload(models.CertificateEventDownloadExpired, serial, download.Username, "download link expired before it was used")
+		w.RespondCertificateDownload(msg, CertificateDownloadResponse{Error: "the download link has expired"})
+		return
+	}
+
+	info := "certificate downloaded"
+	if dr.RemoteAddress != "" {
+		info += " from " + dr.RemoteAddress
+	}
+	w.auditCertificateDownload(models.CertificateEventDownloaded, serial, download.Username, info)
+	log.Printf("[INFO]: user %s has downloaded the certificate with serial %s", download.Username, download.Serial)
+
+	w.RespondCertificateDownload(msg, CertificateDownloadResponse{
+		Success:  true,
+		Username: download.Username,
+		FileName: download.Username + ".pfx",
+		PKCS12:   download.PKCS12,
+	})
+}
+
+func (w *Worker) RespondCertificateDownload(msg *nats.Msg, response CertificateDownloadResponse) {
+	if msg.Reply == "" {
+		return
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("[ERROR]: could not marshal certificate download response, reason: %v", err)
+		return
+	}
+
+	if err := msg.Respond(data); err != nil {
+		log.Printf("[ERROR]: could not respond to certificate download request, reason: %v", err)
+	}
+}
+
+func (w *Worker) StartCertificateDownloadJob() error {
+	var err error
+
+	if w.CertificateDownloadJob != nil || w.UserCertificateDelivery != UserCertificateDeliveryDownload {
+		return nil
+	}
+
+	w.CertificateDownloadJob, err = w.TaskScheduler.NewJob(
+		gocron.DurationJob(
+			certificateDownloadPurgeFrequency,
+		),
+		gocron.NewTask(w.PurgeExpiredCertificateDownloads),
+		gocron.WithStartAt(gocron.WithStartImmediately()),
+	)
+	if err != nil {
+		log.Printf("[ERROR]: could not start the certificate downloads job: %v", err)
+		return err
+	}
+	log.Printf("[INFO]: new certificate downloads job has been scheduled every %s", certificateDownloadPurgeFrequency)
+	return nil
+}
+
+// PurgeExpiredCertificateDownloads deletes the PKCS#12 files nobody downloaded in time
+func (w *Worker) PurgeExpiredCertificateDownloads() {
+	if w.Model == nil {
+		log.Println("[ERROR]: could not purge expired certificate downloads, reason: no connection with database")
+		return
+	}
+
+	downloads, err := w.Model.DeleteExpiredCertificateDownloads()
+	if err != nil {
+		log.Printf("[ERROR]: could not purge expired certificate downloads, reason: %v", err)
+		return
+	}
+
+	for _, d := range downloads {
+		serial, err := ParseSerial(d.Serial)
+		if err != nil {
+			continue
+		}
+		w.auditCertificateDownload(models.CertificateEventDownloadExpired, serial, d.Username, "download link expired before it was used")
+		log.Printf("[INFO]: the certificate download for user %s has expired", d.Username)
+	}
+}
+
+func (w *Worker) auditCertificateDownload(event string, serial *big.Int, username, info string) {
+	if err := w.Model.AddCertificateEvent(event, models.ShortSerial(serial), username, info); err != nil {
+		log.Printf("[ERROR]: could not record the certificate download event, reason: %v", err)
+	}
+}
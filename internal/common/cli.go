@@ -30,7 +30,7 @@ func (w *Worker) CheckCLICommonRequisites(cCtx *cli.Context) error {
 	}
 
 	w.ClientKeyPath = filepath.Join(cwd, cCtx.String("key"))
-	_, err = utils.ReadPEMPrivateKey(w.ClientKeyPath)
+	_, err = ReadPEMSigner(w.ClientKeyPath)
 	if err != nil {
 		return err
 	}
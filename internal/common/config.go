@@ -1,11 +1,13 @@
 package common
 
 import (
+	"fmt"
 	"log"
 	"strings"
 	"time"
 
 	"github.com/go-co-op/gocron/v2"
+	"github.com/scncore/scnorion-worker/internal/common/notifications"
 	"github.com/scncore/utils"
 	"gopkg.in/ini.v1"
 )
@@ -72,6 +74,92 @@ func (w *Worker) GenerateCommonWorkerConfig(c string) error {
 
 	w.Replicas = len(strings.Split(w.NATSServers, ","))
 
+	if c == "notification-worker" {
+		if err := w.GenerateSMTPTLSConfig(cfg); err != nil {
+			return err
+		}
+		if err := w.GenerateSMTPOAuth2Config(cfg); err != nil {
+			return err
+		}
+		w.GenerateNotificationTemplatesConfig(cfg)
+		if err := w.GenerateNotificationSigningConfig(cfg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GenerateSMTPTLSConfig reads the optional TLS settings for the SMTP relay from the Notifications section
+func (w *Worker) GenerateSMTPTLSConfig(cfg *ini.File) error {
+	var err error
+
+	settings := map[string]string{}
+	for _, name := range []string{"SMTPTLSMode", "SMTPCABundle", "SMTPClientCert", "SMTPClientKey"} {
+		key, err := cfg.Section("Notifications").GetKey(name)
+		if err == nil {
+			settings[name] = key.String()
+		}
+	}
+
+	w.SMTPTLS, err = notifications.LoadSMTPTLSOptions(settings["SMTPTLSMode"], settings["SMTPCABundle"], settings["SMTPClientCert"], settings["SMTPClientKey"])
+	if err != nil {
+		log.Printf("[ERROR]: could not read the SMTP TLS settings, reason: %v", err)
+		return err
+	}
+	return nil
+}
+
+// GenerateSMTPOAuth2Config reads the optional OAuth2 client credentials used by XOAUTH2 relays from the Notifications section
+func (w *Worker) GenerateSMTPOAuth2Config(cfg *ini.File) error {
+	var err error
+
+	settings := map[string]string{}
+	for _, name := range []string{"SMTPOAuth2TokenURL", "SMTPOAuth2ClientID", "SMTPOAuth2ClientSecret", "SMTPOAuth2Scopes"} {
+		key, err := cfg.Section("Notifications").GetKey(name)
+		if err == nil {
+			settings[name] = key.String()
+		}
+	}
+
+	w.SMTPOAuth2, err = notifications.LoadSMTPOAuth2(settings["SMTPOAuth2TokenURL"], settings["SMTPOAuth2ClientID"], settings["SMTPOAuth2ClientSecret"], settings["SMTPOAuth2Scopes"])
+	if err != nil {
+		log.Printf("[ERROR]: could not read the SMTP OAuth2 settings, reason: %v", err)
+		return err
+	}
+	return nil
+}
+
+// GenerateNotificationTemplatesConfig reads the optional templates directory and default locale from the Notifications section
+func (w *Worker) GenerateNotificationTemplatesConfig(cfg *ini.File) {
+	key, err := cfg.Section("Notifications").GetKey("TemplatesDir")
+	if err == nil {
+		w.TemplatesDir = key.String()
+	}
+
+	key, err = cfg.Section("Notifications").GetKey("DefaultLocale")
+	if err == nil {
+		w.DefaultLocale = key.String()
+	}
+}
+
+// GenerateNotificationSigningConfig reads the optional DKIM keys directory and S/MIME certificate from the Notifications section
+func (w *Worker) GenerateNotificationSigningConfig(cfg *ini.File) error {
+	var err error
+
+	settings := map[string]string{}
+	for _, name := range []string{"DKIMKeysDir", "SMIMECert", "SMIMEKey"} {
+		key, err := cfg.Section("Notifications").GetKey(name)
+		if err == nil {
+			settings[name] = key.String()
+		}
+	}
+
+	w.NotificationSigning, err = notifications.LoadSigningOptions(settings["DKIMKeysDir"], settings["SMIMECert"], settings["SMIMEKey"])
+	if err != nil {
+		log.Printf("[ERROR]: could not read the notification signing settings, reason: %v", err)
+		return err
+	}
 	return nil
 }
 
@@ -110,6 +198,184 @@ func (w *Worker) GenerateCertManagerWorkerConfig() error {
 	}
 	w.OCSPResponders = ocspServers
 
+	// CRL settings are optional
+	key, err = cfg.Section("Certificates").GetKey("CRLPath")
+	if err == nil {
+		w.CRLPath = key.String()
+	}
+
+	key, err = cfg.Section("Certificates").GetKey("CRLUrls")
+	if err == nil {
+		crlURLs := []string{}
+		for _, crl := range strings.Split(key.String(), ",") {
+			if strings.TrimSpace(crl) != "" {
+				crlURLs = append(crlURLs, strings.TrimSpace(crl))
+			}
+		}
+		w.CRLDistributionPoints = crlURLs
+	}
+
+	key, err = cfg.Section("Certificates").GetKey("CRLFrequencyInMinutes")
+	if err == nil {
+		minutes, err := key.Int()
+		if err != nil {
+			log.Println("[ERROR]: could not parse CRL frequency")
+			return err
+		}
+		w.CRLFrequency = time.Duration(minutes) * time.Minute
+	}
+
+	// Legacy agent enrollment generates the agent's private key here. It's deprecated but
+	// stays on until it's disabled, so the agents that don't send a CSR yet aren't denied
+	w.LegacyAgentEnrollment = true
+	key, err = cfg.Section("Certificates").GetKey("LegacyAgentEnrollment")
+	if err == nil {
+		w.LegacyAgentEnrollment, err = key.Bool()
+		if err != nil {
+			log.Println("[ERROR]: could not parse LegacyAgentEnrollment setting")
+			return err
+		}
+	}
+
+	// Key algorithm for issued certificates, RSA 4096 is used if not set
+	key, err = cfg.Section("Certificates").GetKey("UserKeyAlgorithm")
+	if err == nil {
+		w.UserKeySpec, err = ParseKeySpec(key.String())
+		if err != nil {
+			log.Printf("[ERROR]: could not parse UserKeyAlgorithm setting, reason: %v", err)
+			return err
+		}
+	}
+
+	key, err = cfg.Section("Certificates").GetKey("AgentKeyAlgorithm")
+	if err == nil {
+		w.AgentKeySpec, err = ParseKeySpec(key.String())
+		if err != nil {
+			log.Printf("[ERROR]: could not parse AgentKeyAlgorithm setting, reason: %v", err)
+			return err
+		}
+	}
+
+	key, err = cfg.Section("Certificates").GetKey("MaxConcurrentIssuance")
+	if err == nil {
+		w.MaxConcurrentIssuance, err = key.Int()
+		if err != nil {
+			log.Println("[ERROR]: could not parse MaxConcurrentIssuance setting")
+			return err
+		}
+	}
+
+	key, err = cfg.Section("Certificates").GetKey("AgentRenewalWindowInDays")
+	if err == nil {
+		days, err := key.Int()
+		if err != nil {
+			log.Println("[ERROR]: could not parse AgentRenewalWindowInDays setting")
+			return err
+		}
+		w.AgentRenewalWindow = RenewalWindow(days)
+	}
+
+	// Users are reminded of their certificate expiry unless disabled
+	w.UserExpiryReminders = true
+	key, err = cfg.Section("Certificates").GetKey("UserExpiryReminders")
+	if err == nil {
+		w.UserExpiryReminders, err = key.Bool()
+		if err != nil {
+			log.Println("[ERROR]: could not parse UserExpiryReminders setting")
+			return err
+		}
+	}
+
+	w.UserAutoRenewal = false
+	key, err = cfg.Section("Certificates").GetKey("UserCertificateAutoRenewal")
+	if err == nil {
+		w.UserAutoRenewal, err = key.Bool()
+		if err != nil {
+			log.Println("[ERROR]: could not parse UserCertificateAutoRenewal setting")
+			return err
+		}
+	}
+
+	// User certificates can be emailed as an attachment (default) or as a one-time download link
+	w.UserCertificateDelivery = UserCertificateDeliveryAttachment
+	key, err = cfg.Section("Certificates").GetKey("UserCertificateDelivery")
+	if err == nil {
+		switch key.String() {
+		case UserCertificateDeliveryAttachment, UserCertificateDeliveryDownload:
+			w.UserCertificateDelivery = key.String()
+		default:
+			log.Printf("[ERROR]: UserCertificateDelivery must be %s or %s", UserCertificateDeliveryAttachment, UserCertificateDeliveryDownload)
+			return fmt.Errorf("invalid UserCertificateDelivery setting %s", key.String())
+		}
+	}
+
+	w.UserCertificateDownloadTTL = DefaultUserCertificateDownloadTTL
+	key, err = cfg.Section("Certificates").GetKey("UserCertificateDownloadTTLInHours")
+	if err == nil {
+		hours, err := key.Int()
+		if err != nil {
+			log.Println("[ERROR]: could not parse UserCertificateDownloadTTLInHours setting")
+			return err
+		}
+		w.UserCertificateDownloadTTL = time.Duration(hours) * time.Hour
+	}
+
+	key, err = cfg.Section("Certificates").GetKey("ConsoleURL")
+	if err == nil {
+		w.ConsoleURL = key.String()
+	}
+
+	// The ACME server is optional, it's only started if an address is set
+	key, err = cfg.Section("Certificates").GetKey("ACMEAddress")
+	if err == nil {
+		w.ACMEAddress = key.String()
+	}
+
+	key, err = cfg.Section("Certificates").GetKey("ACMEURL")
+	if err == nil {
+		w.ACMEURL = key.String()
+	}
+
+	key, err = cfg.Section("Certificates").GetKey("ACMETLSCert")
+	if err == nil {
+		w.ACMETLSCertPath = key.String()
+	}
+
+	key, err = cfg.Section("Certificates").GetKey("ACMETLSKey")
+	if err == nil {
+		w.ACMETLSKeyPath = key.String()
+	}
+
+	key, err = cfg.Section("Certificates").GetKey("ACMEDNSSuffixes")
+	if err == nil {
+		acmeSuffixes := []string{}
+		for _, suffix := range strings.Split(key.String(), ",") {
+			if strings.TrimSpace(suffix) != "" {
+				acmeSuffixes = append(acmeSuffixes, strings.TrimSpace(suffix))
+			}
+		}
+		w.ACMEDNSSuffixes = acmeSuffixes
+	}
+
+	key, err = cfg.Section("Certificates").GetKey("ACMEValidityInDays")
+	if err == nil {
+		days, err := key.Int()
+		if err != nil {
+			log.Println("[ERROR]: could not parse ACMEValidityInDays setting")
+			return err
+		}
+		w.ACMEValidity = time.Duration(days) * 24 * time.Hour
+	}
+
+	key, err = cfg.Section("Certificates").GetKey("ACMEHTTP01Port")
+	if err == nil {
+		w.ACMEHTTP01Port, err = key.Int()
+		if err != nil {
+			log.Println("[ERROR]: could not parse ACMEHTTP01Port setting")
+			return err
+		}
+	}
+
 	// read required certificates and private keys
 	w.CACert, err = utils.ReadPEMCertificate(w.CACertPath)
 	if err != nil {
@@ -117,12 +383,28 @@ func (w *Worker) GenerateCertManagerWorkerConfig() error {
 		return err
 	}
 
-	w.CAPrivateKey, err = utils.ReadPEMPrivateKey(w.CAKeyPath)
+	key, err = cfg.Section("Certificates").GetKey("CAKeyPassphraseFile")
+	if err == nil {
+		w.CAKeyPassphraseFile = key.String()
+	}
+
+	w.CAPrivateKey, err = ReadEncryptedPEMSigner(w.CAKeyPath, CAKeyPassphrase(w.CAKeyPassphraseFile, false))
 	if err != nil {
 		log.Println("[ERROR]: could not read CA private key file")
 		return err
 	}
 
+	caChainPath := ""
+	key, err = cfg.Section("Certificates").GetKey("CAChain")
+	if err == nil {
+		caChainPath = key.String()
+	}
+
+	if err := w.LoadCAChain(caChainPath); err != nil {
+		log.Printf("[ERROR]: could not load the CA chain: %v", err)
+		return err
+	}
+
 	return nil
 }
 
@@ -0,0 +1,192 @@
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	DefaultCRLFrequency = 60 * time.Minute
+
+	// CRLBucket is the object store that keeps the latest CRL for the services that
+	// start after it was published, CRLObject is the name of the CRL in DER format
+	CRLBucket = "SCNORION_CRL"
+	CRLObject = "ca.crl"
+
+	crlStoreTimeout = time.Minute
+)
+
+func (w *Worker) StartCRLJob() error {
+	var err error
+
+	if w.CRLJob != nil {
+		return nil
+	}
+
+	if w.CRLFrequency == 0 {
+		w.CRLFrequency = DefaultCRLFrequency
+	}
+
+	// Generate a first CRL as soon as the worker is ready
+	if err := w.GenerateCRL(); err != nil {
+		log.Printf("[ERROR]: could not generate the CRL, reason: %v", err)
+	}
+
+	w.CRLJob, err = w.TaskScheduler.NewJob(
+		gocron.DurationJob(
+			w.CRLFrequency,
+		),
+		gocron.NewTask(
+			func() {
+				if err := w.GenerateCRL(); err != nil {
+					log.Printf("[ERROR]: could not generate the CRL, reason: %v", err)
+				}
+			},
+		),
+	)
+	if err != nil {
+		log.Printf("[ERROR]: could not start the CRL job: %v", err)
+		return err
+	}
+	log.Printf("[INFO]: new CRL job has been scheduled every %s", w.CRLFrequency)
+	return nil
+}
+
+func (w *Worker) GenerateCRL() error {
+	w.crlMutex.Lock()
+	defer w.crlMutex.Unlock()
+
+	if w.CACert == nil || w.CAPrivateKey == nil {
+		return errors.New("CA certificate and private key are required to sign the CRL")
+	}
+
+	if w.Model == nil {
+		return errors.New("no connection with database")
+	}
+
+	revocations, err := w.Model.GetUnexpiredRevocations()
+	if err != nil {
+		return err
+	}
+
+	shortSerials := []int64{}
+	for _, r := range revocations {
+		shortSerials = append(shortSerials, r.ID)
+	}
+
+	serials, err := w.Model.GetFullSerials(shortSerials)
+	if err != nil {
+		return err
+	}
+
+	entries := []x509.RevocationListEntry{}
+	for _, r := range revocations {
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   serials[r.ID],
+			RevocationTime: r.Revoked.UTC(),
+			ReasonCode:     r.Reason,
+		})
+	}
+
+	number, err := w.nextCRLNumber()
+	if err != nil {
+		return fmt.Errorf("could not get the CRL number: %v", err)
+	}
+
+	now := time.Now().UTC()
+	template := x509.RevocationList{
+		RevokedCertificateEntries: entries,
+		Number:                    number,
+		ThisUpdate:                now,
+		// Leave room for a missed run before relying parties consider the CRL stale
+		NextUpdate: now.Add(2 * w.CRLFrequency),
+	}
+
+	crlBytes, err := x509.CreateRevocationList(rand.Reader, &template, w.CACert, w.CAPrivateKey)
+	if err != nil {
+		return err
+	}
+	w.CRLNumber = template.Number
+
+	if w.CRLPath != "" {
+		crlPEM := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlBytes})
+		if err := os.WriteFile(w.CRLPath, crlPEM, 0644); err != nil {
+			return err
+		}
+	}
+
+	if w.Jetstream != nil {
+		if err := w.storeCRL(crlBytes); err != nil {
+			return err
+		}
+	}
+
+	// Services already running are told right away, the others read the object store
+	if w.NATSConnection != nil && w.NATSConnection.IsConnected() {
+		if err := w.NATSConnection.Publish("certificates.crl", crlBytes); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("[INFO]: CRL number %s has been generated with %d revoked certificates", template.Number.String(), len(entries))
+	return nil
+}
+
+// storeCRL replaces the CRL kept in the object store
+func (w *Worker) storeCRL(crlBytes []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), crlStoreTimeout)
+	defer cancel()
+
+	replicas := w.Replicas
+	if replicas < 1 {
+		replicas = 1
+	}
+
+	store, err := w.Jetstream.CreateOrUpdateObjectStore(ctx, jetstream.ObjectStoreConfig{
+		Bucket:      CRLBucket,
+		Description: "CRL signed by the scnorion CA",
+		Replicas:    replicas,
+	})
+	if err != nil {
+		return fmt.Errorf("could not open the %s object store: %v", CRLBucket, err)
+	}
+
+	if _, err := store.PutBytes(ctx, CRLObject, crlBytes); err != nil {
+		return fmt.Errorf("could not store the CRL: %v", err)
+	}
+	return nil
+}
+
+// nextCRLNumber gets the number from the database so it keeps increasing whatever
+// replica signs the CRL. The CRL written to disk before the numbers were stored
+// is used as the lowest number
+func (w *Worker) nextCRLNumber() (*big.Int, error) {
+	floor := int64(1)
+	if w.CRLPath != "" {
+		if data, err := os.ReadFile(w.CRLPath); err == nil {
+			if block, _ := pem.Decode(data); block != nil {
+				data = block.Bytes
+			}
+			if crl, err := x509.ParseRevocationList(data); err == nil && crl.Number != nil && crl.Number.IsInt64() {
+				floor = crl.Number.Int64() + 1
+			}
+		}
+	}
+
+	number, err := w.Model.NextCRLNumber(floor)
+	if err != nil {
+		return nil, err
+	}
+	return big.NewInt(number), nil
+}
@@ -0,0 +1,286 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Work queues are kept in JetStream so a failed issuance or a failed SMTP send
+// is retried instead of lost. Request/reply subjects like certificates.revoke or
+// certificates.download stay on core NATS as a stream would answer the requester
+// with its publish ack
+
+const (
+	CertificatesStream  = "SCNORION_CERTIFICATES"
+	NotificationsStream = "SCNORION_NOTIFICATIONS"
+	DeadLetterStream    = "SCNORION_DEAD_LETTER"
+
+	// DeadLetterSubjectPrefix is prepended to the original subject of the messages that ran out of deliveries
+	DeadLetterSubjectPrefix = "deadletter."
+
+	// jetstreamMaxDeliveriesAdvisory is followed by the stream and the consumer, the server
+	// publishes there the messages whose last delivery was not acknowledged
+	jetstreamMaxDeliveriesAdvisory = "$JS.EVENT.ADVISORY.CONSUMER.MAX_DELIVERIES."
+
+	jetstreamWorkQueueMaxAge  = 7 * 24 * time.Hour
+	jetstreamDeadLetterMaxAge = 30 * 24 * time.Hour
+)
+
+// jetstreamBackOff is the delay before each redelivery, used both for the
+// messages that are not acknowledged in time and for the ones the handlers reject
+var jetstreamBackOff = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute, 30 * time.Minute, time.Hour}
+
+// jetstreamMaxDeliver is the number of attempts before a message goes to the dead-letter subject
+var jetstreamMaxDeliver = len(jetstreamBackOff) + 1
+
+// JetStreamConsumer is a durable pull consumer that calls Handler for every message in Subject
+type JetStreamConsumer struct {
+	Durable string
+	Subject string
+	Handler jetstream.MessageHandler
+	// MaxMessages limits the messages pulled before they're handled, the default
+	// buffer is far larger than what a handler that blocks can take in its ack wait
+	MaxMessages int
+}
+
+// StartJetStream creates the streams, missing ones are created and existing ones updated
+func (w *Worker) StartJetStream(stream string, subjects []string) error {
+	var err error
+	var ctx context.Context
+
+	if w.Jetstream == nil {
+		w.Jetstream, err = jetstream.New(w.NATSConnection)
+		if err != nil {
+			log.Printf("[ERROR]: could not create the JetStream context, reason: %v", err)
+			return err
+		}
+	}
+
+	if w.JetstreamContextCancel != nil {
+		w.JetstreamContextCancel()
+	}
+	ctx, w.JetstreamContextCancel = context.WithCancel(context.Background())
+
+	replicas := w.Replicas
+	if replicas < 1 {
+		replicas = 1
+	}
+
+	if _, err := w.Jetstream.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:      stream,
+		Subjects:  subjects,
+		Retention: jetstream.WorkQueuePolicy,
+		MaxAge:    jetstreamWorkQueueMaxAge,
+		Replicas:  replicas,
+	}); err != nil {
+		log.Printf("[ERROR]: could not create the %s stream, reason: %v", stream, err)
+		return err
+	}
+	log.Printf("[INFO]: stream %s is ready", stream)
+
+	if _, err := w.Jetstream.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:      DeadLetterStream,
+		Subjects:  []string{DeadLetterSubjectPrefix + ">"},
+		Retention: jetstream.LimitsPolicy,
+		MaxAge:    jetstreamDeadLetterMaxAge,
+		Replicas:  replicas,
+	}); err != nil {
+		log.Printf("[ERROR]: could not create the %s stream, reason: %v", DeadLetterStream, err)
+		return err
+	}
+
+	return nil
+}
+
+// ConsumeJetStream attaches the handlers to durable consumers of the stream, every
+// worker sharing a durable name gets a different subset of the messages like a queue group
+func (w *Worker) ConsumeJetStream(stream string, consumers []JetStreamConsumer) error {
+	ctx := context.Background()
+
+	// The subscription is retried until it succeeds, don't consume twice
+	w.StopJetStreamConsumers()
+
+	for _, c := range consumers {
+		consumer, err := w.Jetstream.CreateOrUpdateConsumer(ctx, stream, jetstream.ConsumerConfig{
+			Durable:       c.Durable,
+			FilterSubject: c.Subject,
+			AckPolicy:     jetstream.AckExplicitPolicy,
+			MaxDeliver:    jetstreamMaxDeliver,
+			BackOff:       jetstreamBackOff,
+		})
+		if err != nil {
+			log.Printf("[ERROR]: could not create the %s consumer, reason: %v", c.Durable, err)
+			return err
+		}
+
+		opts := []jetstream.PullConsumeOpt{}
+		if c.MaxMessages > 0 {
+			opts = append(opts, jetstream.PullMaxMessages(c.MaxMessages))
+		}
+
+		handler := c.Handler
+		consumeContext, err := consumer.Consume(func(msg jetstream.Msg) {
+			handler(&retryMsg{Msg: msg, w: w})
+		}, opts...)
+		if err != nil {
+			log.Printf("[ERROR]: could not consume messages from %s, reason: %v", c.Subject, err)
+			return err
+		}
+		w.consumeContexts = append(w.consumeContexts, consumeContext)
+		log.Printf("[INFO]: consuming %s with durable consumer %s", c.Subject, c.Durable)
+
+		// A handler that never answers its last delivery, because it hung or the worker
+		// stopped, doesn't reach retryMsg.Nak, the server only announces the message ran out of deliveries
+		advisory, err := w.NATSConnection.QueueSubscribe(jetstreamMaxDeliveriesAdvisory+stream+"."+c.Durable, "scnorion-dead-letter", w.MaxDeliveriesHandler)
+		if err != nil {
+			log.Printf("[ERROR]: could not subscribe to the max deliveries advisories of %s, reason: %v", c.Durable, err)
+			return err
+		}
+		w.advisorySubscriptions = append(w.advisorySubscriptions, advisory)
+	}
+
+	return nil
+}
+
+// StopJetStreamConsumers stops pulling messages, the ones not acknowledged yet will be redelivered
+func (w *Worker) StopJetStreamConsumers() {
+	for _, c := range w.consumeContexts {
+		c.Stop()
+	}
+	w.consumeContexts = nil
+
+	for _, s := range w.advisorySubscriptions {
+		if err := s.Unsubscribe(); err != nil && !errors.Is(err, nats.ErrConnectionClosed) && !errors.Is(err, nats.ErrBadSubscription) {
+			log.Printf("[ERROR]: could not unsubscribe from %s, reason: %v", s.Subject, err)
+		}
+	}
+	w.advisorySubscriptions = nil
+}
+
+// jetStreamMessageID is the publisher's Nats-Msg-Id if set, or the stream sequence,
+// so a redelivered message is recognized by the handler
+func jetStreamMessageID(msg jetstream.Msg) (string, error) {
+	if id := msg.Headers().Get(nats.MsgIdHdr); id != "" {
+		return id, nil
+	}
+
+	meta, err := msg.Metadata()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%d", meta.Stream, meta.Sequence.Stream), nil
+}
+
+// retryMsg redelivers the messages the handlers reject with Nak following the
+// backoff schedule, and moves the message to the dead-letter subject when it
+// was its last delivery so it's not silently dropped by the server
+type retryMsg struct {
+	jetstream.Msg
+	w *Worker
+}
+
+func (m *retryMsg) Nak() error {
+	meta, err := m.Metadata()
+	if err != nil {
+		return m.Msg.Nak()
+	}
+
+	if meta.NumDelivered >= uint64(jetstreamMaxDeliver) {
+		if err := m.w.PublishDeadLetter(m.Msg, meta); err != nil {
+			log.Printf("[ERROR]: could not move message from %s to the dead-letter subject, reason: %v", m.Subject(), err)
+			return m.Msg.Nak()
+		}
+		return m.Term()
+	}
+
+	delay := jetstreamBackOff[len(jetstreamBackOff)-1]
+	if int(meta.NumDelivered) <= len(jetstreamBackOff) {
+		delay = jetstreamBackOff[meta.NumDelivered-1]
+	}
+	return m.Msg.NakWithDelay(delay)
+}
+
+func (m *retryMsg) NakWithDelay(time.Duration) error {
+	return m.Nak()
+}
+
+// PublishDeadLetter stores a copy of the message in the dead-letter stream with where it came from in the headers
+func (w *Worker) PublishDeadLetter(msg jetstream.Msg, meta *jetstream.MsgMetadata) error {
+	return w.publishDeadLetter(msg.Subject(), msg.Data(), msg.Headers(), meta.Stream, meta.Consumer, meta.Sequence.Stream, meta.NumDelivered)
+}
+
+func (w *Worker) publishDeadLetter(subject string, data []byte, headers nats.Header, stream, consumer string, sequence, deliveries uint64) error {
+	deadLetter := nats.NewMsg(DeadLetterSubjectPrefix + subject)
+	deadLetter.Data = data
+	for k, v := range headers {
+		deadLetter.Header[k] = v
+	}
+	deadLetter.Header.Set("Scnorion-Original-Subject", subject)
+	deadLetter.Header.Set("Scnorion-Stream", stream)
+	deadLetter.Header.Set("Scnorion-Consumer", consumer)
+	deadLetter.Header.Set("Scnorion-Stream-Sequence", strconv.FormatUint(sequence, 10))
+	deadLetter.Header.Set("Scnorion-Deliveries", strconv.FormatUint(deliveries, 10))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := w.Jetstream.PublishMsg(ctx, deadLetter); err != nil {
+		return err
+	}
+
+	log.Printf("[ERROR]: message %d from %s has been moved to %s after %d deliveries", sequence, subject, deadLetter.Subject, deliveries)
+	return nil
+}
+
+// maxDeliveriesAdvisory is the part of the io.nats.jetstream.advisory.v1.max_deliver advisory the worker uses
+type maxDeliveriesAdvisory struct {
+	Stream     string `json:"stream"`
+	Consumer   string `json:"consumer"`
+	StreamSeq  uint64 `json:"stream_seq"`
+	Deliveries uint64 `json:"deliveries"`
+}
+
+// MaxDeliveriesHandler moves a message that ran out of deliveries to the dead-letter subject,
+// the server keeps it in the work queue but no consumer will get it again
+func (w *Worker) MaxDeliveriesHandler(msg *nats.Msg) {
+	advisory := maxDeliveriesAdvisory{}
+	if err := json.Unmarshal(msg.Data, &advisory); err != nil {
+		log.Printf("[ERROR]: could not unmarshall max deliveries advisory, reason: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := w.Jetstream.Stream(ctx, advisory.Stream)
+	if err != nil {
+		log.Printf("[ERROR]: could not get the %s stream, reason: %v", advisory.Stream, err)
+		return
+	}
+
+	m, err := stream.GetMsg(ctx, advisory.StreamSeq)
+	if err != nil {
+		if errors.Is(err, jetstream.ErrMsgNotFound) {
+			// The handler acknowledged it late or it has already been moved
+			return
+		}
+		log.Printf("[ERROR]: could not get message %d from %s, reason: %v", advisory.StreamSeq, advisory.Stream, err)
+		return
+	}
+
+	if err := w.publishDeadLetter(m.Subject, m.Data, m.Header, advisory.Stream, advisory.Consumer, advisory.StreamSeq, advisory.Deliveries); err != nil {
+		log.Printf("[ERROR]: could not move message %d from %s to the dead-letter subject, reason: %v", advisory.StreamSeq, m.Subject, err)
+		return
+	}
+
+	if err := stream.DeleteMsg(ctx, advisory.StreamSeq); err != nil && !errors.Is(err, jetstream.ErrMsgNotFound) {
+		log.Printf("[ERROR]: could not delete message %d from %s, reason: %v", advisory.StreamSeq, advisory.Stream, err)
+	}
+}
@@ -0,0 +1,166 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// newTestJetStream connects the worker to an embedded server with JetStream, the
+// redeliveries are shortened so a message runs out of them in a second
+func newTestJetStream(t *testing.T) *Worker {
+	t.Helper()
+
+	backOff, maxDeliver := jetstreamBackOff, jetstreamMaxDeliver
+	jetstreamBackOff = []time.Duration{200 * time.Millisecond, 200 * time.Millisecond}
+	jetstreamMaxDeliver = len(jetstreamBackOff) + 1
+	t.Cleanup(func() {
+		jetstreamBackOff, jetstreamMaxDeliver = backOff, maxDeliver
+	})
+
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.Start()
+	t.Cleanup(ns.Shutdown)
+	if !ns.ReadyForConnections(10 * time.Second) {
+		t.Fatal("the NATS server is not ready")
+	}
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+
+	w := newTestWorker(t)
+	w.NATSConnection = nc
+	t.Cleanup(w.StopJetStreamConsumers)
+	return w
+}
+
+// waitDeadLetter returns the first message in the dead-letter stream
+func waitDeadLetter(t *testing.T, w *Worker) *jetstream.RawStreamMsg {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := w.Jetstream.Stream(ctx, DeadLetterStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		msg, err := stream.GetMsg(ctx, 1)
+		if err == nil {
+			return msg
+		}
+		if !errors.Is(err, jetstream.ErrMsgNotFound) {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatal("no message has been moved to the dead-letter stream")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func TestDeadLetterAfterAckWait(t *testing.T) {
+	w := newTestJetStream(t)
+
+	if err := w.StartJetStream(CertificatesStream, []string{"certificates.user"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The handler never answers, as when it hangs, so only the server knows the message ran out of deliveries
+	deliveries := make(chan struct{}, 10)
+	if err := w.ConsumeJetStream(CertificatesStream, []JetStreamConsumer{
+		{Durable: "test", Subject: "certificates.user", Handler: func(msg jetstream.Msg) { deliveries <- struct{}{} }},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.Jetstream.Publish(context.Background(), "certificates.user", []byte("request")); err != nil {
+		t.Fatal(err)
+	}
+
+	deadLetter := waitDeadLetter(t, w)
+	if deadLetter.Subject != DeadLetterSubjectPrefix+"certificates.user" || string(deadLetter.Data) != "request" {
+		t.Errorf("got dead letter %s %q", deadLetter.Subject, deadLetter.Data)
+	}
+	if got := deadLetter.Header.Get("Scnorion-Consumer"); got != "test" {
+		t.Errorf("got consumer %q in the dead letter", got)
+	}
+	if got := deadLetter.Header.Get("Scnorion-Deliveries"); got != "3" {
+		t.Errorf("got %s deliveries in the dead letter, want 3", got)
+	}
+	if len(deliveries) != jetstreamMaxDeliver {
+		t.Errorf("the message has been delivered %d times, want %d", len(deliveries), jetstreamMaxDeliver)
+	}
+
+	// The work queue must not keep the message nobody will get again
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := w.Jetstream.Stream(ctx, CertificatesStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.GetMsg(ctx, 1); !errors.Is(err, jetstream.ErrMsgNotFound) {
+		t.Errorf("got %v for the message in the work queue, want it deleted", err)
+	}
+}
+
+func TestDeadLetterAfterNak(t *testing.T) {
+	w := newTestJetStream(t)
+
+	if err := w.StartJetStream(CertificatesStream, []string{"certificates.user"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.ConsumeJetStream(CertificatesStream, []JetStreamConsumer{
+		{Durable: "test", Subject: "certificates.user", Handler: func(msg jetstream.Msg) { msg.Nak() }},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.Jetstream.Publish(context.Background(), "certificates.user", []byte("request")); err != nil {
+		t.Fatal(err)
+	}
+
+	deadLetter := waitDeadLetter(t, w)
+	if got := deadLetter.Header.Get("Scnorion-Deliveries"); got != "3" {
+		t.Errorf("got %s deliveries in the dead letter, want 3", got)
+	}
+
+	// The last delivery is terminated, the advisory must not move the message again
+	time.Sleep(time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := w.Jetstream.Stream(ctx, DeadLetterStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := stream.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State.Msgs != 1 {
+		t.Errorf("got %d dead letters, want 1", info.State.Msgs)
+	}
+}
@@ -0,0 +1,217 @@
+package common
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	KeyAlgorithmRSA     = "rsa"
+	KeyAlgorithmECDSA   = "ecdsa"
+	KeyAlgorithmEd25519 = "ed25519"
+)
+
+// KeySpec describes the private key generated for an issued certificate,
+// Size is the modulus length for RSA and the curve size for ECDSA
+type KeySpec struct {
+	Algorithm string
+	Size      int
+}
+
+var DefaultKeySpec = KeySpec{Algorithm: KeyAlgorithmRSA, Size: 4096}
+
+// ParseKeySpec reads values like rsa-4096, ecdsa-p256 or ed25519
+func ParseKeySpec(value string) (KeySpec, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		return DefaultKeySpec, nil
+	}
+
+	algorithm, size, _ := strings.Cut(value, "-")
+	switch algorithm {
+	case KeyAlgorithmRSA:
+		if size == "" {
+			return KeySpec{Algorithm: KeyAlgorithmRSA, Size: DefaultKeySpec.Size}, nil
+		}
+		bits, err := strconv.Atoi(size)
+		if err != nil || (bits != 2048 && bits != 3072 && bits != 4096) {
+			return KeySpec{}, fmt.Errorf("unsupported RSA key size %s, use 2048, 3072 or 4096", size)
+		}
+		return KeySpec{Algorithm: KeyAlgorithmRSA, Size: bits}, nil
+	case KeyAlgorithmECDSA:
+		if size == "" {
+			return KeySpec{Algorithm: KeyAlgorithmECDSA, Size: 256}, nil
+		}
+		bits, err := strconv.Atoi(strings.TrimPrefix(size, "p"))
+		if err != nil || (bits != 256 && bits != 384 && bits != 521) {
+			return KeySpec{}, fmt.Errorf("unsupported ECDSA curve %s, use p256, p384 or p521", size)
+		}
+		return KeySpec{Algorithm: KeyAlgorithmECDSA, Size: bits}, nil
+	case KeyAlgorithmEd25519:
+		return KeySpec{Algorithm: KeyAlgorithmEd25519}, nil
+	default:
+		return KeySpec{}, fmt.Errorf("unsupported key algorithm %s, use rsa, ecdsa or ed25519", algorithm)
+	}
+}
+
+func (k KeySpec) String() string {
+	switch k.Algorithm {
+	case KeyAlgorithmRSA:
+		return fmt.Sprintf("rsa-%d", k.Size)
+	case KeyAlgorithmECDSA:
+		return fmt.Sprintf("ecdsa-p%d", k.Size)
+	default:
+		return k.Algorithm
+	}
+}
+
+func (k KeySpec) OrDefault() KeySpec {
+	if k.Algorithm == "" {
+		return DefaultKeySpec
+	}
+	return k
+}
+
+func GenerateKey(spec KeySpec) (crypto.Signer, error) {
+	switch spec.Algorithm {
+	case KeyAlgorithmRSA:
+		return rsa.GenerateKey(rand.Reader, spec.Size)
+	case KeyAlgorithmECDSA:
+		var curve elliptic.Curve
+		switch spec.Size {
+		case 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported ECDSA curve size %d", spec.Size)
+		}
+		return ecdsa.GenerateKey(curve, rand.Reader)
+	case KeyAlgorithmEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, fmt.Errorf("unsupported key algorithm %s", spec.Algorithm)
+	}
+}
+
+// ReadPEMSigner loads a private key stored as PKCS#1, PKCS#8 or SEC1 PEM
+func ReadPEMSigner(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePEMSigner(data)
+}
+
+// ReadEncryptedPEMSigner also accepts encrypted PKCS#8 keys, the passphrase
+// is only requested if the key is encrypted
+func ReadEncryptedPEMSigner(path string, passphrase PassphraseFunc) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeBytes(data)
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "ENCRYPTED PRIVATE KEY" {
+		return ParsePEMSigner(data)
+	}
+
+	secret, err := passphrase()
+	if err != nil {
+		return nil, err
+	}
+	defer wipeBytes(secret)
+
+	der, err := DecryptPKCS8PrivateKey(block.Bytes, secret)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeBytes(der)
+
+	return parsePKCS8Signer(der)
+}
+
+func ParsePEMSigner(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Bytes == nil {
+		return nil, errors.New("file does not content a private key")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		return parsePKCS8Signer(block.Bytes)
+	case "ENCRYPTED PRIVATE KEY":
+		return nil, errors.New("the private key is encrypted, a passphrase is required")
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %s", block.Type)
+	}
+}
+
+func parsePKCS8Signer(der []byte) (crypto.Signer, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// WipeSigner zeroes the secret values held in the fields of a private key. It's not an
+// erase: since Go 1.24 RSA keys also keep a precomputed copy in the FIPS module that
+// can't be reached from here, and the garbage collector may have left other copies.
+// It only keeps the fields from being read after the key is no longer used
+func WipeSigner(key crypto.Signer) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		wipeBigInt(k.D)
+		for _, p := range k.Primes {
+			wipeBigInt(p)
+		}
+		wipeBigInt(k.Precomputed.Dp)
+		wipeBigInt(k.Precomputed.Dq)
+		wipeBigInt(k.Precomputed.Qinv)
+	case *ecdsa.PrivateKey:
+		wipeBigInt(k.D)
+	case ed25519.PrivateKey:
+		wipeBytes(k)
+	}
+}
+
+func wipeBigInt(n *big.Int) {
+	if n == nil {
+		return
+	}
+	clear(n.Bits())
+	n.SetInt64(0)
+}
+
+// MarshalPrivateKey keeps PKCS#1 for RSA keys so existing agents can read them, other keys use PKCS#8
+func MarshalPrivateKey(key crypto.Signer) ([]byte, error) {
+	if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+		return x509.MarshalPKCS1PrivateKey(rsaKey), nil
+	}
+	return x509.MarshalPKCS8PrivateKey(key)
+}
@@ -0,0 +1,79 @@
+package common
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// TestKeySpecPKCS12 checks the keys of every supported algorithm can be delivered in a pfx
+func TestKeySpecPKCS12(t *testing.T) {
+	w := newTestWorker(t)
+
+	for _, value := range []string{"rsa-2048", "ecdsa-p256", "ecdsa-p384", "ed25519"} {
+		t.Run(value, func(t *testing.T) {
+			spec, err := ParseKeySpec(value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if spec.String() != value {
+				t.Errorf("got key spec %s", spec)
+			}
+
+			key, err := GenerateKey(spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			template := &x509.Certificate{
+				SerialNumber: big.NewInt(1),
+				Subject:      pkix.Name{CommonName: "user"},
+				NotBefore:    time.Now().Add(-5 * time.Minute),
+				NotAfter:     time.Now().Add(time.Hour),
+				KeyUsage:     x509.KeyUsageDigitalSignature,
+				ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			}
+			der, err := x509.CreateCertificate(rand.Reader, template, w.CACert, key.Public(), w.CAPrivateKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pfx, err := pkcs12.Modern.Encode(key, cert, w.CertificateChain(), testPassphrase)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decodedKey, decodedCert, chain, err := pkcs12.DecodeChain(pfx, testPassphrase)
+			if err != nil {
+				t.Fatal(err)
+			}
+			signer, ok := decodedKey.(crypto.Signer)
+			if !ok {
+				t.Fatalf("got a %T key", decodedKey)
+			}
+			if !signer.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(key.Public()) {
+				t.Error("the pfx has another key")
+			}
+			if !decodedCert.Equal(cert) {
+				t.Error("the pfx has another certificate")
+			}
+			if len(chain) != len(w.CertificateChain()) {
+				t.Errorf("the pfx has %d CA certificates, want %d", len(chain), len(w.CertificateChain()))
+			}
+
+			if _, _, _, err := pkcs12.DecodeChain(pfx, "wrong"); err == nil {
+				t.Error("the pfx has been opened with a wrong password")
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/scncore/scnorion-worker/internal/common/notifications"
+)
+
+const (
+	// NotificationAttachmentsBucket is the object store for attachments too large to travel in a notification
+	NotificationAttachmentsBucket = "SCNORION_ATTACHMENTS"
+
+	// maxEmbeddedAttachmentSize keeps the notification under the default 1MB NATS payload once base64 encoded
+	maxEmbeddedAttachmentSize = 256 * 1024
+
+	notificationAttachmentsTimeout = time.Minute
+)
+
+// NotificationAttachment returns the attachment with its content embedded or, if it's
+// large, stored in the attachments object store. Objects expire with the work queues
+func (w *Worker) NotificationAttachment(filename, contentType string, data []byte) (notifications.Attachment, error) {
+	attachment := notifications.Attachment{Filename: filename, ContentType: contentType}
+
+	if len(data) <= maxEmbeddedAttachmentSize {
+		attachment.Content = base64.StdEncoding.EncodeToString(data)
+		return attachment, nil
+	}
+
+	if w.Jetstream == nil {
+		return attachment, fmt.Errorf("attachment %s is too large to be sent without JetStream", filename)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notificationAttachmentsTimeout)
+	defer cancel()
+
+	replicas := w.Replicas
+	if replicas < 1 {
+		replicas = 1
+	}
+
+	store, err := w.Jetstream.CreateOrUpdateObjectStore(ctx, jetstream.ObjectStoreConfig{
+		Bucket:   NotificationAttachmentsBucket,
+		TTL:      jetstreamWorkQueueMaxAge,
+		Replicas: replicas,
+	})
+	if err != nil {
+		return attachment, fmt.Errorf("could not open the %s object store: %v", NotificationAttachmentsBucket, err)
+	}
+
+	id := make([]byte, 16)
+	// crypto/rand.Read never fails since Go 1.24
+	rand.Read(id)
+	key := hex.EncodeToString(id) + "/" + filename
+
+	if _, err := store.PutBytes(ctx, key, data); err != nil {
+		return attachment, fmt.Errorf("could not store attachment %s: %v", filename, err)
+	}
+
+	attachment.ObjectStore = NotificationAttachmentsBucket
+	attachment.ObjectKey = key
+	return attachment, nil
+}
+
+// StoreOutboxAttachments moves the content of the attachments, the legacy fields too, to the
+// attachments object store so the outbox only keeps references to them. The objects are deleted
+// once every delivery of the message is final or expire with the work queues
+func (w *Worker) StoreOutboxAttachments(messageID string, n *TenantNotification) error {
+	attachments := append(notifications.LegacyAttachments(&n.Notification), n.Attachments...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), notificationAttachmentsTimeout)
+	defer cancel()
+
+	var store jetstream.ObjectStore
+	for i, a := range attachments {
+		if a.ObjectKey != "" || a.Content == "" {
+			continue
+		}
+
+		data, err := a.Data(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		if store == nil {
+			if w.Jetstream == nil {
+				return errors.New("the attachments can't be stored without JetStream")
+			}
+
+			replicas := w.Replicas
+			if replicas < 1 {
+				replicas = 1
+			}
+			store, err = w.Jetstream.CreateOrUpdateObjectStore(ctx, jetstream.ObjectStoreConfig{
+				Bucket:   NotificationAttachmentsBucket,
+				TTL:      jetstreamWorkQueueMaxAge,
+				Replicas: replicas,
+			})
+			if err != nil {
+				return fmt.Errorf("could not open the %s object store: %v", NotificationAttachmentsBucket, err)
+			}
+		}
+
+		// A redelivered message overwrites the objects of its first delivery
+		key := "outbox/" + messageID + "/" + strconv.Itoa(i) + "/" + a.Filename
+		if _, err := store.PutBytes(ctx, key, data); err != nil {
+			return fmt.Errorf("could not store attachment %s: %v", a.Filename, err)
+		}
+
+		attachments[i].Content = ""
+		attachments[i].ObjectStore = NotificationAttachmentsBucket
+		attachments[i].ObjectKey = key
+	}
+
+	n.MessageAttachFileName, n.MessageAttachFile = "", ""
+	n.MessageAttachFileName2, n.MessageAttachFile2 = "", ""
+	n.Attachments = attachments
+	return nil
+}
+
+// DeleteOutboxAttachments removes the attachments of the notification from the object stores
+func (w *Worker) DeleteOutboxAttachments(n *TenantNotification) error {
+	if w.Jetstream == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notificationAttachmentsTimeout)
+	defer cancel()
+
+	for _, a := range n.Attachments {
+		if a.ObjectKey == "" {
+			continue
+		}
+
+		bucket := a.ObjectStore
+		if bucket == "" {
+			bucket = NotificationAttachmentsBucket
+		}
+		store, err := w.Jetstream.ObjectStore(ctx, bucket)
+		if err != nil {
+			return fmt.Errorf("could not open the %s object store: %v", bucket, err)
+		}
+		if err := store.Delete(ctx, a.ObjectKey); err != nil && !errors.Is(err, jetstream.ErrObjectNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// jetstreamObjects reads the notification attachments from the NATS object stores
+type jetstreamObjects struct {
+	js jetstream.JetStream
+}
+
+func (o jetstreamObjects) GetObject(ctx context.Context, bucket, key string) ([]byte, error) {
+	if bucket == "" {
+		bucket = NotificationAttachmentsBucket
+	}
+
+	store, err := o.js.ObjectStore(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("could not open the %s object store: %v", bucket, err)
+	}
+
+	data, err := store.GetBytes(ctx, key)
+	if err != nil {
+		if errors.Is(err, jetstream.ErrObjectNotFound) {
+			// The object expired or was deleted, retrying won't bring it back
+			return nil, &notifications.DeliveryError{Err: fmt.Errorf("attachment %s not found in the %s object store", key, bucket), Permanent: true}
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// notificationObjects returns the object stores reader, nil if JetStream is not available
+func (w *Worker) notificationObjects() notifications.ObjectStore {
+	if w.Jetstream == nil {
+		return nil
+	}
+	return jetstreamObjects{js: w.Jetstream}
+}
@@ -0,0 +1,98 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/nats-io/nats.go/jetstream"
+	scnorion_nats "github.com/scncore/nats"
+	"github.com/scncore/scnorion-worker/internal/common/notifications"
+)
+
+// TestStoreOutboxAttachments checks the payload kept in the outbox has no attachment content
+func TestStoreOutboxAttachments(t *testing.T) {
+	w := newTestJetStream(t)
+	js, err := jetstream.New(w.NATSConnection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Jetstream = js
+
+	pfx := []byte("private key and certificate")
+	legacy := []byte("legacy attachment")
+	n := TenantNotification{
+		Notification: scnorion_nats.Notification{
+			To:                    "user@example.com",
+			MessageAttachFileName: "legacy.txt",
+			MessageAttachFile:     base64.StdEncoding.EncodeToString(legacy),
+		},
+		Attachments: []notifications.Attachment{
+			{Filename: "user.pfx", ContentType: "application/x-pkcs12", Content: base64.StdEncoding.EncodeToString(pfx)},
+		},
+	}
+
+	if err := w.StoreOutboxAttachments("SCNORION_NOTIFICATIONS-1", &n); err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := json.Marshal(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range [][]byte{pfx, legacy} {
+		if bytes.Contains(payload, []byte(base64.StdEncoding.EncodeToString(content))) {
+			t.Errorf("the payload still has the content of an attachment: %s", payload)
+		}
+	}
+	if n.MessageAttachFileName != "" || n.MessageAttachFile != "" {
+		t.Error("the legacy attachment fields have not been cleared")
+	}
+
+	// The legacy attachment goes first as it did when it was sent from its fields
+	if len(n.Attachments) != 2 || n.Attachments[0].Filename != "legacy.txt" || n.Attachments[1].Filename != "user.pfx" {
+		t.Fatalf("got attachments %+v", n.Attachments)
+	}
+	for i, want := range [][]byte{legacy, pfx} {
+		data, err := n.Attachments[i].Data(context.Background(), w.notificationObjects())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, want) {
+			t.Errorf("got attachment %q, want %q", data, want)
+		}
+	}
+	if n.Attachments[1].ContentType != "application/x-pkcs12" {
+		t.Errorf("got content type %s", n.Attachments[1].ContentType)
+	}
+
+	if err := w.DeleteOutboxAttachments(&n); err != nil {
+		t.Fatal(err)
+	}
+	_, err = n.Attachments[1].Data(context.Background(), w.notificationObjects())
+	deliveryErr := &notifications.DeliveryError{}
+	if !errors.As(err, &deliveryErr) || !deliveryErr.Permanent {
+		t.Errorf("got %v for a deleted attachment, want a permanent delivery error", err)
+	}
+
+	// Deleting them again is not an error
+	if err := w.DeleteOutboxAttachments(&n); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStoreOutboxAttachmentsWithoutContent(t *testing.T) {
+	w := newTestWorker(t)
+
+	// Nothing has to be stored so JetStream is not needed
+	n := TenantNotification{Notification: scnorion_nats.Notification{To: "user@example.com"}}
+	if err := w.StoreOutboxAttachments("message", &n); err != nil {
+		t.Fatal(err)
+	}
+	if len(n.Attachments) != 0 {
+		t.Errorf("got attachments %+v", n.Attachments)
+	}
+}
@@ -0,0 +1,314 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/scncore/scnorion-worker/internal/common/notifications"
+	"github.com/scncore/scnorion-worker/internal/models"
+)
+
+const (
+	notificationOutboxFrequency = 30 * time.Second
+	// notificationOutboxBatch deliveries are claimed at once, the lease covers sending all of them
+	notificationOutboxBatch = 10
+	notificationOutboxLease = notificationOutboxBatch*notificationSendTimeout + time.Minute
+	// A delivery is retried after 1, 2, 4... minutes up to an hour between attempts
+	notificationOutboxFirstRetry  = time.Minute
+	notificationOutboxMaxRetry    = time.Hour
+	notificationOutboxMaxAttempts = 10
+	// Sent and dead deliveries are kept for the status requests this long
+	notificationOutboxRetention = 30 * 24 * time.Hour
+
+	defaultNotificationStatusLimit = 50
+	maxNotificationStatusLimit     = 500
+)
+
+// NotificationStatusRequest asks for the deliveries of a message, of a recipient or both
+type NotificationStatusRequest struct {
+	MessageID string `json:"message_id,omitempty"`
+	Recipient string `json:"recipient,omitempty"`
+	Limit     int    `json:"limit,omitempty"`
+}
+
+type NotificationStatus struct {
+	MessageID    string     `json:"message_id"`
+	Channel      string     `json:"channel"`
+	ChannelType  string     `json:"channel_type"`
+	TenantID     int        `json:"tenant_id"`
+	Type         string     `json:"type"`
+	Recipient    string     `json:"recipient"`
+	State        string     `json:"state"`
+	Attempts     int        `json:"attempts"`
+	NextAttempt  *time.Time `json:"next_attempt,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	LastResponse string     `json:"last_response,omitempty"`
+	Created      time.Time  `json:"created"`
+	Updated      time.Time  `json:"updated"`
+	Sent         *time.Time `json:"sent,omitempty"`
+}
+
+type NotificationStatusResponse struct {
+	Notifications []NotificationStatus `json:"notifications"`
+	Error         string               `json:"error,omitempty"`
+}
+
+func (w *Worker) StartNotificationOutboxJob() error {
+	var err error
+
+	if w.NotificationOutboxJob != nil {
+		return nil
+	}
+
+	w.NotificationOutboxJob, err = w.TaskScheduler.NewJob(
+		gocron.DurationJob(
+			notificationOutboxFrequency,
+		),
+		gocron.NewTask(w.ProcessNotificationOutbox),
+		gocron.WithStartAt(gocron.WithStartImmediately()),
+		gocron.WithSingletonMode(gocron.LimitModeReschedule),
+	)
+	if err != nil {
+		log.Printf("[ERROR]: could not start the notification outbox job: %v", err)
+		return err
+	}
+	log.Printf("[INFO]: new notification outbox job has been scheduled every %s", notificationOutboxFrequency)
+	return nil
+}
+
+// TriggerNotificationOutbox runs the outbox job now, so a new notification doesn't wait for
+// the next run. A run in progress picks it up as it claims the due deliveries until none is left
+func (w *Worker) TriggerNotificationOutbox() {
+	if w.NotificationOutboxJob == nil {
+		return
+	}
+
+	if err := w.NotificationOutboxJob.RunNow(); err != nil {
+		log.Printf("[ERROR]: could not run the notification outbox job, reason: %v", err)
+	}
+}
+
+// ProcessNotificationOutbox retries the deliveries that are due and purges the old ones
+func (w *Worker) ProcessNotificationOutbox() {
+	if w.Model == nil {
+		log.Println("[ERROR]: could not process the notification outbox, reason: no connection with database")
+		return
+	}
+
+	w.DeliverDueNotifications("")
+
+	deleted, err := w.Model.DeleteOldOutboxNotifications(time.Now().Add(-notificationOutboxRetention))
+	if err != nil {
+		log.Printf("[ERROR]: could not purge the notification outbox, reason: %v", err)
+		return
+	}
+	if deleted > 0 {
+		log.Printf("[INFO]: %d old notifications have been purged from the outbox", deleted)
+	}
+}
+
+// DeliverDueNotifications sends the deliveries that are due, only those of the message if messageID is set
+func (w *Worker) DeliverDueNotifications(messageID string) {
+	for {
+		deliveries, err := w.Model.ClaimDueNotifications(messageID, notificationOutboxBatch, notificationOutboxLease)
+		if err != nil {
+			log.Printf("[ERROR]: could not read the notification outbox, reason: %v", err)
+			return
+		}
+
+		for _, d := range deliveries {
+			w.deliverNotification(d)
+		}
+
+		if len(deliveries) < notificationOutboxBatch {
+			return
+		}
+	}
+}
+
+func (w *Worker) deliverNotification(d *models.OutboxNotification) {
+	attempt := d.Attempts + 1
+
+	err := w.sendOutboxNotification(d)
+	if err == nil {
+		if err := w.Model.RecordNotificationAttempt(d.ID, models.OutboxStateSent, time.Now(), "", ""); err != nil {
+			log.Printf("[ERROR]: could not record the delivery of notification %s to channel %s, reason: %v", d.MessageID, d.Channel, err)
+			return
+		}
+		w.releaseOutboxAttachments(d)
+		return
+	}
+
+	response := ""
+	permanent := false
+	var deliveryErr *notifications.DeliveryError
+	if errors.As(err, &deliveryErr) {
+		response = deliveryErr.Response
+		permanent = deliveryErr.Permanent
+	}
+
+	state := models.OutboxStateFailed
+	nextAttempt := time.Now().Add(notificationOutboxBackoff(attempt))
+	if permanent || attempt >= notificationOutboxMaxAttempts {
+		state = models.OutboxStateDead
+		log.Printf("[ERROR]: notification %s to channel %s won't be retried after %d attempts, reason: %v", d.MessageID, d.Channel, attempt, err)
+	} else {
+		log.Printf("[ERROR]: could not send %s notification %s to channel %s, it will be retried at %s, reason: %v", d.Type, d.MessageID, d.Channel, nextAttempt.Format(time.RFC3339), err)
+	}
+
+	if err := w.Model.RecordNotificationAttempt(d.ID, state, nextAttempt, err.Error(), response); err != nil {
+		log.Printf("[ERROR]: could not record the delivery of notification %s to channel %s, reason: %v", d.MessageID, d.Channel, err)
+		return
+	}
+	if state == models.OutboxStateDead {
+		w.releaseOutboxAttachments(d)
+	}
+}
+
+// releaseOutboxAttachments deletes the attachments of the message once none of its deliveries will be retried
+func (w *Worker) releaseOutboxAttachments(d *models.OutboxNotification) {
+	pending, err := w.Model.CountPendingOutboxNotifications(d.MessageID)
+	if err != nil {
+		log.Printf("[ERROR]: could not check the pending deliveries of notification %s, reason: %v", d.MessageID, err)
+		return
+	}
+	if pending > 0 {
+		return
+	}
+
+	n := TenantNotification{}
+	if err := json.Unmarshal(d.Payload, &n); err != nil {
+		return
+	}
+	if err := w.DeleteOutboxAttachments(&n); err != nil {
+		log.Printf("[ERROR]: could not delete the attachments of notification %s, they'll expire with the work queues, reason: %v", d.MessageID, err)
+	}
+}
+
+// sendOutboxNotification renders the notification and delivers it to the channel as it's
+// configured now, so a fixed channel configuration or template is used by the retries
+func (w *Worker) sendOutboxNotification(d *models.OutboxNotification) error {
+	n := TenantNotification{}
+	if err := json.Unmarshal(d.Payload, &n); err != nil {
+		return &notifications.DeliveryError{Err: fmt.Errorf("could not unmarshal notification: %v", err), Permanent: true}
+	}
+
+	event := notifications.Event{
+		Type:         d.Type,
+		TenantID:     d.TenantID,
+		Notification: &n.Notification,
+		Locale:       n.Locale,
+		Attachments:  n.Attachments,
+		Objects:      w.notificationObjects(),
+	}
+	if err := w.NotificationTemplates.Render(&event, n.Template, n.Data); err != nil {
+		return &notifications.DeliveryError{Err: err, Permanent: true}
+	}
+
+	transports, err := w.NotificationTransports(d.TenantID, d.Type)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range transports {
+		if t.Name() != d.Channel {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), notificationSendTimeout)
+		defer cancel()
+
+		return t.Send(ctx, &event)
+	}
+
+	return &notifications.DeliveryError{Err: fmt.Errorf("channel %s no longer receives %s notifications", d.Channel, d.Type), Permanent: true}
+}
+
+// notificationOutboxBackoff doubles the delay after every failed attempt
+func notificationOutboxBackoff(attempt int) time.Duration {
+	delay := notificationOutboxFirstRetry
+	for i := 1; i < attempt && delay < notificationOutboxMaxRetry; i++ {
+		delay *= 2
+	}
+	return min(delay, notificationOutboxMaxRetry)
+}
+
+// NotificationStatusHandler answers the console with the deliveries of a message or a recipient
+func (w *Worker) NotificationStatusHandler(msg *nats.Msg) {
+	request := NotificationStatusRequest{}
+	if err := json.Unmarshal(msg.Data, &request); err != nil {
+		log.Printf("[ERROR]: could not unmarshal notification status request, reason: %v", err)
+		w.RespondNotificationStatus(msg, NotificationStatusResponse{Error: fmt.Sprintf("could not read status request: %v", err)})
+		return
+	}
+
+	if request.MessageID == "" && request.Recipient == "" {
+		w.RespondNotificationStatus(msg, NotificationStatusResponse{Error: "a message ID or a recipient is required"})
+		return
+	}
+
+	if w.Model == nil {
+		w.RespondNotificationStatus(msg, NotificationStatusResponse{Error: "no connection with database"})
+		return
+	}
+
+	limit := request.Limit
+	if limit <= 0 {
+		limit = defaultNotificationStatusLimit
+	}
+	limit = min(limit, maxNotificationStatusLimit)
+
+	deliveries, err := w.Model.GetOutboxNotifications(request.MessageID, request.Recipient, limit)
+	if err != nil {
+		log.Printf("[ERROR]: could not get the notification status, reason: %v", err)
+		w.RespondNotificationStatus(msg, NotificationStatusResponse{Error: err.Error()})
+		return
+	}
+
+	response := NotificationStatusResponse{Notifications: []NotificationStatus{}}
+	for _, d := range deliveries {
+		status := NotificationStatus{
+			MessageID:    d.MessageID,
+			Channel:      d.Channel,
+			ChannelType:  d.ChannelType,
+			TenantID:     d.TenantID,
+			Type:         d.Type,
+			Recipient:    d.Recipient,
+			State:        d.State,
+			Attempts:     d.Attempts,
+			LastError:    d.LastError,
+			LastResponse: d.LastResponse,
+			Created:      d.Created,
+			Updated:      d.Updated,
+			Sent:         d.Sent,
+		}
+		if d.State == models.OutboxStateQueued || d.State == models.OutboxStateFailed {
+			status.NextAttempt = &d.NextAttempt
+		}
+		response.Notifications = append(response.Notifications, status)
+	}
+
+	w.RespondNotificationStatus(msg, response)
+}
+
+func (w *Worker) RespondNotificationStatus(msg *nats.Msg, response NotificationStatusResponse) {
+	if msg.Reply == "" {
+		return
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("[ERROR]: could not marshal notification status response, reason: %v", err)
+		return
+	}
+
+	if err := msg.Respond(data); err != nil {
+		log.Printf("[ERROR]: could not respond to notification status request, reason: %v", err)
+	}
+}
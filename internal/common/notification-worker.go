@@ -4,13 +4,14 @@ import (
 	"log"
 
 	"github.com/scncore/ent"
+	"github.com/scncore/scnorion-worker/internal/common/notifications"
 )
 
 func (w *Worker) SubscribeToNotificationWorkerQueues() error {
 	var err error
 
 	// read SMTP settings from database
-	w.Settings, err = w.Model.GetSMTPSettings()
+	_, err = w.Model.GetSMTPSettings()
 	if err != nil {
 		if ent.IsNotFound(err) {
 			log.Println("[INFO]: no SMTP settings found")
@@ -20,6 +21,18 @@ func (w *Worker) SubscribeToNotificationWorkerQueues() error {
 		}
 	}
 
+	if w.SMTPClients == nil {
+		w.SMTPClients = notifications.NewSMTPClientCache(w.Model.GetTenantSMTPSettings, w.SMTPTLS, w.NotificationSigning, w.SMTPOAuth2)
+	}
+
+	if w.NotificationTemplates == nil {
+		w.NotificationTemplates = notifications.NewTemplateRegistry(w.DefaultLocale, w.NotificationTemplateSources()...)
+		if err := w.NotificationTemplates.Load(); err != nil {
+			// The built-in templates are still available
+			log.Printf("[ERROR]: could not load the notification templates, reason: %v", err)
+		}
+	}
+
 	_, err = w.NATSConnection.Subscribe("notification.reload_settings", w.ReloadSettingsHandler)
 	if err != nil {
 		log.Printf("[ERROR]: could not subscribe to notification.reload_settings, reason: %v", err)
@@ -27,19 +40,30 @@ func (w *Worker) SubscribeToNotificationWorkerQueues() error {
 	}
 	log.Println("[INFO]: subscribed to queue notification.reload_setting")
 
-	_, err = w.NATSConnection.QueueSubscribe("notification.confirm_email", "scnorion-notification", w.SendConfirmEmailHandler)
-	if err != nil {
-		log.Printf("[ERROR]: could not subscribe to notification.confirm_email, reason: %v", err)
+	subjects := []string{"notification.confirm_email", "notification.send_certificate", "notification.certificate_password", "notification.certificate_expiry"}
+	if err := w.StartJetStream(NotificationsStream, subjects); err != nil {
 		return err
 	}
-	log.Println("[INFO]: subscribed to queue notification.confirm_email")
 
-	_, err = w.NATSConnection.QueueSubscribe("notification.send_certificate", "scnorion-notification", w.SendUserCertificateHandler)
+	if err := w.ConsumeJetStream(NotificationsStream, []JetStreamConsumer{
+		{Durable: "scnorion-notification-confirm-email", Subject: "notification.confirm_email", Handler: w.SendNotificationHandler},
+		{Durable: "scnorion-notification-send-certificate", Subject: "notification.send_certificate", Handler: w.SendNotificationHandler},
+		{Durable: "scnorion-notification-certificate-password", Subject: "notification.certificate_password", Handler: w.SendNotificationHandler},
+		{Durable: "scnorion-notification-certificate-expiry", Subject: "notification.certificate_expiry", Handler: w.SendNotificationHandler},
+	}); err != nil {
+		return err
+	}
+
+	_, err = w.NATSConnection.QueueSubscribe("notification.status", "scnorion-notification", w.NotificationStatusHandler)
 	if err != nil {
-		log.Printf("[ERROR]: could not subscribe to notification.send_certificate, reason: %v", err)
+		log.Printf("[ERROR]: could not subscribe to notification.status, reason: %v", err)
+		return err
+	}
+	log.Printf("[INFO]: subscribed to queue notification.status")
+
+	if err := w.StartNotificationOutboxJob(); err != nil {
 		return err
 	}
-	log.Println("[INFO]: subscribed to queue notification.send_certificate")
 
 	_, err = w.NATSConnection.QueueSubscribe("ping.notificationworker", "scnorion-notification", w.PingHandler)
 	if err != nil {
@@ -50,3 +74,41 @@ func (w *Worker) SubscribeToNotificationWorkerQueues() error {
 
 	return nil
 }
+
+// NotificationTemplateSources returns the templates directory, if any, and the database,
+// so a template in the database replaces the file of the same tenant, type and locale
+func (w *Worker) NotificationTemplateSources() []notifications.TemplateSource {
+	sources := []notifications.TemplateSource{}
+	if w.TemplatesDir != "" {
+		sources = append(sources, notifications.LoadTemplatesDir(w.TemplatesDir))
+	}
+
+	return append(sources, func() ([]*notifications.Template, error) {
+		saved, err := w.Model.GetNotificationTemplates()
+		if err != nil {
+			return nil, err
+		}
+
+		templates := []*notifications.Template{}
+		for _, t := range saved {
+			templates = append(templates, &notifications.Template{
+				TenantID:        t.TenantID,
+				Type:            t.Type,
+				Locale:          t.Locale,
+				Subject:         t.Subject,
+				Title:           t.Title,
+				Greeting:        t.Greeting,
+				Text:            t.Text,
+				Action:          t.Action,
+				HTML:            t.HTML,
+				LogoURL:         t.LogoURL,
+				LogoAlt:         t.LogoAlt,
+				PrimaryColor:    t.PrimaryColor,
+				BodyColor:       t.BodyColor,
+				BackgroundColor: t.BackgroundColor,
+				Footer:          t.Footer,
+			})
+		}
+		return templates, nil
+	})
+}
@@ -2,110 +2,180 @@ package common
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
 	"github.com/scncore/ent"
 	scnorion_nats "github.com/scncore/nats"
 	"github.com/scncore/scnorion-worker/internal/common/notifications"
+	"github.com/scncore/scnorion-worker/internal/models"
 )
 
-func (w *Worker) SendConfirmEmailHandler(msg *nats.Msg) {
-	notification := scnorion_nats.Notification{}
+// NotificationTenantHeader is the optional NATS header with the tenant of a notification, it
+// takes precedence over the tenant_id field. Notifications without a tenant use the global settings
+const NotificationTenantHeader = "Scnorion-Tenant"
+
+// TenantNotification is a notification that may say which tenant it belongs to, so it's
+// sent with the tenant's relay, sender, channels and templates. Template names the
+// template used instead of the notification type, Data holds the values its texts use
+// and Locale picks its language, the worker's default locale is used if empty.
+// Attachments are sent after the fixed attachment fields
+type TenantNotification struct {
+	scnorion_nats.Notification
+	TenantID    int                        `json:"tenant_id,omitempty"`
+	Template    string                     `json:"template,omitempty"`
+	Locale      string                     `json:"locale,omitempty"`
+	Data        map[string]string          `json:"data,omitempty"`
+	Attachments []notifications.Attachment `json:"attachments,omitempty"`
+}
 
-	if w.Settings == nil {
-		log.Println("[ERROR]: no SMTP settings found, retry in 5 minutes")
-		msg.NakWithDelay(5 * time.Minute)
-		return
-	}
+const notificationSendTimeout = 2 * time.Minute
 
-	err := json.Unmarshal(msg.Data, &notification)
-	if err != nil {
+// SendNotificationHandler adds a delivery to the outbox for every channel the notification
+// type is routed to, the message is acknowledged once it has been stored and the outbox
+// job delivers it, so a slow channel never holds the consumer
+func (w *Worker) SendNotificationHandler(msg jetstream.Msg) {
+	notification := TenantNotification{}
+
+	if err := json.Unmarshal(msg.Data(), &notification); err != nil {
 		log.Printf("[ERROR]: could not unmarshal notification request, reason: %v", err.Error())
-		msg.NakWithDelay(5 * time.Minute)
+		msg.Nak()
 		return
 	}
 
-	mailMessage, err := notifications.PrepareMessage(&notification, w.Settings)
+	notificationType := strings.TrimPrefix(msg.Subject(), "notification.")
+	if tenant := msg.Headers().Get(NotificationTenantHeader); tenant != "" {
+		tenantID, err := strconv.Atoi(tenant)
+		if err != nil {
+			log.Printf("[ERROR]: notification has an invalid tenant %s, the tenant_id field will be used", tenant)
+		} else {
+			notification.TenantID = tenantID
+		}
+	}
+
+	transports, err := w.NotificationTransports(notification.TenantID, notificationType)
 	if err != nil {
-		log.Printf("[ERROR]: could not prepare notification message, reason: %v", err.Error())
-		msg.NakWithDelay(5 * time.Minute)
+		log.Printf("[ERROR]: could not get the notification channels, reason: %v", err)
+		msg.Nak()
 		return
 	}
 
-	client, err := notifications.PrepareSMTPClient(w.Settings)
+	messageID, err := jetStreamMessageID(msg)
 	if err != nil {
-		log.Printf("[ERROR]: could not prepare SMTP client, reason: %v", err.Error())
-		msg.NakWithDelay(5 * time.Minute)
+		log.Printf("[ERROR]: could not get the notification message ID, reason: %v", err)
+		msg.Nak()
 		return
 	}
-	if err := client.DialAndSend(mailMessage); err != nil {
-		log.Printf("[ERROR]: could not connect and send message, reason: %v", err.Error())
-		msg.NakWithDelay(5 * time.Minute)
+
+	// The outbox only keeps references to the attachments, they may hold private keys
+	if err := w.StoreOutboxAttachments(messageID, &notification); err != nil {
+		log.Printf("[ERROR]: could not store the notification attachments, reason: %v", err)
+		msg.Nak()
 		return
 	}
 
-	if err := msg.Ack(); err != nil {
-		log.Printf("[ERROR]: could not send ACK, reason: %v", err.Error())
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		log.Printf("[ERROR]: could not marshal notification, reason: %v", err)
+		msg.Nak()
 		return
 	}
-}
 
-func (w *Worker) SendUserCertificateHandler(msg *nats.Msg) {
-	notification := scnorion_nats.Notification{}
-
-	if w.Settings == nil {
-		log.Println("[ERROR]: no SMTP settings found, retry in 5 minutes")
-		msg.NakWithDelay(5 * time.Minute)
-		return
+	deliveries := []*models.OutboxNotification{}
+	for _, t := range transports {
+		deliveries = append(deliveries, &models.OutboxNotification{
+			MessageID:   messageID,
+			Channel:     t.Name(),
+			ChannelType: notifications.TransportType(t),
+			TenantID:    notification.TenantID,
+			Type:        notificationType,
+			Recipient:   notification.To,
+			Payload:     payload,
+		})
 	}
 
-	if err := json.Unmarshal(msg.Data, &notification); err != nil {
-		log.Printf("[ERROR]: could not unmarshal notification request, reason: %v", err.Error())
-		msg.NakWithDelay(5 * time.Minute)
+	if err := w.Model.EnqueueNotifications(deliveries); err != nil {
+		log.Printf("[ERROR]: could not add the notification to the outbox, reason: %v", err)
+		msg.Nak()
 		return
 	}
 
-	mailMessage, err := notifications.PrepareMessage(&notification, w.Settings)
-	if err != nil {
-		log.Printf("[ERROR]: could not prepare notification message, reason: %v", err.Error())
-		msg.NakWithDelay(5 * time.Minute)
-		return
+	if err := msg.Ack(); err != nil {
+		log.Printf("[ERROR]: could not send ACK, reason: %v", err.Error())
 	}
 
-	client, err := notifications.PrepareSMTPClient(w.Settings)
+	w.TriggerNotificationOutbox()
+}
+
+// NotificationTransports returns the transports of the tenant's channels that receive the notification
+// type. If no channel does, the notification is emailed to its recipient as it was before channels existed
+func (w *Worker) NotificationTransports(tenantID int, notificationType string) ([]notifications.Transport, error) {
+	transports := []notifications.Transport{}
+
+	channels, err := w.Model.GetNotificationChannels(tenantID)
 	if err != nil {
-		log.Printf("[ERROR]: could not prepare SMTP client, reason: %v", err.Error())
-		msg.NakWithDelay(5 * time.Minute)
-		return
+		return nil, err
 	}
 
-	err = client.DialAndSend(mailMessage)
-	if err != nil {
-		log.Printf("[ERROR]: could not connect and send message, reason: %v", err.Error())
-		msg.NakWithDelay(5 * time.Minute)
-		return
+	for _, c := range channels {
+		if len(c.NotificationTypes) > 0 && !slices.Contains(c.NotificationTypes, notificationType) && !slices.Contains(c.NotificationTypes, "*") {
+			continue
+		}
+
+		var smtp *notifications.SMTPClient
+		if c.Type == notifications.ChannelEmail {
+			smtp, err = w.SMTPClients.Get(tenantID)
+			if err != nil && !ent.IsNotFound(err) {
+				return nil, err
+			}
+		}
+
+		t, err := notifications.NewTransport(c.Name, c.Type, c.Config, smtp)
+		if err != nil {
+			// A retry won't fix the configuration, the other channels still get the notification
+			log.Printf("[ERROR]: notification channel %s is skipped, reason: %v", c.Name, err)
+			continue
+		}
+		transports = append(transports, t)
 	}
 
-	if err := msg.Ack(); err != nil {
-		log.Printf("[ERROR]: could not send response, reason: %v", err.Error())
-		return
+	if len(transports) == 0 {
+		smtp, err := w.SMTPClients.Get(tenantID)
+		if err != nil {
+			if ent.IsNotFound(err) {
+				return nil, errors.New("no SMTP settings found")
+			}
+			return nil, err
+		}
+		transports = append(transports, &notifications.EmailTransport{ChannelName: notifications.ChannelEmail, SMTP: smtp})
 	}
+
+	return transports, nil
 }
 
+// ReloadSettingsHandler drops the cached SMTP clients so the settings are read again. The
+// message may carry a tenant ID to only reload that tenant, global settings reload every
+// tenant and the notification templates
 func (w *Worker) ReloadSettingsHandler(msg *nats.Msg) {
-	var err error
-	// read again SMTP settings from database
-	w.Settings, err = w.Model.GetSMTPSettings()
-	if err != nil {
-		if ent.IsNotFound(err) {
-			log.Println("[INFO]: no SMTP settings found")
-		} else {
-			log.Printf("[ERROR]: could not get settings from DB, reason: %v", err)
-			return
-		}
+	tenant := strings.TrimSpace(string(msg.Data))
+	if tenantID, err := strconv.Atoi(tenant); err == nil && tenantID > 0 {
+		w.SMTPClients.Invalidate(tenantID)
+		log.Printf("[INFO]: SMTP settings of tenant %d will be reloaded", tenantID)
+		return
 	}
 
+	w.SMTPClients.Invalidate()
 	log.Println("[INFO]: SMTP settings have been reloaded")
+
+	if err := w.NotificationTemplates.Load(); err != nil {
+		log.Printf("[ERROR]: could not reload the notification templates, reason: %v", err)
+		return
+	}
+	log.Println("[INFO]: notification templates have been reloaded")
 }
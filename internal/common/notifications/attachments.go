@@ -0,0 +1,103 @@
+package notifications
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"path/filepath"
+
+	"github.com/scncore/nats"
+	"github.com/wneessen/go-mail"
+)
+
+// Attachment is a file sent with an email notification. Its content is base64 encoded
+// in the notification or, if it's too large for a NATS message, kept in an object store
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type,omitempty"`
+	Content     string `json:"content,omitempty"`
+	ObjectStore string `json:"object_store,omitempty"`
+	ObjectKey   string `json:"object_key,omitempty"`
+	// Inline attachments are images the HTML shows with cid:<ContentID>, the filename if empty
+	Inline    bool   `json:"inline,omitempty"`
+	ContentID string `json:"content_id,omitempty"`
+}
+
+// ObjectStore reads the attachments kept in NATS object stores
+type ObjectStore interface {
+	GetObject(ctx context.Context, bucket, key string) ([]byte, error)
+}
+
+// Data returns the content of the attachment
+func (a *Attachment) Data(ctx context.Context, objects ObjectStore) ([]byte, error) {
+	if a.ObjectKey != "" {
+		if objects == nil {
+			return nil, fmt.Errorf("attachment %s is in an object store but there's no connection with it", a.Filename)
+		}
+		return objects.GetObject(ctx, a.ObjectStore, a.ObjectKey)
+	}
+
+	if a.Content == "" {
+		return nil, fmt.Errorf("attachment %s has no content", a.Filename)
+	}
+	data, err := base64.StdEncoding.DecodeString(a.Content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode file content: %v", err)
+	}
+	return data, nil
+}
+
+// LegacyAttachments returns the files of the two fixed attachment fields of the notification
+func LegacyAttachments(n *nats.Notification) []Attachment {
+	attachments := []Attachment{}
+	if n.MessageAttachFileName != "" {
+		attachments = append(attachments, Attachment{Filename: n.MessageAttachFileName, Content: n.MessageAttachFile})
+	}
+	if n.MessageAttachFileName2 != "" {
+		attachments = append(attachments, Attachment{Filename: n.MessageAttachFileName2, Content: n.MessageAttachFile2})
+	}
+	return attachments
+}
+
+// attach adds the attachments to the message, inline images are embedded
+func attach(ctx context.Context, m *mail.Msg, attachments []Attachment, objects ObjectStore) error {
+	for _, a := range attachments {
+		if a.Filename == "" {
+			return errors.New("attachments must have a filename")
+		}
+
+		data, err := a.Data(ctx, objects)
+		if err != nil {
+			return err
+		}
+
+		contentType := a.ContentType
+		if contentType == "" {
+			contentType = mime.TypeByExtension(filepath.Ext(a.Filename))
+		}
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		options := []mail.FileOption{mail.WithFileContentType(mail.ContentType(contentType))}
+
+		if a.Inline {
+			contentID := a.ContentID
+			if contentID == "" {
+				contentID = a.Filename
+			}
+			// go-mail writes the Content-ID as is and RFC 2392 wants it between angle brackets
+			if err := m.EmbedReader(a.Filename, bytes.NewReader(data), append(options, mail.WithFileContentID("<"+contentID+">"))...); err != nil {
+				return fmt.Errorf("failed to embed file: %v", err)
+			}
+			continue
+		}
+
+		if err := m.AttachReader(a.Filename, bytes.NewReader(data), options...); err != nil {
+			return fmt.Errorf("failed to attach file: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package notifications
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// dkimKeySuffix names the key files after the DNS record with the public key,
+// <selector>._domainkey.<domain>.pem
+const dkimKeySuffix = "._domainkey."
+
+// dkimSignedHeaders are signed when the message has them, From is always present
+var dkimSignedHeaders = []string{"from", "to", "cc", "reply-to", "subject", "date", "message-id", "mime-version", "content-type"}
+
+// DKIMKey signs the emails sent from a domain with relaxed/relaxed canonicalization
+type DKIMKey struct {
+	Domain   string
+	Selector string
+	Signer   crypto.Signer
+}
+
+// LoadDKIMKeys reads the keys of a directory with <selector>._domainkey.<domain>.pem
+// files, a domain can only have one key. RSA keys are used with rsa-sha256 and
+// Ed25519 keys with ed25519-sha256
+func LoadDKIMKeys(dir string) (map[string]*DKIMKey, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the DKIM keys directory: %v", err)
+	}
+
+	keys := map[string]*DKIMKey{}
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".pem" {
+			continue
+		}
+
+		selector, domain, ok := strings.Cut(strings.TrimSuffix(e.Name(), ".pem"), dkimKeySuffix)
+		if !ok || selector == "" || domain == "" {
+			return nil, fmt.Errorf("DKIM key %s must be named <selector>._domainkey.<domain>.pem", e.Name())
+		}
+		domain = strings.ToLower(domain)
+
+		if existing, ok := keys[domain]; ok {
+			return nil, fmt.Errorf("domain %s has two DKIM keys, selectors %s and %s", domain, existing.Selector, selector)
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("could not read DKIM key %s: %v", e.Name(), err)
+		}
+
+		signer, err := parseDKIMKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse DKIM key %s: %v", e.Name(), err)
+		}
+
+		keys[domain] = &DKIMKey{Domain: domain, Selector: selector, Signer: signer}
+	}
+	return keys, nil
+}
+
+func parseDKIMKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var key any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %s, use an unencrypted PKCS#1 or PKCS#8 key", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		// RFC 8301 forbids verifiers to accept shorter keys
+		if k.N.BitLen() < 1024 {
+			return nil, fmt.Errorf("RSA keys must be at least 1024 bits, this one has %d", k.N.BitLen())
+		}
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, use RSA or Ed25519", key)
+	}
+}
+
+// DKIMKeyFor returns the key of the sender's domain or of its closest parent, nil if there's none
+func DKIMKeyFor(keys map[string]*DKIMKey, sender string) *DKIMKey {
+	_, domain, ok := strings.Cut(strings.TrimSuffix(sender, ">"), "@")
+	if !ok {
+		return nil
+	}
+
+	domain = strings.ToLower(domain)
+	for domain != "" {
+		if key, ok := keys[domain]; ok {
+			return key
+		}
+		_, domain, _ = strings.Cut(domain, ".")
+	}
+	return nil
+}
+
+func (k *DKIMKey) algorithm() string {
+	if _, ok := k.Signer.(ed25519.PrivateKey); ok {
+		return "ed25519-sha256"
+	}
+	return "rsa-sha256"
+}
+
+// Sign returns the message with a DKIM-Signature header prepended. The message must
+// not change after it's signed, it has to be sent as it's returned
+func (k *DKIMKey) Sign(message []byte, now time.Time) ([]byte, error) {
+	message = bytes.ReplaceAll(bytes.ReplaceAll(message, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+
+	header, body, ok := bytes.Cut(message, []byte("\r\n\r\n"))
+	if !ok {
+		return nil, errors.New("the message has no body")
+	}
+	fields := dkimHeaderFields(string(header) + "\r\n")
+
+	bodyHash := sha256.Sum256(dkimRelaxedBody(body))
+
+	// Fields are picked bottom up as verifiers do, every name is signed once
+	signed := []string{}
+	hashed := bytes.Buffer{}
+	for _, name := range dkimSignedHeaders {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if dkimFieldName(fields[i]) == name {
+				signed = append(signed, name)
+				hashed.WriteString(dkimRelaxedHeader(fields[i]) + "\r\n")
+				break
+			}
+		}
+	}
+	if len(signed) == 0 || signed[0] != "from" {
+		return nil, errors.New("the message has no From header")
+	}
+
+	// Every tag is folded on its own line, the signature goes after b= once computed
+	signature := fmt.Sprintf("DKIM-Signature: v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		k.algorithm(), k.Domain, k.Selector, now.Unix(), strings.Join(signed, ":"), base64.StdEncoding.EncodeToString(bodyHash[:]))
+	hashed.WriteString(dkimRelaxedHeader(signature))
+
+	digest := sha256.Sum256(hashed.Bytes())
+
+	var b []byte
+	var err error
+	if _, ok := k.Signer.(ed25519.PrivateKey); ok {
+		// RFC 8463 signs the SHA-256 digest with PureEdDSA
+		b, err = k.Signer.Sign(rand.Reader, digest[:], crypto.Hash(0))
+	} else {
+		b, err = k.Signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not sign the message: %v", err)
+	}
+
+	// Lines are kept under the 78 characters recommended by RFC 5322
+	encoded := base64.StdEncoding.EncodeToString(b)
+	for len(encoded) > 72 {
+		signature += encoded[:72] + "\r\n\t"
+		encoded = encoded[72:]
+	}
+	signature += encoded + "\r\n"
+
+	return append([]byte(signature), message...), nil
+}
+
+// dkimHeaderFields splits the header in fields, keeping their folding
+func dkimHeaderFields(header string) []string {
+	fields := []string{}
+	for _, line := range strings.SplitAfter(header, "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+func dkimFieldName(field string) string {
+	name, _, _ := strings.Cut(field, ":")
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// dkimRelaxedHeader canonicalizes a field as RFC 6376 section 3.4.2 describes,
+// without the trailing CRLF
+func dkimRelaxedHeader(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	return strings.ToLower(strings.TrimRight(name, " \t")) + ":" + strings.Trim(dkimCollapseWSP(value), " ")
+}
+
+// dkimRelaxedBody canonicalizes the body as RFC 6376 section 3.4.4 describes
+func dkimRelaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+
+	canonical := strings.Builder{}
+	empty := 0
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t")
+		if line == "" {
+			empty++
+			continue
+		}
+		// Empty lines are only kept if a line with content follows them
+		canonical.WriteString(strings.Repeat("\r\n", empty))
+		empty = 0
+
+		canonical.WriteString(dkimCollapseWSP(line))
+		canonical.WriteString("\r\n")
+	}
+	return []byte(canonical.String())
+}
+
+// dkimCollapseWSP replaces every run of spaces and tabs with a single space
+func dkimCollapseWSP(s string) string {
+	collapsed := strings.Builder{}
+	space := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			collapsed.WriteByte(' ')
+			space = false
+		}
+		collapsed.WriteByte(s[i])
+	}
+	if space {
+		collapsed.WriteByte(' ')
+	}
+	return collapsed.String()
+}
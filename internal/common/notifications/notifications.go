@@ -1,18 +1,21 @@
 package notifications
 
 import (
-	"bytes"
 	"context"
-	"encoding/base64"
+	"errors"
 	"fmt"
+	"net/textproto"
+	"regexp"
 	"strings"
 
 	"github.com/scncore/ent"
-	"github.com/scncore/nats"
 	"github.com/wneessen/go-mail"
 )
 
-func PrepareMessage(notification *nats.Notification, settings *ent.Settings) (*mail.Msg, error) {
+// PrepareMessage builds the email with a plain text part, the HTML alternative and the
+// attachments, the fixed attachment fields of older publishers go before the list
+func PrepareMessage(ctx context.Context, event *Event, settings *ent.Settings) (*mail.Msg, error) {
+	notification := event.Notification
 	if notification.From == "" {
 		if settings.MessageFrom != "" {
 			notification.From = settings.MessageFrom
@@ -30,53 +33,143 @@ func PrepareMessage(notification *nats.Notification, settings *ent.Settings) (*m
 	}
 
 	m.Subject(notification.Subject)
-	templateBuffer := new(bytes.Buffer)
-	if err := EmailTemplate(notification).Render(context.Background(), templateBuffer); err != nil {
-		return nil, fmt.Errorf("failed to set To address: %v", err)
-	}
-	m.SetBodyString(mail.TypeTextHTML, templateBuffer.String())
-
-	if notification.MessageAttachFileName != "" {
-		data, err := base64.StdEncoding.DecodeString(notification.MessageAttachFile)
-		if err != nil {
-			return nil, fmt.Errorf("failed to decode file content: %v", err)
-		}
-		reader := bytes.NewReader(data)
-		err = m.AttachReader(notification.MessageAttachFileName, reader)
-		if err != nil {
-			return nil, fmt.Errorf("failed to attach file: %v", err)
-		}
+	body, err := EmailBody(event)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render the email template: %v", err)
 	}
+	m.SetBodyString(mail.TypeTextPlain, EmailText(event))
+	m.AddAlternativeString(mail.TypeTextHTML, body)
 
-	if notification.MessageAttachFileName2 != "" {
-		data, err := base64.StdEncoding.DecodeString(notification.MessageAttachFile2)
-		if err != nil {
-			return nil, fmt.Errorf("failed to decode file content: %v", err)
-		}
-		reader := bytes.NewReader(data)
-		err = m.AttachReader(notification.MessageAttachFileName2, reader)
-		if err != nil {
-			return nil, fmt.Errorf("failed to attach file: %v", err)
-		}
+	attachments := append(LegacyAttachments(notification), event.Attachments...)
+	if err := attach(ctx, m, attachments, event.Objects); err != nil {
+		return nil, err
 	}
 	return m, nil
 }
 
-func PrepareSMTPClient(settings *ent.Settings) (*mail.Client, error) {
+// PrepareSMTPClient creates the client of the relay, the tokens are only used if its
+// authentication is XOAUTH2
+func PrepareSMTPClient(settings *ent.Settings, tlsOptions *SMTPTLSOptions, tokens *OAuth2TokenSource) (*mail.Client, error) {
 	var err error
 	var c *mail.Client
 
 	smtpServer := strings.TrimSpace(settings.SMTPServer)
 
-	if settings.SMTPAuth == "NOAUTH" || (settings.SMTPUser == "" && settings.SMTPPassword == "") {
-		c, err = mail.NewClient(smtpServer, mail.WithPort(settings.SMTPPort))
-	} else {
-		c, err = mail.NewClient(smtpServer, mail.WithPort(settings.SMTPPort), mail.WithSMTPAuth(mail.SMTPAuthType(settings.SMTPAuth)),
+	options := append([]mail.Option{mail.WithPort(settings.SMTPPort)}, smtpTLSClientOptions(settings, tlsOptions)...)
+	if UsesXOAUTH2(settings) {
+		oauth2Options, err := xoauth2Options(settings, tokens)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, oauth2Options...)
+	} else if settings.SMTPAuth != "NOAUTH" && (settings.SMTPUser != "" || settings.SMTPPassword != "") {
+		options = append(options, mail.WithSMTPAuth(mail.SMTPAuthType(settings.SMTPAuth)),
 			mail.WithUsername(settings.SMTPUser), mail.WithPassword(settings.SMTPPassword))
 	}
 
+	c, err = mail.NewClient(smtpServer, options...)
 	if err != nil {
 		return nil, err
 	}
 	return c, nil
 }
+
+// EmailTransport sends the notification with the email template to its recipient
+type EmailTransport struct {
+	ChannelName string
+	SMTP        *SMTPClient
+}
+
+func (t *EmailTransport) Name() string {
+	return t.ChannelName
+}
+
+func (t *EmailTransport) Send(ctx context.Context, event *Event) error {
+	mailMessage, err := PrepareMessage(ctx, event, t.SMTP.Settings)
+	if err != nil {
+		return fmt.Errorf("could not prepare notification message: %w", err)
+	}
+
+	send := func() error { return t.SMTP.Client.DialAndSendWithContext(ctx, mailMessage) }
+	if t.SMTP.Signing.Enabled() {
+		message, err := t.SMTP.Signing.Sign(mailMessage)
+		if err != nil {
+			return fmt.Errorf("could not sign notification message: %w", err)
+		}
+		send = func() error { return sendSignedMessage(ctx, t.SMTP.Client, mailMessage, message) }
+	}
+
+	err = send()
+	if err != nil && t.SMTP.Tokens != nil && isSMTPAuthFailure(err) {
+		// The cached token may have been revoked, a new one is tried once
+		t.SMTP.Tokens.Invalidate()
+		err = send()
+	}
+	if err != nil {
+		return smtpDeliveryError(err)
+	}
+	return nil
+}
+
+// sendSignedMessage sends the message as it was signed, go-mail would render it again
+func sendSignedMessage(ctx context.Context, client *mail.Client, m *mail.Msg, message []byte) error {
+	from, err := m.GetSender(false)
+	if err != nil {
+		return err
+	}
+	rcpts, err := m.GetRecipients()
+	if err != nil {
+		return err
+	}
+
+	smtpClient, err := client.DialToSMTPClientWithContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.CloseWithSMTPClient(smtpClient)
+
+	if err := smtpClient.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range rcpts {
+		if err := smtpClient.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+
+	writer, err := smtpClient.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(message); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// enhancedStatusCode finds the RFC 3463 code at the start of a reply text
+var enhancedStatusCode = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}\b`)
+
+// smtpDeliveryError keeps the reply code of the relay, 5xx replies are permanent
+// while 4xx replies and errors without a reply, like a refused connection, are retried
+func smtpDeliveryError(err error) error {
+	deliveryErr := DeliveryError{Err: fmt.Errorf("could not connect and send message: %w", err)}
+
+	var sendErr *mail.SendError
+	var replyErr *textproto.Error
+	switch {
+	case errors.As(err, &sendErr) && sendErr.ErrorCode() > 0:
+		deliveryErr.Response = strings.TrimSpace(fmt.Sprintf("%d %s", sendErr.ErrorCode(), sendErr.EnhancedStatusCode()))
+		deliveryErr.Permanent = sendErr.ErrorCode() >= 500
+	case errors.As(err, &replyErr):
+		// Signed messages are sent without go-mail, so the reply is the relay's as is
+		deliveryErr.Response = strings.TrimSpace(fmt.Sprintf("%d %s", replyErr.Code, enhancedStatusCode.FindString(replyErr.Msg)))
+		deliveryErr.Permanent = replyErr.Code >= 500
+	}
+
+	// Rejected credentials are fixed in the settings, the notification waits for them
+	if isSMTPAuthFailure(err) {
+		deliveryErr.Permanent = false
+	}
+	return &deliveryErr
+}
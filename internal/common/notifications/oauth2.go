@@ -0,0 +1,238 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/scncore/ent"
+	"github.com/wneessen/go-mail"
+	"github.com/wneessen/go-mail/smtp"
+)
+
+const (
+	oauth2TokenTimeout = 30 * time.Second
+	// Tokens are renewed this long before they expire so they don't expire mid-session
+	oauth2ExpiryMargin = time.Minute
+	// oauth2DefaultLifetime is used if the token endpoint doesn't say when the token expires
+	oauth2DefaultLifetime = 10 * time.Minute
+)
+
+// OAuth2TokenSource gets the access tokens of the SMTP relays that use XOAUTH2 with the
+// client credentials flow, the token is cached until it expires or the relay rejects it.
+// SMTPClientCache uses a source per tenant and relay so a token is never shared by them
+type OAuth2TokenSource struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	HTTPClient   *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// LoadSMTPOAuth2 validates the client credentials settings, nil is returned if none is set.
+// Scopes are separated by spaces or commas, e.g https://outlook.office365.com/.default
+func LoadSMTPOAuth2(tokenURL, clientID, clientSecret, scopes string) (*OAuth2TokenSource, error) {
+	if tokenURL == "" && clientID == "" && clientSecret == "" {
+		return nil, nil
+	}
+
+	if tokenURL == "" || clientID == "" || clientSecret == "" {
+		return nil, errors.New("the SMTP OAuth2 token URL, client ID and client secret are required")
+	}
+
+	u, err := url.Parse(tokenURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("%s is not a valid SMTP OAuth2 token URL", tokenURL)
+	}
+	// The client secret is only sent in plain text to a token server on this host
+	if u.Scheme != "https" && !(u.Scheme == "http" && isLoopback(u.Hostname())) {
+		return nil, fmt.Errorf("the SMTP OAuth2 token URL must use https")
+	}
+
+	return &OAuth2TokenSource{
+		TokenURL:     tokenURL,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Scopes:       strings.FieldsFunc(scopes, func(r rune) bool { return r == ' ' || r == ',' }),
+		HTTPClient:   &http.Client{Timeout: oauth2TokenTimeout},
+	}, nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// newSource returns a source with the same client credentials and its own token
+func (s *OAuth2TokenSource) newSource() *OAuth2TokenSource {
+	return &OAuth2TokenSource{
+		TokenURL:     s.TokenURL,
+		ClientID:     s.ClientID,
+		ClientSecret: s.ClientSecret,
+		Scopes:       s.Scopes,
+		HTTPClient:   s.HTTPClient,
+	}
+}
+
+// Token returns the cached access token or requests a new one if it's about to expire
+func (s *OAuth2TokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && time.Now().Before(s.expiry) {
+		return s.token, nil
+	}
+
+	token, lifetime, err := s.requestToken(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	s.token = token
+	s.expiry = time.Now().Add(max(lifetime-oauth2ExpiryMargin, 0))
+	return s.token, nil
+}
+
+// Invalidate drops the cached token so the next Token call requests a new one
+func (s *OAuth2TokenSource) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.token = ""
+	s.expiry = time.Time{}
+}
+
+type oauth2TokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int    `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func (s *OAuth2TokenSource) requestToken(ctx context.Context) (string, time.Duration, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", s.ClientID)
+	form.Set("client_secret", s.ClientSecret)
+	if len(s.Scopes) > 0 {
+		form.Set("scope", strings.Join(s.Scopes, " "))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	client := s.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: oauth2TokenTimeout}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("could not request the SMTP OAuth2 token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", 0, fmt.Errorf("could not read the SMTP OAuth2 token: %v", err)
+	}
+
+	token := oauth2TokenResponse{}
+	if err := json.Unmarshal(body, &token); err != nil && resp.StatusCode == http.StatusOK {
+		return "", 0, fmt.Errorf("could not decode the SMTP OAuth2 token: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK || token.AccessToken == "" {
+		reason := strings.TrimSpace(token.Error + " " + token.ErrorDescription)
+		if reason == "" {
+			reason = "no access token"
+		}
+		return "", 0, fmt.Errorf("the SMTP OAuth2 token endpoint answered %s: %s", resp.Status, reason)
+	}
+
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		return "", 0, fmt.Errorf("unsupported SMTP OAuth2 token type %s", token.TokenType)
+	}
+
+	lifetime := oauth2DefaultLifetime
+	if token.ExpiresIn > 0 {
+		lifetime = time.Duration(token.ExpiresIn) * time.Second
+	}
+	return token.AccessToken, lifetime, nil
+}
+
+// xoauth2Auth authenticates with the token of the source every time a connection is
+// opened, so a client lives longer than its tokens
+type xoauth2Auth struct {
+	username string
+	tokens   *OAuth2TokenSource
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// The bearer token must not travel in plain text, unless the relay is on this host
+	if !server.TLS && !isLoopback(server.Name) {
+		return "", nil, errors.New("XOAUTH2 requires an encrypted connection")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), oauth2TokenTimeout)
+	defer cancel()
+
+	token, err := a.tokens.Token(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	return smtp.XOAuth2Auth(a.username, token).Start(server)
+}
+
+func (a *xoauth2Auth) Next(_ []byte, more bool) ([]byte, error) {
+	// The relay sends the error as a challenge and expects an empty answer to reply with 535
+	if more {
+		return []byte(""), nil
+	}
+	return nil, nil
+}
+
+// UsesXOAUTH2 tells if the relay authenticates with OAuth2 tokens instead of a password
+func UsesXOAUTH2(settings *ent.Settings) bool {
+	return strings.EqualFold(settings.SMTPAuth, string(mail.SMTPAuthXOAUTH2))
+}
+
+// xoauth2Options are the client options of a relay whose console settings use XOAUTH2,
+// the SMTP user is the mailbox the token is used for
+func xoauth2Options(settings *ent.Settings, tokens *OAuth2TokenSource) ([]mail.Option, error) {
+	if tokens == nil {
+		return nil, errors.New("the SMTP relay uses XOAUTH2 but the worker has no OAuth2 client credentials")
+	}
+	if settings.SMTPUser == "" {
+		return nil, errors.New("the SMTP relay uses XOAUTH2 but no SMTP user is set")
+	}
+	return []mail.Option{mail.WithSMTPAuthCustom(&xoauth2Auth{username: settings.SMTPUser, tokens: tokens})}, nil
+}
+
+// isSMTPAuthFailure tells if the relay rejected the credentials, for XOAUTH2 the token
+// may have been revoked or its permissions changed before it expired
+func isSMTPAuthFailure(err error) bool {
+	var replyErr *textproto.Error
+	return errors.As(err, &replyErr) && replyErr.Code == 535
+}
@@ -0,0 +1,165 @@
+package notifications
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// testTokenServer issues token-1, token-2... with the client credentials flow
+type testTokenServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	issued   int
+	response func(rw http.ResponseWriter) bool
+}
+
+func newTestTokenServer(t *testing.T) *testTokenServer {
+	t.Helper()
+
+	s := &testTokenServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.Method != http.MethodPost || r.PostForm.Get("grant_type") != "client_credentials" ||
+			r.PostForm.Get("client_id") != "client" || r.PostForm.Get("client_secret") != "secret" ||
+			r.PostForm.Get("scope") != "https://outlook.office365.com/.default SMTP.Send" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(rw, `{"error":"invalid_client","error_description":"wrong credentials"}`)
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.response != nil && s.response(rw) {
+			return
+		}
+		s.issued++
+		fmt.Fprintf(rw, `{"access_token":"token-%d","token_type":"Bearer","expires_in":3600}`, s.issued)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Respond replaces the token with the response written by the function, if it returns true
+func (s *testTokenServer) Respond(response func(rw http.ResponseWriter) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.response = response
+}
+
+func (s *testTokenServer) Issued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.issued
+}
+
+func (s *testTokenServer) Source(t *testing.T) *OAuth2TokenSource {
+	t.Helper()
+
+	tokens, err := LoadSMTPOAuth2(s.URL, "client", "secret", "https://outlook.office365.com/.default,SMTP.Send")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokens
+}
+
+func TestOAuth2TokenSource(t *testing.T) {
+	server := newTestTokenServer(t)
+	tokens := server.Source(t)
+
+	for range 2 {
+		token, err := tokens.Token(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "token-1" {
+			t.Errorf("got %s, the cached token-1 was expected", token)
+		}
+	}
+
+	tokens.Invalidate()
+	if token, err := tokens.Token(context.Background()); err != nil || token != "token-2" {
+		t.Errorf("got %s and %v after the token was invalidated", token, err)
+	}
+
+	// Another source with the same credentials has its own token
+	if token, err := tokens.newSource().Token(context.Background()); err != nil || token != "token-3" {
+		t.Errorf("got %s and %v from a new source", token, err)
+	}
+
+	// A token that expires within the margin is not cached
+	server.Respond(func(rw http.ResponseWriter) bool {
+		server.issued++
+		fmt.Fprintf(rw, `{"access_token":"token-%d","expires_in":30}`, server.issued)
+		return true
+	})
+	short := tokens.newSource()
+	for _, want := range []string{"token-4", "token-5"} {
+		if token, err := short.Token(context.Background()); err != nil || token != want {
+			t.Errorf("got %s and %v, want %s", token, err, want)
+		}
+	}
+}
+
+func TestOAuth2TokenErrors(t *testing.T) {
+	server := newTestTokenServer(t)
+
+	wrong, err := LoadSMTPOAuth2(server.URL, "client", "wrong", "https://outlook.office365.com/.default SMTP.Send")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wrong.Token(context.Background()); err == nil || err.Error() != "the SMTP OAuth2 token endpoint answered 401 Unauthorized: invalid_client wrong credentials" {
+		t.Errorf("got %v for wrong credentials", err)
+	}
+
+	for name, body := range map[string]string{
+		"no access token":  `{"token_type":"Bearer"}`,
+		"unsupported type": `{"access_token":"t","token_type":"mac"}`,
+		"invalid JSON":     `{"access_token":`,
+		"HTML page":        `<html>error</html>`,
+	} {
+		server.Respond(func(rw http.ResponseWriter) bool {
+			fmt.Fprint(rw, body)
+			return true
+		})
+		if token, err := server.Source(t).Token(context.Background()); err == nil {
+			t.Errorf("%s: got token %s", name, token)
+		}
+	}
+
+	server.Close()
+	if _, err := server.Source(t).Token(context.Background()); err == nil {
+		t.Error("a token has been got from a closed server")
+	}
+}
+
+func TestLoadSMTPOAuth2(t *testing.T) {
+	if tokens, err := LoadSMTPOAuth2("", "", "", ""); tokens != nil || err != nil {
+		t.Errorf("got %v and %v without settings", tokens, err)
+	}
+
+	for _, tokenURL := range []string{"http://127.0.0.1:8080/token", "http://localhost/token", "https://login.example.com/token"} {
+		if _, err := LoadSMTPOAuth2(tokenURL, "client", "secret", ""); err != nil {
+			t.Errorf("%s: %v", tokenURL, err)
+		}
+	}
+
+	for name, settings := range map[string][3]string{
+		"no secret":      {"https://login.example.com/token", "client", ""},
+		"no URL":         {"", "client", "secret"},
+		"plain HTTP":     {"http://login.example.com/token", "client", "secret"},
+		"no host":        {"https:///token", "client", "secret"},
+		"unparsable URL": {"https://login example.com/%zz", "client", "secret"},
+	} {
+		if _, err := LoadSMTPOAuth2(settings[0], settings[1], settings[2], ""); err == nil {
+			t.Errorf("%s: the settings have been accepted", name)
+		}
+	}
+}
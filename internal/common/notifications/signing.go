@@ -0,0 +1,115 @@
+package notifications
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/wneessen/go-mail"
+)
+
+// SigningOptions are the worker side keys that sign the emails, both are optional
+type SigningOptions struct {
+	// DKIMKeys are the keys of the sender domains
+	DKIMKeys map[string]*DKIMKey
+	// SMIME is a certificate issued by the scnorion CA for the sender addresses,
+	// emails from other addresses are not S/MIME signed
+	SMIME *tls.Certificate
+}
+
+// LoadSigningOptions reads the DKIM keys directory and the S/MIME certificate, the
+// certificate file may have its intermediate CA after it
+func LoadSigningOptions(dkimKeysDir, smimeCertPath, smimeKeyPath string) (*SigningOptions, error) {
+	var err error
+	opts := SigningOptions{}
+
+	if dkimKeysDir != "" {
+		opts.DKIMKeys, err = LoadDKIMKeys(dkimKeysDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if smimeCertPath != "" || smimeKeyPath != "" {
+		if smimeCertPath == "" || smimeKeyPath == "" {
+			return nil, errors.New("both the S/MIME certificate and its private key are required")
+		}
+
+		cert, err := tls.LoadX509KeyPair(smimeCertPath, smimeKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the S/MIME certificate: %v", err)
+		}
+
+		if err := checkSMIMECertificate(&cert); err != nil {
+			return nil, err
+		}
+		opts.SMIME = &cert
+	}
+
+	return &opts, nil
+}
+
+func checkSMIMECertificate(cert *tls.Certificate) error {
+	switch cert.PrivateKey.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+	default:
+		return fmt.Errorf("unsupported S/MIME key type %T, use RSA or ECDSA", cert.PrivateKey)
+	}
+
+	if len(cert.Leaf.EmailAddresses) == 0 {
+		return errors.New("the S/MIME certificate has no email addresses")
+	}
+
+	if len(cert.Leaf.ExtKeyUsage) > 0 && !slices.Contains(cert.Leaf.ExtKeyUsage, x509.ExtKeyUsageEmailProtection) && !slices.Contains(cert.Leaf.ExtKeyUsage, x509.ExtKeyUsageAny) {
+		return errors.New("the S/MIME certificate can't be used for email protection")
+	}
+
+	if time.Now().After(cert.Leaf.NotAfter) {
+		return fmt.Errorf("the S/MIME certificate expired on %s", cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Enabled tells if the emails may be signed
+func (o *SigningOptions) Enabled() bool {
+	return o != nil && (len(o.DKIMKeys) > 0 || o.SMIME != nil)
+}
+
+// Sign renders the message S/MIME signed if the certificate is issued for the sender
+// and adds a DKIM signature if the sender's domain has a key. The S/MIME signature
+// has the signing time and a random boundary, so the message is rendered only once
+func (o *SigningOptions) Sign(m *mail.Msg) ([]byte, error) {
+	from, err := m.GetSender(false)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.SMIME != nil && slices.ContainsFunc(o.SMIME.Leaf.EmailAddresses, func(address string) bool { return strings.EqualFold(address, from) }) {
+		if err := m.SignWithTLSCertificate(o.SMIME); err != nil {
+			return nil, fmt.Errorf("could not S/MIME sign the message: %v", err)
+		}
+	}
+
+	message := bytes.Buffer{}
+	if _, err := m.WriteTo(&message); err != nil {
+		return nil, fmt.Errorf("could not render the message: %v", err)
+	}
+
+	key := DKIMKeyFor(o.DKIMKeys, from)
+	if key == nil {
+		return message.Bytes(), nil
+	}
+
+	signed, err := key.Sign(message.Bytes(), time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("could not DKIM sign the message: %v", err)
+	}
+	return signed, nil
+}
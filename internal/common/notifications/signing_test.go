@@ -0,0 +1,297 @@
+package notifications
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/scncore/ent"
+	"github.com/wneessen/go-mail"
+)
+
+const testSender = "scnorion@example.com"
+
+// testMessage builds the email of a notification with an attachment as the email transport does
+func testMessage(t *testing.T) *mail.Msg {
+	t.Helper()
+
+	event := testEvent()
+	event.Attachments = []Attachment{
+		{Filename: "user.pfx", ContentType: "application/x-pkcs12", Content: base64.StdEncoding.EncodeToString([]byte("certificate"))},
+	}
+
+	m, err := PrepareMessage(context.Background(), event, &ent.Settings{MessageFrom: testSender})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// verifyDKIM checks the signatures of the message with a verifier that doesn't share
+// code with the signer, the public key is published as selector._domainkey.example.com
+func verifyDKIM(t *testing.T, message []byte, public crypto.PublicKey) []*dkim.Verification {
+	t.Helper()
+
+	var record string
+	switch k := public.(type) {
+	case ed25519.PublicKey:
+		record = "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(k)
+	default:
+		der, err := x509.MarshalPKIXPublicKey(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		record = "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+	}
+
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(message), &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			if domain != "selector._domainkey.example.com" {
+				return nil, fmt.Errorf("unexpected lookup of %s", domain)
+			}
+			return []string{record}, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return verifications
+}
+
+func TestDKIMSignature(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, signer := range map[string]crypto.Signer{"rsa-sha256": rsaKey, "ed25519-sha256": ed25519Key} {
+		t.Run(name, func(t *testing.T) {
+			opts := &SigningOptions{DKIMKeys: map[string]*DKIMKey{
+				"example.com": {Domain: "example.com", Selector: "selector", Signer: signer},
+			}}
+
+			message, err := opts.Sign(testMessage(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			verifications := verifyDKIM(t, message, signer.Public())
+			if len(verifications) != 1 {
+				t.Fatalf("got %d signatures", len(verifications))
+			}
+			v := verifications[0]
+			if v.Err != nil {
+				t.Fatalf("the signature is not valid: %v", v.Err)
+			}
+			if v.Domain != "example.com" {
+				t.Errorf("got domain %s", v.Domain)
+			}
+			for _, header := range []string{"from", "to", "subject", "date", "message-id", "mime-version", "content-type"} {
+				if !strings.Contains(strings.ToLower(strings.Join(v.HeaderKeys, ":")), header) {
+					t.Errorf("header %s is not signed, signed %v", header, v.HeaderKeys)
+				}
+			}
+
+			// A changed body or a changed subject are detected
+			for _, tampered := range [][]byte{
+				bytes.Replace(message, []byte("certificate"), []byte("certificatf"), 1),
+				bytes.Replace(message, []byte("Subject: Your certificate"), []byte("Subject: Your certificatf"), 1),
+			} {
+				if bytes.Equal(tampered, message) {
+					t.Fatal("the message has not been changed")
+				}
+				if v := verifyDKIM(t, tampered, signer.Public()); len(v) != 1 || v[0].Err == nil {
+					t.Error("a changed message has a valid signature")
+				}
+			}
+		})
+	}
+}
+
+// TestDKIMLineEndings checks a message with bare LF is signed as it's sent, with CRLF
+func TestDKIMLineEndings(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dkimKey := &DKIMKey{Domain: "example.com", Selector: "selector", Signer: key}
+
+	message := "From: " + testSender + "\nTo: user@example.com\nSubject:   folded\n\tsubject\n\nline  with   spaces \n\n\n"
+	signed, err := dkimKey.Sign([]byte(message), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(bytes.ReplaceAll(signed, []byte("\r\n"), nil), []byte("\n")) {
+		t.Error("the signed message has bare LF")
+	}
+
+	if v := verifyDKIM(t, signed, key.Public()); len(v) != 1 || v[0].Err != nil {
+		t.Fatalf("the signature is not valid: %+v", v)
+	}
+
+	if _, err := dkimKey.Sign([]byte("To: user@example.com\r\n\r\nbody"), time.Now()); err == nil {
+		t.Error("a message without From has been signed")
+	}
+}
+
+// testSMIMECertificate returns a CA and a certificate it issued for the sender to sign emails
+func testSMIMECertificate(t *testing.T) (*x509.Certificate, *tls.Certificate) {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "scnorion CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(2),
+		Subject:        pkix.Name{CommonName: testSender},
+		EmailAddresses: []string{testSender},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+	if err := checkSMIMECertificate(cert); err != nil {
+		t.Fatal(err)
+	}
+	return ca, cert
+}
+
+// TestSMIMESignature checks openssl verifies the signature against the CA, with and
+// without a DKIM signature added afterwards
+func TestSMIMESignature(t *testing.T) {
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl is not installed")
+	}
+
+	ca, cert := testSMIMECertificate(t)
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, dkimKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, opts := range map[string]*SigningOptions{
+		"smime": {SMIME: cert},
+		"smime and dkim": {SMIME: cert, DKIMKeys: map[string]*DKIMKey{
+			"example.com": {Domain: "example.com", Selector: "selector", Signer: dkimKey},
+		}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			message, err := opts.Sign(testMessage(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Contains(message, []byte("multipart/signed")) {
+				t.Fatalf("the message is not S/MIME signed:\n%s", message)
+			}
+
+			messageFile := filepath.Join(t.TempDir(), "message.eml")
+			if err := os.WriteFile(messageFile, message, 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			out, err := exec.Command("openssl", "smime", "-verify", "-in", messageFile, "-CAfile", caFile, "-purpose", "smimesign").CombinedOutput()
+			if err != nil {
+				t.Fatalf("openssl could not verify the signature: %v\n%s", err, out)
+			}
+			if !bytes.Contains(out, []byte("Your certificate")) {
+				t.Errorf("the signed content has not the notification:\n%s", out)
+			}
+
+			if opts.DKIMKeys != nil {
+				if v := verifyDKIM(t, message, dkimKey.Public()); len(v) != 1 || v[0].Err != nil {
+					t.Fatalf("the DKIM signature is not valid: %+v", v)
+				}
+			}
+
+			// A changed signed part doesn't pass
+			tampered := filepath.Join(t.TempDir(), "tampered.eml")
+			if err := os.WriteFile(tampered, bytes.Replace(message, []byte("ready"), []byte("reaDy"), 1), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if out, err := exec.Command("openssl", "smime", "-verify", "-in", tampered, "-CAfile", caFile, "-purpose", "smimesign").CombinedOutput(); err == nil {
+				t.Errorf("openssl has verified a changed message:\n%s", out)
+			}
+		})
+	}
+}
+
+// TestSMIMEOtherSender checks an email from an address the certificate doesn't have is not S/MIME signed
+func TestSMIMEOtherSender(t *testing.T) {
+	_, cert := testSMIMECertificate(t)
+
+	event := testEvent()
+	m, err := PrepareMessage(context.Background(), event, &ent.Settings{MessageFrom: "other@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message, err := (&SigningOptions{SMIME: cert}).Sign(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(message, []byte("multipart/signed")) {
+		t.Error("an email from another sender has been S/MIME signed")
+	}
+}
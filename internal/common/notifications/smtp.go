@@ -0,0 +1,272 @@
+package notifications
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/scncore/ent"
+	"github.com/wneessen/go-mail"
+)
+
+// SMTP connection security modes
+const (
+	// SMTPTLSModeSMTPS is implicit TLS, usually on port 465
+	SMTPTLSModeSMTPS = "smtps"
+	// SMTPTLSModeStartTLS fails if the relay doesn't offer STARTTLS
+	SMTPTLSModeStartTLS = "starttls"
+	// SMTPTLSModeOpportunistic uses STARTTLS only if the relay offers it
+	SMTPTLSModeOpportunistic = "opportunistic"
+	// SMTPTLSModeNone never encrypts the connection
+	SMTPTLSModeNone = "none"
+)
+
+// SMTPTLSOptions are the worker side TLS settings for the SMTP relay, the console
+// settings only say whether TLS and STARTTLS are used
+type SMTPTLSOptions struct {
+	// Mode overrides the mode derived from the console settings if set
+	Mode         string
+	RootCAs      *x509.CertPool
+	Certificates []tls.Certificate
+}
+
+// LoadSMTPTLSOptions validates the mode and reads the CA bundle and the client certificate, all are optional
+func LoadSMTPTLSOptions(mode, caBundlePath, certPath, keyPath string) (*SMTPTLSOptions, error) {
+	opts := SMTPTLSOptions{Mode: strings.ToLower(strings.TrimSpace(mode))}
+
+	switch opts.Mode {
+	case "", SMTPTLSModeSMTPS, SMTPTLSModeStartTLS, SMTPTLSModeOpportunistic, SMTPTLSModeNone:
+	default:
+		return nil, fmt.Errorf("unsupported SMTP TLS mode %s, use %s, %s, %s or %s", mode, SMTPTLSModeSMTPS, SMTPTLSModeStartTLS, SMTPTLSModeOpportunistic, SMTPTLSModeNone)
+	}
+
+	if caBundlePath != "" {
+		data, err := os.ReadFile(caBundlePath)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the SMTP CA bundle: %v", err)
+		}
+		opts.RootCAs = x509.NewCertPool()
+		if !opts.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no PEM certificates found in the SMTP CA bundle %s", caBundlePath)
+		}
+	}
+
+	if certPath != "" || keyPath != "" {
+		if certPath == "" || keyPath == "" {
+			return nil, errors.New("both the SMTP client certificate and its private key are required")
+		}
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the SMTP client certificate: %v", err)
+		}
+		opts.Certificates = []tls.Certificate{cert}
+	}
+
+	return &opts, nil
+}
+
+// SMTPTLSMode returns the mode used for the relay. Without an override, TLS alone
+// means implicit TLS, STARTTLS means mandatory STARTTLS and neither means STARTTLS
+// if offered, plain text is only used if the worker is configured with none
+func SMTPTLSMode(settings *ent.Settings, opts *SMTPTLSOptions) string {
+	if opts != nil && opts.Mode != "" {
+		return opts.Mode
+	}
+
+	switch {
+	case settings.SMTPStarttls:
+		return SMTPTLSModeStartTLS
+	case settings.SMTPTLS:
+		return SMTPTLSModeSMTPS
+	default:
+		return SMTPTLSModeOpportunistic
+	}
+}
+
+func smtpTLSClientOptions(settings *ent.Settings, opts *SMTPTLSOptions) []mail.Option {
+	tlsConfig := &tls.Config{
+		ServerName: strings.TrimSpace(settings.SMTPServer),
+		MinVersion: tls.VersionTLS12,
+	}
+	if opts != nil {
+		tlsConfig.RootCAs = opts.RootCAs
+		tlsConfig.Certificates = opts.Certificates
+	}
+
+	options := []mail.Option{mail.WithTLSConfig(tlsConfig)}
+
+	switch SMTPTLSMode(settings, opts) {
+	case SMTPTLSModeSMTPS:
+		options = append(options, mail.WithSSL())
+	case SMTPTLSModeStartTLS:
+		options = append(options, mail.WithTLSPolicy(mail.TLSMandatory))
+	case SMTPTLSModeOpportunistic:
+		options = append(options, mail.WithTLSPolicy(mail.TLSOpportunistic))
+	case SMTPTLSModeNone:
+		options = append(options, mail.WithTLSPolicy(mail.NoTLS))
+	}
+
+	return options
+}
+
+// SMTPConnectionReport describes the connection TestSMTPConnection established
+type SMTPConnectionReport struct {
+	Server         string
+	Mode           string
+	Encrypted      bool
+	TLSVersion     string
+	CipherSuite    string
+	ServerSubject  string
+	ServerIssuer   string
+	ServerNotAfter string
+	Authenticated  bool
+}
+
+// TestSMTPConnection connects and authenticates to the relay without sending a message
+func TestSMTPConnection(ctx context.Context, settings *ent.Settings, opts *SMTPTLSOptions, tokens *OAuth2TokenSource) (*SMTPConnectionReport, error) {
+	report := SMTPConnectionReport{
+		Server:        fmt.Sprintf("%s:%d", strings.TrimSpace(settings.SMTPServer), settings.SMTPPort),
+		Mode:          SMTPTLSMode(settings, opts),
+		Authenticated: UsesXOAUTH2(settings) || (settings.SMTPAuth != "NOAUTH" && (settings.SMTPUser != "" || settings.SMTPPassword != "")),
+	}
+
+	client, err := PrepareSMTPClient(settings, opts, tokens)
+	if err != nil {
+		return &report, err
+	}
+
+	smtpClient, err := client.DialToSMTPClientWithContext(ctx)
+	if err != nil {
+		return &report, err
+	}
+	defer client.CloseWithSMTPClient(smtpClient)
+
+	state, err := smtpClient.GetTLSConnectionState()
+	if err != nil || state == nil {
+		return &report, nil
+	}
+
+	report.Encrypted = true
+	report.TLSVersion = tls.VersionName(state.Version)
+	report.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	if len(state.PeerCertificates) > 0 {
+		leaf := state.PeerCertificates[0]
+		report.ServerSubject = leaf.Subject.String()
+		report.ServerIssuer = leaf.Issuer.String()
+		report.ServerNotAfter = leaf.NotAfter.UTC().Format("2006-01-02 15:04 MST")
+	}
+	return &report, nil
+}
+
+// SMTPClient is the relay of a tenant, a single client can be used concurrently
+// as every DialAndSend opens its own connection
+type SMTPClient struct {
+	Settings *ent.Settings
+	Client   *mail.Client
+	Signing  *SigningOptions
+	// Tokens are set if the relay uses XOAUTH2
+	Tokens *OAuth2TokenSource
+}
+
+// SMTPClientCache keeps a client per tenant so settings are not read for every
+// notification, Invalidate must be called when the settings change
+type SMTPClientCache struct {
+	mu         sync.Mutex
+	clients    map[int]*SMTPClient
+	load       func(tenantID int) (*ent.Settings, error)
+	tlsOptions *SMTPTLSOptions
+	signing    *SigningOptions
+	// tokens has the client credentials, the tokens are cached by the sources of
+	// the tenants' relays which outlive the clients if the relay doesn't change
+	tokens       *OAuth2TokenSource
+	tokenSources map[oauth2SourceKey]*OAuth2TokenSource
+}
+
+// oauth2SourceKey is the mailbox of a tenant's relay the tokens are requested for
+type oauth2SourceKey struct {
+	tenantID int
+	relay    string
+	user     string
+}
+
+func NewSMTPClientCache(load func(tenantID int) (*ent.Settings, error), tlsOptions *SMTPTLSOptions, signing *SigningOptions, tokens *OAuth2TokenSource) *SMTPClientCache {
+	return &SMTPClientCache{
+		clients:      map[int]*SMTPClient{},
+		load:         load,
+		tlsOptions:   tlsOptions,
+		signing:      signing,
+		tokens:       tokens,
+		tokenSources: map[oauth2SourceKey]*OAuth2TokenSource{},
+	}
+}
+
+// Get returns the tenant's client, creating it from its settings the first time
+func (c *SMTPClientCache) Get(tenantID int) (*SMTPClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if client, ok := c.clients[tenantID]; ok {
+		return client, nil
+	}
+
+	settings, err := c.load(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens *OAuth2TokenSource
+	if UsesXOAUTH2(settings) && c.tokens != nil {
+		tokens = c.tokenSource(tenantID, settings)
+	}
+
+	mailClient, err := PrepareSMTPClient(settings, c.tlsOptions, tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &SMTPClient{Settings: settings, Client: mailClient, Signing: c.signing, Tokens: tokens}
+	c.clients[tenantID] = client
+	return client, nil
+}
+
+// tokenSource returns the source of the tenant's relay, the sources of the relays
+// the tenant used before are dropped with their tokens
+func (c *SMTPClientCache) tokenSource(tenantID int, settings *ent.Settings) *OAuth2TokenSource {
+	key := oauth2SourceKey{
+		tenantID: tenantID,
+		relay:    fmt.Sprintf("%s:%d", strings.ToLower(strings.TrimSpace(settings.SMTPServer)), settings.SMTPPort),
+		user:     strings.ToLower(settings.SMTPUser),
+	}
+
+	for k := range c.tokenSources {
+		if k.tenantID == tenantID && k != key {
+			delete(c.tokenSources, k)
+		}
+	}
+
+	source, ok := c.tokenSources[key]
+	if !ok {
+		source = c.tokens.newSource()
+		c.tokenSources[key] = source
+	}
+	return source
+}
+
+// Invalidate drops the client of the tenants, or every client if none is given
+func (c *SMTPClientCache) Invalidate(tenantIDs ...int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(tenantIDs) == 0 {
+		c.clients = map[int]*SMTPClient{}
+		return
+	}
+	for _, id := range tenantIDs {
+		delete(c.clients, id)
+	}
+}
@@ -0,0 +1,270 @@
+package notifications
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/scncore/ent"
+)
+
+// testSMTPServer is a relay on this host that accepts the XOAUTH2 tokens that have not been revoked
+type testSMTPServer struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	revoked  map[string]bool
+	auths    []string
+	messages []string
+}
+
+func newTestSMTPServer(t *testing.T) *testSMTPServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testSMTPServer{listener: listener, revoked: map[string]bool{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return s
+}
+
+func (s *testSMTPServer) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *testSMTPServer) Revoke(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revoked[token] = true
+}
+
+// Auths returns the user and token of every authentication, as user/token
+func (s *testSMTPServer) Auths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.auths...)
+}
+
+func (s *testSMTPServer) Messages() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.messages)
+}
+
+func (s *testSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(lines ...string) {
+		fmt.Fprint(conn, strings.Join(lines, "\r\n")+"\r\n")
+	}
+
+	reply("220 localhost ESMTP")
+	authenticated := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command, argument, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+
+		switch strings.ToUpper(command) {
+		case "EHLO", "HELO":
+			reply("250-localhost", "250-AUTH XOAUTH2", "250 8BITMIME")
+		case "AUTH":
+			mechanism, initial, _ := strings.Cut(argument, " ")
+			response, err := base64.StdEncoding.DecodeString(initial)
+			if mechanism != "XOAUTH2" || err != nil {
+				reply("504 5.5.4 Unrecognized authentication type")
+				continue
+			}
+			fields := strings.Split(string(response), "\x01")
+			user := strings.TrimPrefix(fields[0], "user=")
+			token := strings.TrimPrefix(fields[1], "auth=Bearer ")
+
+			s.mu.Lock()
+			s.auths = append(s.auths, user+"/"+token)
+			revoked := s.revoked[token]
+			s.mu.Unlock()
+
+			if revoked {
+				// The error goes in a challenge, the client answers it empty
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte(`{"status":"401","schemes":"bearer"}`)))
+				if _, err := r.ReadString('\n'); err != nil {
+					return
+				}
+				reply("535 5.7.8 Authentication unsuccessful")
+				continue
+			}
+			authenticated = true
+			reply("235 2.7.0 Authentication successful")
+		case "MAIL":
+			if !authenticated {
+				reply("530 5.7.0 Authentication required")
+				continue
+			}
+			reply("250 2.1.0 OK")
+		case "RCPT", "RSET", "NOOP":
+			reply("250 2.1.5 OK")
+		case "DATA":
+			reply("354 Go ahead")
+			message := strings.Builder{}
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				message.WriteString(line)
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, message.String())
+			s.mu.Unlock()
+			reply("250 2.0.0 OK queued")
+		case "QUIT":
+			reply("221 2.0.0 Bye")
+			return
+		default:
+			reply("502 5.5.2 Command not implemented")
+		}
+	}
+}
+
+// TestSMTPClientCacheTokens checks every tenant's relay gets its own XOAUTH2 token from the
+// worker's client credentials and a revoked token is only renewed for its tenant
+func TestSMTPClientCacheTokens(t *testing.T) {
+	tokenServer := newTestTokenServer(t)
+	relay := newTestSMTPServer(t)
+
+	var mu sync.Mutex
+	mailboxes := map[int]string{1: "one@example.com", 2: "two@example.com", 3: "three@example.com"}
+	load := func(tenantID int) (*ent.Settings, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		settings := &ent.Settings{
+			SMTPServer:  "127.0.0.1",
+			SMTPPort:    relay.Port(),
+			SMTPUser:    mailboxes[tenantID],
+			SMTPAuth:    "XOAUTH2",
+			MessageFrom: mailboxes[tenantID],
+		}
+		// Tenant 3 doesn't authenticate
+		if tenantID == 3 {
+			settings.SMTPAuth = "NOAUTH"
+		}
+		return settings, nil
+	}
+
+	cache := NewSMTPClientCache(load, &SMTPTLSOptions{Mode: SMTPTLSModeNone}, nil, tokenServer.Source(t))
+
+	send := func(tenantID int) {
+		t.Helper()
+
+		client, err := cache.Get(tenantID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		transport := &EmailTransport{ChannelName: "email", SMTP: client}
+		if err := transport.Send(context.Background(), testEvent()); err != nil {
+			t.Fatalf("tenant %d: %v", tenantID, err)
+		}
+	}
+	wantAuths := func(want ...string) {
+		t.Helper()
+
+		if got := relay.Auths(); strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Fatalf("got authentications %v, want %v", got, want)
+		}
+	}
+
+	send(1)
+	send(2)
+	send(1)
+	wantAuths("one@example.com/token-1", "two@example.com/token-2", "one@example.com/token-1")
+
+	client, err := cache.Get(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Tokens != nil {
+		t.Error("a relay without XOAUTH2 has a token source")
+	}
+
+	// The revoked token is renewed once and the other tenant keeps its own
+	relay.Revoke("token-1")
+	send(1)
+	send(2)
+	wantAuths("one@example.com/token-1", "two@example.com/token-2", "one@example.com/token-1",
+		"one@example.com/token-1", "one@example.com/token-3", "two@example.com/token-2")
+
+	// The token outlives the client while the relay doesn't change
+	cache.Invalidate()
+	send(2)
+	if tokenServer.Issued() != 3 {
+		t.Errorf("%d tokens have been issued, the token of tenant 2 has not been reused", tokenServer.Issued())
+	}
+
+	// A tenant that moves to another mailbox doesn't use the token of the previous one
+	mu.Lock()
+	mailboxes[1] = "other@example.com"
+	mu.Unlock()
+	cache.Invalidate(1)
+	send(1)
+	wantAuths("one@example.com/token-1", "two@example.com/token-2", "one@example.com/token-1",
+		"one@example.com/token-1", "one@example.com/token-3", "two@example.com/token-2",
+		"two@example.com/token-2", "other@example.com/token-4")
+	if relay.Messages() != 7 {
+		t.Errorf("the relay got %d messages, want 7", relay.Messages())
+	}
+
+	// Without the worker's credentials a XOAUTH2 relay can't be used
+	if _, err := NewSMTPClientCache(load, nil, nil, nil).Get(1); err == nil {
+		t.Error("a XOAUTH2 relay has been used without client credentials")
+	}
+}
+
+// TestSMTPRevokedToken checks a token that is rejected again after it's renewed is a retryable failure
+func TestSMTPRevokedToken(t *testing.T) {
+	tokenServer := newTestTokenServer(t)
+	relay := newTestSMTPServer(t)
+	relay.Revoke("token-1")
+	relay.Revoke("token-2")
+
+	settings := &ent.Settings{SMTPServer: "127.0.0.1", SMTPPort: relay.Port(), SMTPUser: "one@example.com", SMTPAuth: "XOAUTH2", MessageFrom: "one@example.com"}
+	cache := NewSMTPClientCache(func(int) (*ent.Settings, error) { return settings, nil }, &SMTPTLSOptions{Mode: SMTPTLSModeNone}, nil, tokenServer.Source(t))
+
+	client, err := cache.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = (&EmailTransport{ChannelName: "email", SMTP: client}).Send(context.Background(), testEvent())
+
+	deliveryErr := &DeliveryError{}
+	if !errors.As(err, &deliveryErr) || deliveryErr.Permanent {
+		t.Fatalf("got %v, want a retryable delivery error", err)
+	}
+	if got := relay.Auths(); strings.Join(got, " ") != "one@example.com/token-1 one@example.com/token-2" {
+		t.Errorf("got authentications %v", got)
+	}
+}
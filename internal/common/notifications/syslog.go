@@ -0,0 +1,119 @@
+package notifications
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Syslog facilities and severity used for the notifications (RFC 5424)
+const (
+	syslogFacilityLocal0 = 16
+	syslogSeverityNotice = 5
+	syslogTimeout        = 10 * time.Second
+)
+
+// SyslogTransport sends RFC 5424 messages over UDP or TCP, log/syslog is not used
+// as it's not available on Windows
+type SyslogTransport struct {
+	ChannelName string `json:"-"`
+	// Network is udp (default) or tcp
+	Network string `json:"network,omitempty"`
+	Address string `json:"address"`
+	// Tag is the APP-NAME of the messages, scnorion by default
+	Tag string `json:"tag,omitempty"`
+	// Facility is the syslog facility code, local0 by default
+	Facility *int `json:"facility,omitempty"`
+}
+
+func (t *SyslogTransport) Name() string {
+	return t.ChannelName
+}
+
+func (t *SyslogTransport) Send(ctx context.Context, event *Event) error {
+	if t.Address == "" {
+		return fmt.Errorf("the syslog channel has no address")
+	}
+
+	network := t.Network
+	if network == "" {
+		network = "udp"
+	}
+	if network != "udp" && network != "tcp" {
+		return fmt.Errorf("unsupported syslog network %s", network)
+	}
+
+	dialer := net.Dialer{Timeout: syslogTimeout}
+	conn, err := dialer.DialContext(ctx, network, t.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SetWriteDeadline(time.Now().Add(syslogTimeout)); err != nil {
+		return err
+	}
+
+	msg := t.Format(event, time.Now())
+	if network == "tcp" {
+		// Octet counting framing (RFC 6587)
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+
+	_, err = conn.Write([]byte(msg))
+	return err
+}
+
+// Format returns the RFC 5424 message for the event
+func (t *SyslogTransport) Format(event *Event, now time.Time) string {
+	facility := syslogFacilityLocal0
+	if t.Facility != nil {
+		facility = *t.Facility
+	}
+
+	tag := t.Tag
+	if tag == "" {
+		tag = "scnorion"
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	n := event.Notification
+	text := strings.Join(strings.Fields(PlainText(n.MessageText)), " ")
+	msg := fmt.Sprintf("%s: %s", chatTitle(event), text)
+	if n.To != "" {
+		msg += " (to: " + n.To + ")"
+	}
+
+	// 32473 is the private enterprise number reserved for examples, there's no registered one for scnorion
+	return fmt.Sprintf("<%d>1 %s %s %s %d %s [scnorion@32473 type=\"%s\" tenant=\"%d\"] %s",
+		facility*8+syslogSeverityNotice, now.UTC().Format(time.RFC3339), hostname, tag, os.Getpid(),
+		syslogMsgID(event.Type), syslogParam(event.Type), event.TenantID, msg)
+}
+
+// syslogMsgID keeps the MSGID within the printable ASCII without spaces RFC 5424 allows
+func syslogMsgID(s string) string {
+	id := strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return -1
+		}
+		return r
+	}, s)
+	if id == "" {
+		return "-"
+	}
+	if len(id) > 32 {
+		id = id[:32]
+	}
+	return id
+}
+
+func syslogParam(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(s)
+}
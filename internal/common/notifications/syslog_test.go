@@ -0,0 +1,143 @@
+package notifications
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogFormat(t *testing.T) {
+	facility := 4
+	transport := &SyslogTransport{Tag: "app", Facility: &facility}
+
+	event := testEvent()
+	event.Type = "send certificate\"]"
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := fmt.Sprintf(`<37>1 2026-01-02T03:04:05Z %s app %d sendcertificate"] [scnorion@32473 type="send certificate\"\]" tenant="3"] scnorion | Your certificate: Hi your certificate is ready (to: user@example.com)`,
+		hostname, os.Getpid())
+	if got := transport.Format(event, now); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestSyslogUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	transport := &SyslogTransport{Address: conn.LocalAddr().String()}
+	if err := transport.Send(context.Background(), testEvent()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 2048)
+	n, _, err := conn.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// local0 and notice by default
+	if !regexp.MustCompile(`^<133>1 \S+ \S+ scnorion \d+ send_certificate \[scnorion@32473 type="send_certificate" tenant="3"\] `).Match(b[:n]) {
+		t.Errorf("unexpected message %q", b[:n])
+	}
+}
+
+// TestSyslogTCP checks the messages are framed by octet counting
+func TestSyslogTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	messages := make(chan string, 1)
+	errs := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		length, err := r.ReadString(' ')
+		if err != nil {
+			errs <- err
+			return
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(length))
+		if err != nil {
+			errs <- err
+			return
+		}
+		msg := make([]byte, size)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			errs <- err
+			return
+		}
+		messages <- string(msg)
+	}()
+
+	transport := &SyslogTransport{Network: "tcp", Address: listener.Addr().String()}
+	if err := transport.Send(context.Background(), testEvent()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-messages:
+		if !strings.HasPrefix(msg, "<133>1 ") || !strings.HasSuffix(msg, "(to: user@example.com)") {
+			t.Errorf("unexpected message %q", msg)
+		}
+	case err := <-errs:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message has been received")
+	}
+}
+
+func TestSyslogErrors(t *testing.T) {
+	if err := (&SyslogTransport{}).Send(context.Background(), testEvent()); err == nil {
+		t.Error("a syslog channel without address has succeeded")
+	}
+	if err := (&SyslogTransport{Network: "unix", Address: "/dev/log"}).Send(context.Background(), testEvent()); err == nil {
+		t.Error("an unsupported network has been accepted")
+	}
+
+	// Nobody listens on the port once the listener is closed
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	if err := (&SyslogTransport{Network: "tcp", Address: address}).Send(context.Background(), testEvent()); err == nil {
+		t.Error("sending to a closed port has succeeded")
+	}
+
+	// The delivery deadline stops the dial
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := (&SyslogTransport{Network: "tcp", Address: address}).Send(ctx, testEvent()); err == nil {
+		t.Error("a cancelled delivery has succeeded")
+	}
+}
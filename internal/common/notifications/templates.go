@@ -0,0 +1,460 @@
+package notifications
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+
+	"github.com/scncore/nats"
+)
+
+const (
+	// TemplateBranding is the template type with the logo, colors, footer and
+	// layout used by every notification type of a tenant
+	TemplateBranding = "branding"
+	// DefaultLocale is used when neither the notification nor the worker set one
+	DefaultLocale = "en"
+)
+
+// Branding is the look of the built-in email layout
+type Branding struct {
+	Locale          string
+	LogoURL         string
+	LogoAlt         string
+	PrimaryColor    string
+	BodyColor       string
+	BackgroundColor string
+	// Footer is HTML shown below the message
+	Footer string
+}
+
+// Lang is the value of the lang attribute of the email
+func (b Branding) Lang() string {
+	if b.Locale == "" {
+		return "und"
+	}
+	return b.Locale
+}
+
+var DefaultBranding = Branding{
+	LogoURL:         "https://res.cloudinary.com/dyjqffeuz/image/upload/v1722080061/banner_bedozh.png",
+	LogoAlt:         "scnorion Logo",
+	PrimaryColor:    "#3a7d22",
+	BodyColor:       "#dff7ea",
+	BackgroundColor: "#f5f7f6",
+}
+
+// Layout is how an email looks, HTML replaces the built-in layout if set
+type Layout struct {
+	Branding Branding
+	HTML     string
+}
+
+// Template customizes a notification type for a tenant and a locale, an empty locale
+// matches every locale. Texts are Go templates with the notification data as a map,
+// Text is HTML and its values are escaped. Empty fields are taken from the next
+// template in the fallback chain
+type Template struct {
+	TenantID        int    `json:"-"`
+	Type            string `json:"-"`
+	Locale          string `json:"-"`
+	Subject         string `json:"subject,omitempty"`
+	Title           string `json:"title,omitempty"`
+	Greeting        string `json:"greeting,omitempty"`
+	Text            string `json:"text,omitempty"`
+	Action          string `json:"action,omitempty"`
+	HTML            string `json:"html,omitempty"`
+	LogoURL         string `json:"logo_url,omitempty"`
+	LogoAlt         string `json:"logo_alt,omitempty"`
+	PrimaryColor    string `json:"primary_color,omitempty"`
+	BodyColor       string `json:"body_color,omitempty"`
+	BackgroundColor string `json:"background_color,omitempty"`
+	Footer          string `json:"footer,omitempty"`
+}
+
+var templateColor = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// Validate checks the colors, as they end up in style attributes, and the syntax of the texts
+func (t *Template) Validate() error {
+	for _, color := range []string{t.PrimaryColor, t.BodyColor, t.BackgroundColor} {
+		if color != "" && !templateColor.MatchString(color) {
+			return fmt.Errorf("invalid color %s, colors must be #rgb or #rrggbb", color)
+		}
+	}
+
+	for _, text := range []string{t.Subject, t.Title, t.Greeting, t.Action} {
+		if _, err := texttemplate.New("").Parse(text); err != nil {
+			return err
+		}
+	}
+	for _, text := range []string{t.Text, t.HTML} {
+		if _, err := htmltemplate.New("").Parse(text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NormalizeLocale turns es_ES or ES-es into es-es so locales can be compared
+func NormalizeLocale(locale string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(locale)), "_", "-")
+}
+
+// TemplateSource returns the custom templates of every tenant
+type TemplateSource func() ([]*Template, error)
+
+type templateKey struct {
+	tenantID     int
+	templateType string
+	locale       string
+}
+
+// TemplateRegistry holds the custom templates by type, tenant and locale. A template
+// is looked up for the tenant, then for the default tenant and then in the built-in
+// templates, each with the full locale, its language and no locale
+type TemplateRegistry struct {
+	mu            sync.RWMutex
+	templates     map[templateKey]*Template
+	sources       []TemplateSource
+	defaultLocale string
+}
+
+// NewTemplateRegistry returns a registry with only the built-in templates until it's
+// loaded, templates of later sources replace the ones of earlier sources
+func NewTemplateRegistry(defaultLocale string, sources ...TemplateSource) *TemplateRegistry {
+	if defaultLocale == "" {
+		defaultLocale = DefaultLocale
+	}
+	return &TemplateRegistry{
+		templates:     map[templateKey]*Template{},
+		sources:       sources,
+		defaultLocale: NormalizeLocale(defaultLocale),
+	}
+}
+
+// Load reads the templates from the sources again, invalid templates are skipped so
+// they don't hide the rest and the templates are kept if a source can't be read
+func (r *TemplateRegistry) Load() error {
+	templates := map[templateKey]*Template{}
+
+	for _, source := range r.sources {
+		loaded, err := source()
+		if err != nil {
+			return err
+		}
+		for _, t := range loaded {
+			if err := t.Validate(); err != nil {
+				log.Printf("[ERROR]: notification template %s of tenant %d and locale %q is skipped, reason: %v", t.Type, t.TenantID, t.Locale, err)
+				continue
+			}
+			templates[templateKey{t.TenantID, t.Type, NormalizeLocale(t.Locale)}] = t
+		}
+	}
+
+	r.mu.Lock()
+	r.templates = templates
+	r.mu.Unlock()
+	return nil
+}
+
+// chain returns the custom templates for the type from the most to the least specific, and the built-in ones
+func (r *TemplateRegistry) chain(tenantID int, templateType, locale string) (custom []*Template, builtin []*Template) {
+	locales := []string{locale}
+	if lang, _, found := strings.Cut(locale, "-"); found {
+		locales = append(locales, lang)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	tenants := []int{tenantID}
+	if tenantID != 0 {
+		tenants = append(tenants, 0)
+	}
+	for _, tenant := range tenants {
+		for _, l := range append(locales, "") {
+			if t, ok := r.templates[templateKey{tenant, templateType, l}]; ok {
+				custom = append(custom, t)
+			}
+		}
+	}
+
+	for _, l := range append(locales, DefaultLocale) {
+		if t, ok := builtinTemplates[templateKey{0, templateType, l}]; ok {
+			builtin = append(builtin, t)
+		}
+	}
+	return custom, builtin
+}
+
+// Render localizes the event with the template name for its tenant and locale, the
+// notification's type if name is empty. Custom templates take precedence over the texts
+// of the notification, which take precedence over the built-in templates, so texts sent
+// by older publishers are kept unless a tenant customizes them
+func (r *TemplateRegistry) Render(event *Event, name string, data map[string]string) error {
+	if name == "" {
+		name = event.Type
+	}
+
+	locale := NormalizeLocale(event.Locale)
+	if locale == "" {
+		locale = r.defaultLocale
+	}
+	event.Locale = locale
+
+	n := event.Notification
+	values := map[string]string{"to": n.To, "action_url": n.MessageActionURL}
+	for k, v := range data {
+		values[k] = v
+	}
+
+	custom, builtin := r.chain(event.TenantID, name, locale)
+	brandingCustom, brandingBuiltin := r.chain(event.TenantID, TemplateBranding, locale)
+	texts := templateChain{custom: custom, builtin: builtin}
+	// The type may override the tenant's branding
+	looks := templateChain{custom: append(custom, brandingCustom...), builtin: append(builtin, brandingBuiltin...)}
+
+	var err error
+	text := func(field func(*Template) string, own string) string {
+		v, isTemplate := texts.resolve(field, own)
+		if !isTemplate {
+			return v
+		}
+		return renderText(v, values, &err)
+	}
+	html := func(c templateChain, field func(*Template) string, own string) string {
+		v, isTemplate := c.resolve(field, own)
+		if !isTemplate {
+			return v
+		}
+		return renderHTML(v, values, &err)
+	}
+	value := func(field func(*Template) string) string {
+		v, _ := looks.resolve(field, "")
+		return v
+	}
+
+	rendered := *n
+	rendered.Subject = text(func(t *Template) string { return t.Subject }, n.Subject)
+	rendered.MessageTitle = text(func(t *Template) string { return t.Title }, n.MessageTitle)
+	rendered.MessageGreeting = text(func(t *Template) string { return t.Greeting }, n.MessageGreeting)
+	rendered.MessageText = html(texts, func(t *Template) string { return t.Text }, n.MessageText)
+	rendered.MessageAction = text(func(t *Template) string { return t.Action }, n.MessageAction)
+
+	layout := Layout{
+		Branding: Branding{
+			Locale:          locale,
+			LogoURL:         value(func(t *Template) string { return t.LogoURL }),
+			LogoAlt:         value(func(t *Template) string { return t.LogoAlt }),
+			PrimaryColor:    value(func(t *Template) string { return t.PrimaryColor }),
+			BodyColor:       value(func(t *Template) string { return t.BodyColor }),
+			BackgroundColor: value(func(t *Template) string { return t.BackgroundColor }),
+			Footer:          html(looks, func(t *Template) string { return t.Footer }, ""),
+		},
+		HTML: value(func(t *Template) string { return t.HTML }),
+	}
+	if err != nil {
+		return fmt.Errorf("could not render notification template %s: %v", name, err)
+	}
+
+	event.Notification = &rendered
+	event.Layout = &layout
+	return nil
+}
+
+// templateChain is the custom and built-in templates a field is looked up in
+type templateChain struct {
+	custom  []*Template
+	builtin []*Template
+}
+
+// resolve returns the first value of the field and whether it's a template or the notification's own text
+func (c templateChain) resolve(field func(*Template) string, own string) (string, bool) {
+	for _, t := range c.custom {
+		if v := field(t); v != "" {
+			return v, true
+		}
+	}
+	if own != "" {
+		return own, false
+	}
+	for _, t := range c.builtin {
+		if v := field(t); v != "" {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+func renderText(text string, values map[string]string, renderErr *error) string {
+	t, err := texttemplate.New("").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		*renderErr = errors.Join(*renderErr, err)
+		return ""
+	}
+	buf := new(bytes.Buffer)
+	if err := t.Execute(buf, values); err != nil {
+		*renderErr = errors.Join(*renderErr, err)
+		return ""
+	}
+	return buf.String()
+}
+
+func renderHTML(text string, values map[string]string, renderErr *error) string {
+	t, err := htmltemplate.New("").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		*renderErr = errors.Join(*renderErr, err)
+		return ""
+	}
+	buf := new(bytes.Buffer)
+	if err := t.Execute(buf, values); err != nil {
+		*renderErr = errors.Join(*renderErr, err)
+		return ""
+	}
+	return buf.String()
+}
+
+// EmailLayoutData is what a custom HTML layout can use, Text is the rendered HTML message
+type EmailLayoutData struct {
+	*nats.Notification
+	Text     htmltemplate.HTML
+	Footer   htmltemplate.HTML
+	Branding Branding
+}
+
+// EmailBody renders the HTML of the email with the event's layout, the built-in one if it has none
+func EmailBody(event *Event) (string, error) {
+	layout := event.Layout
+	if layout == nil {
+		layout = &Layout{Branding: DefaultBranding}
+	}
+
+	buf := new(bytes.Buffer)
+	if layout.HTML == "" {
+		if err := EmailTemplate(event.Notification, layout.Branding).Render(context.Background(), buf); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
+
+	t, err := htmltemplate.New("layout").Parse(layout.HTML)
+	if err != nil {
+		return "", err
+	}
+	if err := t.Execute(buf, EmailLayoutData{
+		Notification: event.Notification,
+		Text:         htmltemplate.HTML(event.Notification.MessageText),
+		Footer:       htmltemplate.HTML(layout.Branding.Footer),
+		Branding:     layout.Branding,
+	}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// EmailText is the plain text alternative of the email for clients that don't show HTML
+func EmailText(event *Event) string {
+	n := event.Notification
+	parts := []string{}
+
+	if n.MessageGreeting != "" {
+		parts = append(parts, n.MessageGreeting)
+	}
+	if text := PlainText(n.MessageText); text != "" {
+		parts = append(parts, text)
+	}
+	switch {
+	case n.MessageActionURL != "" && n.MessageAction != "":
+		parts = append(parts, n.MessageAction+": "+n.MessageActionURL)
+	case n.MessageActionURL != "":
+		parts = append(parts, n.MessageActionURL)
+	}
+	if event.Layout != nil {
+		if footer := PlainText(event.Layout.Branding.Footer); footer != "" {
+			parts = append(parts, "--\n"+footer)
+		}
+	}
+
+	return strings.Join(parts, "\n\n") + "\n"
+}
+
+// LoadTemplatesDir reads the templates of a directory. Templates of the default tenant
+// are named <type>.json or <type>.<locale>.json and the ones of a tenant are in a
+// subdirectory named after its ID. A <type>[.<locale>].html file next to them is
+// used as the HTML layout
+func LoadTemplatesDir(dir string) TemplateSource {
+	return func() ([]*Template, error) {
+		templates := []*Template{}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the templates directory: %v", err)
+		}
+
+		dirs := map[int]string{0: dir}
+		for _, e := range entries {
+			if !e.IsDir() {
+				continue
+			}
+			tenantID, err := strconv.Atoi(e.Name())
+			if err != nil || tenantID <= 0 {
+				continue
+			}
+			dirs[tenantID] = filepath.Join(dir, e.Name())
+		}
+
+		for tenantID, d := range dirs {
+			files, err := filepath.Glob(filepath.Join(d, "*.json"))
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range files {
+				t, err := loadTemplateFile(f)
+				if err != nil {
+					log.Printf("[ERROR]: notification template %s is skipped, reason: %v", f, err)
+					continue
+				}
+				t.TenantID = tenantID
+				templates = append(templates, t)
+			}
+		}
+
+		return templates, nil
+	}
+}
+
+func loadTemplateFile(path string) (*Template, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	t := Template{}
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, err
+	}
+
+	base := strings.TrimSuffix(filepath.Base(path), ".json")
+	t.Type, t.Locale, _ = strings.Cut(base, ".")
+
+	if t.HTML == "" {
+		html, err := os.ReadFile(strings.TrimSuffix(path, ".json") + ".html")
+		if err == nil {
+			t.HTML = string(html)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return &t, nil
+}
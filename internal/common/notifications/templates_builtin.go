@@ -0,0 +1,180 @@
+package notifications
+
+// Names of the built-in templates of the notifications sent by the workers
+const (
+	TemplateSendCertificate     = "send_certificate"
+	TemplateCertificateDownload = "certificate_download"
+	TemplateCertificatePassword = "certificate_password"
+	TemplateCertificateExpiry   = "certificate_expiry"
+)
+
+// builtinTemplates are used when neither the tenant nor the notification set a text
+var builtinTemplates = map[templateKey]*Template{
+	{0, TemplateBranding, "en"}: {
+		LogoURL:         DefaultBranding.LogoURL,
+		LogoAlt:         DefaultBranding.LogoAlt,
+		PrimaryColor:    DefaultBranding.PrimaryColor,
+		BodyColor:       DefaultBranding.BodyColor,
+		BackgroundColor: DefaultBranding.BackgroundColor,
+	},
+
+	// English
+	{0, TemplateSendCertificate, "en"}: {
+		Subject:  "Your certificate to log in to scnorion web console",
+		Title:    "scnorion | Your certificate",
+		Greeting: "Hi {{.name}}",
+		Text: `You can find attached the digital certificate in pfx format that you must import to your browser so you can use it to log in to the scnorion console.
+
+		<br/><br/>Also you may need to import the zipped ca.cer file as a trusted root certificate authority, and any intermediate-N.cer file as an intermediate certificate authority, so your browser can trust in the certificates generated by scnorion CA`,
+		Action: "Go to console",
+	},
+	{0, TemplateCertificateDownload, "en"}: {
+		Subject:  "Your certificate to log in to scnorion web console",
+		Title:    "scnorion | Your certificate",
+		Greeting: "Hi {{.name}}",
+		Text: `Your digital certificate to log in to the scnorion console is ready. Use the button below to download it in pfx format and import it to your browser, the link can only be used once and expires on {{.expires}}.
+
+		<br/><br/>You'll receive the password of the pfx file in a separate message.
+
+		<br/><br/>Also you may need to import the zipped ca.cer file as a trusted root certificate authority, and any intermediate-N.cer file as an intermediate certificate authority, so your browser can trust in the certificates generated by scnorion CA`,
+		Action: "Download certificate",
+	},
+	{0, TemplateCertificatePassword, "en"}: {
+		Subject:  "The password of your certificate for scnorion web console",
+		Title:    "scnorion | Your certificate password",
+		Greeting: "Hi {{.name}}",
+		Text: `Use the following password to import the certificate you can download from the link we've sent you in a separate message:
+
+		<br/><br/><b>{{.password}}</b>`,
+		Action: "Go to console",
+	},
+	{0, TemplateCertificateExpiry, "en"}: {
+		Subject:  `Your certificate to log in to scnorion web console expires {{if eq .days "1"}}tomorrow{{else}}in {{.days}} days{{end}}`,
+		Title:    "scnorion | Your certificate expires soon",
+		Greeting: "Hi {{.name}}",
+		Text: `The digital certificate you use to log in to the scnorion console expires {{if eq .days "1"}}tomorrow{{else}}in {{.days}} days{{end}}, on {{.expiry}}.
+
+		<br/><br/>Please ask an administrator for a new certificate before that date or you won't be able to log in to the console`,
+		Action: "Go to console",
+	},
+
+	// Spanish
+	{0, TemplateSendCertificate, "es"}: {
+		Subject:  "Su certificado para acceder a la consola web de scnorion",
+		Title:    "scnorion | Su certificado",
+		Greeting: "Hola {{.name}}",
+		Text: `Adjunto encontrará el certificado digital en formato pfx que debe importar en su navegador para poder acceder a la consola de scnorion.
+
+		<br/><br/>También puede que necesite importar el archivo ca.cer del zip como autoridad de certificación raíz de confianza, y cualquier archivo intermediate-N.cer como autoridad de certificación intermedia, para que su navegador confíe en los certificados generados por la CA de scnorion`,
+		Action: "Ir a la consola",
+	},
+	{0, TemplateCertificateDownload, "es"}: {
+		Subject:  "Su certificado para acceder a la consola web de scnorion",
+		Title:    "scnorion | Su certificado",
+		Greeting: "Hola {{.name}}",
+		Text: `Su certificado digital para acceder a la consola de scnorion está listo. Use el botón de abajo para descargarlo en formato pfx e importarlo en su navegador, el enlace solo puede usarse una vez y caduca el {{.expires}}.
+
+		<br/><br/>Recibirá la contraseña del archivo pfx en un mensaje aparte.
+
+		<br/><br/>También puede que necesite importar el archivo ca.cer del zip como autoridad de certificación raíz de confianza, y cualquier archivo intermediate-N.cer como autoridad de certificación intermedia, para que su navegador confíe en los certificados generados por la CA de scnorion`,
+		Action: "Descargar certificado",
+	},
+	{0, TemplateCertificatePassword, "es"}: {
+		Subject:  "La contraseña de su certificado para la consola web de scnorion",
+		Title:    "scnorion | La contraseña de su certificado",
+		Greeting: "Hola {{.name}}",
+		Text: `Use la siguiente contraseña para importar el certificado que puede descargar desde el enlace que le hemos enviado en un mensaje aparte:
+
+		<br/><br/><b>{{.password}}</b>`,
+		Action: "Ir a la consola",
+	},
+	{0, TemplateCertificateExpiry, "es"}: {
+		Subject:  `Su certificado para acceder a la consola web de scnorion caduca {{if eq .days "1"}}mañana{{else}}en {{.days}} días{{end}}`,
+		Title:    "scnorion | Su certificado caduca pronto",
+		Greeting: "Hola {{.name}}",
+		Text: `El certificado digital que usa para acceder a la consola de scnorion caduca {{if eq .days "1"}}mañana{{else}}en {{.days}} días{{end}}, el {{.expiry}}.
+
+		<br/><br/>Pida un nuevo certificado a un administrador antes de esa fecha o no podrá acceder a la consola`,
+		Action: "Ir a la consola",
+	},
+
+	// French
+	{0, TemplateSendCertificate, "fr"}: {
+		Subject:  "Votre certificat pour vous connecter à la console web scnorion",
+		Title:    "scnorion | Votre certificat",
+		Greeting: "Bonjour {{.name}}",
+		Text: `Vous trouverez ci-joint le certificat numérique au format pfx que vous devez importer dans votre navigateur pour vous connecter à la console scnorion.
+
+		<br/><br/>Vous devrez peut-être aussi importer le fichier ca.cer de l'archive zip comme autorité de certification racine de confiance, et chaque fichier intermediate-N.cer comme autorité de certification intermédiaire, afin que votre navigateur fasse confiance aux certificats générés par l'AC scnorion`,
+		Action: "Aller à la console",
+	},
+	{0, TemplateCertificateDownload, "fr"}: {
+		Subject:  "Votre certificat pour vous connecter à la console web scnorion",
+		Title:    "scnorion | Votre certificat",
+		Greeting: "Bonjour {{.name}}",
+		Text: `Votre certificat numérique pour vous connecter à la console scnorion est prêt. Utilisez le bouton ci-dessous pour le télécharger au format pfx et l'importer dans votre navigateur, le lien n'est utilisable qu'une seule fois et expire le {{.expires}}.
+
+		<br/><br/>Vous recevrez le mot de passe du fichier pfx dans un message séparé.
+
+		<br/><br/>Vous devrez peut-être aussi importer le fichier ca.cer de l'archive zip comme autorité de certification racine de confiance, et chaque fichier intermediate-N.cer comme autorité de certification intermédiaire, afin que votre navigateur fasse confiance aux certificats générés par l'AC scnorion`,
+		Action: "Télécharger le certificat",
+	},
+	{0, TemplateCertificatePassword, "fr"}: {
+		Subject:  "Le mot de passe de votre certificat pour la console web scnorion",
+		Title:    "scnorion | Le mot de passe de votre certificat",
+		Greeting: "Bonjour {{.name}}",
+		Text: `Utilisez le mot de passe suivant pour importer le certificat que vous pouvez télécharger depuis le lien que nous vous avons envoyé dans un message séparé :
+
+		<br/><br/><b>{{.password}}</b>`,
+		Action: "Aller à la console",
+	},
+	{0, TemplateCertificateExpiry, "fr"}: {
+		Subject:  `Votre certificat pour vous connecter à la console web scnorion expire {{if eq .days "1"}}demain{{else}}dans {{.days}} jours{{end}}`,
+		Title:    "scnorion | Votre certificat expire bientôt",
+		Greeting: "Bonjour {{.name}}",
+		Text: `Le certificat numérique que vous utilisez pour vous connecter à la console scnorion expire {{if eq .days "1"}}demain{{else}}dans {{.days}} jours{{end}}, le {{.expiry}}.
+
+		<br/><br/>Veuillez demander un nouveau certificat à un administrateur avant cette date, sinon vous ne pourrez plus vous connecter à la console`,
+		Action: "Aller à la console",
+	},
+
+	// German
+	{0, TemplateSendCertificate, "de"}: {
+		Subject:  "Ihr Zertifikat für die Anmeldung an der scnorion-Webkonsole",
+		Title:    "scnorion | Ihr Zertifikat",
+		Greeting: "Hallo {{.name}}",
+		Text: `Im Anhang finden Sie das digitale Zertifikat im pfx-Format, das Sie in Ihren Browser importieren müssen, um sich an der scnorion-Konsole anzumelden.
+
+		<br/><br/>Eventuell müssen Sie auch die Datei ca.cer aus dem Zip-Archiv als vertrauenswürdige Stammzertifizierungsstelle und jede Datei intermediate-N.cer als Zwischenzertifizierungsstelle importieren, damit Ihr Browser den von der scnorion-CA ausgestellten Zertifikaten vertraut`,
+		Action: "Zur Konsole",
+	},
+	{0, TemplateCertificateDownload, "de"}: {
+		Subject:  "Ihr Zertifikat für die Anmeldung an der scnorion-Webkonsole",
+		Title:    "scnorion | Ihr Zertifikat",
+		Greeting: "Hallo {{.name}}",
+		Text: `Ihr digitales Zertifikat für die Anmeldung an der scnorion-Konsole ist bereit. Laden Sie es über die Schaltfläche unten im pfx-Format herunter und importieren Sie es in Ihren Browser. Der Link kann nur einmal verwendet werden und läuft am {{.expires}} ab.
+
+		<br/><br/>Das Passwort der pfx-Datei erhalten Sie in einer separaten Nachricht.
+
+		<br/><br/>Eventuell müssen Sie auch die Datei ca.cer aus dem Zip-Archiv als vertrauenswürdige Stammzertifizierungsstelle und jede Datei intermediate-N.cer als Zwischenzertifizierungsstelle importieren, damit Ihr Browser den von der scnorion-CA ausgestellten Zertifikaten vertraut`,
+		Action: "Zertifikat herunterladen",
+	},
+	{0, TemplateCertificatePassword, "de"}: {
+		Subject:  "Das Passwort Ihres Zertifikats für die scnorion-Webkonsole",
+		Title:    "scnorion | Das Passwort Ihres Zertifikats",
+		Greeting: "Hallo {{.name}}",
+		Text: `Verwenden Sie das folgende Passwort, um das Zertifikat zu importieren, das Sie über den Link in unserer separaten Nachricht herunterladen können:
+
+		<br/><br/><b>{{.password}}</b>`,
+		Action: "Zur Konsole",
+	},
+	{0, TemplateCertificateExpiry, "de"}: {
+		Subject:  `Ihr Zertifikat für die Anmeldung an der scnorion-Webkonsole läuft {{if eq .days "1"}}morgen{{else}}in {{.days}} Tagen{{end}} ab`,
+		Title:    "scnorion | Ihr Zertifikat läuft bald ab",
+		Greeting: "Hallo {{.name}}",
+		Text: `Das digitale Zertifikat, mit dem Sie sich an der scnorion-Konsole anmelden, läuft {{if eq .days "1"}}morgen{{else}}in {{.days}} Tagen{{end}} ab, am {{.expiry}}.
+
+		<br/><br/>Bitte fordern Sie vor diesem Datum bei einem Administrator ein neues Zertifikat an, sonst können Sie sich nicht mehr an der Konsole anmelden`,
+		Action: "Zur Konsole",
+	},
+}
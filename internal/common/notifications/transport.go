@@ -0,0 +1,138 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/scncore/nats"
+)
+
+// Channel types that can be configured for a tenant
+const (
+	ChannelEmail   = "email"
+	ChannelWebhook = "webhook"
+	ChannelSlack   = "slack"
+	ChannelTeams   = "teams"
+	ChannelSyslog  = "syslog"
+)
+
+// Event is a notification with what the routing rules need to know about it
+type Event struct {
+	// Type is the last token of the NATS subject, e.g send_certificate
+	Type         string
+	TenantID     int
+	Notification *nats.Notification
+	Locale       string
+	// Layout is the tenant's email look, the built-in one is used if nil
+	Layout *Layout
+	// Attachments are only sent by email, Objects reads the ones in an object store
+	Attachments []Attachment
+	Objects     ObjectStore
+}
+
+// Transport delivers a notification to a single channel
+type Transport interface {
+	Name() string
+	Send(ctx context.Context, event *Event) error
+}
+
+// NewTransport builds the transport for a channel from its JSON configuration,
+// smtp is the tenant's relay and it's only used by the email channel
+func NewTransport(name, channelType string, config []byte, smtp *SMTPClient) (Transport, error) {
+	if len(config) == 0 {
+		config = []byte("{}")
+	}
+
+	var t Transport
+	var err error
+
+	switch channelType {
+	case ChannelEmail:
+		if smtp == nil {
+			return nil, fmt.Errorf("no SMTP settings found for channel %s", name)
+		}
+		t = &EmailTransport{ChannelName: name, SMTP: smtp}
+	case ChannelWebhook:
+		w := WebhookTransport{ChannelName: name}
+		err = json.Unmarshal(config, &w)
+		t = &w
+	case ChannelSlack:
+		s := SlackTransport{ChannelName: name}
+		err = json.Unmarshal(config, &s)
+		t = &s
+	case ChannelTeams:
+		m := TeamsTransport{ChannelName: name}
+		err = json.Unmarshal(config, &m)
+		t = &m
+	case ChannelSyslog:
+		s := SyslogTransport{ChannelName: name}
+		err = json.Unmarshal(config, &s)
+		t = &s
+	default:
+		return nil, fmt.Errorf("unsupported channel type %s for channel %s", channelType, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration for channel %s: %v", name, err)
+	}
+
+	return t, nil
+}
+
+var (
+	lineBreaks = regexp.MustCompile(`(?i)<br\s*/?>|</p>`)
+	htmlTags   = regexp.MustCompile(`<[^>]*>`)
+	blankLines = regexp.MustCompile(`\n[ \t]*\n[\s]*`)
+)
+
+// PlainText turns the HTML message text written for the email template into
+// plain text for channels that can't render HTML
+func PlainText(text string) string {
+	text = lineBreaks.ReplaceAllString(text, "\n")
+	text = htmlTags.ReplaceAllString(text, "")
+	text = html.UnescapeString(text)
+
+	lines := strings.Split(text, "\n")
+	for i, l := range lines {
+		lines[i] = strings.Join(strings.Fields(l), " ")
+	}
+	text = strings.Join(lines, "\n")
+	return strings.TrimSpace(blankLines.ReplaceAllString(text, "\n\n"))
+}
+
+// DeliveryError is a failed delivery with what the remote server answered, a
+// permanent error is not retried as the server would reject it again
+type DeliveryError struct {
+	Err       error
+	Response  string
+	Permanent bool
+}
+
+func (e *DeliveryError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DeliveryError) Unwrap() error {
+	return e.Err
+}
+
+// TransportType returns the channel type of a transport
+func TransportType(t Transport) string {
+	switch t.(type) {
+	case *EmailTransport:
+		return ChannelEmail
+	case *WebhookTransport:
+		return ChannelWebhook
+	case *SlackTransport:
+		return ChannelSlack
+	case *TeamsTransport:
+		return ChannelTeams
+	case *SyslogTransport:
+		return ChannelSyslog
+	default:
+		return ""
+	}
+}
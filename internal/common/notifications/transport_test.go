@@ -0,0 +1,68 @@
+package notifications
+
+import (
+	"testing"
+)
+
+func TestNewTransport(t *testing.T) {
+	tests := []struct {
+		channelType string
+		config      string
+		want        string
+	}{
+		{ChannelWebhook, `{"url":"https://hooks.example.com","secret":"s"}`, ChannelWebhook},
+		{ChannelSlack, `{"url":"https://hooks.example.com"}`, ChannelSlack},
+		{ChannelTeams, `{"url":"https://hooks.example.com"}`, ChannelTeams},
+		{ChannelSyslog, `{"address":"127.0.0.1:514","network":"tcp"}`, ChannelSyslog},
+		{ChannelSyslog, ``, ChannelSyslog},
+	}
+
+	for _, tt := range tests {
+		transport, err := NewTransport("channel", tt.channelType, []byte(tt.config), nil)
+		if err != nil {
+			t.Errorf("%s: %v", tt.channelType, err)
+			continue
+		}
+		if got := TransportType(transport); got != tt.want {
+			t.Errorf("got transport type %s, want %s", got, tt.want)
+		}
+		if transport.Name() != "channel" {
+			t.Errorf("got channel name %s", transport.Name())
+		}
+	}
+
+	webhook, err := NewTransport("channel", ChannelWebhook, []byte(`{"url":"https://hooks.example.com","secret":"s","headers":{"X-Key":"v"}}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := webhook.(*WebhookTransport)
+	if w.URL != "https://hooks.example.com" || w.Secret != "s" || w.Headers["X-Key"] != "v" {
+		t.Errorf("got webhook %+v", w)
+	}
+
+	for name, tt := range map[string]struct{ channelType, config string }{
+		"email without SMTP": {ChannelEmail, `{}`},
+		"unknown type":       {"pager", `{}`},
+		"invalid JSON":       {ChannelWebhook, `{"url":`},
+	} {
+		if _, err := NewTransport("channel", tt.channelType, []byte(tt.config), nil); err == nil {
+			t.Errorf("%s: the channel has been accepted", name)
+		}
+	}
+}
+
+func TestPlainText(t *testing.T) {
+	tests := map[string]string{
+		"Hi":                                     "Hi",
+		"line<br/>next<br>last":                  "line\nnext\nlast",
+		"<p>first</p><p>second</p>":              "first\nsecond",
+		"a &amp; b &lt;c&gt;":                    "a & b <c>",
+		"text\n\n\t\t<br/><br/>more   spaces":    "text\n\nmore spaces",
+		"<b>bold</b> and <a href=\"x\">link</a>": "bold and link",
+	}
+	for html, want := range tests {
+		if got := PlainText(html); got != want {
+			t.Errorf("PlainText(%q) = %q, want %q", html, got, want)
+		}
+	}
+}
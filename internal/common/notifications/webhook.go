@@ -0,0 +1,217 @@
+package notifications
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Attachments are never sent to webhooks or chats, they may hold private keys
+
+const (
+	WebhookSignatureHeader = "X-Scnorion-Signature"
+	WebhookTimestampHeader = "X-Scnorion-Timestamp"
+
+	webhookTimeout = 15 * time.Second
+)
+
+// WebhookPayload is the JSON posted to generic webhooks
+type WebhookPayload struct {
+	Type      string    `json:"type"`
+	TenantID  int       `json:"tenant_id"`
+	To        string    `json:"to,omitempty"`
+	Subject   string    `json:"subject,omitempty"`
+	Title     string    `json:"title,omitempty"`
+	Greeting  string    `json:"greeting,omitempty"`
+	Text      string    `json:"text,omitempty"`
+	Action    string    `json:"action,omitempty"`
+	ActionURL string    `json:"action_url,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// WebhookTransport posts the notification as JSON, if a secret is set the body is
+// signed with HMAC-SHA256 over "<timestamp>.<body>" so receivers can reject replays
+type WebhookTransport struct {
+	ChannelName string            `json:"-"`
+	URL         string            `json:"url"`
+	Secret      string            `json:"secret,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	HTTPClient  *http.Client      `json:"-"`
+}
+
+func (t *WebhookTransport) Name() string {
+	return t.ChannelName
+}
+
+func (t *WebhookTransport) Send(ctx context.Context, event *Event) error {
+	n := event.Notification
+	now := time.Now().UTC()
+
+	body, err := json.Marshal(WebhookPayload{
+		Type:      event.Type,
+		TenantID:  event.TenantID,
+		To:        n.To,
+		Subject:   n.Subject,
+		Title:     n.MessageTitle,
+		Greeting:  n.MessageGreeting,
+		Text:      PlainText(n.MessageText),
+		Action:    n.MessageAction,
+		ActionURL: n.MessageActionURL,
+		Timestamp: now,
+	})
+	if err != nil {
+		return err
+	}
+
+	headers := map[string]string{}
+	for k, v := range t.Headers {
+		headers[k] = v
+	}
+	if t.Secret != "" {
+		timestamp := strconv.FormatInt(now.Unix(), 10)
+		headers[WebhookTimestampHeader] = timestamp
+		headers[WebhookSignatureHeader] = "sha256=" + SignWebhook(t.Secret, timestamp, body)
+	}
+
+	return postJSON(ctx, t.HTTPClient, t.URL, body, headers)
+}
+
+// SignWebhook returns the hex HMAC-SHA256 of the timestamp and the body with the channel secret
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SlackTransport posts to Slack-compatible incoming webhooks (Slack, Mattermost, Rocket.Chat)
+type SlackTransport struct {
+	ChannelName string       `json:"-"`
+	URL         string       `json:"url"`
+	HTTPClient  *http.Client `json:"-"`
+}
+
+func (t *SlackTransport) Name() string {
+	return t.ChannelName
+}
+
+func (t *SlackTransport) Send(ctx context.Context, event *Event) error {
+	n := event.Notification
+
+	// Slack only wants &, < and > escaped in mrkdwn
+	escape := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace
+
+	text := fmt.Sprintf("*%s*\n%s", escape(chatTitle(event)), escape(PlainText(n.MessageText)))
+	if n.MessageActionURL != "" {
+		action := n.MessageAction
+		if action == "" {
+			action = n.MessageActionURL
+		}
+		text += fmt.Sprintf("\n<%s|%s>", n.MessageActionURL, escape(action))
+	}
+
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, t.HTTPClient, t.URL, body, nil)
+}
+
+// TeamsTransport posts an Adaptive Card to Teams-compatible incoming webhooks
+type TeamsTransport struct {
+	ChannelName string       `json:"-"`
+	URL         string       `json:"url"`
+	HTTPClient  *http.Client `json:"-"`
+}
+
+func (t *TeamsTransport) Name() string {
+	return t.ChannelName
+}
+
+func (t *TeamsTransport) Send(ctx context.Context, event *Event) error {
+	n := event.Notification
+
+	card := map[string]any{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.4",
+		"body": []map[string]any{
+			{"type": "TextBlock", "text": chatTitle(event), "weight": "Bolder", "size": "Medium", "wrap": true},
+			{"type": "TextBlock", "text": PlainText(n.MessageText), "wrap": true},
+		},
+	}
+	if n.MessageActionURL != "" {
+		action := n.MessageAction
+		if action == "" {
+			action = "Open"
+		}
+		card["actions"] = []map[string]any{{"type": "Action.OpenUrl", "title": action, "url": n.MessageActionURL}}
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"type": "message",
+		"attachments": []map[string]any{
+			{"contentType": "application/vnd.microsoft.card.adaptive", "content": card},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, t.HTTPClient, t.URL, body, nil)
+}
+
+func chatTitle(event *Event) string {
+	if event.Notification.MessageTitle != "" {
+		return event.Notification.MessageTitle
+	}
+	if event.Notification.Subject != "" {
+		return event.Notification.Subject
+	}
+	return "scnorion | " + event.Type
+}
+
+func postJSON(ctx context.Context, client *http.Client, url string, body []byte, headers map[string]string) error {
+	if url == "" {
+		return fmt.Errorf("the channel has no URL")
+	}
+
+	if client == nil {
+		client = &http.Client{Timeout: webhookTimeout}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &DeliveryError{
+			Err:      fmt.Errorf("the webhook answered %s: %s", resp.Status, bytes.TrimSpace(msg)),
+			Response: resp.Status,
+			// Timeouts and rate limits are worth retrying, other client errors are not
+			Permanent: resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+				resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests,
+		}
+	}
+	return nil
+}
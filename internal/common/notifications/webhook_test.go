@@ -0,0 +1,254 @@
+package notifications
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/scncore/nats"
+)
+
+func testEvent() *Event {
+	return &Event{
+		Type:     "send_certificate",
+		TenantID: 3,
+		Notification: &nats.Notification{
+			To:               "user@example.com",
+			Subject:          "Your certificate",
+			MessageTitle:     "scnorion | Your certificate",
+			MessageText:      "Hi<br/>your <b>certificate</b> is ready",
+			MessageAction:    "Go to console",
+			MessageActionURL: "https://console.example.com",
+		},
+	}
+}
+
+// TestWebhookSignature checks the signature a receiver computes with the secret matches the headers
+func TestWebhookSignature(t *testing.T) {
+	const secret = "webhook secret"
+
+	type received struct {
+		header http.Header
+		body   []byte
+	}
+	requests := make(chan received, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- received{header: r.Header.Clone(), body: body}
+	}))
+	defer server.Close()
+
+	transport := &WebhookTransport{URL: server.URL, Secret: secret, Headers: map[string]string{"X-Tenant": "3"}}
+	if err := transport.Send(context.Background(), testEvent()); err != nil {
+		t.Fatal(err)
+	}
+	r := <-requests
+
+	if got := r.header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("got content type %q", got)
+	}
+	if got := r.header.Get("X-Tenant"); got != "3" {
+		t.Errorf("got custom header %q, want 3", got)
+	}
+
+	timestamp := r.header.Get(WebhookTimestampHeader)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		t.Fatalf("invalid timestamp %q: %v", timestamp, err)
+	}
+	if d := time.Since(time.Unix(unix, 0)); d < -time.Minute || d > time.Minute {
+		t.Errorf("the timestamp is %s away from now", d)
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + string(r.body)))
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := r.header.Get(WebhookSignatureHeader); got != want {
+		t.Errorf("got signature %s, want %s", got, want)
+	}
+
+	payload := WebhookPayload{}
+	if err := json.Unmarshal(r.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Type != "send_certificate" || payload.TenantID != 3 || payload.Text != "Hi\nyour certificate is ready" {
+		t.Errorf("got payload %+v", payload)
+	}
+
+	// Without a secret there's nothing to sign
+	transport.Secret = ""
+	if err := transport.Send(context.Background(), testEvent()); err != nil {
+		t.Fatal(err)
+	}
+	r = <-requests
+	if r.header.Get(WebhookSignatureHeader) != "" || r.header.Get(WebhookTimestampHeader) != "" {
+		t.Error("a webhook without a secret has been signed")
+	}
+}
+
+func TestWebhookStatusCodes(t *testing.T) {
+	tests := []struct {
+		status    int
+		err       bool
+		permanent bool
+	}{
+		{http.StatusOK, false, false},
+		{http.StatusAccepted, false, false},
+		{http.StatusNoContent, false, false},
+		{http.StatusBadRequest, true, true},
+		{http.StatusUnauthorized, true, true},
+		{http.StatusForbidden, true, true},
+		{http.StatusNotFound, true, true},
+		{http.StatusGone, true, true},
+		{http.StatusRequestTimeout, true, false},
+		{http.StatusTooManyRequests, true, false},
+		{http.StatusInternalServerError, true, false},
+		{http.StatusBadGateway, true, false},
+		{http.StatusServiceUnavailable, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.status), func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				rw.WriteHeader(tt.status)
+				_, _ = rw.Write([]byte("  the reason  "))
+			}))
+			defer server.Close()
+
+			for _, transport := range []Transport{
+				&WebhookTransport{URL: server.URL},
+				&SlackTransport{URL: server.URL},
+				&TeamsTransport{URL: server.URL},
+			} {
+				err := transport.Send(context.Background(), testEvent())
+				if !tt.err {
+					if err != nil {
+						t.Errorf("%T: %v", transport, err)
+					}
+					continue
+				}
+
+				deliveryErr := &DeliveryError{}
+				if !errors.As(err, &deliveryErr) {
+					t.Fatalf("%T: got %v, want a delivery error", transport, err)
+				}
+				if deliveryErr.Permanent != tt.permanent {
+					t.Errorf("%T: got permanent %t, want %t", transport, deliveryErr.Permanent, tt.permanent)
+				}
+				if deliveryErr.Response != strconv.Itoa(tt.status)+" "+http.StatusText(tt.status) {
+					t.Errorf("%T: got response %q", transport, deliveryErr.Response)
+				}
+				if !strings.HasSuffix(err.Error(), ": the reason") {
+					t.Errorf("%T: the error doesn't have the answer: %v", transport, err)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	// The client timeout
+	transport := &WebhookTransport{URL: server.URL, HTTPClient: &http.Client{Timeout: 100 * time.Millisecond}}
+	start := time.Now()
+	err := transport.Send(context.Background(), testEvent())
+	if err == nil {
+		t.Fatal("a webhook that doesn't answer has succeeded")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("the webhook gave up after %s", d)
+	}
+	deliveryErr := &DeliveryError{}
+	if errors.As(err, &deliveryErr) && deliveryErr.Permanent {
+		t.Error("a timeout has been considered permanent")
+	}
+
+	// The deadline of the delivery
+	transport.HTTPClient = nil
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := transport.Send(ctx, testEvent()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the deadline exceeded", err)
+	}
+}
+
+func TestChatPayloads(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- body
+	}))
+	defer server.Close()
+
+	event := testEvent()
+	event.Notification.MessageText = "a < b & c"
+
+	if err := (&SlackTransport{URL: server.URL}).Send(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	slack := map[string]string{}
+	if err := json.Unmarshal(<-bodies, &slack); err != nil {
+		t.Fatal(err)
+	}
+	want := "*scnorion | Your certificate*\na &lt; b &amp; c\n<https://console.example.com|Go to console>"
+	if slack["text"] != want {
+		t.Errorf("got Slack text %q, want %q", slack["text"], want)
+	}
+
+	if err := (&TeamsTransport{URL: server.URL}).Send(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	teams := struct {
+		Type        string `json:"type"`
+		Attachments []struct {
+			ContentType string `json:"contentType"`
+			Content     struct {
+				Body []struct {
+					Text string `json:"text"`
+				} `json:"body"`
+				Actions []struct {
+					Title string `json:"title"`
+					URL   string `json:"url"`
+				} `json:"actions"`
+			} `json:"content"`
+		} `json:"attachments"`
+	}{}
+	if err := json.Unmarshal(<-bodies, &teams); err != nil {
+		t.Fatal(err)
+	}
+	if teams.Type != "message" || len(teams.Attachments) != 1 || teams.Attachments[0].ContentType != "application/vnd.microsoft.card.adaptive" {
+		t.Fatalf("got Teams message %+v", teams)
+	}
+	card := teams.Attachments[0].Content
+	if len(card.Body) != 2 || card.Body[1].Text != "a < b & c" {
+		t.Errorf("got card body %+v", card.Body)
+	}
+	if len(card.Actions) != 1 || card.Actions[0].URL != "https://console.example.com" {
+		t.Errorf("got card actions %+v", card.Actions)
+	}
+}
+
+func TestWebhookWithoutURL(t *testing.T) {
+	if err := (&WebhookTransport{}).Send(context.Background(), testEvent()); err == nil {
+		t.Error("a webhook without URL has succeeded")
+	}
+}
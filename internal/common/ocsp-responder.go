@@ -0,0 +1,320 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/scncore/ent"
+	"github.com/scncore/scnorion-worker/internal/models"
+	"golang.org/x/crypto/ocsp"
+)
+
+const DefaultOCSPCacheDuration = 10 * time.Minute
+
+// maxOCSPRequestSize is far above any real OCSP request and protects the responder from huge bodies
+const maxOCSPRequestSize = 10 * 1024
+
+// maxOCSPCacheEntries bounds the memory used by the cache, whatever serials are requested
+const maxOCSPCacheEntries = 10000
+
+type OCSPResponder struct {
+	Model         *models.Model
+	CACert        *x509.Certificate
+	SignerCert    *x509.Certificate
+	Signer        crypto.Signer
+	CacheDuration time.Duration
+	Server        *http.Server
+	cache         map[string]*cachedOCSPResponse
+	cacheMutex    sync.RWMutex
+}
+
+type cachedOCSPResponse struct {
+	der        []byte
+	thisUpdate time.Time
+	nextUpdate time.Time
+}
+
+// NewOCSPResponder uses the CA key to sign responses unless a delegated
+// OCSP signing certificate issued by the same CA is provided
+func NewOCSPResponder(model *models.Model, caCert *x509.Certificate, signerCert *x509.Certificate, signer crypto.Signer, cacheDuration time.Duration) (*OCSPResponder, error) {
+	if caCert == nil || signer == nil {
+		return nil, errors.New("the CA certificate and a signing key are required")
+	}
+
+	if signerCert == nil {
+		signerCert = caCert
+	} else {
+		if err := signerCert.CheckSignatureFrom(caCert); err != nil {
+			return nil, fmt.Errorf("the OCSP signing certificate has not been issued by the CA: %v", err)
+		}
+
+		if !hasOCSPSigningUsage(signerCert) {
+			return nil, errors.New("the OCSP signing certificate must include the OCSP signing extended key usage")
+		}
+	}
+
+	if cacheDuration <= 0 {
+		cacheDuration = DefaultOCSPCacheDuration
+	}
+
+	return &OCSPResponder{
+		Model:         model,
+		CACert:        caCert,
+		SignerCert:    signerCert,
+		Signer:        signer,
+		CacheDuration: cacheDuration,
+		cache:         map[string]*cachedOCSPResponse{},
+	}, nil
+}
+
+func (r *OCSPResponder) Start(address string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", r.OCSPHandler)
+
+	r.Server = &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Printf("[INFO]: OCSP responder listening on %s", address)
+	if err := r.Server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (r *OCSPResponder) Stop() {
+	if r.Server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := r.Server.Shutdown(ctx); err != nil {
+			log.Printf("[ERROR]: could not shutdown the OCSP responder, reason: %v", err)
+		}
+	}
+
+	if r.Model != nil {
+		r.Model.Close()
+	}
+}
+
+func (r *OCSPResponder) OCSPHandler(w http.ResponseWriter, req *http.Request) {
+	var data []byte
+	var err error
+
+	switch req.Method {
+	case http.MethodGet:
+		// RFC 6960 Appendix A.1, the request is base64 encoded and then url encoded
+		encoded, err := url.PathUnescape(strings.TrimPrefix(req.URL.EscapedPath(), "/"))
+		if err != nil {
+			r.writeResponse(w, ocsp.MalformedRequestErrorResponse, nil)
+			return
+		}
+		data, err = base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			r.writeResponse(w, ocsp.MalformedRequestErrorResponse, nil)
+			return
+		}
+	case http.MethodPost:
+		if req.Header.Get("Content-Type") != "application/ocsp-request" {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		data, err = io.ReadAll(io.LimitReader(req.Body, maxOCSPRequestSize))
+		if err != nil {
+			r.writeResponse(w, ocsp.MalformedRequestErrorResponse, nil)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ocspRequest, err := ocsp.ParseRequest(data)
+	if err != nil {
+		log.Printf("[ERROR]: could not parse OCSP request, reason: %v", err)
+		r.writeResponse(w, ocsp.MalformedRequestErrorResponse, nil)
+		return
+	}
+
+	if !r.isIssuedByCA(ocspRequest) {
+		r.writeResponse(w, ocsp.UnauthorizedErrorResponse, nil)
+		return
+	}
+
+	response, err := r.GetResponse(ocspRequest.SerialNumber)
+	if err != nil {
+		log.Printf("[ERROR]: could not create OCSP response for serial %s, reason: %v", ocspRequest.SerialNumber.String(), err)
+		r.writeResponse(w, ocsp.InternalErrorErrorResponse, nil)
+		return
+	}
+
+	r.writeResponse(w, response.der, response)
+}
+
+// GetResponse returns a signed response for the serial, cached until the next update
+func (r *OCSPResponder) GetResponse(serial *big.Int) (*cachedOCSPResponse, error) {
+	key := serial.String()
+
+	r.cacheMutex.RLock()
+	cached, ok := r.cache[key]
+	r.cacheMutex.RUnlock()
+	if ok && time.Now().Before(cached.nextUpdate) {
+		return cached, nil
+	}
+
+	now := time.Now().UTC().Truncate(time.Minute)
+	template := ocsp.Response{
+		SerialNumber: serial,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(r.CacheDuration),
+	}
+
+	if r.SignerCert != r.CACert {
+		template.Certificate = r.SignerCert
+	}
+
+	if err := r.setStatus(&template); err != nil {
+		return nil, err
+	}
+
+	der, err := ocsp.CreateResponse(r.CACert, r.SignerCert, template, r.Signer)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &cachedOCSPResponse{der: der, thisUpdate: template.ThisUpdate, nextUpdate: template.NextUpdate}
+
+	// Anyone can ask for random serials, only the certificates we know about are cached
+	if template.Status != ocsp.Unknown {
+		r.cacheResponse(key, response)
+	}
+
+	return response, nil
+}
+
+// cacheResponse adds the response to the cache, expired responses are removed when
+// it's full and, if that's not enough, the one closest to its next update
+func (r *OCSPResponder) cacheResponse(key string, response *cachedOCSPResponse) {
+	r.cacheMutex.Lock()
+	defer r.cacheMutex.Unlock()
+
+	if _, ok := r.cache[key]; !ok && len(r.cache) >= maxOCSPCacheEntries {
+		now := time.Now()
+		oldest := ""
+		for k, cached := range r.cache {
+			if !now.Before(cached.nextUpdate) {
+				delete(r.cache, k)
+				continue
+			}
+			if oldest == "" || cached.nextUpdate.Before(r.cache[oldest].nextUpdate) {
+				oldest = k
+			}
+		}
+
+		if len(r.cache) >= maxOCSPCacheEntries {
+			delete(r.cache, oldest)
+		}
+	}
+
+	r.cache[key] = response
+}
+
+func (r *OCSPResponder) setStatus(template *ocsp.Response) error {
+	serial := template.SerialNumber
+
+	revoked, err := r.Model.GetRevocationBySerial(serial)
+	if err == nil {
+		template.Status = ocsp.Revoked
+		template.RevokedAt = revoked.Revoked.UTC()
+		template.RevocationReason = revoked.Reason
+		return nil
+	}
+	if !ent.IsNotFound(err) {
+		return err
+	}
+
+	if _, err := r.Model.GetCertificateBySerial(serial); err != nil {
+		if !ent.IsNotFound(err) {
+			return err
+		}
+		if _, err := r.Model.GetACMECertificate(serial); err != nil {
+			if ent.IsNotFound(err) {
+				template.Status = ocsp.Unknown
+				return nil
+			}
+			return err
+		}
+	}
+
+	template.Status = ocsp.Good
+	return nil
+}
+
+func (r *OCSPResponder) isIssuedByCA(req *ocsp.Request) bool {
+	if !req.HashAlgorithm.Available() {
+		return false
+	}
+
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(r.CACert.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return false
+	}
+
+	h := req.HashAlgorithm.New()
+	h.Write(r.CACert.RawSubject)
+	nameHash := h.Sum(nil)
+
+	h.Reset()
+	h.Write(spki.PublicKey.RightAlign())
+	keyHash := h.Sum(nil)
+
+	return bytes.Equal(nameHash, req.IssuerNameHash) && bytes.Equal(keyHash, req.IssuerKeyHash)
+}
+
+func (r *OCSPResponder) writeResponse(w http.ResponseWriter, der []byte, response *cachedOCSPResponse) {
+	w.Header().Set("Content-Type", "application/ocsp-response")
+
+	// RFC 5019 section 6, let HTTP caches keep the response until the next update
+	if response != nil {
+		maxAge := int(time.Until(response.nextUpdate).Seconds())
+		if maxAge < 0 {
+			maxAge = 0
+		}
+		w.Header().Set("Last-Modified", response.thisUpdate.Format(http.TimeFormat))
+		w.Header().Set("Expires", response.nextUpdate.Format(http.TimeFormat))
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, public, no-transform, must-revalidate", maxAge))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(der); err != nil {
+		log.Printf("[ERROR]: could not write OCSP response, reason: %v", err)
+	}
+}
+
+func hasOCSPSigningUsage(cert *x509.Certificate) bool {
+	for _, usage := range cert.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageOCSPSigning {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package common
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestOCSPCacheIsBounded(t *testing.T) {
+	r := &OCSPResponder{cache: map[string]*cachedOCSPResponse{}}
+
+	now := time.Now()
+	for i := range maxOCSPCacheEntries {
+		r.cacheResponse(strconv.Itoa(i), &cachedOCSPResponse{nextUpdate: now.Add(time.Hour + time.Duration(i)*time.Second)})
+	}
+
+	// The response closest to its next update makes room for the new one
+	r.cacheResponse("new", &cachedOCSPResponse{nextUpdate: now.Add(2 * time.Hour)})
+	if len(r.cache) != maxOCSPCacheEntries {
+		t.Fatalf("the cache has %d responses, want %d", len(r.cache), maxOCSPCacheEntries)
+	}
+	if _, ok := r.cache["0"]; ok {
+		t.Error("the oldest response was not evicted")
+	}
+	if _, ok := r.cache["new"]; !ok {
+		t.Error("the new response was not cached")
+	}
+
+	// Expired responses are all removed once the cache is full
+	for i := 1; i <= 10; i++ {
+		r.cache[strconv.Itoa(i)].nextUpdate = now.Add(-time.Minute)
+	}
+	r.cacheResponse("newer", &cachedOCSPResponse{nextUpdate: now.Add(2 * time.Hour)})
+	if len(r.cache) != maxOCSPCacheEntries-9 {
+		t.Errorf("the cache has %d responses, want %d", len(r.cache), maxOCSPCacheEntries-9)
+	}
+}
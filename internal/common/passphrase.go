@@ -0,0 +1,89 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// CAKeyPassphraseEnv holds the CA key passphrase, prefer a file with a
+// Docker or Kubernetes secret as environment variables are easier to leak
+const CAKeyPassphraseEnv = "CA_KEY_PASSPHRASE"
+
+type PassphraseFunc func() ([]byte, error)
+
+// CAKeyPassphrase reads the passphrase from the environment, then from the file
+// if set and finally asks for it if interactive and stdin is a terminal
+func CAKeyPassphrase(file string, interactive bool) PassphraseFunc {
+	return func() ([]byte, error) {
+		if value := os.Getenv(CAKeyPassphraseEnv); value != "" {
+			return []byte(value), nil
+		}
+
+		if file != "" {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("could not read the CA key passphrase file: %v", err)
+			}
+			passphrase := bytes.TrimRight(data, "\r\n")
+			if len(passphrase) == 0 {
+				return nil, errors.New("the CA key passphrase file is empty")
+			}
+			return passphrase, nil
+		}
+
+		if interactive && isTerminal(os.Stdin) {
+			return readPassphrase("Enter the CA private key passphrase: ")
+		}
+
+		return nil, fmt.Errorf("the CA private key is encrypted, set %s or a passphrase file", CAKeyPassphraseEnv)
+	}
+}
+
+// NewCAKeyPassphrase is used when a CA key is created, a typed passphrase must be confirmed
+func NewCAKeyPassphrase(file string) PassphraseFunc {
+	return func() ([]byte, error) {
+		if os.Getenv(CAKeyPassphraseEnv) != "" || file != "" || !isTerminal(os.Stdin) {
+			return CAKeyPassphrase(file, false)()
+		}
+
+		passphrase, err := readPassphrase("Enter a passphrase for the CA private key: ")
+		if err != nil {
+			return nil, err
+		}
+		if len(passphrase) == 0 {
+			return nil, errors.New("the passphrase cannot be empty")
+		}
+
+		confirmation, err := readPassphrase("Confirm the passphrase: ")
+		if err != nil {
+			wipeBytes(passphrase)
+			return nil, err
+		}
+		defer wipeBytes(confirmation)
+
+		if !bytes.Equal(passphrase, confirmation) {
+			wipeBytes(passphrase)
+			return nil, errors.New("the passphrases don't match")
+		}
+		return passphrase, nil
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// readPassphrase disables the echo while the passphrase is typed
+func readPassphrase(prompt string) ([]byte, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	return passphrase, nil
+}
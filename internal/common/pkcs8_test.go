@@ -0,0 +1,136 @@
+package common
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+const testPassphrase = "correct horse battery staple"
+
+func testPKCS8Key(t *testing.T) []byte {
+	t.Helper()
+
+	key, err := GenerateKey(KeySpec{Algorithm: KeyAlgorithmECDSA, Size: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func lookOpenSSL(t *testing.T) string {
+	t.Helper()
+
+	openssl, err := exec.LookPath("openssl")
+	if err != nil {
+		t.Skip("openssl is not installed")
+	}
+	return openssl
+}
+
+func TestPKCS8RoundTrip(t *testing.T) {
+	der := testPKCS8Key(t)
+
+	encrypted, err := EncryptPKCS8PrivateKey(der, []byte(testPassphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain, err := DecryptPKCS8PrivateKey(encrypted, []byte(testPassphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plain) != string(der) {
+		t.Error("the decrypted key is not the encrypted one")
+	}
+
+	if _, err := DecryptPKCS8PrivateKey(encrypted, []byte("wrong")); !errors.Is(err, ErrIncorrectPassphrase) {
+		t.Errorf("a wrong passphrase returned %v", err)
+	}
+}
+
+// TestPKCS8DecryptsOpenSSL reads the keys written by openssl pkcs8 -topk8 -v2
+func TestPKCS8DecryptsOpenSSL(t *testing.T) {
+	openssl := lookOpenSSL(t)
+	dir := t.TempDir()
+
+	der := testPKCS8Key(t)
+	plainPath := filepath.Join(dir, "plain.pem")
+	if err := os.WriteFile(plainPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{
+		{"-v2", "aes-256-cbc"},
+		{"-v2", "aes-128-cbc", "-v2prf", "hmacWithSHA1"},
+		{"-v2", "aes-192-cbc", "-v2prf", "hmacWithSHA512"},
+		{"-v2", "aes-256-cbc", "-v2prf", "hmacWithSHA384", "-iter", "1000"},
+	} {
+		encryptedPath := filepath.Join(dir, "encrypted.pem")
+		cmd := exec.Command(openssl, append([]string{"pkcs8", "-topk8", "-in", plainPath, "-out", encryptedPath, "-passout", "pass:" + testPassphrase}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("openssl %v failed: %v\n%s", args, err, out)
+		}
+
+		signer, err := ReadEncryptedPEMSigner(encryptedPath, func() ([]byte, error) { return []byte(testPassphrase), nil })
+		if err != nil {
+			t.Errorf("could not read the key encrypted with %v: %v", args, err)
+			continue
+		}
+
+		got, err := x509.MarshalPKCS8PrivateKey(signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(der) {
+			t.Errorf("the key encrypted with %v is not the original one", args)
+		}
+	}
+}
+
+// TestPKCS8EncryptsForOpenSSL checks that openssl pkcs8 reads the keys we encrypt
+func TestPKCS8EncryptsForOpenSSL(t *testing.T) {
+	openssl := lookOpenSSL(t)
+	dir := t.TempDir()
+
+	der := testPKCS8Key(t)
+	encrypted, err := EncryptPKCS8PrivateKey(der, []byte(testPassphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encryptedPath := filepath.Join(dir, "encrypted.pem")
+	if err := os.WriteFile(encryptedPath, pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: encrypted}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command(openssl, "pkcs8", "-in", encryptedPath, "-passin", "pass:"+testPassphrase, "-topk8", "-nocrypt", "-outform", "DER").Output()
+	if err != nil {
+		t.Fatalf("openssl could not decrypt the key: %v", err)
+	}
+	// openssl may encode the key differently, compare the keys
+	got, err := parsePKCS8Signer(out)
+	if err != nil {
+		t.Fatalf("could not parse the key decrypted by openssl: %v", err)
+	}
+	want, err := parsePKCS8Signer(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(want.Public()) {
+		t.Error("openssl decrypted a different key")
+	}
+
+	if err := exec.Command(openssl, "pkcs8", "-in", encryptedPath, "-passin", "pass:wrong", "-topk8", "-nocrypt", "-outform", "DER").Run(); err == nil {
+		t.Error("openssl decrypted the key with a wrong passphrase")
+	}
+}
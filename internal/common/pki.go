@@ -0,0 +1,237 @@
+package common
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/scncore/ent/certificate"
+)
+
+const (
+	PKICertificateWorker = "worker"
+	PKICertificateServer = "server"
+	PKICertificateNATS   = "nats"
+	// PKICertificateSMIME signs the emails sent by the notification worker
+	PKICertificateSMIME = "smime"
+)
+
+// ServiceCertificateRequest describes a certificate for scnorion's own
+// services, issued from the CLI instead of a NATS request
+type ServiceCertificateRequest struct {
+	Type        string
+	Subject     pkix.Name
+	DNSNames    []string
+	IPAddresses []net.IP
+	// EmailAddresses are the sender addresses of an S/MIME certificate
+	EmailAddresses []string
+	YearsValid     int
+	KeySpec        KeySpec
+}
+
+// NewRootCA creates a self-signed CA allowed to sign one level of issuing intermediates
+func NewRootCA(subject pkix.Name, yearsValid int, spec KeySpec) (*x509.Certificate, crypto.Signer, error) {
+	key, err := GenerateKey(spec.OrDefault())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// There's no database yet to check the serial against
+	serialNumber, err := (&Worker{}).NewSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               subject,
+		NotBefore:             time.Now().Add(-5 * time.Minute).UTC(),
+		NotAfter:              time.Now().AddDate(yearsValid, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            1,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cert, key, nil
+}
+
+func (w *Worker) IssueServiceCertificate(req *ServiceCertificateRequest) (*IssuedCertificate, error) {
+	var err error
+
+	template, err := w.NewX509ServiceCertificateTemplate(req)
+	if err != nil {
+		return nil, err
+	}
+
+	issued := IssuedCertificate{}
+
+	issued.PrivateKey, err = GenerateKey(req.KeySpec.OrDefault())
+	if err != nil {
+		return nil, err
+	}
+
+	issued.CertBytes, err = x509.CreateCertificate(rand.Reader, template, w.CACert, issued.PrivateKey.Public(), w.CAPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	issued.Cert, err = x509.ParseCertificate(issued.CertBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &issued, nil
+}
+
+func (w *Worker) NewX509ServiceCertificateTemplate(req *ServiceCertificateRequest) (*x509.Certificate, error) {
+	var extKeyUsage []x509.ExtKeyUsage
+	keyUsage := x509.KeyUsageDigitalSignature
+
+	switch req.Type {
+	case PKICertificateWorker:
+		extKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	case PKICertificateServer:
+		extKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	case PKICertificateNATS:
+		// NATS cluster routes and leaf nodes authenticate as clients too
+		extKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	case PKICertificateSMIME:
+		extKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection}
+		keyUsage |= x509.KeyUsageContentCommitment
+		// The S/MIME signer of the notification worker only supports these keys
+		if req.KeySpec.Algorithm == KeyAlgorithmEd25519 {
+			return nil, fmt.Errorf("%s certificates need an RSA or ECDSA key", req.Type)
+		}
+		if len(req.EmailAddresses) == 0 {
+			return nil, fmt.Errorf("a %s certificate needs at least one email address", req.Type)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported certificate type %s, use worker, server, nats or smime", req.Type)
+	}
+
+	if req.Type != PKICertificateWorker && req.Type != PKICertificateSMIME && len(req.DNSNames) == 0 && len(req.IPAddresses) == 0 {
+		return nil, fmt.Errorf("a %s certificate needs at least one DNS name or IP address", req.Type)
+	}
+
+	serialNumber, err := w.NewSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	dnsNames := []string{}
+	for _, dnsName := range req.DNSNames {
+		dnsNames = append(dnsNames, strings.ToLower(dnsName))
+	}
+
+	return &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               req.Subject,
+		Issuer:                w.CACert.Subject,
+		DNSNames:              dnsNames,
+		IPAddresses:           req.IPAddresses,
+		EmailAddresses:        req.EmailAddresses,
+		NotBefore:             time.Now().Add(-5 * time.Minute).UTC(),
+		NotAfter:              time.Now().AddDate(req.YearsValid, 0, 0),
+		ExtKeyUsage:           extKeyUsage,
+		KeyUsage:              keyUsage,
+		OCSPServer:            w.OCSPResponders,
+		CRLDistributionPoints: w.CRLDistributionPoints,
+	}, nil
+}
+
+// SaveServiceCertificate records the certificate and revokes the one issued before for the same service
+func (w *Worker) SaveServiceCertificate(req *ServiceCertificateRequest, issued *IssuedCertificate) error {
+	certType := certificate.TypeWorker
+	switch req.Type {
+	case PKICertificateServer:
+		certType = certificate.TypeConsole
+	case PKICertificateNATS:
+		certType = certificate.TypeNats
+	}
+
+	certDescription := req.Subject.CommonName + " " + req.Type + " certificate"
+
+	if _, err := w.Model.RevokePreviousCertificates(certDescription); err != nil {
+		return err
+	}
+
+	return w.Model.SaveCertificate(issued.Cert.SerialNumber, certType, "", certDescription, issued.Cert.NotAfter)
+}
+
+func WriteCertificatePEM(path string, der []byte, overwrite bool) error {
+	return writePEMFile(path, &pem.Block{Type: "CERTIFICATE", Bytes: der}, 0644, overwrite)
+}
+
+// WritePrivateKeyPEM writes an encrypted PKCS#8 key if a passphrase is given
+func WritePrivateKeyPEM(path string, key crypto.Signer, passphrase []byte, overwrite bool) error {
+	if len(passphrase) == 0 {
+		der, err := MarshalPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		defer wipeBytes(der)
+
+		blockType := "PRIVATE KEY"
+		if _, ok := key.(*rsa.PrivateKey); ok {
+			blockType = "RSA PRIVATE KEY"
+		}
+		return writePEMFile(path, &pem.Block{Type: blockType, Bytes: der}, 0600, overwrite)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	defer wipeBytes(der)
+
+	encrypted, err := EncryptPKCS8PrivateKey(der, passphrase)
+	if err != nil {
+		return err
+	}
+	return writePEMFile(path, &pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: encrypted}, 0600, overwrite)
+}
+
+func writePEMFile(path string, block *pem.Block, perm os.FileMode, overwrite bool) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !overwrite {
+		flags |= os.O_EXCL
+	}
+
+	f, err := os.OpenFile(path, flags, perm)
+	if err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("%s already exists, use --force to overwrite it", path)
+		}
+		return err
+	}
+
+	if err := pem.Encode(f, block); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
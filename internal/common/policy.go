@@ -0,0 +1,274 @@
+package common
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/scncore/ent/certificate"
+	scnorion_nats "github.com/scncore/nats"
+	"github.com/scncore/scnorion-worker/internal/models"
+)
+
+var (
+	oidExtensionSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+	oidUserPrincipalName       = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2, 3}
+)
+
+var policyExtKeyUsages = map[string]x509.ExtKeyUsage{
+	"serverauth":      x509.ExtKeyUsageServerAuth,
+	"clientauth":      x509.ExtKeyUsageClientAuth,
+	"codesigning":     x509.ExtKeyUsageCodeSigning,
+	"emailprotection": x509.ExtKeyUsageEmailProtection,
+	"timestamping":    x509.ExtKeyUsageTimeStamping,
+	"ipsecendsystem":  x509.ExtKeyUsageIPSECEndSystem,
+	"ipsectunnel":     x509.ExtKeyUsageIPSECTunnel,
+	"ipsecuser":       x509.ExtKeyUsageIPSECUser,
+}
+
+var policyKeyUsages = map[string]x509.KeyUsage{
+	"digitalsignature":  x509.KeyUsageDigitalSignature,
+	"contentcommitment": x509.KeyUsageContentCommitment,
+	"keyencipherment":   x509.KeyUsageKeyEncipherment,
+	"dataencipherment":  x509.KeyUsageDataEncipherment,
+	"keyagreement":      x509.KeyUsageKeyAgreement,
+}
+
+// PolicyError is a request the tenant policy doesn't allow, it's denied as
+// retrying the same request would be rejected again
+type PolicyError struct {
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return e.Reason
+}
+
+func policyViolation(format string, a ...any) error {
+	return &PolicyError{Reason: fmt.Sprintf(format, a...)}
+}
+
+// UserCertificatePolicy returns the policy for user certificates, users are
+// not bound to a tenant so the default tenant's policy is used
+func (w *Worker) UserCertificatePolicy() (*models.CertificatePolicy, error) {
+	if w.Model == nil {
+		return nil, nil
+	}
+
+	tenantID := models.DefaultPolicyTenant
+	if t, err := w.Model.GetDefaultTenant(); err == nil {
+		tenantID = t.ID
+	}
+
+	return w.Model.GetCertificatePolicy(tenantID, certificate.TypeUser.String())
+}
+
+func (w *Worker) AgentCertificatePolicy(agentID string) (*models.CertificatePolicy, error) {
+	if w.Model == nil {
+		return nil, nil
+	}
+
+	tenantID, err := w.Model.GetTenantFromAgentID(scnorion_nats.RemoteConfigRequest{AgentID: agentID})
+	if err != nil {
+		tenantID = models.DefaultPolicyTenant
+	}
+
+	return w.Model.GetCertificatePolicy(tenantID, certificate.TypeAgent.String())
+}
+
+// ApplyUserPolicy checks the template against the policy and adds the SANs and usages it sets
+func ApplyUserPolicy(template *x509.Certificate, cr *scnorion_nats.CertificateRequest, policy *models.CertificatePolicy) error {
+	if policy == nil {
+		return nil
+	}
+
+	if err := applyCommonPolicy(template, policy); err != nil {
+		return err
+	}
+
+	sans := []asn1.RawValue{}
+
+	if policy.EmailSAN {
+		if cr.Email == "" {
+			return policyViolation("the tenant policy requires an email address for user %s", cr.Username)
+		}
+		if !emailDomainAllowed(cr.Email, policy.AllowedEmailDomains) {
+			return policyViolation("email address %s is not in a domain allowed by the tenant policy", cr.Email)
+		}
+		template.EmailAddresses = []string{cr.Email}
+		sans = append(sans, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, Bytes: []byte(cr.Email)})
+	}
+
+	if policy.UPNDomain != "" {
+		upn, err := marshalUPN(cr.Username + "@" + policy.UPNDomain)
+		if err != nil {
+			return err
+		}
+		sans = append(sans, upn)
+
+		// Go can't write otherName SANs, the whole extension is built here and overrides EmailAddresses
+		value, err := asn1.Marshal(sans)
+		if err != nil {
+			return err
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, pkix.Extension{Id: oidExtensionSubjectAltName, Value: value})
+	}
+
+	return nil
+}
+
+// ApplyAgentPolicy checks the agent DNS name and the requested IP addresses against the policy
+func ApplyAgentPolicy(template *x509.Certificate, ipAddresses []net.IP, policy *models.CertificatePolicy) error {
+	if policy == nil {
+		if len(ipAddresses) > 0 {
+			return policyViolation("IP addresses can only be requested if the tenant policy allows them")
+		}
+		return nil
+	}
+
+	if err := applyCommonPolicy(template, policy); err != nil {
+		return err
+	}
+
+	if len(policy.AllowedDNSSuffixes) > 0 {
+		for _, dnsName := range template.DNSNames {
+			if !dnsSuffixAllowed(dnsName, policy.AllowedDNSSuffixes) {
+				return policyViolation("DNS name %s does not end with a suffix allowed by the tenant policy", dnsName)
+			}
+		}
+	}
+
+	for _, ip := range ipAddresses {
+		allowed, err := ipAllowed(ip, policy.AllowedIPRanges)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return policyViolation("IP address %s is not in a range allowed by the tenant policy", ip.String())
+		}
+	}
+	template.IPAddresses = ipAddresses
+
+	return nil
+}
+
+func applyCommonPolicy(template *x509.Certificate, policy *models.CertificatePolicy) error {
+	if policy.MaxValidityDays > 0 {
+		maxNotAfter := time.Now().AddDate(0, 0, policy.MaxValidityDays)
+		if template.NotAfter.After(maxNotAfter) {
+			days := int(time.Until(template.NotAfter).Round(24*time.Hour).Hours() / 24)
+			return policyViolation("requested validity of %d days exceeds the maximum of %d days allowed by the tenant policy", days, policy.MaxValidityDays)
+		}
+	}
+
+	for _, name := range policy.KeyUsages {
+		usage, ok := policyKeyUsages[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("the tenant policy has an unsupported key usage %s", name)
+		}
+		template.KeyUsage |= usage
+	}
+
+	for _, name := range policy.ExtKeyUsages {
+		if usage, ok := policyExtKeyUsages[strings.ToLower(name)]; ok {
+			if !hasExtKeyUsage(template.ExtKeyUsage, usage) {
+				template.ExtKeyUsage = append(template.ExtKeyUsage, usage)
+			}
+			continue
+		}
+
+		// Any other usage must be given as a dotted OID
+		oid, err := parseOID(name)
+		if err != nil {
+			return fmt.Errorf("the tenant policy has an unsupported extended key usage %s", name)
+		}
+		template.UnknownExtKeyUsage = append(template.UnknownExtKeyUsage, oid)
+	}
+
+	return nil
+}
+
+func dnsSuffixAllowed(dnsName string, suffixes []string) bool {
+	dnsName = strings.ToLower(dnsName)
+	for _, suffix := range suffixes {
+		suffix = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(suffix), "."))
+		if suffix != "" && (dnsName == suffix || strings.HasSuffix(dnsName, "."+suffix)) {
+			return true
+		}
+	}
+	return false
+}
+
+func emailDomainAllowed(email string, domains []string) bool {
+	if len(domains) == 0 {
+		return true
+	}
+
+	_, domain, found := strings.Cut(email, "@")
+	if !found {
+		return false
+	}
+	return dnsSuffixAllowed(domain, domains)
+}
+
+func ipAllowed(ip net.IP, ranges []string) (bool, error) {
+	for _, r := range ranges {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(r))
+		if err != nil {
+			return false, fmt.Errorf("the tenant policy has an invalid IP range %s", r)
+		}
+		if network.Contains(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func hasExtKeyUsage(usages []x509.ExtKeyUsage, usage x509.ExtKeyUsage) bool {
+	for _, u := range usages {
+		if u == usage {
+			return true
+		}
+	}
+	return false
+}
+
+func parseOID(value string) (asn1.ObjectIdentifier, error) {
+	oid := asn1.ObjectIdentifier{}
+	for _, part := range strings.Split(value, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid OID %s", value)
+		}
+		oid = append(oid, n)
+	}
+	if len(oid) < 2 {
+		return nil, fmt.Errorf("invalid OID %s", value)
+	}
+	return oid, nil
+}
+
+// marshalUPN encodes a Microsoft UPN as an otherName SAN used for smart card logon
+func marshalUPN(upn string) (asn1.RawValue, error) {
+	typeID, err := asn1.Marshal(oidUserPrincipalName)
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+
+	value, err := asn1.MarshalWithParams(upn, "utf8")
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+
+	explicitValue, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: value})
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: append(typeID, explicitValue...)}, nil
+}
@@ -0,0 +1,254 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	scnorion_nats "github.com/scncore/nats"
+	"github.com/scncore/scnorion-worker/internal/models"
+)
+
+type policyResult int
+
+const (
+	policyAllowed policyResult = iota
+	policyDenied
+	policyInvalid
+)
+
+// checkPolicyResult checks a denied request returns a PolicyError and a policy that
+// can't be applied returns any other error, so the request is retried once it's fixed
+func checkPolicyResult(t *testing.T, err error, want policyResult) {
+	t.Helper()
+
+	var policyErr *PolicyError
+	switch want {
+	case policyAllowed:
+		if err != nil {
+			t.Fatalf("the request has been rejected: %v", err)
+		}
+	case policyDenied:
+		if !errors.As(err, &policyErr) {
+			t.Fatalf("got %v, want a policy error", err)
+		}
+	case policyInvalid:
+		if err == nil || errors.As(err, &policyErr) {
+			t.Fatalf("got %v, want an error that is not a policy error", err)
+		}
+	}
+}
+
+func testPolicyTemplate(days int, dnsNames ...string) *x509.Certificate {
+	return &x509.Certificate{
+		NotBefore:   time.Now().Add(-5 * time.Minute),
+		NotAfter:    time.Now().AddDate(0, 0, days),
+		DNSNames:    dnsNames,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+}
+
+// policyCertificate signs the template so the test checks what ends up in the certificate
+func policyCertificate(t *testing.T, template *x509.Certificate) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(1)
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// certificateUPN returns the UPN otherName of the certificate, if any
+func certificateUPN(t *testing.T, cert *x509.Certificate) string {
+	t.Helper()
+
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidExtensionSubjectAltName) {
+			continue
+		}
+		var sans []asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &sans); err != nil {
+			t.Fatal(err)
+		}
+		for _, san := range sans {
+			if san.Class != asn1.ClassContextSpecific || san.Tag != 0 {
+				continue
+			}
+			var typeID asn1.ObjectIdentifier
+			rest, err := asn1.Unmarshal(san.Bytes, &typeID)
+			if err != nil || !typeID.Equal(oidUserPrincipalName) {
+				continue
+			}
+			var explicit asn1.RawValue
+			if _, err := asn1.Unmarshal(rest, &explicit); err != nil {
+				t.Fatal(err)
+			}
+			var upn string
+			if _, err := asn1.UnmarshalWithParams(explicit.Bytes, &upn, "utf8"); err != nil {
+				t.Fatal(err)
+			}
+			return upn
+		}
+	}
+	return ""
+}
+
+func TestApplyUserPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		days   int
+		email  string
+		policy *models.CertificatePolicy
+		want   policyResult
+		check  func(t *testing.T, cert *x509.Certificate)
+	}{
+		{name: "no policy", days: 3650, policy: nil, want: policyAllowed},
+		{name: "within max validity", days: 90, policy: &models.CertificatePolicy{MaxValidityDays: 365}, want: policyAllowed},
+		{name: "over max validity", days: 400, policy: &models.CertificatePolicy{MaxValidityDays: 365}, want: policyDenied},
+		{
+			name: "email SAN", days: 90, email: "user@example.com",
+			policy: &models.CertificatePolicy{EmailSAN: true},
+			want:   policyAllowed,
+			check: func(t *testing.T, cert *x509.Certificate) {
+				if !slices.Equal(cert.EmailAddresses, []string{"user@example.com"}) {
+					t.Errorf("got email addresses %v", cert.EmailAddresses)
+				}
+			},
+		},
+		{name: "email SAN without email", days: 90, policy: &models.CertificatePolicy{EmailSAN: true}, want: policyDenied},
+		{
+			name: "email in an allowed subdomain", days: 90, email: "user@sales.example.com",
+			policy: &models.CertificatePolicy{EmailSAN: true, AllowedEmailDomains: []string{"example.com"}},
+			want:   policyAllowed,
+		},
+		{
+			name: "email in another domain", days: 90, email: "user@notexample.com",
+			policy: &models.CertificatePolicy{EmailSAN: true, AllowedEmailDomains: []string{"example.com"}},
+			want:   policyDenied,
+		},
+		{
+			name: "UPN SAN", days: 90, email: "user@example.com",
+			policy: &models.CertificatePolicy{EmailSAN: true, UPNDomain: "corp.example.com"},
+			want:   policyAllowed,
+			check: func(t *testing.T, cert *x509.Certificate) {
+				if upn := certificateUPN(t, cert); upn != "user@corp.example.com" {
+					t.Errorf("got UPN %q", upn)
+				}
+				// The SAN extension built for the UPN keeps the email address
+				if !slices.Equal(cert.EmailAddresses, []string{"user@example.com"}) {
+					t.Errorf("got email addresses %v", cert.EmailAddresses)
+				}
+			},
+		},
+		{
+			name: "extra usages", days: 90,
+			policy: &models.CertificatePolicy{
+				KeyUsages:    []string{"keyEncipherment"},
+				ExtKeyUsages: []string{"ClientAuth", "emailProtection", "1.3.6.1.4.1.311.20.2.2"},
+			},
+			want: policyAllowed,
+			check: func(t *testing.T, cert *x509.Certificate) {
+				if cert.KeyUsage != x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment {
+					t.Errorf("got key usage %b", cert.KeyUsage)
+				}
+				if !slices.Equal(cert.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageEmailProtection}) {
+					t.Errorf("got extended key usages %v", cert.ExtKeyUsage)
+				}
+				if len(cert.UnknownExtKeyUsage) != 1 || cert.UnknownExtKeyUsage[0].String() != "1.3.6.1.4.1.311.20.2.2" {
+					t.Errorf("got unknown extended key usages %v", cert.UnknownExtKeyUsage)
+				}
+			},
+		},
+		{name: "unsupported key usage", days: 90, policy: &models.CertificatePolicy{KeyUsages: []string{"certSign"}}, want: policyInvalid},
+		{name: "unsupported extended key usage", days: 90, policy: &models.CertificatePolicy{ExtKeyUsages: []string{"smartcardlogon"}}, want: policyInvalid},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			template := testPolicyTemplate(tc.days)
+			cr := &scnorion_nats.CertificateRequest{Username: "user", Email: tc.email}
+
+			err := ApplyUserPolicy(template, cr, tc.policy)
+			checkPolicyResult(t, err, tc.want)
+			if err == nil && tc.check != nil {
+				tc.check(t, policyCertificate(t, template))
+			}
+		})
+	}
+}
+
+func TestApplyAgentPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		days        int
+		dnsName     string
+		ipAddresses []string
+		policy      *models.CertificatePolicy
+		want        policyResult
+	}{
+		{name: "no policy", days: 3650, dnsName: "agent.example.org", policy: nil, want: policyAllowed},
+		{name: "IP addresses without policy", days: 90, dnsName: "agent", ipAddresses: []string{"10.0.0.5"}, policy: nil, want: policyDenied},
+		{name: "over max validity", days: 400, dnsName: "agent", policy: &models.CertificatePolicy{MaxValidityDays: 365}, want: policyDenied},
+		{name: "allowed DNS suffix", days: 90, dnsName: "agent.corp.example.com", policy: &models.CertificatePolicy{AllowedDNSSuffixes: []string{".Corp.example.com"}}, want: policyAllowed},
+		{name: "DNS name is the suffix", days: 90, dnsName: "corp.example.com", policy: &models.CertificatePolicy{AllowedDNSSuffixes: []string{"corp.example.com"}}, want: policyAllowed},
+		{name: "DNS name in another domain", days: 90, dnsName: "agent.example.org", policy: &models.CertificatePolicy{AllowedDNSSuffixes: []string{"corp.example.com"}}, want: policyDenied},
+		{name: "DNS name that only ends like the suffix", days: 90, dnsName: "badcorp.example.com", policy: &models.CertificatePolicy{AllowedDNSSuffixes: []string{"corp.example.com"}}, want: policyDenied},
+		{
+			name: "allowed IP ranges", days: 90, dnsName: "agent", ipAddresses: []string{"10.0.0.5", "fd00::1"},
+			policy: &models.CertificatePolicy{AllowedIPRanges: []string{"10.0.0.0/8", " fd00::/8"}},
+			want:   policyAllowed,
+		},
+		{
+			name: "IP address out of range", days: 90, dnsName: "agent", ipAddresses: []string{"10.0.0.5", "192.168.1.1"},
+			policy: &models.CertificatePolicy{AllowedIPRanges: []string{"10.0.0.0/8"}},
+			want:   policyDenied,
+		},
+		{name: "IP address without ranges", days: 90, dnsName: "agent", ipAddresses: []string{"10.0.0.5"}, policy: &models.CertificatePolicy{}, want: policyDenied},
+		{
+			name: "invalid IP range", days: 90, dnsName: "agent", ipAddresses: []string{"10.0.0.5"},
+			policy: &models.CertificatePolicy{AllowedIPRanges: []string{"10.0.0.0/33"}},
+			want:   policyInvalid,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			template := testPolicyTemplate(tc.days, tc.dnsName)
+			ipAddresses := []net.IP{}
+			for _, ip := range tc.ipAddresses {
+				ipAddresses = append(ipAddresses, net.ParseIP(ip))
+			}
+
+			err := ApplyAgentPolicy(template, ipAddresses, tc.policy)
+			checkPolicyResult(t, err, tc.want)
+			if err != nil {
+				return
+			}
+
+			cert := policyCertificate(t, template)
+			if len(cert.IPAddresses) != len(ipAddresses) {
+				t.Fatalf("got IP addresses %v, want %v", cert.IPAddresses, ipAddresses)
+			}
+			for i := range ipAddresses {
+				if !cert.IPAddresses[i].Equal(ipAddresses[i]) {
+					t.Errorf("got IP addresses %v, want %v", cert.IPAddresses, ipAddresses)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package common
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"github.com/scncore/ent"
+	"github.com/scncore/ent/certificate"
+	scnorion_nats "github.com/scncore/nats"
+	"github.com/scncore/scnorion-worker/internal/models"
+)
+
+const (
+	DefaultAgentRenewalWindow = 30 * 24 * time.Hour
+	agentRenewalFrequency     = 6 * time.Hour
+)
+
+// RenewalWindow converts the configured days, a negative value disables the renewal
+func RenewalWindow(days int) time.Duration {
+	if days < 0 {
+		return -1
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func (w *Worker) StartAgentRenewalJob() error {
+	var err error
+
+	if w.AgentRenewalJob != nil || w.AgentRenewalWindow < 0 {
+		return nil
+	}
+
+	if w.AgentRenewalWindow == 0 {
+		w.AgentRenewalWindow = DefaultAgentRenewalWindow
+	}
+
+	w.AgentRenewalJob, err = w.TaskScheduler.NewJob(
+		gocron.DurationJob(
+			agentRenewalFrequency,
+		),
+		gocron.NewTask(w.RenewExpiringAgentCertificates),
+		gocron.WithStartAt(gocron.WithStartImmediately()),
+	)
+	if err != nil {
+		log.Printf("[ERROR]: could not start the agent certificates renewal job: %v", err)
+		return err
+	}
+	log.Printf("[INFO]: new agent certificates renewal job has been scheduled every %s", agentRenewalFrequency)
+	return nil
+}
+
+func (w *Worker) RenewExpiringAgentCertificates() {
+	if w.Model == nil {
+		log.Println("[ERROR]: could not renew agent certificates, reason: no connection with database")
+		return
+	}
+
+	certs, err := w.Model.GetAgentCertificatesExpiringBefore(time.Now().Add(w.AgentRenewalWindow))
+	if err != nil {
+		log.Printf("[ERROR]: could not get expiring agent certificates, reason: %v", err)
+		return
+	}
+
+	for _, c := range certs {
+		if err := w.RenewAgentCertificate(c); err != nil {
+			log.Printf("[ERROR]: could not renew agent certificate %s, reason: %v", c.Description, err)
+		}
+	}
+}
+
+func (w *Worker) RenewAgentCertificate(c *ent.Certificate) error {
+	dnsName := strings.TrimSuffix(c.Description, " agent certificate")
+
+	agentID, err := w.getCertificateAgentID(c, dnsName)
+	if err != nil {
+		if err := w.Model.AddCertificateEvent(models.CertificateEventRenewalFailed, c.ID, dnsName, err.Error()); err != nil {
+			log.Printf("[ERROR]: could not record the renewal outcome, reason: %v", err)
+		}
+		return err
+	}
+
+	err = w.renewAgentCertificate(agentID, dnsName, c)
+	if err != nil {
+		if err := w.Model.AddCertificateEvent(models.CertificateEventRenewalFailed, c.ID, agentID, err.Error()); err != nil {
+			log.Printf("[ERROR]: could not record the renewal outcome, reason: %v", err)
+		}
+		return err
+	}
+
+	log.Printf("[INFO]: %s for agent %s has been renewed", c.Description, agentID)
+	return nil
+}
+
+// renewAgentCertificate signs the public key of the agents that keep their private key again,
+// the agents get the new certificate on agent.certificate.<id> as when they enrolled. The
+// others get a new private key if legacy enrollment is still allowed
+func (w *Worker) renewAgentCertificate(agentID, dnsName string, c *ent.Certificate) error {
+	var previous *x509.Certificate
+
+	der, agentKey, err := w.Model.GetIssuedAgentCertificate(c.ID)
+	if err != nil && !ent.IsNotFound(err) {
+		return err
+	}
+	if err == nil {
+		previous, err = x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("could not parse the certificate to renew: %v", err)
+		}
+	}
+
+	cr := w.agentRenewalRequest(agentID, dnsName, previous)
+
+	if err := w.CheckAgentAdmission(&cr); err != nil {
+		w.DenyAgentCertificate(agentID, err)
+		return err
+	}
+
+	var issued *IssuedCertificate
+	switch {
+	case previous != nil && agentKey:
+		issued, err = w.signAgentCertificate(&cr, previous.PublicKey, previous.IPAddresses)
+	case w.LegacyAgentEnrollment:
+		// Legacy agents don't know how to send a CSR, issue the certificate and the key for them
+		issued, err = w.GenerateAgentCertificate(&cr)
+	default:
+		return errors.New("the agent's public key is unknown and legacy enrollment is disabled, the agent must enroll again")
+	}
+	if err != nil {
+		var policyErr *PolicyError
+		if errors.As(err, &policyErr) {
+			w.DenyAgentCertificate(agentID, err)
+		}
+		return err
+	}
+
+	if err := w.SaveAgentCertificate(agentID, issued); err != nil {
+		return err
+	}
+
+	if err := w.SendAgentCertificate(agentID, issued); err != nil {
+		if err := w.discardCertificate(certificate.TypeAgent.String(), agentID, issued.Cert.SerialNumber, "the renewed certificate could not be sent"); err != nil {
+			log.Printf("[ERROR]: could not revoke the renewed certificate that was not sent, reason: %v", err)
+		}
+		return err
+	}
+
+	w.SupersedeAgentCertificates(agentID, issued)
+	return nil
+}
+
+// agentRenewalRequest asks for the validity of the certificate being renewed, certificates
+// issued before they were kept don't say it and get the year the console asks for
+func (w *Worker) agentRenewalRequest(agentID, dnsName string, previous *x509.Certificate) scnorion_nats.CertificateRequest {
+	cr := scnorion_nats.CertificateRequest{
+		AgentId:    agentID,
+		DNSName:    dnsName,
+		YearsValid: 1,
+	}
+
+	if previous != nil {
+		cr.YearsValid = 0
+		cr.DaysValid = certificateValidityDays(previous)
+	}
+
+	tenantID, err := w.Model.GetTenantFromAgentID(scnorion_nats.RemoteConfigRequest{AgentID: agentID})
+	if err == nil {
+		if settings, err := w.Model.GetSettings(strconv.Itoa(tenantID)); err == nil {
+			cr.Organization = settings.Organization
+			cr.Country = settings.Country
+			cr.Province = settings.Province
+			cr.Locality = settings.Locality
+			cr.Address = settings.PostalAddress
+			cr.PostalCode = settings.PostalCode
+		}
+	}
+
+	// Stay within the tenant policy as nobody is there to ask for a shorter validity
+	if policy, err := w.AgentCertificatePolicy(agentID); err == nil && policy != nil && policy.MaxValidityDays > 0 {
+		if days := validityDays(cr); days > policy.MaxValidityDays {
+			cr.YearsValid = 0
+			cr.DaysValid = policy.MaxValidityDays
+		}
+	}
+
+	return cr
+}
+
+// certificateValidityDays returns the validity of a certificate in whole days, the
+// minutes its NotBefore is backdated are not counted
+func certificateValidityDays(cert *x509.Certificate) int {
+	return max(int(cert.NotAfter.Sub(cert.NotBefore).Round(24*time.Hour)/(24*time.Hour)), 1)
+}
+
+// validityDays returns the days between now and the end of the validity requested
+func validityDays(cr scnorion_nats.CertificateRequest) int {
+	now := time.Now()
+	return int(now.AddDate(cr.YearsValid, cr.MonthsValid, cr.DaysValid).Sub(now).Round(24*time.Hour) / (24 * time.Hour))
+}
+
+// getCertificateAgentID uses the owner stored with the certificate, older
+// certificates have no owner and the agent is found from its hostname
+func (w *Worker) getCertificateAgentID(c *ent.Certificate, dnsName string) (string, error) {
+	if c.UID != "" {
+		return c.UID, nil
+	}
+
+	hostname, _, _ := strings.Cut(dnsName, ".")
+	a, err := w.Model.GetAgentByHostname(hostname)
+	if err != nil {
+		return "", fmt.Errorf("could not find the agent that owns the certificate: %v", err)
+	}
+	return a.ID, nil
+}
@@ -0,0 +1,36 @@
+package common
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	scnorion_nats "github.com/scncore/nats"
+)
+
+func TestCertificateValidityDays(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		notBefore, notAfter time.Time
+		days                int
+	}{
+		// Issued certificates are backdated five minutes
+		{now.Add(-5 * time.Minute), now.AddDate(1, 0, 0), 365},
+		{now.Add(-5 * time.Minute), now.AddDate(0, 0, 90), 90},
+		{now, now.Add(time.Hour), 1},
+	} {
+		cert := &x509.Certificate{NotBefore: tc.notBefore, NotAfter: tc.notAfter}
+		if days := certificateValidityDays(cert); days != tc.days && !(tc.days == 365 && days == 366) {
+			t.Errorf("certificate valid from %s to %s has %d days, want %d", tc.notBefore, tc.notAfter, days, tc.days)
+		}
+	}
+}
+
+func TestValidityDays(t *testing.T) {
+	if days := validityDays(scnorion_nats.CertificateRequest{DaysValid: 90}); days != 90 {
+		t.Errorf("got %d days, want 90", days)
+	}
+	if days := validityDays(scnorion_nats.CertificateRequest{YearsValid: 1}); days != 365 && days != 366 {
+		t.Errorf("got %d days for a year", days)
+	}
+}
@@ -0,0 +1,60 @@
+package common
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+
+	"github.com/scncore/scnorion-worker/internal/models"
+)
+
+// maxSerialAttempts limits the retries when a generated serial collides with an issued one
+const maxSerialAttempts = 5
+
+// serialNumberLimit gives 128 random bits, well within the 20 octets allowed by RFC 5280
+var serialNumberLimit = new(big.Int).Lsh(big.NewInt(1), 128)
+
+// NewSerialNumber generates a random serial and reserves it in the database
+// so two certificates never share the same serial
+func (w *Worker) NewSerialNumber() (*big.Int, error) {
+	for range maxSerialAttempts {
+		serial, err := rand.Int(rand.Reader, serialNumberLimit)
+		if err != nil {
+			return nil, err
+		}
+		if serial.Sign() == 0 {
+			continue
+		}
+
+		if w.Model == nil {
+			return serial, nil
+		}
+
+		err = w.Model.ReserveSerial(serial)
+		if err == nil {
+			return serial, nil
+		}
+		if !errors.Is(err, models.ErrSerialCollision) && !errors.Is(err, models.ErrShortSerialCollision) {
+			return nil, err
+		}
+		log.Printf("[INFO]: serial number %s can't be used, generating a new one, reason: %v", models.FormatSerial(serial), err)
+	}
+
+	return nil, errors.New("could not generate a unique serial number")
+}
+
+// ParseSerial reads a serial number in hexadecimal, with or without colons as shown by openssl
+func ParseSerial(value string) (*big.Int, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	value = strings.TrimPrefix(value, "0x")
+	value = strings.ReplaceAll(value, ":", "")
+
+	serial, ok := new(big.Int).SetString(value, 16)
+	if !ok || serial.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid serial number %q", value)
+	}
+	return serial, nil
+}
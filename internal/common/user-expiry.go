@@ -0,0 +1,235 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"github.com/scncore/ent"
+	"github.com/scncore/ent/certificate"
+	scnorion_nats "github.com/scncore/nats"
+	"github.com/scncore/scnorion-worker/internal/common/notifications"
+	"github.com/scncore/scnorion-worker/internal/models"
+	"golang.org/x/crypto/ocsp"
+)
+
+const userExpiryCheckFrequency = time.Hour
+
+// userExpiryReminderDays are the days before expiry when users are reminded, one reminder per step
+var userExpiryReminderDays = []int{1, 7, 30}
+
+func (w *Worker) StartUserExpiryJob() error {
+	var err error
+
+	if w.UserExpiryJob != nil || !w.UserExpiryReminders {
+		return nil
+	}
+
+	w.UserExpiryJob, err = w.TaskScheduler.NewJob(
+		gocron.DurationJob(
+			userExpiryCheckFrequency,
+		),
+		gocron.NewTask(w.RemindExpiringUserCertificates),
+		gocron.WithStartAt(gocron.WithStartImmediately()),
+	)
+	if err != nil {
+		log.Printf("[ERROR]: could not start the user certificates expiry job: %v", err)
+		return err
+	}
+	log.Printf("[INFO]: new user certificates expiry job has been scheduled every %s", userExpiryCheckFrequency)
+	return nil
+}
+
+func (w *Worker) RemindExpiringUserCertificates() {
+	if w.Model == nil {
+		log.Println("[ERROR]: could not check user certificates expiry, reason: no connection with database")
+		return
+	}
+
+	maxDays := userExpiryReminderDays[len(userExpiryReminderDays)-1]
+	certs, err := w.Model.GetUserCertificatesExpiringBefore(time.Now().AddDate(0, 0, maxDays))
+	if err != nil {
+		log.Printf("[ERROR]: could not get expiring user certificates, reason: %v", err)
+		return
+	}
+
+	for _, c := range certs {
+		if err := w.RemindUserCertificateExpiry(c); err != nil {
+			log.Printf("[ERROR]: could not handle the expiry of %s, reason: %v", c.Description, err)
+		}
+	}
+}
+
+// RemindUserCertificateExpiry sends the reminder for the closest step not sent yet,
+// or renews the certificate if the automatic renewal is enabled
+func (w *Worker) RemindUserCertificateExpiry(c *ent.Certificate) error {
+	days := 0
+	for _, d := range userExpiryReminderDays {
+		if time.Until(c.Expiry) <= time.Duration(d)*24*time.Hour {
+			days = d
+			break
+		}
+	}
+	if days == 0 {
+		return nil
+	}
+
+	info := fmt.Sprintf("%d days", days)
+	sent, err := w.Model.HasCertificateEvent(c.ID, models.CertificateEventExpiryReminder, info)
+	if err != nil {
+		return err
+	}
+	if sent {
+		return nil
+	}
+
+	uid := c.UID
+	if uid == "" {
+		uid = strings.TrimSuffix(c.Description, " client certificate")
+	}
+
+	u, err := w.Model.GetUserById(uid)
+	if err != nil {
+		return fmt.Errorf("could not find the user that owns the certificate: %v", err)
+	}
+
+	// The user already got a newer certificate, from the console or a renewal
+	if u.Expiry.After(c.Expiry) {
+		return nil
+	}
+
+	if u.Email == "" {
+		return fmt.Errorf("user %s has no email address", u.ID)
+	}
+
+	if w.UserAutoRenewal {
+		err := w.RenewUserCertificate(u, c)
+		if err == nil {
+			return w.Model.AddCertificateEvent(models.CertificateEventExpiryReminder, c.ID, u.ID, info)
+		}
+
+		log.Printf("[ERROR]: could not renew the certificate of user %s, a reminder will be sent instead, reason: %v", u.ID, err)
+		if err := w.Model.AddCertificateEvent(models.CertificateEventRenewalFailed, c.ID, u.ID, err.Error()); err != nil {
+			log.Printf("[ERROR]: could not record the renewal outcome, reason: %v", err)
+		}
+	}
+
+	if err := w.SendUserExpiryReminder(u, c, days); err != nil {
+		return err
+	}
+
+	log.Printf("[INFO]: user %s has been reminded that the certificate expires in %s", u.ID, info)
+	return w.Model.AddCertificateEvent(models.CertificateEventExpiryReminder, c.ID, u.ID, info)
+}
+
+// RenewUserCertificate issues a new certificate and sends it like the console does, the
+// current certificate is revoked as superseded so the user has a single certificate
+func (w *Worker) RenewUserCertificate(u *ent.User, c *ent.Certificate) error {
+	previous, err := w.Model.GetFullSerial(c.ID)
+	if err != nil {
+		return fmt.Errorf("could not get the serial of the certificate to renew: %v", err)
+	}
+
+	cr := scnorion_nats.CertificateRequest{
+		Username:   u.ID,
+		FullName:   u.Name,
+		Email:      u.Email,
+		Password:   u.CertClearPassword,
+		ConsoleURL: w.ConsoleURL,
+		YearsValid: 1,
+	}
+
+	if settings, err := w.Model.GetSettings(""); err == nil {
+		cr.Organization = settings.Organization
+		cr.Country = settings.Country
+		cr.Province = settings.Province
+		cr.Locality = settings.Locality
+		cr.Address = settings.PostalAddress
+		cr.PostalCode = settings.PostalCode
+		if settings.UserCertYearsValid > 0 {
+			cr.YearsValid = settings.UserCertYearsValid
+		}
+	}
+
+	// Stay within the policy as nobody is there to ask for a shorter validity
+	if policy, err := w.UserCertificatePolicy(); err == nil && policy != nil && policy.MaxValidityDays > 0 && policy.MaxValidityDays < 365*cr.YearsValid {
+		cr.YearsValid = 0
+		cr.DaysValid = policy.MaxValidityDays
+	}
+
+	issued, err := w.GenerateUserCertificate(&cr)
+	if err != nil {
+		var policyErr *PolicyError
+		if errors.As(err, &policyErr) {
+			w.DenyUserCertificate(cr.Username, err)
+		}
+		return err
+	}
+
+	// The certificate is saved before it's sent, as the console and the agents' renewal do
+	certDescription := cr.Username + " client certificate"
+	if err := w.Model.SaveCertificate(issued.Cert.SerialNumber, certificate.TypeUser, cr.Username, certDescription, issued.Cert.NotAfter); err != nil {
+		return err
+	}
+
+	if err := w.SendCertificate(issued); err != nil {
+		if err := w.discardCertificate(certificate.TypeUser.String(), u.ID, issued.Cert.SerialNumber, "the renewed certificate could not be sent"); err != nil {
+			log.Printf("[ERROR]: could not revoke the renewed certificate that was not sent, reason: %v", err)
+		}
+		// Saving it moved the user's expiry, the next check must still find the current certificate
+		if err := w.Model.SetUserExpiry(u.ID, u.Expiry); err != nil {
+			log.Printf("[ERROR]: could not restore the certificate expiry of user %s, reason: %v", u.ID, err)
+		}
+		return err
+	}
+
+	// The user has the new certificate, so the previous one is no longer needed
+	info := fmt.Sprintf("certificate %s renewed by %s", models.FormatSerial(previous), models.FormatSerial(issued.Cert.SerialNumber))
+	if _, err := w.Model.RevokeCertificate(previous, ocsp.Superseded, info); err != nil {
+		return fmt.Errorf("could not revoke the renewed certificate: %v", err)
+	}
+	w.AnnounceRevocation(certificate.TypeUser.String(), u.ID, models.FormatSerial(previous), ocsp.Superseded, info)
+
+	if err := w.Model.AddCertificateEvent(models.CertificateEventRenewed, models.ShortSerial(issued.Cert.SerialNumber), u.ID, info); err != nil {
+		log.Printf("[ERROR]: could not record the certificate renewal, reason: %v", err)
+	}
+
+	log.Printf("[INFO]: the certificate of user %s has been renewed before expiry", u.ID)
+	return nil
+}
+
+func (w *Worker) SendUserExpiryReminder(u *ent.User, c *ent.Certificate, days int) error {
+	name := u.Name
+	if name == "" {
+		name = u.ID
+	}
+
+	notification := TenantNotification{
+		Notification: scnorion_nats.Notification{
+			To:               u.Email,
+			MessageActionURL: w.ConsoleURL,
+		},
+		Template: notifications.TemplateCertificateExpiry,
+		Data: map[string]string{
+			"name":   name,
+			"days":   strconv.Itoa(days),
+			"expiry": c.Expiry.UTC().Format("2006-01-02 15:04 MST"),
+		},
+	}
+
+	data, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	if w.NATSConnection == nil || !w.NATSConnection.IsConnected() {
+		return errors.New("NATS is not connected")
+	}
+
+	return w.NATSConnection.Publish("notification.certificate_expiry", data)
+}
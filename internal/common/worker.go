@@ -2,50 +2,97 @@ package common
 
 import (
 	"context"
-	"crypto/rsa"
+	"crypto"
 	"crypto/x509"
 	"encoding/json"
 	"log"
+	"math/big"
+	"sync"
+	"time"
 
 	"github.com/go-co-op/gocron/v2"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
-	"github.com/scncore/ent"
 	"github.com/scncore/ent/server"
 	scnorion_nats "github.com/scncore/nats"
+	"github.com/scncore/scnorion-worker/internal/common/notifications"
 	"github.com/scncore/scnorion-worker/internal/models"
 	"github.com/scncore/utils"
 )
 
+// stopTimeout bounds the time the worker waits for the messages being handled when it stops,
+// it's the default drain timeout of the NATS client
+const stopTimeout = 30 * time.Second
+
 type Worker struct {
-	NATSConnection         *nats.Conn
-	NATSConnectJob         gocron.Job
-	NATSServers            string
-	DBUrl                  string
-	DBConnectJob           gocron.Job
-	ConfigJob              gocron.Job
-	TaskScheduler          gocron.Scheduler
-	Model                  *models.Model
-	CACert                 *x509.Certificate
-	CAPrivateKey           *rsa.PrivateKey
-	ClientCertPath         string
-	ClientKeyPath          string
-	CACertPath             string
-	CAKeyPath              string
-	PKCS12                 []byte
-	Cert                   *x509.Certificate
-	CertBytes              []byte
-	PrivateKey             *rsa.PrivateKey
-	CertRequest            *scnorion_nats.CertificateRequest
-	Settings               *ent.Settings
-	Logger                 *utils.scnorionLogger
-	ConsoleURL             string
-	OCSPResponders         []string
-	JetstreamContextCancel context.CancelFunc
-	Version                string
-	Channel                server.Channel
-	Replicas               int
-	Jetstream              jetstream.JetStream
+	NATSConnection             *nats.Conn
+	NATSConnectJob             gocron.Job
+	NATSServers                string
+	DBUrl                      string
+	DBConnectJob               gocron.Job
+	ConfigJob                  gocron.Job
+	TaskScheduler              gocron.Scheduler
+	Model                      *models.Model
+	CACert                     *x509.Certificate
+	CAPrivateKey               crypto.Signer
+	ClientCertPath             string
+	ClientKeyPath              string
+	CACertPath                 string
+	RootCACert                 *x509.Certificate
+	CAChain                    []*x509.Certificate
+	CAChainPath                string
+	CAKeyPath                  string
+	CAKeyPassphraseFile        string
+	UserKeySpec                KeySpec
+	AgentKeySpec               KeySpec
+	MaxConcurrentIssuance      int
+	SMTPTLS                    *notifications.SMTPTLSOptions
+	SMTPOAuth2                 *notifications.OAuth2TokenSource
+	SMTPClients                *notifications.SMTPClientCache
+	NotificationSigning        *notifications.SigningOptions
+	NotificationOutboxJob      gocron.Job
+	NotificationTemplates      *notifications.TemplateRegistry
+	TemplatesDir               string
+	DefaultLocale              string
+	Logger                     *utils.scnorionLogger
+	ConsoleURL                 string
+	OCSPResponders             []string
+	CRLPath                    string
+	CRLDistributionPoints      []string
+	CRLFrequency               time.Duration
+	CRLNumber                  *big.Int
+	CRLJob                     gocron.Job
+	AgentRenewalJob            gocron.Job
+	AgentRenewalWindow         time.Duration
+	LegacyAgentEnrollment      bool
+	UserExpiryJob              gocron.Job
+	UserExpiryReminders        bool
+	UserAutoRenewal            bool
+	UserCertificateDelivery    string
+	UserCertificateDownloadTTL time.Duration
+	CertificateDownloadJob     gocron.Job
+	CertificateIssuancesJob    gocron.Job
+	ACMEAddress                string
+	ACMEURL                    string
+	ACMETLSCertPath            string
+	ACMETLSKeyPath             string
+	ACMEDNSSuffixes            []string
+	ACMEValidity               time.Duration
+	ACMEHTTP01Port             int
+	ACMEServer                 *ACMEServer
+	ACMEJob                    gocron.Job
+	JetstreamContextCancel     context.CancelFunc
+	Version                    string
+	Channel                    server.Channel
+	Replicas                   int
+	Jetstream                  jetstream.JetStream
+	crlMutex                   sync.Mutex
+	acmeMutex                  sync.Mutex
+	issuanceSlots              chan struct{}
+	certificateStore           CertificateStore
+	issuances                  sync.WaitGroup
+	consumeContexts            []jetstream.ConsumeContext
+	advisorySubscriptions      []*nats.Subscription
 }
 
 func NewWorker(logName string) *Worker {
@@ -66,15 +113,27 @@ func (w *Worker) StartWorker(subscription func() error) {
 }
 
 func (w *Worker) StopWorker() {
+	w.StopJetStreamConsumers()
+
 	if w.NATSConnection != nil {
+		// Drain returns at once, the handlers of the messages already received are still running
 		if err := w.NATSConnection.Drain(); err != nil {
 			log.Printf("[ERROR]: could not drain NATS connection, reason: %v", err)
+		} else {
+			w.waitForDrain()
 		}
 		if w.JetstreamContextCancel != nil {
 			w.JetstreamContextCancel()
 		}
 	}
 
+	// Issuances run in their own goroutines and still use the CA key
+	if !waitTimeout(&w.issuances, stopTimeout) {
+		log.Printf("[ERROR]: certificates were still being issued after %s", stopTimeout)
+	}
+
+	w.StopACMEServer()
+
 	if w.Model != nil {
 		w.Model.Close()
 	}
@@ -85,6 +144,11 @@ func (w *Worker) StopWorker() {
 		}
 	}
 
+	if w.CAPrivateKey != nil {
+		WipeSigner(w.CAPrivateKey)
+		w.CAPrivateKey = nil
+	}
+
 	log.Println("[INFO]: the worker has stopped")
 
 	if w.Logger != nil {
@@ -92,6 +156,34 @@ func (w *Worker) StopWorker() {
 	}
 }
 
+// waitForDrain waits until the drained connection is closed
+func (w *Worker) waitForDrain() {
+	deadline := time.Now().Add(stopTimeout)
+	for !w.NATSConnection.IsClosed() {
+		if time.Now().After(deadline) {
+			log.Printf("[ERROR]: the NATS connection was not drained after %s", stopTimeout)
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// waitTimeout tells if the wait group is done before the timeout
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
 func (w *Worker) PingHandler(msg *nats.Msg) {
 	if err := msg.Respond(nil); err != nil {
 		log.Printf("[ERROR]: could not respond to ping message, reason: %v", err)
@@ -0,0 +1,92 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// newTestWorker returns a worker with its own CA and no database, keys are ECDSA so
+// tests that issue many certificates run fast
+func newTestWorker(t *testing.T) *Worker {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "scnorion test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Worker{
+		CACert:       cert,
+		RootCACert:   cert,
+		CAPrivateKey: key,
+		UserKeySpec:  KeySpec{Algorithm: KeyAlgorithmECDSA, Size: 256},
+		AgentKeySpec: KeySpec{Algorithm: KeyAlgorithmECDSA, Size: 256},
+	}
+}
+
+// testMsg is a JetStream message that records how it was acknowledged, the
+// methods it doesn't override panic as the embedded message is nil
+type testMsg struct {
+	jetstream.Msg
+	subject string
+	data    []byte
+	headers nats.Header
+
+	mu         sync.Mutex
+	acks       int
+	naks       int
+	inProgress int
+}
+
+func newTestMsg(subject string, data []byte) *testMsg {
+	return &testMsg{subject: subject, data: data, headers: nats.Header{}}
+}
+
+func (m *testMsg) Subject() string                  { return m.subject }
+func (m *testMsg) Data() []byte                     { return m.data }
+func (m *testMsg) Headers() nats.Header             { return m.headers }
+func (m *testMsg) Ack() error                       { m.count(&m.acks); return nil }
+func (m *testMsg) Term() error                      { m.count(&m.acks); return nil }
+func (m *testMsg) Nak() error                       { m.count(&m.naks); return nil }
+func (m *testMsg) NakWithDelay(time.Duration) error { m.count(&m.naks); return nil }
+func (m *testMsg) InProgress() error                { m.count(&m.inProgress); return nil }
+
+func (m *testMsg) count(counter *int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	*counter++
+}
+
+func (m *testMsg) counts() (acks, naks, inProgress int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.acks, m.naks, m.inProgress
+}
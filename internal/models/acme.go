@@ -0,0 +1,387 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/scncore/ent"
+	"github.com/scncore/ent/revocation"
+)
+
+// ACME (RFC 8555) state of the cert-manager's ACME server, unknown rows return an ent not found error
+
+type ACMEAccount struct {
+	ID         string
+	JWK        []byte
+	Thumbprint string
+	Contact    []string
+	Status     string
+	Created    time.Time
+}
+
+// ACMEOrder keeps the requested DNS names, NotBefore and NotAfter are zero unless the client asked for them
+type ACMEOrder struct {
+	ID          string
+	AccountID   string
+	Status      string
+	Identifiers []string
+	NotBefore   time.Time
+	NotAfter    time.Time
+	Expires     time.Time
+	Error       string
+	Serial      string
+	Certificate string
+	Created     time.Time
+}
+
+// ACMEAuthorization holds the only challenge offered for a DNS name, an HTTP-01 challenge
+type ACMEAuthorization struct {
+	ID              string
+	OrderID         string
+	AccountID       string
+	Identifier      string
+	Status          string
+	Expires         time.Time
+	Token           string
+	ChallengeStatus string
+	Validated       time.Time
+	Error           string
+}
+
+// ACMECertificate is a certificate issued to an ACME account, the certificate itself is kept with its order
+type ACMECertificate struct {
+	Serial      int64
+	OrderID     string
+	AccountID   string
+	Identifiers []string
+	Expiry      time.Time
+	Created     time.Time
+}
+
+func (m *Model) AddACMENonce(nonce string, expires time.Time) error {
+	_, err := m.DB.ExecContext(context.Background(),
+		`INSERT INTO acme_nonces (nonce, expires) VALUES ($1, $2)`, nonce, expires)
+	return err
+}
+
+// UseACMENonce deletes the nonce so it can't be replayed, it returns false if it was unknown or expired
+func (m *Model) UseACMENonce(nonce string) (bool, error) {
+	result, err := m.DB.ExecContext(context.Background(),
+		`DELETE FROM acme_nonces WHERE nonce = $1 AND expires > NOW()`, nonce)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows == 1, nil
+}
+
+func (m *Model) DeleteExpiredACMENonces() error {
+	_, err := m.DB.ExecContext(context.Background(), `DELETE FROM acme_nonces WHERE expires <= NOW()`)
+	return err
+}
+
+func (m *Model) AddACMEAccount(account *ACMEAccount) error {
+	contact, err := json.Marshal(account.Contact)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.DB.ExecContext(context.Background(),
+		`INSERT INTO acme_accounts (id, jwk, thumbprint, contact, status) VALUES ($1, $2, $3, $4, $5)`,
+		account.ID, account.JWK, account.Thumbprint, contact, account.Status)
+	return err
+}
+
+func (m *Model) GetACMEAccount(id string) (*ACMEAccount, error) {
+	return m.getACMEAccount(`SELECT id, jwk, thumbprint, contact, status, created FROM acme_accounts WHERE id = $1`, id)
+}
+
+func (m *Model) GetACMEAccountByThumbprint(thumbprint string) (*ACMEAccount, error) {
+	return m.getACMEAccount(`SELECT id, jwk, thumbprint, contact, status, created FROM acme_accounts WHERE thumbprint = $1`, thumbprint)
+}
+
+func (m *Model) getACMEAccount(query string, arg string) (*ACMEAccount, error) {
+	account := ACMEAccount{}
+	var contact []byte
+
+	err := m.DB.QueryRowContext(context.Background(), query, arg).
+		Scan(&account.ID, &account.JWK, &account.Thumbprint, &contact, &account.Status, &account.Created)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &ent.NotFoundError{}
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(contact, &account.Contact); err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+func (m *Model) UpdateACMEAccount(account *ACMEAccount) error {
+	contact, err := json.Marshal(account.Contact)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.DB.ExecContext(context.Background(),
+		`UPDATE acme_accounts SET contact = $2, status = $3 WHERE id = $1`,
+		account.ID, contact, account.Status)
+	return err
+}
+
+// AddACMEOrder saves a new order together with the authorizations for its DNS names
+func (m *Model) AddACMEOrder(order *ACMEOrder, authorizations []*ACMEAuthorization) error {
+	ctx := context.Background()
+
+	identifiers, err := json.Marshal(order.Identifiers)
+	if err != nil {
+		return err
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO acme_orders (id, account_id, status, identifiers, not_before, not_after, expires) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		order.ID, order.AccountID, order.Status, identifiers, nullTime(order.NotBefore), nullTime(order.NotAfter), order.Expires)
+	if err != nil {
+		return err
+	}
+
+	for _, authz := range authorizations {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO acme_authorizations (id, order_id, account_id, identifier, status, expires, token, challenge_status) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			authz.ID, order.ID, authz.AccountID, authz.Identifier, authz.Status, authz.Expires, authz.Token, authz.ChallengeStatus)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (m *Model) GetACMEOrder(id string) (*ACMEOrder, error) {
+	order := ACMEOrder{}
+	var identifiers []byte
+	var notBefore, notAfter sql.NullTime
+
+	err := m.DB.QueryRowContext(context.Background(),
+		`SELECT id, account_id, status, identifiers, not_before, not_after, expires, error, serial, certificate, created FROM acme_orders WHERE id = $1`,
+		id).Scan(&order.ID, &order.AccountID, &order.Status, &identifiers, &notBefore, &notAfter, &order.Expires, &order.Error, &order.Serial, &order.Certificate, &order.Created)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &ent.NotFoundError{}
+		}
+		return nil, err
+	}
+	order.NotBefore = notBefore.Time
+	order.NotAfter = notAfter.Time
+
+	if err := json.Unmarshal(identifiers, &order.Identifiers); err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// GetACMEOrderIDBySerial returns the order that issued a certificate, the serial is in hex
+func (m *Model) GetACMEOrderIDBySerial(serial string) (string, error) {
+	var id string
+
+	err := m.DB.QueryRowContext(context.Background(),
+		`SELECT id FROM acme_orders WHERE serial = $1 AND serial <> ''`, serial).Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", &ent.NotFoundError{}
+		}
+		return "", err
+	}
+	return id, nil
+}
+
+func (m *Model) GetACMEAccountOrderIDs(accountID string) ([]string, error) {
+	rows, err := m.DB.QueryContext(context.Background(),
+		`SELECT id FROM acme_orders WHERE account_id = $1 AND status IN ('pending', 'ready', 'processing', 'valid') AND expires > NOW() ORDER BY created`,
+		accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (m *Model) UpdateACMEOrder(order *ACMEOrder) error {
+	_, err := m.DB.ExecContext(context.Background(),
+		`UPDATE acme_orders SET status = $2, error = $3, serial = $4, certificate = $5 WHERE id = $1`,
+		order.ID, order.Status, order.Error, order.Serial, order.Certificate)
+	return err
+}
+
+// SetACMEOrderStatus changes the status only if it still is the expected one, so
+// concurrent finalize requests can't both issue a certificate
+func (m *Model) SetACMEOrderStatus(id, from, to string) (bool, error) {
+	result, err := m.DB.ExecContext(context.Background(),
+		`UPDATE acme_orders SET status = $3 WHERE id = $1 AND status = $2`, id, from, to)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows == 1, nil
+}
+
+func (m *Model) GetACMEAuthorization(id string) (*ACMEAuthorization, error) {
+	rows, err := m.DB.QueryContext(context.Background(),
+		`SELECT id, order_id, account_id, identifier, status, expires, token, challenge_status, validated, error FROM acme_authorizations WHERE id = $1`,
+		id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	authorizations, err := scanACMEAuthorizations(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(authorizations) == 0 {
+		return nil, &ent.NotFoundError{}
+	}
+	return authorizations[0], nil
+}
+
+func (m *Model) GetACMEOrderAuthorizations(orderID string) ([]*ACMEAuthorization, error) {
+	rows, err := m.DB.QueryContext(context.Background(),
+		`SELECT id, order_id, account_id, identifier, status, expires, token, challenge_status, validated, error FROM acme_authorizations WHERE order_id = $1 ORDER BY identifier`,
+		orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanACMEAuthorizations(rows)
+}
+
+func (m *Model) UpdateACMEAuthorization(authz *ACMEAuthorization) error {
+	_, err := m.DB.ExecContext(context.Background(),
+		`UPDATE acme_authorizations SET status = $2, challenge_status = $3, validated = $4, error = $5 WHERE id = $1`,
+		authz.ID, authz.Status, authz.ChallengeStatus, nullTime(authz.Validated), authz.Error)
+	return err
+}
+
+// SetACMEChallengeStatus changes the challenge status only if it still is the expected
+// one, a challenge is validated once even if the client posts it several times
+func (m *Model) SetACMEChallengeStatus(id, from, to string) (bool, error) {
+	result, err := m.DB.ExecContext(context.Background(),
+		`UPDATE acme_authorizations SET challenge_status = $3 WHERE id = $1 AND challenge_status = $2`, id, from, to)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows == 1, nil
+}
+
+func scanACMEAuthorizations(rows *sql.Rows) ([]*ACMEAuthorization, error) {
+	authorizations := []*ACMEAuthorization{}
+	for rows.Next() {
+		authz := ACMEAuthorization{}
+		var validated sql.NullTime
+		if err := rows.Scan(&authz.ID, &authz.OrderID, &authz.AccountID, &authz.Identifier, &authz.Status, &authz.Expires, &authz.Token, &authz.ChallengeStatus, &validated, &authz.Error); err != nil {
+			return nil, err
+		}
+		authz.Validated = validated.Time
+		authorizations = append(authorizations, &authz)
+	}
+	return authorizations, rows.Err()
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+func (m *Model) SaveACMECertificate(serial *big.Int, order *ACMEOrder, expiry time.Time) error {
+	if err := m.recordSerial(serial); err != nil {
+		return err
+	}
+
+	identifiers, err := json.Marshal(order.Identifiers)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.DB.ExecContext(context.Background(),
+		`INSERT INTO acme_certificates (serial, order_id, account_id, identifiers, expiry) VALUES ($1, $2, $3, $4, $5)`,
+		ShortSerial(serial), order.ID, order.AccountID, identifiers, expiry)
+	return err
+}
+
+func (m *Model) GetACMECertificate(serial *big.Int) (*ACMECertificate, error) {
+	shortSerial, err := m.GetShortSerial(serial)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := ACMECertificate{}
+	var identifiers []byte
+
+	err = m.DB.QueryRowContext(context.Background(),
+		`SELECT serial, order_id, account_id, identifiers, expiry, created FROM acme_certificates WHERE serial = $1`,
+		shortSerial).Scan(&cert.Serial, &cert.OrderID, &cert.AccountID, &identifiers, &cert.Expiry, &cert.Created)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &ent.NotFoundError{}
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(identifiers, &cert.Identifiers); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// RevokeACMECertificate revokes a certificate issued with ACME and returns it
+func (m *Model) RevokeACMECertificate(serial *big.Int, reason int, info string) (*ACMECertificate, error) {
+	cert, err := m.GetACMECertificate(serial)
+	if err != nil {
+		return nil, err
+	}
+
+	alreadyRevoked, err := m.Client.Revocation.Query().Where(revocation.ID(cert.Serial)).Exist(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if alreadyRevoked {
+		return nil, fmt.Errorf("certificate with serial %s has already been revoked", FormatSerial(serial))
+	}
+
+	return cert, m.AddRevocation(serial, reason, info, cert.Expiry)
+}
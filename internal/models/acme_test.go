@@ -0,0 +1,58 @@
+package models
+
+import (
+	"crypto/rand"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/scncore/ent"
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestACMECertificates(t *testing.T) {
+	m := newTestModel(t)
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.GetACMECertificate(serial); !ent.IsNotFound(err) {
+		t.Fatalf("got %v for an unknown serial, want not found", err)
+	}
+
+	order := &ACMEOrder{ID: "order", AccountID: "account", Identifiers: []string{"www.example.internal"}}
+	expiry := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	if err := m.SaveACMECertificate(serial, order, expiry); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := m.GetACMECertificate(serial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.AccountID != "account" || cert.OrderID != "order" || !cert.Expiry.Equal(expiry) {
+		t.Errorf("got certificate %+v", cert)
+	}
+
+	// ACME certificates are not saved with the ent certificates
+	if _, err := m.GetCertificateBySerial(serial); !ent.IsNotFound(err) {
+		t.Errorf("got %v from the ent certificates, want not found", err)
+	}
+
+	if _, err := m.RevokeACMECertificate(serial, ocsp.KeyCompromise, "test"); err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := m.GetRevocationBySerial(serial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revoked.Reason != ocsp.KeyCompromise || !revoked.Expiry.Equal(expiry) {
+		t.Errorf("got revocation %+v", revoked)
+	}
+
+	if _, err := m.RevokeACMECertificate(serial, ocsp.KeyCompromise, "test"); err == nil {
+		t.Error("the certificate has been revoked twice")
+	}
+}
@@ -825,3 +825,11 @@ func (m *Model) ValidateTenantAndSite(tenantID, siteID int) (bool, error) {
 func (m *Model) GetAgentApps(agentId string) ([]*ent.App, error) {
 	return m.Client.App.Query().Where(app.HasOwnerWith(agent.ID(agentId), agent.AgentStatusNEQ(agent.AgentStatusWaitingForAdmission))).All(context.Background())
 }
+
+func (m *Model) GetAgentById(agentId string) (*ent.Agent, error) {
+	return m.Client.Agent.Query().Where(agent.ID(agentId)).Only(context.Background())
+}
+
+func (m *Model) GetAgentByHostname(hostname string) (*ent.Agent, error) {
+	return m.Client.Agent.Query().Where(agent.HostnameEqualFold(hostname)).Only(context.Background())
+}
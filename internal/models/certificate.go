@@ -2,46 +2,169 @@ package models
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
 	"time"
 
 	"github.com/scncore/ent"
 	"github.com/scncore/ent/certificate"
+	"github.com/scncore/ent/revocation"
 	"golang.org/x/crypto/ocsp"
 )
 
-func (m *Model) SaveCertificate(serial int64, certType certificate.Type, uid, description string, expiry time.Time) error {
+func (m *Model) SaveCertificate(serial *big.Int, certType certificate.Type, uid, description string, expiry time.Time) error {
+	if err := m.recordSerial(serial); err != nil {
+		return err
+	}
+
+	query := m.Client.Certificate.Create().SetID(ShortSerial(serial)).SetType(certType).SetDescription(description).SetExpiry(expiry)
 
+	// uid holds the owner of the certificate, the user ID for user certificates and the agent ID for agent certificates
 	if uid != "" {
-		_, err := m.Client.Certificate.Create().SetID(serial).SetType(certType).SetDescription(description).SetExpiry(expiry).SetUID(uid).Save(context.Background())
-		if err != nil {
-			return err
-		}
+		query.SetUID(uid)
+	}
 
+	if _, err := query.Save(context.Background()); err != nil {
+		return err
+	}
+
+	if uid != "" && certType == certificate.TypeUser {
 		if _, err := m.Client.User.UpdateOneID(uid).SetExpiry(expiry).Save(context.Background()); err != nil {
 			return err
 		}
-	} else {
-		_, err := m.Client.Certificate.Create().SetID(serial).SetType(certType).SetDescription(description).SetExpiry(expiry).Save(context.Background())
-		if err != nil {
-			return err
-		}
 	}
 
 	return nil
 }
 
-func (m *Model) RevokePreviousCertificates(description string) error {
+// RevokePreviousCertificates revokes the certificate superseded by a new one and returns it, if any
+func (m *Model) RevokePreviousCertificates(description string) (*ent.Certificate, error) {
 	cert, err := m.Client.Certificate.Query().Where(certificate.DescriptionEQ(description)).Only(context.Background())
 	if err != nil {
 		if ent.IsNotFound(err) {
-			return nil
+			return nil, nil
 		}
-		return err
+		return nil, err
+	}
+
+	serial, err := m.GetFullSerial(cert.ID)
+	if err != nil {
+		return nil, err
 	}
 
 	if err := m.Client.Certificate.DeleteOneID(cert.ID).Exec(context.Background()); err != nil {
-		return err
+		return nil, err
+	}
+
+	return cert, m.AddRevocation(serial, ocsp.Superseded, "new certificate requested from console", cert.Expiry)
+}
+
+func (m *Model) RevokeCertificate(serial *big.Int, reason int, info string) (*ent.Certificate, error) {
+	shortSerial, err := m.GetShortSerial(serial)
+	if err != nil {
+		if ent.IsNotFound(err) {
+			return nil, fmt.Errorf("certificate with serial %s not found", FormatSerial(serial))
+		}
+		return nil, err
+	}
+
+	alreadyRevoked, err := m.Client.Revocation.Query().Where(revocation.ID(shortSerial)).Exist(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if alreadyRevoked {
+		return nil, fmt.Errorf("certificate with serial %s has already been revoked", FormatSerial(serial))
+	}
+
+	cert, err := m.Client.Certificate.Get(context.Background(), shortSerial)
+	if err != nil {
+		if ent.IsNotFound(err) {
+			return nil, fmt.Errorf("certificate with serial %s not found", FormatSerial(serial))
+		}
+		return nil, err
 	}
 
-	return m.AddRevocation(cert.ID, ocsp.Superseded, "new certificate requested from console", cert.Expiry)
+	// Record the revocation first so a failed delete never leaves the certificate unrevoked
+	if err := m.AddRevocation(serial, reason, info, cert.Expiry); err != nil {
+		return nil, err
+	}
+
+	if err := m.Client.Certificate.DeleteOneID(cert.ID).Exec(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+// SupersedeCertificates revokes the certificates with the description except the one with
+// the serial, used once the new certificate has been saved and delivered
+func (m *Model) SupersedeCertificates(description string, serial *big.Int, info string) ([]*ent.Certificate, error) {
+	certs, err := m.Client.Certificate.Query().Where(certificate.DescriptionEQ(description), certificate.IDNEQ(ShortSerial(serial))).All(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cert := range certs {
+		previous, err := m.GetFullSerial(cert.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := m.AddRevocation(previous, ocsp.Superseded, info, cert.Expiry); err != nil {
+			return nil, err
+		}
+
+		if err := m.Client.Certificate.DeleteOneID(cert.ID).Exec(context.Background()); err != nil {
+			return nil, err
+		}
+	}
+
+	return certs, nil
+}
+
+func (m *Model) GetCertificateBySerial(serial *big.Int) (*ent.Certificate, error) {
+	shortSerial, err := m.GetShortSerial(serial)
+	if err != nil {
+		return nil, err
+	}
+	return m.Client.Certificate.Get(context.Background(), shortSerial)
+}
+
+// GetAgentCertificatesExpiringBefore returns the agent certificates that are still valid but expire before t
+func (m *Model) GetAgentCertificatesExpiringBefore(t time.Time) ([]*ent.Certificate, error) {
+	return m.Client.Certificate.Query().Where(certificate.TypeEQ(certificate.TypeAgent), certificate.ExpiryGT(time.Now()), certificate.ExpiryLT(t)).All(context.Background())
+}
+
+// SaveIssuedAgentCertificate keeps the DER of an agent certificate, agentKey tells
+// if the agent sent a CSR and keeps the private key
+func (m *Model) SaveIssuedAgentCertificate(serial *big.Int, agentID string, der []byte, agentKey bool) error {
+	_, err := m.DB.ExecContext(context.Background(),
+		`INSERT INTO agent_certificates (serial, agent_id, certificate, agent_key) VALUES ($1, $2, $3, $4) ON CONFLICT (serial) DO NOTHING`,
+		ShortSerial(serial), agentID, der, agentKey)
+	return err
+}
+
+// GetIssuedAgentCertificate returns the DER of an agent certificate and if the agent keeps
+// its private key, certificates issued before they were kept return an ent not found error
+func (m *Model) GetIssuedAgentCertificate(shortSerial int64) ([]byte, bool, error) {
+	var der []byte
+	var agentKey bool
+
+	err := m.DB.QueryRowContext(context.Background(),
+		`SELECT certificate, agent_key FROM agent_certificates WHERE serial = $1`,
+		shortSerial).Scan(&der, &agentKey)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, false, &ent.NotFoundError{}
+		}
+		return nil, false, err
+	}
+	return der, agentKey, nil
+}
+
+// GetUserCertificatesExpiringBefore returns the user certificates that are still valid but expire before t
+func (m *Model) GetUserCertificatesExpiringBefore(t time.Time) ([]*ent.Certificate, error) {
+	return m.Client.Certificate.Query().Where(certificate.TypeEQ(certificate.TypeUser), certificate.ExpiryGT(time.Now()), certificate.ExpiryLT(t)).All(context.Background())
 }
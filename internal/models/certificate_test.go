@@ -0,0 +1,99 @@
+package models
+
+import (
+	"crypto/rand"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/scncore/ent/certificate"
+	"golang.org/x/crypto/ocsp"
+)
+
+// TestRevokePreviousCertificatesAfterRenewal checks a renewal that supersedes the certificate
+// by its serial leaves a single certificate with the description
+func TestRevokePreviousCertificatesAfterRenewal(t *testing.T) {
+	m := newTestModel(t)
+
+	previous, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewed, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	description := FormatSerial(previous) + " test certificate"
+	expiry := time.Now().Add(24 * time.Hour)
+	if err := m.SaveCertificate(previous, certificate.TypeWorker, "", description, expiry); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.RevokeCertificate(previous, ocsp.Superseded, "renewed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SaveCertificate(renewed, certificate.TypeWorker, "", description, expiry); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := m.RevokePreviousCertificates(description)
+	if err != nil {
+		t.Fatalf("could not revoke the certificate with the description: %v", err)
+	}
+	if cert == nil || cert.ID != ShortSerial(renewed) {
+		t.Errorf("got certificate %v, want the renewed one", cert)
+	}
+
+	revoked, err := m.GetRevocationBySerial(previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revoked.Reason != ocsp.Superseded {
+		t.Errorf("got revocation reason %d, want superseded", revoked.Reason)
+	}
+}
+
+// TestSupersedeCertificates checks every other certificate with the description is revoked,
+// including the ones saved by attempts that could not deliver them
+func TestSupersedeCertificates(t *testing.T) {
+	m := newTestModel(t)
+
+	description := time.Now().Format(time.RFC3339Nano) + " agent certificate"
+	expiry := time.Now().Add(24 * time.Hour)
+
+	serials := []*big.Int{}
+	for range 3 {
+		serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.SaveCertificate(serial, certificate.TypeAgent, "agent", description, expiry); err != nil {
+			t.Fatal(err)
+		}
+		serials = append(serials, serial)
+	}
+
+	latest := serials[len(serials)-1]
+	superseded, err := m.SupersedeCertificates(description, latest, "superseded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(superseded) != len(serials)-1 {
+		t.Errorf("%d certificates have been superseded, want %d", len(superseded), len(serials)-1)
+	}
+
+	for _, serial := range serials[:len(serials)-1] {
+		revoked, err := m.GetRevocationBySerial(serial)
+		if err != nil {
+			t.Fatalf("certificate %s has not been revoked: %v", FormatSerial(serial), err)
+		}
+		if revoked.Reason != ocsp.Superseded {
+			t.Errorf("got revocation reason %d, want superseded", revoked.Reason)
+		}
+	}
+
+	if _, err := m.GetCertificateBySerial(latest); err != nil {
+		t.Errorf("the latest certificate is not valid anymore: %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/scncore/ent"
+)
+
+// CertificateDownload is a user PKCS#12 waiting to be downloaded once, only the
+// hash of the download token is stored
+type CertificateDownload struct {
+	Username string
+	Serial   string
+	PKCS12   []byte
+	Expires  time.Time
+	Created  time.Time
+}
+
+func (m *Model) AddCertificateDownload(tokenHash string, download *CertificateDownload) error {
+	_, err := m.DB.ExecContext(context.Background(),
+		`INSERT INTO certificate_downloads (token_hash, username, serial, pkcs12, expires) VALUES ($1, $2, $3, $4, $5)`,
+		tokenHash, download.Username, download.Serial, download.PKCS12, download.Expires)
+	return err
+}
+
+// RedeemCertificateDownload deletes the download and returns it, so a token can
+// only be used once. Expired downloads are returned too and the caller must check Expires
+func (m *Model) RedeemCertificateDownload(tokenHash string) (*CertificateDownload, error) {
+	download := CertificateDownload{}
+
+	err := m.DB.QueryRowContext(context.Background(),
+		`DELETE FROM certificate_downloads WHERE token_hash = $1 RETURNING username, serial, pkcs12, expires, created`,
+		tokenHash).Scan(&download.Username, &download.Serial, &download.PKCS12, &download.Expires, &download.Created)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &ent.NotFoundError{}
+		}
+		return nil, err
+	}
+	return &download, nil
+}
+
+// DeleteExpiredCertificateDownloads removes the downloads nobody redeemed in time and returns them without the PKCS#12
+func (m *Model) DeleteExpiredCertificateDownloads() ([]*CertificateDownload, error) {
+	rows, err := m.DB.QueryContext(context.Background(),
+		`DELETE FROM certificate_downloads WHERE expires <= NOW() RETURNING username, serial, expires, created`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	downloads := []*CertificateDownload{}
+	for rows.Next() {
+		download := CertificateDownload{}
+		if err := rows.Scan(&download.Username, &download.Serial, &download.Expires, &download.Created); err != nil {
+			return nil, err
+		}
+		downloads = append(downloads, &download)
+	}
+	return downloads, rows.Err()
+}
@@ -0,0 +1,61 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const (
+	CertificateEventRenewed         = "renewed"
+	CertificateEventRenewalFailed   = "renewal_failed"
+	CertificateEventIssuanceDenied  = "issuance_denied"
+	CertificateEventExpiryReminder  = "expiry_reminder"
+	CertificateEventDownloadCreated = "download_created"
+	CertificateEventDownloaded      = "downloaded"
+	CertificateEventDownloadExpired = "download_expired"
+)
+
+type CertificateEvent struct {
+	ID      int64     `json:"id"`
+	Event   string    `json:"event"`
+	Serial  int64     `json:"serial,omitempty"`
+	Owner   string    `json:"owner,omitempty"`
+	Info    string    `json:"info,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+func (m *Model) AddCertificateEvent(event string, serial int64, owner, info string) error {
+	_, err := m.DB.ExecContext(context.Background(),
+		`INSERT INTO certificate_events (event, serial, owner, info) VALUES ($1, NULLIF($2::bigint, 0), $3, $4)`,
+		event, serial, owner, info)
+	return err
+}
+
+func (m *Model) GetLastCertificateEvent(owner, event string) (*CertificateEvent, error) {
+	e := CertificateEvent{}
+	var serial sql.NullInt64
+
+	err := m.DB.QueryRowContext(context.Background(),
+		`SELECT id, event, serial, owner, info, created FROM certificate_events WHERE owner = $1 AND event = $2 ORDER BY created DESC LIMIT 1`,
+		owner, event).Scan(&e.ID, &e.Event, &serial, &e.Owner, &e.Info, &e.Created)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	e.Serial = serial.Int64
+
+	return &e, nil
+}
+
+func (m *Model) HasCertificateEvent(serial int64, event, info string) (bool, error) {
+	var exists bool
+
+	err := m.DB.QueryRowContext(context.Background(),
+		`SELECT EXISTS (SELECT 1 FROM certificate_events WHERE serial = $1 AND event = $2 AND info = $3)`,
+		serial, event, info).Scan(&exists)
+	return exists, err
+}
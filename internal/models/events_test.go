@@ -0,0 +1,40 @@
+package models
+
+import (
+	"math"
+	"math/big"
+	"testing"
+)
+
+func TestCertificateEventWithLargeSerial(t *testing.T) {
+	m := newTestModel(t)
+
+	// Serials are random up to 2^63, far above the int4 parameters infer by default
+	serial := ShortSerial(new(big.Int).SetUint64(math.MaxUint64 - 12345))
+	owner := "test-large-serial-" + big.NewInt(serial).Text(36)
+
+	if err := m.AddCertificateEvent(CertificateEventExpiryReminder, serial, owner, "7"); err != nil {
+		t.Fatalf("could not add the event: %v", err)
+	}
+
+	found, err := m.HasCertificateEvent(serial, CertificateEventExpiryReminder, "7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Error("the event of the large serial was not found")
+	}
+
+	last, err := m.GetLastCertificateEvent(owner, CertificateEventExpiryReminder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last == nil || last.Serial != serial {
+		t.Errorf("got event %+v, want serial %d", last, serial)
+	}
+
+	// Events without a certificate store NULL
+	if err := m.AddCertificateEvent(CertificateEventIssuanceDenied, 0, owner, "denied"); err != nil {
+		t.Fatalf("could not add the event without serial: %v", err)
+	}
+}
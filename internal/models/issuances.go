@@ -0,0 +1,62 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/scncore/ent"
+)
+
+// CertificateIssuance is the certificate issued for a request, Sent is set once the
+// certificate has been delivered so the request only has to be acknowledged
+type CertificateIssuance struct {
+	RequestID string
+	Serial    string
+	Owner     string
+	Sent      bool
+	Created   time.Time
+}
+
+func (m *Model) GetCertificateIssuance(requestID string) (*CertificateIssuance, error) {
+	issuance := CertificateIssuance{RequestID: requestID}
+
+	err := m.DB.QueryRowContext(context.Background(),
+		`SELECT serial, owner, sent, created FROM certificate_issuances WHERE request_id = $1`,
+		requestID).Scan(&issuance.Serial, &issuance.Owner, &issuance.Sent, &issuance.Created)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &ent.NotFoundError{}
+		}
+		return nil, err
+	}
+	return &issuance, nil
+}
+
+// SaveCertificateIssuance records the certificate issued for the request before it's sent,
+// a retry replaces the certificate of the previous attempt
+func (m *Model) SaveCertificateIssuance(requestID string, serial *big.Int, owner string) error {
+	_, err := m.DB.ExecContext(context.Background(),
+		`INSERT INTO certificate_issuances (request_id, serial, owner) VALUES ($1, $2, $3)
+		ON CONFLICT (request_id) DO UPDATE SET serial = EXCLUDED.serial, owner = EXCLUDED.owner, sent = FALSE, created = NOW()`,
+		requestID, FormatSerial(serial), owner)
+	return err
+}
+
+func (m *Model) SetCertificateIssuanceSent(requestID string) error {
+	_, err := m.DB.ExecContext(context.Background(),
+		`UPDATE certificate_issuances SET sent = TRUE WHERE request_id = $1`, requestID)
+	return err
+}
+
+// DeleteCertificateIssuances removes the issuances of requests that can no longer be redelivered
+func (m *Model) DeleteCertificateIssuances(before time.Time) (int64, error) {
+	result, err := m.DB.ExecContext(context.Background(),
+		`DELETE FROM certificate_issuances WHERE created < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,62 @@
+package models
+
+import (
+	"crypto/rand"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/scncore/ent"
+)
+
+func TestCertificateIssuances(t *testing.T) {
+	m := newTestModel(t)
+
+	requestID := "SCNORION_CERTIFICATES-" + time.Now().Format(time.RFC3339Nano)
+	if _, err := m.GetCertificateIssuance(requestID); !ent.IsNotFound(err) {
+		t.Fatalf("got %v for an unknown request, want not found", err)
+	}
+
+	first, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SaveCertificateIssuance(requestID, first, "user"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A retry replaces the certificate of the failed attempt
+	second, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SaveCertificateIssuance(requestID, second, "user"); err != nil {
+		t.Fatal(err)
+	}
+
+	issuance, err := m.GetCertificateIssuance(requestID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issuance.Serial != FormatSerial(second) || issuance.Owner != "user" || issuance.Sent {
+		t.Errorf("got issuance %+v", issuance)
+	}
+
+	if err := m.SetCertificateIssuanceSent(requestID); err != nil {
+		t.Fatal(err)
+	}
+	issuance, err = m.GetCertificateIssuance(requestID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !issuance.Sent {
+		t.Error("the issuance has not been marked as sent")
+	}
+
+	if _, err := m.DeleteCertificateIssuances(time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.GetCertificateIssuance(requestID); !ent.IsNotFound(err) {
+		t.Errorf("got %v for a purged issuance, want not found", err)
+	}
+}
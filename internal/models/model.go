@@ -15,6 +15,7 @@ import (
 
 type Model struct {
 	Client *ent.Client
+	DB     *sql.DB
 }
 
 func New(dbUrl string) (*Model, error) {
@@ -26,6 +27,7 @@ func New(dbUrl string) (*Model, error) {
 	}
 
 	model.Client = ent.NewClient(ent.Driver(entsql.OpenDB(dialect.Postgres, db)))
+	model.DB = db
 
 	// TODO Automatic migrations only in development
 	ctx := context.Background()
@@ -37,6 +39,11 @@ func New(dbUrl string) (*Model, error) {
 		}
 	}
 
+	// Tables owned by the workers are not part of the ent schema, they have their own migrations
+	if err := model.MigrateWorkerTables(ctx); err != nil {
+		return nil, err
+	}
+
 	return &model, nil
 }
 
@@ -0,0 +1,25 @@
+package models
+
+import (
+	"os"
+	"testing"
+)
+
+// newTestModel connects to the database of TEST_DATABASE_URL, the tests that need
+// Postgres are skipped if it isn't set. The database must be disposable, the ent
+// schema and the worker migrations are applied to it
+func newTestModel(t *testing.T) *Model {
+	t.Helper()
+
+	dbUrl := os.Getenv("TEST_DATABASE_URL")
+	if dbUrl == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	model, err := New(dbUrl)
+	if err != nil {
+		t.Fatalf("could not connect to the test database: %v", err)
+	}
+	t.Cleanup(model.Close)
+	return model
+}
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// DefaultNotificationTenant holds the channels used by tenants without their own
+const DefaultNotificationTenant = 0
+
+// NotificationChannel is where a tenant's notifications are delivered, Config
+// depends on the channel type and an empty NotificationTypes receives every type
+type NotificationChannel struct {
+	TenantID          int
+	Name              string
+	Type              string
+	Config            json.RawMessage
+	NotificationTypes []string
+	Enabled           bool
+}
+
+// GetNotificationChannels returns the enabled channels of the tenant, or the
+// default tenant's channels if the tenant has none
+func (m *Model) GetNotificationChannels(tenantID int) ([]*NotificationChannel, error) {
+	rows, err := m.DB.QueryContext(context.Background(),
+		`SELECT tenant_id, name, type, config, notification_types FROM notification_channels
+		WHERE enabled AND tenant_id = (SELECT tenant_id FROM notification_channels WHERE enabled AND tenant_id IN ($1, $2) ORDER BY tenant_id = $1 DESC LIMIT 1)
+		ORDER BY name`,
+		tenantID, DefaultNotificationTenant)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	channels := []*NotificationChannel{}
+	for rows.Next() {
+		c := NotificationChannel{Enabled: true}
+		var config, types []byte
+		if err := rows.Scan(&c.TenantID, &c.Name, &c.Type, &config, &types); err != nil {
+			return nil, err
+		}
+		c.Config = config
+		if err := json.Unmarshal(types, &c.NotificationTypes); err != nil {
+			return nil, err
+		}
+		channels = append(channels, &c)
+	}
+	return channels, rows.Err()
+}
+
+func (m *Model) SaveNotificationChannel(c *NotificationChannel) error {
+	types, err := json.Marshal(c.NotificationTypes)
+	if err != nil {
+		return err
+	}
+
+	config := c.Config
+	if len(config) == 0 {
+		config = json.RawMessage("{}")
+	}
+
+	_, err = m.DB.ExecContext(context.Background(),
+		`INSERT INTO notification_channels (tenant_id, name, type, config, notification_types, enabled) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (tenant_id, name) DO UPDATE SET type = EXCLUDED.type, config = EXCLUDED.config,
+		notification_types = EXCLUDED.notification_types, enabled = EXCLUDED.enabled, updated = NOW()`,
+		c.TenantID, c.Name, c.Type, []byte(config), types, c.Enabled)
+	return err
+}
@@ -0,0 +1,156 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// States of a notification in the outbox, queued and failed notifications are
+// still delivered while sent and dead ones are final
+const (
+	OutboxStateQueued = "queued"
+	OutboxStateSent   = "sent"
+	OutboxStateFailed = "failed"
+	OutboxStateDead   = "dead"
+)
+
+// OutboxNotification is the delivery of a notification to one of its channels. Payload
+// only references the attachments and it's cleared once the state is final
+type OutboxNotification struct {
+	ID           int64
+	MessageID    string
+	Channel      string
+	ChannelType  string
+	TenantID     int
+	Type         string
+	Recipient    string
+	Payload      json.RawMessage
+	State        string
+	Attempts     int
+	NextAttempt  time.Time
+	LastError    string
+	LastResponse string
+	Created      time.Time
+	Updated      time.Time
+	Sent         *time.Time
+}
+
+const outboxColumns = `id, message_id, channel, channel_type, tenant_id, type, recipient, payload, state, attempts,
+	next_attempt, last_error, last_response, created, updated, sent`
+
+// EnqueueNotifications adds the deliveries of a notification, a delivery that is
+// already in the outbox for the same message and channel is left untouched so a
+// redelivered message is not sent twice
+func (m *Model) EnqueueNotifications(notifications []*OutboxNotification) error {
+	ctx := context.Background()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, n := range notifications {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO notification_outbox (message_id, channel, channel_type, tenant_id, type, recipient, payload, state)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT (message_id, channel) DO NOTHING`,
+			n.MessageID, n.Channel, n.ChannelType, n.TenantID, n.Type, n.Recipient, []byte(n.Payload), OutboxStateQueued); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ClaimDueNotifications returns up to limit deliveries whose next attempt is due, of a
+// single message if messageID is set. Their next attempt is moved lease ahead so other
+// workers skip them, if the worker dies before recording the attempt they're retried then
+func (m *Model) ClaimDueNotifications(messageID string, limit int, lease time.Duration) ([]*OutboxNotification, error) {
+	rows, err := m.DB.QueryContext(context.Background(),
+		`UPDATE notification_outbox SET next_attempt = NOW() + make_interval(secs => $1), updated = NOW()
+		WHERE id IN (
+			SELECT id FROM notification_outbox WHERE state IN ($2, $3) AND next_attempt <= NOW() AND ($4 = '' OR message_id = $4)
+			ORDER BY next_attempt LIMIT $5 FOR UPDATE SKIP LOCKED
+		) RETURNING `+outboxColumns,
+		lease.Seconds(), OutboxStateQueued, OutboxStateFailed, messageID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanOutboxNotifications(rows)
+}
+
+// RecordNotificationAttempt saves the result of a delivery attempt, the payload is
+// removed when the notification reaches a final state
+func (m *Model) RecordNotificationAttempt(id int64, state string, nextAttempt time.Time, lastError, lastResponse string) error {
+	_, err := m.DB.ExecContext(context.Background(),
+		`UPDATE notification_outbox SET state = $2, attempts = attempts + 1, next_attempt = $3, last_error = $4, last_response = $5, updated = NOW(),
+		sent = CASE WHEN $2 = $6 THEN NOW() ELSE sent END,
+		payload = CASE WHEN $2 IN ($6, $7) THEN NULL ELSE payload END
+		WHERE id = $1`,
+		id, state, nextAttempt, lastError, lastResponse, OutboxStateSent, OutboxStateDead)
+	return err
+}
+
+// CountPendingOutboxNotifications returns how many deliveries of the message are still queued or failed
+func (m *Model) CountPendingOutboxNotifications(messageID string) (int, error) {
+	var pending int
+	err := m.DB.QueryRowContext(context.Background(),
+		`SELECT COUNT(*) FROM notification_outbox WHERE message_id = $1 AND state IN ($2, $3)`,
+		messageID, OutboxStateQueued, OutboxStateFailed).Scan(&pending)
+	return pending, err
+}
+
+// GetOutboxNotifications returns the newest deliveries of a message or a recipient without their payload
+func (m *Model) GetOutboxNotifications(messageID, recipient string, limit int) ([]*OutboxNotification, error) {
+	rows, err := m.DB.QueryContext(context.Background(),
+		`SELECT `+outboxColumns+` FROM notification_outbox
+		WHERE ($1 = '' OR message_id = $1) AND ($2 = '' OR LOWER(recipient) = LOWER($2))
+		ORDER BY created DESC, id DESC LIMIT $3`,
+		messageID, recipient, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	notifications, err := scanOutboxNotifications(rows)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range notifications {
+		n.Payload = nil
+	}
+	return notifications, nil
+}
+
+// DeleteOldOutboxNotifications removes the sent and dead deliveries last updated before the date
+func (m *Model) DeleteOldOutboxNotifications(before time.Time) (int64, error) {
+	result, err := m.DB.ExecContext(context.Background(),
+		`DELETE FROM notification_outbox WHERE state IN ($1, $2) AND updated < $3`,
+		OutboxStateSent, OutboxStateDead, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func scanOutboxNotifications(rows *sql.Rows) ([]*OutboxNotification, error) {
+	defer rows.Close()
+
+	notifications := []*OutboxNotification{}
+	for rows.Next() {
+		n := OutboxNotification{}
+		var payload []byte
+		var sent sql.NullTime
+		if err := rows.Scan(&n.ID, &n.MessageID, &n.Channel, &n.ChannelType, &n.TenantID, &n.Type, &n.Recipient, &payload,
+			&n.State, &n.Attempts, &n.NextAttempt, &n.LastError, &n.LastResponse, &n.Created, &n.Updated, &sent); err != nil {
+			return nil, err
+		}
+		n.Payload = payload
+		if sent.Valid {
+			n.Sent = &sent.Time
+		}
+		notifications = append(notifications, &n)
+	}
+	return notifications, rows.Err()
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+)
+
+// DefaultPolicyTenant holds the policies used by tenants without their own
+const DefaultPolicyTenant = 0
+
+// CertificatePolicy restricts what the cert-manager worker signs for a tenant,
+// empty values keep the worker defaults
+type CertificatePolicy struct {
+	MaxValidityDays     int      `json:"max_validity_days,omitempty"`
+	AllowedDNSSuffixes  []string `json:"allowed_dns_suffixes,omitempty"`
+	AllowedIPRanges     []string `json:"allowed_ip_ranges,omitempty"`
+	EmailSAN            bool     `json:"email_san,omitempty"`
+	AllowedEmailDomains []string `json:"allowed_email_domains,omitempty"`
+	UPNDomain           string   `json:"upn_domain,omitempty"`
+	KeyUsages           []string `json:"key_usages,omitempty"`
+	ExtKeyUsages        []string `json:"ext_key_usages,omitempty"`
+}
+
+// GetCertificatePolicy returns the tenant's policy for a certificate type, or the
+// default policy if the tenant has none. It returns nil if no policy exists
+func (m *Model) GetCertificatePolicy(tenantID int, certType string) (*CertificatePolicy, error) {
+	var data []byte
+
+	err := m.DB.QueryRowContext(context.Background(),
+		`SELECT policy FROM certificate_policies WHERE tenant_id IN ($1, $2) AND type = $3 ORDER BY tenant_id = $1 DESC LIMIT 1`,
+		tenantID, DefaultPolicyTenant, certType).Scan(&data)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	policy := CertificatePolicy{}
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+func (m *Model) SaveCertificatePolicy(tenantID int, certType string, policy *CertificatePolicy) error {
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.DB.ExecContext(context.Background(),
+		`INSERT INTO certificate_policies (tenant_id, type, policy) VALUES ($1, $2, $3)
+		ON CONFLICT (tenant_id, type) DO UPDATE SET policy = EXCLUDED.policy, updated = NOW()`,
+		tenantID, certType, data)
+	return err
+}
@@ -2,13 +2,48 @@ package models
 
 import (
 	"context"
+	"math/big"
 	"time"
+
+	"github.com/scncore/ent"
+	"github.com/scncore/ent/revocation"
 )
 
-func (m *Model) AddRevocation(serial int64, reason int, info string, expiry time.Time) error {
-	_, err := m.Client.Revocation.Create().SetID(serial).SetReason(reason).SetInfo(info).SetExpiry(expiry).SetRevoked(time.Now()).Save(context.Background())
+func (m *Model) AddRevocation(serial *big.Int, reason int, info string, expiry time.Time) error {
+	if err := m.recordSerial(serial); err != nil {
+		return err
+	}
+
+	_, err := m.Client.Revocation.Create().SetID(ShortSerial(serial)).SetReason(reason).SetInfo(info).SetExpiry(expiry).SetRevoked(time.Now()).Save(context.Background())
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+func (m *Model) GetUnexpiredRevocations() ([]*ent.Revocation, error) {
+	return m.Client.Revocation.Query().Where(revocation.Or(revocation.ExpiryGT(time.Now()), revocation.ExpiryIsNil())).All(context.Background())
+}
+
+func (m *Model) GetRevocationBySerial(serial *big.Int) (*ent.Revocation, error) {
+	shortSerial, err := m.GetShortSerial(serial)
+	if err != nil {
+		return nil, err
+	}
+	return m.Client.Revocation.Get(context.Background(), shortSerial)
+}
+
+// NextCRLNumber reserves the number of the next CRL, it's never lower than floor so
+// the sequence continues from the CRLs published before the numbers were stored
+func (m *Model) NextCRLNumber(floor int64) (int64, error) {
+	var number int64
+
+	err := m.DB.QueryRowContext(context.Background(),
+		`INSERT INTO crl_numbers (id, number) VALUES (1, $1)
+		ON CONFLICT (id) DO UPDATE SET number = GREATEST(crl_numbers.number + 1, EXCLUDED.number)
+		RETURNING number`, floor).Scan(&number)
+	if err != nil {
+		return 0, err
+	}
+	return number, nil
+}
@@ -0,0 +1,29 @@
+package models
+
+import "testing"
+
+func TestNextCRLNumber(t *testing.T) {
+	m := newTestModel(t)
+
+	first, err := m.NextCRLNumber(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := m.NextCRLNumber(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second != first+1 {
+		t.Errorf("got CRL number %d after %d", second, first)
+	}
+
+	// A CRL found on disk with a higher number moves the sequence forward
+	third, err := m.NextCRLNumber(second + 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third != second+10 {
+		t.Errorf("got CRL number %d, want %d", third, second+10)
+	}
+}
@@ -0,0 +1,147 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+
+	"github.com/scncore/ent"
+)
+
+// The certificates and revocations tables come from the ent schema module shared
+// with the console and the agents, their bigint key can't be changed here without
+// migrating every service that reads them. RFC 5280 allows serials of up to 20
+// octets, so the full serial is kept in certificate_serials together with the key
+// derived from it. short_serial is unique, a serial whose key is already taken by
+// another one is rejected and a new serial is generated
+
+var (
+	// ErrSerialCollision means the serial has already been issued
+	ErrSerialCollision = errors.New("the serial number has already been issued")
+	// ErrShortSerialCollision means another serial already uses the same key
+	ErrShortSerialCollision = errors.New("another serial number has the same short serial")
+)
+
+var shortSerialMask = big.NewInt(math.MaxInt64)
+
+// ShortSerial returns the key used for the serial in the certificates and
+// revocations tables, serials that fit in an int64 keep their own value
+func ShortSerial(serial *big.Int) int64 {
+	if serial.IsInt64() {
+		return serial.Int64()
+	}
+	return new(big.Int).And(serial, shortSerialMask).Int64()
+}
+
+func FormatSerial(serial *big.Int) string {
+	return serial.Text(16)
+}
+
+// ReserveSerial records a new serial before it's used, it fails with ErrSerialCollision
+// if the serial was already issued and with ErrShortSerialCollision if its key was
+func (m *Model) ReserveSerial(serial *big.Int) error {
+	result, err := m.DB.ExecContext(context.Background(),
+		`INSERT INTO certificate_serials (serial, short_serial) VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+		FormatSerial(serial), ShortSerial(serial))
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return m.serialConflict(serial)
+	}
+	return nil
+}
+
+// serialConflict tells which unique constraint the serial broke
+func (m *Model) serialConflict(serial *big.Int) error {
+	var existing string
+
+	err := m.DB.QueryRowContext(context.Background(),
+		`SELECT serial FROM certificate_serials WHERE short_serial = $1`,
+		ShortSerial(serial)).Scan(&existing)
+	if err != nil {
+		return err
+	}
+
+	if existing != FormatSerial(serial) {
+		return fmt.Errorf("%w: %s and %s", ErrShortSerialCollision, existing, FormatSerial(serial))
+	}
+	return ErrSerialCollision
+}
+
+// recordSerial maps the serial of a certificate being saved, it's usually reserved
+// at issuance so only a key taken by another serial is an error
+func (m *Model) recordSerial(serial *big.Int) error {
+	if err := m.ReserveSerial(serial); err != nil && !errors.Is(err, ErrSerialCollision) {
+		return err
+	}
+	return nil
+}
+
+// GetShortSerial returns the key of a full serial, unknown serials return an ent not found error
+func (m *Model) GetShortSerial(serial *big.Int) (int64, error) {
+	var shortSerial int64
+
+	err := m.DB.QueryRowContext(context.Background(),
+		`SELECT short_serial FROM certificate_serials WHERE serial = $1`,
+		FormatSerial(serial)).Scan(&shortSerial)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, &ent.NotFoundError{}
+		}
+		return 0, err
+	}
+	return shortSerial, nil
+}
+
+// GetFullSerials returns the full serial of each short serial, rows that
+// could not be backfilled keep the short serial
+func (m *Model) GetFullSerials(shortSerials []int64) (map[int64]*big.Int, error) {
+	serials := map[int64]*big.Int{}
+	for _, s := range shortSerials {
+		serials[s] = big.NewInt(s)
+	}
+
+	if len(shortSerials) == 0 {
+		return serials, nil
+	}
+
+	rows, err := m.DB.QueryContext(context.Background(),
+		`SELECT serial, short_serial FROM certificate_serials WHERE short_serial = ANY($1)`,
+		shortSerials)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hex string
+		var shortSerial int64
+		if err := rows.Scan(&hex, &shortSerial); err != nil {
+			return nil, err
+		}
+		serial, ok := new(big.Int).SetString(hex, 16)
+		if !ok {
+			return nil, fmt.Errorf("invalid serial number %s stored for %d", hex, shortSerial)
+		}
+		serials[shortSerial] = serial
+	}
+
+	return serials, rows.Err()
+}
+
+func (m *Model) GetFullSerial(shortSerial int64) (*big.Int, error) {
+	serials, err := m.GetFullSerials([]int64{shortSerial})
+	if err != nil {
+		return nil, err
+	}
+	return serials[shortSerial], nil
+}
@@ -0,0 +1,66 @@
+package models
+
+import (
+	"crypto/rand"
+	"errors"
+	"math"
+	"math/big"
+	"testing"
+)
+
+func TestShortSerial(t *testing.T) {
+	for _, tc := range []struct {
+		serial *big.Int
+		short  int64
+	}{
+		{big.NewInt(1), 1},
+		{big.NewInt(math.MaxInt64), math.MaxInt64},
+		// Serials above the bigint range keep their lowest 63 bits
+		{new(big.Int).Add(new(big.Int).Lsh(big.NewInt(1), 64), big.NewInt(5)), 5},
+		{new(big.Int).Lsh(big.NewInt(1), 63), 0},
+	} {
+		if short := ShortSerial(tc.serial); short != tc.short {
+			t.Errorf("short serial of %s is %d, want %d", FormatSerial(tc.serial), short, tc.short)
+		}
+	}
+}
+
+func TestReserveSerialCollisions(t *testing.T) {
+	m := newTestModel(t)
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial.SetBit(serial, 100, 0)
+
+	if err := m.ReserveSerial(serial); err != nil {
+		t.Fatalf("could not reserve %s: %v", FormatSerial(serial), err)
+	}
+
+	if err := m.ReserveSerial(serial); !errors.Is(err, ErrSerialCollision) {
+		t.Errorf("reserving the serial twice returned %v", err)
+	}
+
+	// Same lowest 63 bits, different serial
+	other := new(big.Int).SetBit(new(big.Int).Set(serial), 100, 1)
+	if err := m.ReserveSerial(other); !errors.Is(err, ErrShortSerialCollision) {
+		t.Errorf("reserving a serial with a taken short serial returned %v", err)
+	}
+	if err := m.recordSerial(other); !errors.Is(err, ErrShortSerialCollision) {
+		t.Errorf("saving a certificate with a taken short serial returned %v", err)
+	}
+
+	// Saving the certificate of a reserved serial is fine
+	if err := m.recordSerial(serial); err != nil {
+		t.Errorf("saving the certificate of a reserved serial returned %v", err)
+	}
+
+	full, err := m.GetFullSerial(ShortSerial(serial))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full.Cmp(serial) != 0 {
+		t.Errorf("the short serial maps to %s, want %s", FormatSerial(full), FormatSerial(serial))
+	}
+}
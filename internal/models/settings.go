@@ -3,6 +3,7 @@ package models
 import (
 	"context"
 	"strconv"
+	"strings"
 
 	"github.com/scncore/ent"
 	"github.com/scncore/ent/settings"
@@ -33,3 +34,39 @@ func (m *Model) GetSMTPSettings() (*ent.Settings, error) {
 			settings.FieldSMTPStarttls, settings.FieldSMTPTLS,
 			settings.FieldSMTPUser, settings.FieldMessageFrom).Only(context.Background())
 }
+
+// GetTenantSMTPSettings returns the SMTP settings of the tenant if it has its own
+// relay, or the global ones. A tenant without its own sender uses the global one
+func (m *Model) GetTenantSMTPSettings(tenantID int) (*ent.Settings, error) {
+	global, err := m.GetSMTPSettings()
+	if err != nil && !ent.IsNotFound(err) {
+		return nil, err
+	}
+
+	if tenantID <= 0 {
+		return global, err
+	}
+
+	s, err := m.Client.Settings.Query().Where(settings.HasTenantWith(tenant.ID(tenantID))).
+		Select(settings.FieldSMTPAuth, settings.FieldSMTPPassword,
+			settings.FieldSMTPPort, settings.FieldSMTPServer,
+			settings.FieldSMTPStarttls, settings.FieldSMTPTLS,
+			settings.FieldSMTPUser, settings.FieldMessageFrom).Only(context.Background())
+	if err != nil || strings.TrimSpace(s.SMTPServer) == "" {
+		if global == nil {
+			return nil, &ent.NotFoundError{}
+		}
+		if err == nil && s.MessageFrom != "" {
+			// Same relay but the tenant's own sender
+			merged := *global
+			merged.MessageFrom = s.MessageFrom
+			return &merged, nil
+		}
+		return global, nil
+	}
+
+	if s.MessageFrom == "" && global != nil {
+		s.MessageFrom = global.MessageFrom
+	}
+	return s, nil
+}
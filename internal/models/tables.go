@@ -0,0 +1,301 @@
+package models
+
+import (
+	"context"
+	"fmt"
+)
+
+// The ent schema lives in its own module, shared with the console and the agents,
+// so the tables only the workers use are kept here. They are changed with versioned
+// migrations, never by editing an applied one, so every deployment has the same schema
+
+// workerMigration is a schema change applied once, in order and in its own transaction
+type workerMigration struct {
+	Version    int
+	Name       string
+	Statements []string
+}
+
+// workerMigrations must only be appended to
+var workerMigrations = []workerMigration{
+	{
+		Version: 1,
+		Name:    "crl number",
+		Statements: []string{
+			// A single row shared by the replicas so the CRL numbers keep increasing
+			`CREATE TABLE crl_numbers (
+				id SMALLINT PRIMARY KEY CHECK (id = 1),
+				number BIGINT NOT NULL
+			)`,
+		},
+	},
+	{
+		Version: 2,
+		Name:    "agent certificates",
+		Statements: []string{
+			// What happened to the certificates of an owner, renewals first, so the console can show it
+			`CREATE TABLE certificate_events (
+				id BIGSERIAL PRIMARY KEY,
+				event TEXT NOT NULL,
+				serial BIGINT,
+				owner TEXT NOT NULL DEFAULT '',
+				info TEXT NOT NULL DEFAULT '',
+				created TIMESTAMPTZ NOT NULL DEFAULT NOW()
+			)`,
+			`CREATE INDEX certificate_events_owner_idx ON certificate_events (owner, event, created)`,
+			`CREATE INDEX certificate_events_serial_idx ON certificate_events (serial, event)`,
+			// The issued certificate is kept so it can be renewed for the same key and validity
+			`CREATE TABLE agent_certificates (
+				serial BIGINT PRIMARY KEY,
+				agent_id TEXT NOT NULL,
+				certificate BYTEA NOT NULL,
+				agent_key BOOLEAN NOT NULL,
+				created TIMESTAMPTZ NOT NULL DEFAULT NOW()
+			)`,
+		},
+	},
+	{
+		Version: 3,
+		Name:    "certificate serials",
+		Statements: []string{
+			`CREATE TABLE certificate_serials (
+				serial TEXT PRIMARY KEY,
+				short_serial BIGINT NOT NULL UNIQUE,
+				created TIMESTAMPTZ NOT NULL DEFAULT NOW()
+			)`,
+			// The certificates saved before the full serial was tracked had serials below
+			// math.MaxInt64, so the key stored in the ent tables is their full serial
+			`INSERT INTO certificate_serials (serial, short_serial)
+			SELECT to_hex(serial), serial FROM certificates WHERE serial >= 0
+			ON CONFLICT DO NOTHING`,
+			`INSERT INTO certificate_serials (serial, short_serial)
+			SELECT to_hex(serial), serial FROM revocations WHERE serial >= 0
+			ON CONFLICT DO NOTHING`,
+		},
+	},
+	{
+		Version: 4,
+		Name:    "certificate policies",
+		Statements: []string{
+			// Tenant 0 holds the default policy of each certificate type
+			`CREATE TABLE certificate_policies (
+				tenant_id INTEGER NOT NULL DEFAULT 0,
+				type TEXT NOT NULL,
+				policy JSONB NOT NULL DEFAULT '{}',
+				updated TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+				PRIMARY KEY (tenant_id, type)
+			)`,
+		},
+	},
+	{
+		Version: 5,
+		Name:    "acme",
+		Statements: []string{
+			`CREATE TABLE acme_nonces (
+				nonce TEXT PRIMARY KEY,
+				expires TIMESTAMPTZ NOT NULL
+			)`,
+			`CREATE TABLE acme_accounts (
+				id TEXT PRIMARY KEY,
+				jwk JSONB NOT NULL,
+				thumbprint TEXT NOT NULL UNIQUE,
+				contact JSONB NOT NULL DEFAULT '[]',
+				status TEXT NOT NULL,
+				created TIMESTAMPTZ NOT NULL DEFAULT NOW()
+			)`,
+			`CREATE TABLE acme_orders (
+				id TEXT PRIMARY KEY,
+				account_id TEXT NOT NULL REFERENCES acme_accounts (id) ON DELETE CASCADE,
+				status TEXT NOT NULL,
+				identifiers JSONB NOT NULL DEFAULT '[]',
+				not_before TIMESTAMPTZ,
+				not_after TIMESTAMPTZ,
+				expires TIMESTAMPTZ NOT NULL,
+				error TEXT NOT NULL DEFAULT '',
+				serial TEXT NOT NULL DEFAULT '',
+				certificate TEXT NOT NULL DEFAULT '',
+				created TIMESTAMPTZ NOT NULL DEFAULT NOW()
+			)`,
+			`CREATE INDEX acme_orders_account_idx ON acme_orders (account_id, created)`,
+			`CREATE INDEX acme_orders_serial_idx ON acme_orders (serial)`,
+			`CREATE TABLE acme_authorizations (
+				id TEXT PRIMARY KEY,
+				order_id TEXT NOT NULL REFERENCES acme_orders (id) ON DELETE CASCADE,
+				account_id TEXT NOT NULL,
+				identifier TEXT NOT NULL,
+				status TEXT NOT NULL,
+				expires TIMESTAMPTZ NOT NULL,
+				token TEXT NOT NULL,
+				challenge_status TEXT NOT NULL,
+				validated TIMESTAMPTZ,
+				error TEXT NOT NULL DEFAULT ''
+			)`,
+			`CREATE INDEX acme_authorizations_order_idx ON acme_authorizations (order_id)`,
+			// ACME certificates have no owner the console knows about, they're kept apart from
+			// the ent certificates so the OCSP responder and revocations still find them
+			`CREATE TABLE acme_certificates (
+				serial BIGINT PRIMARY KEY,
+				order_id TEXT NOT NULL,
+				account_id TEXT NOT NULL,
+				identifiers JSONB NOT NULL DEFAULT '[]',
+				expiry TIMESTAMPTZ NOT NULL,
+				created TIMESTAMPTZ NOT NULL DEFAULT NOW()
+			)`,
+		},
+	},
+	{
+		Version: 6,
+		Name:    "certificate downloads",
+		Statements: []string{
+			// Only the hash of the one-time token is stored, the link has the token
+			`CREATE TABLE certificate_downloads (
+				token_hash TEXT PRIMARY KEY,
+				username TEXT NOT NULL,
+				serial TEXT NOT NULL,
+				pkcs12 BYTEA NOT NULL,
+				expires TIMESTAMPTZ NOT NULL,
+				created TIMESTAMPTZ NOT NULL DEFAULT NOW()
+			)`,
+		},
+	},
+	{
+		Version: 7,
+		Name:    "certificate issuances",
+		Statements: []string{
+			// The certificate issued for each JetStream request, so a redelivered request
+			// doesn't leave two valid certificates or send one twice
+			`CREATE TABLE certificate_issuances (
+				request_id TEXT PRIMARY KEY,
+				serial TEXT NOT NULL,
+				owner TEXT NOT NULL DEFAULT '',
+				sent BOOLEAN NOT NULL DEFAULT FALSE,
+				created TIMESTAMPTZ NOT NULL DEFAULT NOW()
+			)`,
+			`CREATE INDEX certificate_issuances_created_idx ON certificate_issuances (created)`,
+		},
+	},
+	{
+		Version: 8,
+		Name:    "notification channels",
+		Statements: []string{
+			// Tenant 0 holds the channels of the tenants without their own
+			`CREATE TABLE notification_channels (
+				tenant_id INTEGER NOT NULL DEFAULT 0,
+				name TEXT NOT NULL,
+				type TEXT NOT NULL,
+				config JSONB NOT NULL DEFAULT '{}',
+				notification_types JSONB NOT NULL DEFAULT '[]',
+				enabled BOOLEAN NOT NULL DEFAULT TRUE,
+				updated TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+				PRIMARY KEY (tenant_id, name)
+			)`,
+		},
+	},
+	{
+		Version: 9,
+		Name:    "notification outbox",
+		Statements: []string{
+			// A row per delivery of a message to a channel, with its retries
+			`CREATE TABLE notification_outbox (
+				id BIGSERIAL PRIMARY KEY,
+				message_id TEXT NOT NULL,
+				channel TEXT NOT NULL,
+				channel_type TEXT NOT NULL,
+				tenant_id INTEGER NOT NULL DEFAULT 0,
+				type TEXT NOT NULL,
+				recipient TEXT NOT NULL DEFAULT '',
+				payload JSONB,
+				state TEXT NOT NULL,
+				attempts INTEGER NOT NULL DEFAULT 0,
+				next_attempt TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+				last_error TEXT NOT NULL DEFAULT '',
+				last_response TEXT NOT NULL DEFAULT '',
+				created TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+				updated TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+				sent TIMESTAMPTZ,
+				UNIQUE (message_id, channel)
+			)`,
+			`CREATE INDEX notification_outbox_due_idx ON notification_outbox (state, next_attempt)`,
+			`CREATE INDEX notification_outbox_recipient_idx ON notification_outbox (recipient, created)`,
+		},
+	},
+	{
+		Version: 10,
+		Name:    "notification templates",
+		Statements: []string{
+			// An empty locale matches every locale and tenant 0 holds the defaults
+			`CREATE TABLE notification_templates (
+				tenant_id INTEGER NOT NULL DEFAULT 0,
+				type TEXT NOT NULL,
+				locale TEXT NOT NULL DEFAULT '',
+				subject TEXT NOT NULL DEFAULT '',
+				title TEXT NOT NULL DEFAULT '',
+				greeting TEXT NOT NULL DEFAULT '',
+				text TEXT NOT NULL DEFAULT '',
+				action TEXT NOT NULL DEFAULT '',
+				html TEXT NOT NULL DEFAULT '',
+				logo_url TEXT NOT NULL DEFAULT '',
+				logo_alt TEXT NOT NULL DEFAULT '',
+				primary_color TEXT NOT NULL DEFAULT '',
+				body_color TEXT NOT NULL DEFAULT '',
+				background_color TEXT NOT NULL DEFAULT '',
+				footer TEXT NOT NULL DEFAULT '',
+				updated TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+				PRIMARY KEY (tenant_id, type, locale)
+			)`,
+		},
+	},
+}
+
+// workerMigrationsLock is the advisory lock that keeps workers starting at once
+// from applying the same migration
+const workerMigrationsLock = 7339001
+
+// MigrateWorkerTables applies the migrations newer than the recorded schema version
+func (m *Model) MigrateWorkerTables(ctx context.Context) error {
+	if _, err := m.DB.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS worker_schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`); err != nil {
+		return fmt.Errorf("could not create the worker migrations table: %v", err)
+	}
+
+	for _, migration := range workerMigrations {
+		if err := m.applyWorkerMigration(ctx, migration); err != nil {
+			return fmt.Errorf("could not apply worker migration %d (%s): %v", migration.Version, migration.Name, err)
+		}
+	}
+	return nil
+}
+
+func (m *Model) applyWorkerMigration(ctx context.Context, migration workerMigration) error {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, workerMigrationsLock); err != nil {
+		return err
+	}
+
+	var applied bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM worker_schema_migrations WHERE version = $1)`, migration.Version).Scan(&applied); err != nil {
+		return err
+	}
+	if applied {
+		return nil
+	}
+
+	for _, statement := range migration.Statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO worker_schema_migrations (version, name) VALUES ($1, $2)`, migration.Version, migration.Name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,35 @@
+package models
+
+import (
+	"context"
+	"testing"
+)
+
+func TestWorkerMigrationsAreSequential(t *testing.T) {
+	for i, migration := range workerMigrations {
+		if migration.Version != i+1 {
+			t.Errorf("migration %q has version %d, want %d", migration.Name, migration.Version, i+1)
+		}
+		if migration.Name == "" || len(migration.Statements) == 0 {
+			t.Errorf("migration %d has no name or statements", migration.Version)
+		}
+	}
+}
+
+func TestMigrateWorkerTablesTwice(t *testing.T) {
+	m := newTestModel(t)
+	ctx := context.Background()
+
+	// New already applied them, the second run must find every version recorded
+	if err := m.MigrateWorkerTables(ctx); err != nil {
+		t.Fatalf("could not migrate again: %v", err)
+	}
+
+	var applied int
+	if err := m.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM worker_schema_migrations`).Scan(&applied); err != nil {
+		t.Fatal(err)
+	}
+	if applied != len(workerMigrations) {
+		t.Errorf("%d migrations recorded, want %d", applied, len(workerMigrations))
+	}
+}
@@ -0,0 +1,58 @@
+package models
+
+import "context"
+
+// NotificationTemplate customizes the texts and the look of a notification type for a
+// tenant and a locale, empty fields fall back to the default tenant and the built-in templates
+type NotificationTemplate struct {
+	TenantID        int
+	Type            string
+	Locale          string
+	Subject         string
+	Title           string
+	Greeting        string
+	Text            string
+	Action          string
+	HTML            string
+	LogoURL         string
+	LogoAlt         string
+	PrimaryColor    string
+	BodyColor       string
+	BackgroundColor string
+	Footer          string
+}
+
+// GetNotificationTemplates returns the templates of every tenant
+func (m *Model) GetNotificationTemplates() ([]*NotificationTemplate, error) {
+	rows, err := m.DB.QueryContext(context.Background(),
+		`SELECT tenant_id, type, locale, subject, title, greeting, text, action, html, logo_url, logo_alt,
+		primary_color, body_color, background_color, footer FROM notification_templates`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	templates := []*NotificationTemplate{}
+	for rows.Next() {
+		t := NotificationTemplate{}
+		if err := rows.Scan(&t.TenantID, &t.Type, &t.Locale, &t.Subject, &t.Title, &t.Greeting, &t.Text, &t.Action, &t.HTML,
+			&t.LogoURL, &t.LogoAlt, &t.PrimaryColor, &t.BodyColor, &t.BackgroundColor, &t.Footer); err != nil {
+			return nil, err
+		}
+		templates = append(templates, &t)
+	}
+	return templates, rows.Err()
+}
+
+func (m *Model) SaveNotificationTemplate(t *NotificationTemplate) error {
+	_, err := m.DB.ExecContext(context.Background(),
+		`INSERT INTO notification_templates (tenant_id, type, locale, subject, title, greeting, text, action, html, logo_url, logo_alt,
+		primary_color, body_color, background_color, footer) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+		ON CONFLICT (tenant_id, type, locale) DO UPDATE SET subject = EXCLUDED.subject, title = EXCLUDED.title, greeting = EXCLUDED.greeting,
+		text = EXCLUDED.text, action = EXCLUDED.action, html = EXCLUDED.html, logo_url = EXCLUDED.logo_url, logo_alt = EXCLUDED.logo_alt,
+		primary_color = EXCLUDED.primary_color, body_color = EXCLUDED.body_color, background_color = EXCLUDED.background_color,
+		footer = EXCLUDED.footer, updated = NOW()`,
+		t.TenantID, t.Type, t.Locale, t.Subject, t.Title, t.Greeting, t.Text, t.Action, t.HTML,
+		t.LogoURL, t.LogoAlt, t.PrimaryColor, t.BodyColor, t.BackgroundColor, t.Footer)
+	return err
+}
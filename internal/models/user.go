@@ -2,7 +2,9 @@ package models
 
 import (
 	"context"
+	"time"
 
+	"github.com/scncore/ent"
 	"github.com/scncore/ent/user"
 	"github.com/scncore/nats"
 )
@@ -14,3 +16,11 @@ func (m *Model) SetCertificateSent(uid string) error {
 func (m *Model) SetEmailVerified(uid string) error {
 	return m.Client.User.Update().SetEmailVerified(true).Where(user.ID(uid)).Exec(context.Background())
 }
+
+func (m *Model) SetUserExpiry(uid string, expiry time.Time) error {
+	return m.Client.User.Update().SetExpiry(expiry).Where(user.ID(uid)).Exec(context.Background())
+}
+
+func (m *Model) GetUserById(uid string) (*ent.User, error) {
+	return m.Client.User.Query().Where(user.ID(uid)).Only(context.Background())
+}
@@ -27,6 +27,8 @@ func getCommands() []*cli.Command {
 		commands.AgentWorker(),
 		commands.CertManagerWorker(),
 		commands.NotificationsWorker(),
+		commands.OCSPResponder(),
+		commands.PKI(),
 		commands.HealthCheck(),
 	}
 }